@@ -0,0 +1,301 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Policies for objects found in the base at a hashed location which is not
+// in the map file of the directory.
+const (
+	// unmappedIgnore leaves the objects unreachable.
+	unmappedIgnore = "ignore"
+	// unmappedWarn logs the objects but leaves them unreachable.
+	unmappedWarn = "warn"
+	// unmappedAdopt adds the objects to the map file using their name file.
+	unmappedAdopt = "adopt"
+)
+
+// unmappedName returns the name of the unmapped file in the hash directory
+// fileHash of the directory entry, as recorded in its name file. It returns
+// false if there is no such file or the name file does not match its
+// location.
+func (f *Fs) unmappedName(ctx context.Context, entry *dirEntry, fileHash string) (string, bool, error) {
+	recorded, err := f.readNameFile(ctx, entry.Hash, fileHash)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	parent, name := path.Split(recorded)
+	parent = strings.TrimSuffix(parent, "/")
+	if _, ok := f.dirHashType(parent, entry.Hash); !ok {
+		return "", false, nil
+	}
+	if _, ok := f.fileHashType(parent, name, fileHash); !ok {
+		return "", false, nil
+	}
+	if _, pending, err := f.pendingSince(ctx, entry.Hash, fileHash); err != nil || pending {
+		// The upload of the file was interrupted.
+		return "", false, err
+	}
+	f.limitMeta(ctx)
+	_, err = f.base.NewObject(ctx, f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return name, true, nil
+}
+
+// handleUnmapped applies the unmapped_objects policy to the unmapped file
+// name in the directory entry. It reports whether the file was adopted into
+// the map file, which is not written.
+func (f *Fs) handleUnmapped(ctx context.Context, entry *dirEntry, name, fileHash string) (bool, error) {
+	overlay := path.Join(entry.Path, name)
+	switch f.opt.UnmappedObjects {
+	case unmappedWarn:
+		fs.Logf(overlay, "found object in the base which is not in the map (%s)", path.Join(entry.Hash, fileHash))
+		return false, nil
+	case unmappedAdopt:
+		fs.Infof(overlay, "adopting object in the base which is not in the map (%s)", path.Join(entry.Hash, fileHash))
+		if err := entry.addFile(ctx, name, fileHash); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// findUnmapped looks for the unmapped file with the given hash in the
+// directory entry and applies the unmapped_objects policy to it. It reports
+// whether the file was adopted, in which case the map file has been written.
+func (f *Fs) findUnmapped(ctx context.Context, entry *dirEntry, fileHash string) (bool, error) {
+	if f.opt.UnmappedObjects == unmappedIgnore {
+		return false, nil
+	}
+	recorded, ok, err := f.unmappedName(ctx, entry, fileHash)
+	if err != nil || !ok {
+		return false, err
+	}
+	adopted, err := f.handleUnmapped(ctx, entry, recorded, fileHash)
+	if err != nil || !adopted {
+		return false, err
+	}
+	return true, entry.write(ctx)
+}
+
+// unmappedDir returns the hash directory in the base of the absolute overlay
+// directory dir which is not in the directory map, with any hash type. It
+// returns false if there is no such hash directory or it does not belong to
+// dir, i.e. it has neither a map file nor a name file recording a path in
+// dir.
+func (f *Fs) unmappedDir(ctx context.Context, dir string) (string, bool, error) {
+	if f.opt.HashType == "none" {
+		// The hash directories can't be told from plain directories.
+		return "", false, nil
+	}
+	for i, ht := range append([]string{f.opt.HashType}, hashTypes...) {
+		if i > 0 && ht == f.opt.HashType {
+			continue
+		}
+		dirHash := f.dirBaseWith(hashers[ht], dir)
+		if _, ok := f.dirMap.byHash(dirHash); ok {
+			continue
+		}
+		f.limitMeta(ctx)
+		baseEntries, err := f.base.List(ctx, dirHash)
+		if errors.Is(err, fs.ErrorDirNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		for _, baseEntry := range baseEntries {
+			if _, ok := baseEntry.(fs.Object); ok && path.Base(baseEntry.Remote()) == "map" {
+				return dirHash, true, nil
+			}
+		}
+		for _, fileHash := range f.fileHashes(baseEntries) {
+			recorded, err := f.readNameFile(ctx, dirHash, fileHash)
+			if errors.Is(err, fs.ErrorObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return "", false, err
+			}
+			if path.Dir(recorded) == dir {
+				return dirHash, true, nil
+			}
+			break
+		}
+	}
+	return "", false, nil
+}
+
+// findUnmappedDir looks for the hash directory of the absolute overlay
+// directory dir if it is not in the directory map, e.g. after the directory
+// map was lost, and applies the unmapped_objects policy to it. It returns
+// the entry of the directory if it was adopted, in which case the directory
+// map has been written.
+func (f *Fs) findUnmappedDir(ctx context.Context, dir string) (*dirEntry, bool, error) {
+	if f.opt.UnmappedObjects == unmappedIgnore {
+		return nil, false, nil
+	}
+	dirHash, ok, err := f.unmappedDir(ctx, dir)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if f.opt.UnmappedObjects == unmappedWarn {
+		fs.Logf(dir, "found directory in the base which is not in the map (%s)", dirHash)
+		return nil, false, nil
+	}
+	fs.Infof(dir, "adopting directory in the base which is not in the map (%s)", dirHash)
+	entry := f.dirMap.newDirEntry(dir)
+	if entry.Hash != dirHash {
+		f.dirMap.setHash(entry, dirHash)
+	}
+	if err := f.dirMap.write(ctx); err != nil {
+		return nil, false, fmt.Errorf("error writing adopted directory to the directory map: %w", err)
+	}
+	return entry, true, nil
+}
+
+// scanUnmapped looks for unmapped files in the hash directory of the
+// directory entry and applies the unmapped_objects policy to them. The map
+// file is written if any file was adopted.
+func (f *Fs) scanUnmapped(ctx context.Context, entry *dirEntry) error {
+	if f.opt.UnmappedObjects == unmappedIgnore {
+		return nil
+	}
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return err
+	}
+	children := f.dirMap.children(entry)
+	known := make(map[string]struct{}, len(files)+len(children))
+	for _, fileHash := range files {
+		known[fileHash] = struct{}{}
+	}
+	for _, child := range children {
+		known[path.Base(child.Hash)] = struct{}{}
+	}
+	baseEntries, err := f.base.List(ctx, entry.Hash)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	adopted := false
+	for _, fileHash := range f.fileHashes(baseEntries) {
+		if _, ok := known[fileHash]; ok {
+			continue
+		}
+		name, ok, err := f.unmappedName(ctx, entry, fileHash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		ok, err = f.handleUnmapped(ctx, entry, name, fileHash)
+		if err != nil {
+			return err
+		}
+		adopted = adopted || ok
+	}
+	if !adopted {
+		return nil
+	}
+	if err := entry.write(ctx); err != nil {
+		return fmt.Errorf("error writing adopted objects to map file: %w", err)
+	}
+	return nil
+}
+
+// isInternal reports whether the object at basePath in the base belongs to
+// the overlay, i.e. is a metadata object or inside a hash directory or a
+// loaded decoy.
+func (f *Fs) isInternal(basePath string) bool {
+	if basePath == "map" || strings.HasPrefix(basePath, "map.") {
+		return true
+	}
+	for dir := path.Dir(basePath); dir != "."; dir = path.Dir(dir) {
+		if _, ok := f.dirMap.byHash(dir); ok || f.isDecoy(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptBase moves the plain object at basePath in the base into the overlay
+// at remote with a server-side move, creating the parent directories as
+// needed.
+func (f *Fs) adoptBase(ctx context.Context, basePath, remote string) (fs.Object, error) {
+	if f.base.Features().Move == nil {
+		return nil, fs.ErrorCantMove
+	}
+	if f.isInternal(basePath) {
+		return nil, fmt.Errorf("refusing to adopt %q which belongs to the overlay", basePath)
+	}
+	srcObj, err := f.base.NewObject(ctx, basePath)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching base object: %w", err)
+	}
+	return f.adoptObject(ctx, srcObj, remote)
+}
+
+// adoptObject moves srcObj, an object of a remote with the same
+// configuration as the base, into the overlay at remote with a server-side
+// move, creating the parent directories as needed.
+func (f *Fs) adoptObject(ctx context.Context, srcObj fs.Object, remote string) (fs.Object, error) {
+	do := f.base.Features().Move
+	if do == nil {
+		return nil, fs.ErrorCantMove
+	}
+	parent, base := path.Split(remote)
+	if err := f.Mkdir(ctx, strings.TrimSuffix(parent, "/")); err != nil {
+		return nil, fmt.Errorf("error creating parent directory: %w", err)
+	}
+	entry, fileHash, ok := f.toHash(remote)
+	if !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := entry.lookupFile(files, base); ok {
+		return nil, fs.ErrorCantMove
+	}
+	if err := f.prepareDest(ctx, srcObj, path.Join(f.root, remote), entry.Hash, fileHash); err != nil {
+		return nil, err
+	}
+	dataObj, err := do(ctx, srcObj, f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf))
+	if err != nil {
+		return nil, fmt.Errorf("error moving base object: %w", err)
+	}
+	if err := entry.addFile(ctx, base, fileHash); err != nil {
+		return nil, err
+	}
+	if err := entry.write(ctx); err != nil {
+		return nil, err
+	}
+	f.notifyChangeRel(opAdopt, remote, "")
+	return object{
+		obj:      dataObj,
+		path:     remote,
+		basePath: path.Join(entry.Hash, fileHash),
+		fs:       f,
+		dirEntry: entry,
+	}, nil
+}
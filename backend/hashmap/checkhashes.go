@@ -0,0 +1,186 @@
+package hashmap
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Kinds of entries reported by the check-hashes command.
+const (
+	hashKindDir  = "dir"
+	hashKindFile = "file"
+)
+
+// hashMismatch is an entry of the map stored at another location in the
+// base than the one derived with the current hash type and layout.
+type hashMismatch struct {
+	// Kind is hashKindDir or hashKindFile.
+	Kind string `json:"kind"`
+	// Path is the overlay path of the entry relative to the root.
+	Path string `json:"path"`
+	// Stored is the location of the entry in the base.
+	Stored string `json:"stored"`
+	// Expected is the location derived with the current settings.
+	Expected string `json:"expected"`
+	// Fixed is set if the entry was moved to the expected location.
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+// checkHashes recomputes the hash directories and file hashes of all
+// directories and files below the root with the current hash type and
+// layout and returns the entries stored at another location, e.g. after
+// hash_type was changed. With fix they are moved to the expected location
+// with server-side moves and the map is updated.
+//
+// The directories are checked parents first, so with the nested layouts
+// the children of a moved directory are checked at their new location.
+func (f *Fs) checkHashes(ctx context.Context, fix bool) ([]hashMismatch, error) {
+	if fix {
+		if err := f.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	var entries []*dirEntry
+	for _, entry := range f.dirMap.entries() {
+		if _, ok := f.underRoot(entry.Path); ok {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	mismatches := make([]hashMismatch, 0)
+	dirsMoved := false
+	for _, entry := range entries {
+		expected := f.dirBase(entry.Path)
+		if entry.Hash == expected {
+			continue
+		}
+		rel, _ := f.underRoot(entry.Path)
+		m := hashMismatch{Kind: hashKindDir, Path: rel, Stored: entry.Hash, Expected: expected}
+		if fix {
+			moved, err := f.fixDirHash(ctx, entry, expected)
+			if err != nil {
+				return mismatches, fmt.Errorf("error moving directory %q: %w", rel, err)
+			}
+			m.Fixed = moved
+			dirsMoved = dirsMoved || moved
+		}
+		mismatches = append(mismatches, m)
+	}
+	if dirsMoved {
+		if err := f.dirMap.write(ctx); err != nil {
+			return mismatches, err
+		}
+	}
+	for _, entry := range entries {
+		files, err := f.fileMismatches(ctx, entry, fix)
+		mismatches = append(mismatches, files...)
+		if err != nil {
+			return mismatches, err
+		}
+	}
+	return mismatches, nil
+}
+
+// fixDirHash moves the hash directory of the directory entry to expected
+// and records it in the directory map. With the nested layouts, the
+// recorded hash directories of its children are moved along. It returns
+// false if the move was skipped with --dry-run.
+func (f *Fs) fixDirHash(ctx context.Context, entry *dirEntry, expected string) (bool, error) {
+	do := f.base.Features().DirMove
+	if do == nil {
+		return false, fs.ErrorCantDirMove
+	}
+	if f.skipBase(ctx, fmt.Sprintf("move hash directory to %q", expected), entry.Hash) {
+		return false, nil
+	}
+	stored := entry.Hash
+	// A missing hash directory was dropped by the base as it was empty,
+	// so only the map needs to change.
+	if err := do(ctx, f.base, stored, expected); err != nil && !isDirMissing(err) {
+		return false, err
+	}
+	f.mirrorDir(stored)
+	f.mirrorDir(expected)
+	f.dirMap.setHash(entry, expected)
+	if f.nested() {
+		for _, child := range f.dirMap.entries() {
+			if strings.HasPrefix(child.Hash, stored+"/") {
+				f.dirMap.setHash(child, expected+strings.TrimPrefix(child.Hash, stored))
+			}
+		}
+	}
+	return true, nil
+}
+
+// fileMismatches returns the files of the directory entry stored at another
+// location than the one derived with the current settings. With fix they
+// are moved there.
+func (f *Fs) fileMismatches(ctx context.Context, entry *dirEntry, fix bool) ([]hashMismatch, error) {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type stale struct {
+		name, hash, ht string
+	}
+	var found []stale
+	entry.mu.Lock()
+	for name, fileHash := range files {
+		if fileHash != f.fileHash(entry.Path, name) {
+			found = append(found, stale{name: name, hash: fileHash, ht: entry.types[name]})
+		}
+	}
+	entry.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].name < found[j].name
+	})
+	var mismatches []hashMismatch
+	for _, s := range found {
+		rel, _ := f.underRoot(path.Join(entry.Path, s.name))
+		expected := f.fileHash(entry.Path, s.name)
+		m := hashMismatch{
+			Kind:     hashKindFile,
+			Path:     rel,
+			Stored:   path.Join(entry.Hash, s.hash),
+			Expected: path.Join(entry.Hash, expected),
+		}
+		if fix {
+			moved, err := f.fixFileHash(ctx, entry, s.name, s.ht, m.Stored, expected)
+			if err != nil {
+				return append(mismatches, m), fmt.Errorf("error moving file %q: %w", rel, err)
+			}
+			m.Fixed = moved
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, nil
+}
+
+// fixFileHash moves the file name of the directory entry, stored at the
+// base path stored with the hash type ht, to the hash expected. It returns false if the move was
+// skipped with --dry-run.
+func (f *Fs) fixFileHash(ctx context.Context, entry *dirEntry, name, ht, stored, expected string) (bool, error) {
+	if f.skipBase(ctx, fmt.Sprintf("move file to %q", path.Join(entry.Hash, expected)), stored) {
+		return false, nil
+	}
+	if modTime, ok := parseEmptyType(ht); ok {
+		// Empty files are only recorded in the map file.
+		if err := entry.addEmptyFile(ctx, name, expected, modTime); err != nil {
+			return false, err
+		}
+		return true, entry.write(ctx)
+	}
+	// The file may be renamed in place, which is also what the file
+	// occupying the expected hash may be.
+	if err := f.relocateRenamed(ctx, entry, name, make(map[string]bool)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,626 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Command the backend to run a named command
+//
+// The command run is name
+// args may be used to read arguments from
+// opts may be used to read optional arguments from
+//
+// The result should be capable of being JSON encoded
+// If it is a string or a []string it will be shown to the user
+// otherwise it will be JSON encoded and shown to the user like that
+func (f *Fs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (out interface{}, err error) {
+	switch name {
+	case "map-versions":
+		return f.mapVersions(ctx)
+	case "map-restore":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the generation of the map version to restore")
+		}
+		generation, err := strconv.ParseInt(arg[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid generation %q: %w", arg[0], err)
+		}
+		return nil, f.restoreMapVersion(ctx, generation)
+	case "map-diff":
+		if len(arg) < 1 || len(arg) > 2 {
+			return nil, errors.New("please provide the generations of the map versions to compare")
+		}
+		newer := currentGeneration
+		if len(arg) > 1 {
+			newer = arg[1]
+		}
+		return f.diffMapVersions(ctx, arg[0], newer)
+	case "decoys":
+		count := f.opt.DecoyCount
+		if len(arg) > 0 {
+			count, err = strconv.Atoi(arg[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid decoy count %q: %w", arg[0], err)
+			}
+			if count < 0 {
+				return nil, fmt.Errorf("invalid decoy count %d: must not be negative", count)
+			}
+		}
+		created, err := f.makeDecoys(ctx, count)
+		return fmt.Sprintf("created %d decoy directories", created), err
+	case "shred":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the path to shred")
+		}
+		_, overwrite := opt["overwrite"]
+		return nil, f.shred(ctx, arg[0], overwrite)
+	case "scrub":
+		if _, ok := opt["status"]; ok {
+			f.scrubMu.Lock()
+			defer f.scrubMu.Unlock()
+			return f.lastScrub, nil
+		}
+		_, clean := opt["clean"]
+		report, _, err := f.scrub(ctx, "", 0, clean)
+		return report, err
+	case "adopt":
+		if len(arg) != 2 {
+			return nil, errors.New("please provide the path in the base and the path in the overlay")
+		}
+		_, err := f.adoptBase(ctx, arg[0], arg[1])
+		return nil, err
+	case "import-crypt":
+		if len(arg) < 1 || len(arg) > 2 {
+			return nil, errors.New("please provide the crypt remote to import and optionally the path in the overlay")
+		}
+		dir := ""
+		if len(arg) > 1 {
+			dir = arg[1]
+		}
+		return f.importCrypt(ctx, arg[0], dir)
+	case "du":
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		usage, err := f.du(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := opt["table"]; ok {
+			return formatUsage(usage), nil
+		}
+		return usage, nil
+	case "inventory":
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		ht, err := f.inventoryHash(opt["hash"])
+		if err != nil {
+			return nil, err
+		}
+		items, err := f.inventory(ctx, dir, ht)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := opt["csv"]; ok {
+			return formatInventory(items)
+		}
+		return items, nil
+	case "orphans":
+		return f.orphans(ctx)
+	case "replicate":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the remote to replicate to")
+		}
+		_, stream := opt["stream"]
+		var bwlimit fs.SizeSuffix
+		if limit, ok := opt["bwlimit"]; ok {
+			if err := bwlimit.Set(limit); err != nil {
+				return nil, fmt.Errorf("invalid bandwidth limit %q: %w", limit, err)
+			}
+		}
+		return nil, f.replicate(ctx, arg[0], stream, bwlimit)
+	case "relocate":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the path to relocate the overlay to")
+		}
+		return nil, f.relocate(ctx, arg[0])
+	case "check-hashes":
+		_, fix := opt["fix"]
+		return f.checkHashes(ctx, fix)
+	case "reencode":
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		return f.reencode(ctx, dir)
+	case "merge-duplicates":
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		merged, err := f.mergeDuplicatesDir(ctx, dir)
+		return fmt.Sprintf("removed %d duplicate hash directories", merged), err
+	case "dump-map":
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		_, withFiles := opt["files"]
+		dirs, err := f.dumpMap(ctx, dir, withFiles)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := opt["csv"]; ok {
+			return formatDumpMap(dirs)
+		}
+		return dirs, nil
+	case "export-map":
+		if len(arg) == 0 {
+			return f.exportMap(ctx)
+		}
+		exported, err := f.exportMapFile(ctx, arg[0])
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("exported %d directories to %q", len(exported.Dirs), arg[0]), nil
+	case "import-map":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the local file to import")
+		}
+		return f.importMapFile(ctx, arg[0])
+	case "encode":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the overlay path to encode")
+		}
+		return f.encode(ctx, arg[0])
+	case "decode":
+		if len(arg) != 1 {
+			return nil, errors.New("please provide the base path to decode")
+		}
+		return f.decode(ctx, arg[0])
+	case "gc":
+		minAge := fs.Duration(gcMinAge)
+		if age, ok := opt["min-age"]; ok {
+			if err := minAge.Set(age); err != nil {
+				return nil, fmt.Errorf("invalid minimum age %q: %w", age, err)
+			}
+		}
+		return f.gc(ctx, time.Duration(minAge))
+	case "fsck":
+		fix, err := parseFsckFix(opt["fix"])
+		if err != nil {
+			return nil, err
+		}
+		return f.fsck(ctx, fix)
+	case "rebuild-map":
+		return f.rebuildMap(ctx)
+	case "cache-clear":
+		if f.opt.Snapshot {
+			return nil, errors.New("the cache can't be cleared with snapshot")
+		}
+		dropped := f.clearMapCache()
+		if f.diskCache == nil {
+			return fmt.Sprintf("dropped %d cached map files", dropped), nil
+		}
+		return fmt.Sprintf("dropped %d cached map files and %d map files cached on disk", dropped, f.diskCache.clear()), nil
+	default:
+		return nil, fs.ErrorCommandNotFound
+	}
+}
+
+var commandHelp = []fs.CommandHelp{{
+	Name:  "map-versions",
+	Short: "List the recorded versions of the directory map",
+	Long: `List the versions of the directory map recorded when map_history is
+enabled, with their generation and time.
+Usage Example:
+    rclone backend map-versions hashmap:
+`,
+}, {
+	Name:  "map-restore",
+	Short: "Restore a previous version of the directory map",
+	Long: `Replace the directory map with the version of the given generation as
+listed by map-versions. The restore itself is recorded as a new version.
+
+With --dry-run the map is not replaced, with -i the restore is confirmed
+first.
+Usage Example:
+    rclone backend map-restore hashmap: 42
+    rclone backend map-restore hashmap: 42 --dry-run
+`,
+}, {
+	Name:  "map-diff",
+	Short: "Compare two versions of the directory map",
+	Long: `Compare the versions of the directory map with the given generations, as
+listed by "map-versions", and output the added, removed and moved
+directories as JSON, e.g. to audit what a sync changed in the namespace.
+The second generation defaults to "current", the directory map in use.
+
+A directory is reported as moved if it is recorded with the same hash
+directory at another path. As the hash directories are derived from the
+paths, most moves show up as a removed and an added directory.
+Usage Example:
+    rclone backend map-diff hashmap: 3 5
+    rclone backend map-diff hashmap: 3
+`,
+}, {
+	Name:  "decoys",
+	Short: "Create decoy directories",
+	Long: `Create decoy directories until there are as many as given, or as set by
+decoy_count if no number is given.
+Usage Example:
+    rclone backend decoys hashmap: 100
+`,
+}, {
+	Name:  "shred",
+	Short: "Securely erase a file or directory",
+	Long: `Remove the data objects, name files and map entries of the given file or
+directory, and remove the directory from all recorded versions of the map.
+Name files are overwritten with zeros before they are deleted so copies
+retained by the base do not reveal the name.
+
+Previous object versions kept by the base itself (e.g. with bucket
+versioning enabled) must be removed with the tools of the base.
+
+With --dry-run the operations on the base are only listed, with -i each of
+them is confirmed before it is performed.
+Usage Example:
+    rclone backend shred hashmap: path/to/file
+    rclone backend shred hashmap: path/to/dir -o overwrite
+    rclone backend shred hashmap: path/to/dir --dry-run
+`,
+	Opts: map[string]string{
+		"overwrite": "Overwrite the data objects with zeros before deleting them",
+	},
+}, {
+	Name:  "scrub",
+	Short: "Verify the maps against the name files and data objects",
+	Long: `Verify the map files of all directories against the name files and data
+objects in the base and report the inconsistencies found as JSON.
+
+With -o status the report of the last run of the background scrubber
+enabled with scrub_interval is shown instead. This is mostly useful with
+the rc command backend/command against a running daemon.
+
+With -o clean the file directories of uploads interrupted more than an
+hour ago, as recorded by pending_markers, are removed. With --dry-run the
+removals and the name file repairs of repair_name_files are only listed,
+with -i each of them is confirmed before it is performed.
+Usage Example:
+    rclone backend scrub hashmap:
+    rclone backend scrub hashmap: -o clean
+    rclone backend scrub hashmap: -o clean --dry-run
+    rclone rc backend/command command=scrub fs=hashmap: -o status
+`,
+	Opts: map[string]string{
+		"status": "Show the report of the last background run instead",
+		"clean":  "Remove interrupted uploads and stale pending markers",
+	},
+}, {
+	Name:  "adopt",
+	Short: "Move a plain object of the base into the overlay",
+	Long: `Move an object which was uploaded directly to the base into the overlay
+at the given path, using a server-side move into its hash directory. The
+parent directories are created as needed.
+
+The path in the base is relative to the remote wrapped by the overlay.
+Usage Example:
+    rclone backend adopt hashmap: upload/report.pdf path/to/report.pdf
+`,
+}, {
+	Name:  "import-crypt",
+	Short: "Move the files of a crypt remote into the overlay",
+	Long: `Move all files of the given crypt remote into the overlay, below the given
+path or at the root, with the names decrypted with the keys configured for
+the crypt remote. This migrates from the encrypted names of crypt to the
+hashed names of the overlay.
+
+The files of a crypt remote with no_data_encryption over a remote with the
+same configuration as the base are moved server-side into their hash
+directories. All other files are decrypted, uploaded to the overlay and
+removed from the crypt remote. The result is the number of directories
+created and files moved and copied, as JSON.
+Usage Example:
+    rclone backend import-crypt hashmap: secret:
+    rclone backend import-crypt hashmap: secret:photos path/to/photos
+`,
+}, {
+	Name:  "du",
+	Short: "Show the usage of each directory",
+	Long: `Show the size and number of the files in each directory below the given
+directory, on its own and including its subdirectories. The sizes are taken
+from the listings of the hash directories so the data objects are not read.
+Usage Example:
+    rclone backend du hashmap:
+    rclone backend du hashmap: path/to/dir -o table
+`,
+	Opts: map[string]string{
+		"table": "Show the usage as a table instead of JSON",
+	},
+}, {
+	Name:  "inventory",
+	Short: "List every file with its location and checksum in the base",
+	Long: `List every file below the given directory with its overlay path, the path
+of its data object in the base, its size, modification time and the checksum
+stored by the base, for auditing or reconciliation against the inventories
+of the base. Files whose data object is missing are listed as missing.
+
+The checksum is the first one supported by the base unless another one is
+given with -o hash.
+Usage Example:
+    rclone backend inventory hashmap:
+    rclone backend inventory hashmap: path/to/dir -o csv -o hash=md5
+`,
+	Opts: map[string]string{
+		"csv":  "Output the inventory as CSV instead of JSON",
+		"hash": "Type of the checksum to include, e.g. md5",
+	},
+}, {
+	Name:  "orphans",
+	Short: "List objects in the base which are not referenced by the map",
+	Long: `List the hash directories and file directories in the base which are not
+referenced by the map, stray objects such as left over temporary files, and
+map entries whose data object is missing, as JSON. Nothing is deleted, so
+the report can be reviewed before cleaning up with other commands.
+
+Each entry has a severity: "error" for files in the map with missing data,
+"warning" for unreferenced data which may be lost files (see lost_and_found)
+and "info" for left overs which are safe to remove.
+Usage Example:
+    rclone backend orphans hashmap:
+`,
+}, {
+	Name:  "replicate",
+	Short: "Copy the whole overlay to another remote",
+	Long: `Copy all objects of the base, the data objects as well as the directory
+map, map files and name files, to the given remote with the same paths, e.g.
+for disaster recovery or to migrate to another region. An overlay configured
+with that remote and the same options contains the same files afterwards.
+
+Objects already present with the same size and modification time are
+skipped, so the command can be run again to catch up. The objects are copied
+server-side if both remotes support it, e.g. two buckets of the same
+provider. The overlay should not be written while it is replicated.
+
+With "-o stream" nothing is copied server-side, e.g. to migrate to another
+provider. The data objects are streamed to the same paths, so their hashes
+are preserved, and the directory map, map files and name files are written
+anew from the overlay, leaving out the map versions, pending markers and
+decoys of the base. The directory map is written last. The progress is
+recorded in the remote, so an interrupted replication continues where it
+stopped when the command is run again.
+Usage Example:
+    rclone backend replicate hashmap: otherbase:bucket/overlay
+    rclone backend replicate -o stream -o bwlimit=10M hashmap: other:bucket/overlay
+`,
+	Opts: map[string]string{
+		"stream":  "Stream the data objects and write the metadata anew",
+		"bwlimit": "Bandwidth limit of the streamed data in bytes per second",
+	},
+}, {
+	Name:  "relocate",
+	Short: "Move the overlay to another path in its base",
+	Long: `Move all objects of the overlay, the data objects as well as the
+directory map, map files and name files, server-side to the given path
+relative to the remote wrapped by the overlay, e.g. to move an overlay out
+of the root of a bucket.
+
+A layout marker pointing to the new path is left behind, so the remote
+doesn't need to be reconfigured. Setting the remote to the new path avoids
+looking up the marker on every start. The path must not exist yet and the
+overlay should not be written while it is relocated.
+Usage Example:
+    rclone backend relocate hashmap: overlay
+`,
+}, {
+	Name:  "check-hashes",
+	Short: "Check that the map matches the configured hash type and layout",
+	Long: `Recompute the hash directory of every directory and the hash of every file
+below the root with the current hash type and layout and report the
+entries stored at another location in the base as JSON, e.g. after
+hash_type was changed or for files renamed within their directory, which
+keep the location of their old name. Such entries are still found through the map, but
+not by tools deriving their location from the path.
+
+With "-o fix" the entries are moved to their expected location with
+server-side moves and the map is updated.
+Usage Example:
+    rclone backend check-hashes hashmap:
+    rclone backend check-hashes hashmap: -o fix
+`,
+	Opts: map[string]string{
+		"fix": "Move the entries to their expected location",
+	},
+}, {
+	Name:  "reencode",
+	Short: "Rewrite the metadata with the current options",
+	Long: `Rewrite the directory map and the map files and name files of all
+directories below the root, or below the given directory, with the current
+metadata options, e.g. after name_padding, name_file_attributes or
+store_mod_times were changed. Attributes which are no longer recorded are
+dropped from the name files, attributes which are recorded now are taken
+from the data objects. The name files of a directory are rewritten
+concurrently, up to --checkers at a time, and the number of rewritten map
+files and name files is returned as JSON.
+
+With resumable_operations an interrupted run continues with the directories
+which were not rewritten yet when it is run again.
+Usage Example:
+    rclone backend reencode hashmap:
+    rclone backend reencode hashmap: dir
+`,
+}, {
+	Name:  "merge-duplicates",
+	Short: "Merge duplicated hash directories in the base",
+	Long: `Look for duplicates of the hash directories of all directories below the
+root, or below the given directory, in the base and merge them into one
+with the MergeDirs feature of the base. Bases like Google Drive allow
+several directories of the same name, which concurrent writers may create
+for the same hash directory, and only the files of one of them are seen
+through the overlay.
+
+The map files of the duplicates are merged into one recording the files of
+all of them. Of other duplicated objects, the most recently modified one
+is kept.
+Usage Example:
+    rclone backend merge-duplicates hashmap:
+    rclone backend merge-duplicates hashmap: dir
+`,
+}, {
+	Name:  "dump-map",
+	Short: "Print the directory map",
+	Long: `Print the directories of the loaded directory map below the given
+directory with their overlay path, hash directory, parent, number of
+subdirectories and number of files, as JSON, for auditing and external
+tooling.
+
+With -o files the map files of the directories are included, mapping the
+names of the files to their hashes. With -o csv the output is CSV, where
+the files follow their directory as rows of type file.
+Usage Example:
+    rclone backend dump-map hashmap:
+    rclone backend dump-map hashmap: path/to/dir -o files -o csv
+`,
+	Opts: map[string]string{
+		"files": "Include the map files of the directories",
+		"csv":   "Output the directory map as CSV instead of JSON",
+	},
+}, {
+	Name:  "export-map",
+	Short: "Export the directory map and all map files to a local file",
+	Long: `Write the directory map and the map files of all directories as JSON to
+the given local file, as a backup of the mapping state which can be
+restored with import-map. Without a file the JSON is printed instead.
+
+The export reveals the names of all files, so keep it safe.
+Usage Example:
+    rclone backend export-map hashmap: /path/to/map.json
+`,
+}, {
+	Name:  "import-map",
+	Short: "Import the directory map and map files from a local file",
+	Long: `Merge the directory map and map files exported with export-map from the
+given local file into the current ones, e.g. after map objects were deleted
+by accident. Directories missing from the directory map are added and files
+missing from the map files are added to them. The records of the current
+map take precedence, as they are newer than the export.
+
+The hashes of all directories and files are validated against their paths
+with the hash types of the hasher, and those which don't match are
+rejected. The export must have the layout of the remote. With --dry-run
+the map is not changed. The number of directories and files imported and
+the rejected paths are returned as JSON.
+Usage Example:
+    rclone backend import-map hashmap: /path/to/map.json
+`,
+}, {
+	Name:  "encode",
+	Short: "Translate an overlay path to its location in the base",
+	Long: `Translate a path of the overlay to its location in the base and return it
+as JSON: the hash directory of a directory, or the file directory, data
+object and name file of a file. Files which don't exist are translated to
+the location they would be stored at, with recorded set to false.
+Usage Example:
+    rclone backend encode hashmap: path/to/file.txt
+`,
+}, {
+	Name:  "decode",
+	Short: "Translate a path in the base to its overlay path",
+	Long: `Translate a hash directory, a file directory or an object in them back to
+the path of the overlay and return it as JSON in the same form as encode.
+Files which are not in the map are translated with their name file, with
+recorded set to false.
+
+The path in the base is relative to the remote wrapped by the overlay.
+Usage Example:
+    rclone backend decode hashmap: 0cc175b9c0f1b6a831c399e269772661/4ce61f142848763a459b6bede5fb2bdb/data
+`,
+}, {
+	Name:  "gc",
+	Short: "Delete hash directories and file directories no map references",
+	Long: `Delete the hash directories in the base which are not in the directory map
+and the file directories which their map file does not reference, e.g. the
+left overs of failed uploads and interrupted purges, and return them as
+JSON with the space freed.
+
+Only the trees whose newest object is older than the minimum age, 24h
+unless given with -o min-age, are deleted, so concurrent uploads are not
+affected. Unreferenced trees may hold lost files, see lost_and_found and
+fsck -o fix=orphaned to recover them first. With --dry-run the trees are
+only listed, with -i each deletion is confirmed before it is performed.
+Usage Example:
+    rclone backend gc hashmap: --dry-run
+    rclone backend gc hashmap: -o min-age=7d
+`,
+	Opts: map[string]string{
+		"min-age": "Only delete trees older than this, default 24h",
+	},
+}, {
+	Name:  "fsck",
+	Short: "Cross-verify the maps, name files and data objects",
+	Long: `Check the directory map, the map files of all directories, the name files
+and the data objects against each other and report the problems found as
+JSON. Each problem has one of these classes:
+
+- missing-data: a file in the map whose data object is missing
+- dangling: a file in the map whose file directory is missing altogether
+- orphaned: a hash directory or file directory not referenced by the maps
+- names: a name file which is missing or records another path than the map
+
+With -o fix the given comma separated classes, or all of them, are
+repaired: files without data are removed from the map, name files are
+rewritten from the map, unreferenced file directories whose name file
+records a path in their directory are added to the map again and those of
+interrupted uploads removed, and unreferenced hash directories are added
+to the directory map from their name files as rebuild-map does. With
+--dry-run the repairs are only listed, with -i each of them is confirmed
+before it is performed.
+Usage Example:
+    rclone backend fsck hashmap:
+    rclone backend fsck hashmap: -o fix=names,missing-data
+    rclone backend fsck hashmap: -o fix=all --dry-run
+`,
+	Opts: map[string]string{
+		"fix": "Comma separated classes of problems to repair, or all",
+	},
+}, {
+	Name:  "rebuild-map",
+	Short: "Rebuild the directory map from the name files in the base",
+	Long: `Reconstruct the directory map from the name files of all hash directories
+in the base, e.g. after it was lost, and add the files found to the map
+files of their directories. The directories of the current map whose hash
+directory exists are kept, so empty directories are not lost. The number
+of directories and files and the directories added to and dropped from the
+map are returned as JSON.
+
+With --dry-run the map is not changed. If the directory map is malformed,
+set recover_map to open the remote. This is not supported with hash type
+none.
+Usage Example:
+    rclone backend rebuild-map hashmap:
+    rclone backend --dry-run rebuild-map hashmap:
+`,
+}, {
+	Name:  "cache-clear",
+	Short: "Drop the map files cached in memory and on disk",
+	Long: `Drop the map files of all directories cached in memory, so they are read
+from the base again when they are used next, e.g. after they were changed
+by another client. The directory map is kept. The copies cached on disk
+with cache_disk_max_size are removed as well.
+
+This is mostly useful with the rc command backend/command against a
+running mount.
+Usage Example:
+    rclone backend cache-clear hashmap:
+    rclone rc backend/command command=cache-clear fs=hashmap:
+`,
+}}
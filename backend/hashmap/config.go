@@ -0,0 +1,119 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/configstruct"
+)
+
+// configDepth is the depth of the directories for which the length of the
+// paths in the base is checked by the config flow.
+const configDepth = 4
+
+// configMaxPath is the length of the paths in the base above which the
+// config flow warns, the limit of the names and paths of many file systems
+// and remotes.
+const configMaxPath = 255
+
+// configure validates the configuration of a new or edited remote, warns about
+// settings which don't suit the base and offers to initialize an empty
+// overlay.
+func configure(ctx context.Context, name string, m configmap.Mapper, in fs.ConfigIn) (*fs.ConfigOut, error) {
+	opt := new(Options)
+	if err := configstruct.Set(m, opt); err != nil {
+		return nil, fmt.Errorf("couldn't parse config into struct: %w", err)
+	}
+	if opt.Raw {
+		return nil, nil
+	}
+	switch in.State {
+	case "":
+		f, err := newConfigFs(ctx, name, m)
+		if err != nil {
+			return nil, err
+		}
+		defer f.stop(ctx)
+		for _, warning := range f.configWarnings() {
+			fs.Logf(nil, "hashmap: %s", warning)
+		}
+		initialized, err := f.initialized(ctx)
+		if err != nil || initialized {
+			return nil, err
+		}
+		return fs.ConfigConfirm("init", true, "config_init", fmt.Sprintf(`Initialize the overlay in %q now?
+
+This writes the directory map and the layout marker to the remote, which
+is otherwise done by the first write to the overlay.
+`, opt.Remote))
+	case "init":
+		if in.Result == "false" {
+			return nil, nil
+		}
+		f, err := newConfigFs(ctx, name, m)
+		if err != nil {
+			return nil, err
+		}
+		defer f.stop(ctx)
+		if err := f.dirMap.write(ctx); err != nil {
+			return nil, fmt.Errorf("failed to initialize the overlay: %w", err)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown state %q", in.State)
+}
+
+// newConfigFs returns the Fs configured by m, checking that the settings are
+// valid and the wrapped remote resolves.
+func newConfigFs(ctx context.Context, name string, m configmap.Mapper) (*Fs, error) {
+	f, err := NewFs(ctx, name, "", m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return f.(*Fs), nil
+}
+
+// initialized reports whether the base already contains an overlay.
+func (f *Fs) initialized(ctx context.Context) (bool, error) {
+	for _, remote := range []string{"map", layoutMarker} {
+		_, err := f.base.NewObject(ctx, remote)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, fs.ErrorObjectNotFound) && !errors.Is(err, fs.ErrorDirNotFound) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// configWarnings returns the warnings about settings which don't suit the
+// base.
+func (f *Fs) configWarnings() []string {
+	var warnings []string
+	if f.opt.HashType == "none" && f.base.Features().CaseInsensitive && !f.opt.CaseInsensitive {
+		warnings = append(warnings, fmt.Sprintf("%q is case insensitive but names are not hashed with hash type none, so names which only differ in case overwrite each other: set case_insensitive or use another hash type", f.opt.Remote))
+	}
+	if f.opt.HashType == "none" {
+		warnings = append(warnings, fmt.Sprintf("paths in %q are as long as the paths in the overlay plus %d characters with hash type none", f.opt.Remote, len(f.fileKey("/", dataLeaf))))
+		return warnings
+	}
+	segments := make([]string, configDepth)
+	for i := range segments {
+		segments[i] = "dir"
+	}
+	dir := strings.Join(segments, "/")
+	key := f.fileKey(path.Join(f.dirBase(dir), f.fileHash(dir, "file")), dataLeaf)
+	if root := f.base.Root(); root != "" {
+		key = path.Join(root, key)
+	}
+	if len(key) > configMaxPath {
+		warnings = append(warnings, fmt.Sprintf("paths in %q are %d characters long for files %d directories deep with layout %s and hash type %s, more than the %d characters supported by some remotes", f.opt.Remote, len(key), configDepth, f.layout, f.opt.HashType, configMaxPath))
+	}
+	return warnings
+}
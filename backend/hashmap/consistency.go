@@ -0,0 +1,83 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// consistencyBackoff is the delay before the first retry of a lookup of an
+// object written within consistency_window. It doubles with every retry.
+const consistencyBackoff = 100 * time.Millisecond
+
+// noteWrite records that the object at remote in the base was just written,
+// so lookups within consistency_window retry if the base doesn't show it
+// yet.
+func (f *Fs) noteWrite(remote string) {
+	window := time.Duration(f.opt.ConsistencyWindow)
+	if window <= 0 {
+		return
+	}
+	now := time.Now()
+	f.writesMu.Lock()
+	defer f.writesMu.Unlock()
+	if f.recentWrites == nil {
+		f.recentWrites = make(map[string]time.Time)
+	}
+	for written, t := range f.recentWrites {
+		if now.Sub(t) > window {
+			delete(f.recentWrites, written)
+		}
+	}
+	f.recentWrites[remote] = now
+}
+
+// forgetWrite drops the write of the object at remote in the base recorded
+// by noteWrite once it was removed, so looking it up isn't retried.
+func (f *Fs) forgetWrite(remote string) {
+	f.writesMu.Lock()
+	delete(f.recentWrites, remote)
+	f.writesMu.Unlock()
+}
+
+// writtenWithin returns the time left until the object at remote in the base
+// was written longer than consistency_window ago. It returns 0 if it wasn't
+// written recently.
+func (f *Fs) writtenWithin(remote string) time.Duration {
+	f.writesMu.Lock()
+	t, ok := f.recentWrites[remote]
+	f.writesMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return time.Duration(f.opt.ConsistencyWindow) - time.Since(t)
+}
+
+// newBaseObject looks up the object at remote in the base. If it isn't found
+// but was written within consistency_window, the lookup is retried with
+// backoff until the window passed.
+func (f *Fs) newBaseObject(ctx context.Context, remote string) (fs.Object, error) {
+	delay := consistencyBackoff
+	for {
+		obj, err := f.base.NewObject(ctx, remote)
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			return obj, err
+		}
+		left := f.writtenWithin(remote)
+		if left <= 0 {
+			return nil, err
+		}
+		if delay > left {
+			delay = left
+		}
+		fs.Debugf(f, "%q was written recently but is not found yet, retrying in %v", remote, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
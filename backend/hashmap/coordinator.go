@@ -0,0 +1,257 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fshttp"
+)
+
+// leaseTTL is the time after which the coordinator releases a lease which
+// was neither renewed nor released by its client, e.g. because it crashed.
+const leaseTTL = 30 * time.Second
+
+// coordinator is the client of the coordination service configured with
+// coordinator_url. Map files are only written while holding a lease on them
+// from the service, which also records the generation of every map file so
+// writes based on an outdated map are detected.
+//
+// The service implements the following JSON endpoints:
+//
+//	POST /lease      {"namespace", "key", "client", "ttl"}
+//	                 -> {"token", "generation"}, 409 if leased by another client
+//	POST /renew      {"namespace", "key", "token", "ttl"}
+//	                 extends the lease, 409 if it is not held any more
+//	POST /release    {"namespace", "key", "token", "generation"}
+//	                 a generation of 0 leaves the generation unchanged
+//	GET  /generation ?namespace=&key= -> {"generation"}
+type coordinator struct {
+	url       string
+	namespace string
+	client    string
+	http      *http.Client
+	// ttl is the time to live of the leases.
+	ttl time.Duration
+	// mu protects seen.
+	mu sync.Mutex
+	// seen maps the map files to the generation they were loaded or
+	// written at by this client.
+	seen map[string]int64
+}
+
+// lease is a lease on a map file obtained from the coordinator.
+type lease struct {
+	Token      string `json:"token"`
+	Generation int64  `json:"generation"`
+}
+
+// newCoordinator returns the client of the coordination service, or nil if
+// coordinator_url is not set.
+func newCoordinator(ctx context.Context, opt *Options) *coordinator {
+	if opt.CoordinatorURL == "" {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	namespace := opt.CoordinatorNamespace
+	if namespace == "" {
+		namespace = opt.Remote
+	}
+	return &coordinator{
+		url:       strings.TrimSuffix(opt.CoordinatorURL, "/"),
+		namespace: namespace,
+		client:    fmt.Sprintf("%s/%d", host, os.Getpid()),
+		http:      fshttp.NewClient(ctx),
+		ttl:       leaseTTL,
+		seen:      make(map[string]int64),
+	}
+}
+
+// call posts in as JSON to the endpoint and decodes the response into out if
+// it is not nil. It returns the HTTP status code.
+func (c *coordinator) call(ctx context.Context, method, endpoint string, in, out interface{}) (int, error) {
+	var body *bytes.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+endpoint, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("coordinator: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("coordinator: %s %s: %s", method, endpoint, resp.Status)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("coordinator: invalid response from %s: %w", endpoint, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// observe records the current generation of the map file key before it is
+// loaded.
+func (c *coordinator) observe(ctx context.Context, key string) error {
+	var out struct {
+		Generation int64 `json:"generation"`
+	}
+	query := url.Values{"namespace": {c.namespace}, "key": {key}}
+	if _, err := c.call(ctx, http.MethodGet, "/generation?"+query.Encode(), nil, &out); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.seen[key] = out.Generation
+	c.mu.Unlock()
+	return nil
+}
+
+// acquire obtains a lease on the map file key, waiting for leases held by
+// other clients. It returns ErrMapConflict if the map file was written by
+// another client since this client loaded or wrote it.
+func (c *coordinator) acquire(ctx context.Context, key string) (*lease, error) {
+	in := map[string]interface{}{
+		"namespace": c.namespace,
+		"key":       key,
+		"client":    c.client,
+		"ttl":       c.ttlSeconds(),
+	}
+	// Wait for leases held by other clients up to twice their TTL.
+	deadline := time.Now().Add(2 * c.ttl)
+	sleep := 100 * time.Millisecond
+	var l lease
+	for {
+		status, err := c.call(ctx, http.MethodPost, "/lease", in, &l)
+		if err == nil {
+			break
+		}
+		if status != http.StatusConflict || time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to lease %q: %w", key, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
+		}
+		if sleep < 2*time.Second {
+			sleep *= 2
+		}
+	}
+	c.mu.Lock()
+	seen, ok := c.seen[key]
+	c.mu.Unlock()
+	if ok && seen != l.Generation {
+		c.release(ctx, key, &l, 0)
+		return nil, fmt.Errorf("%q: %w (generation %d, loaded %d)", key, ErrMapConflict, l.Generation, seen)
+	}
+	return &l, nil
+}
+
+// ttlSeconds returns the time to live of the leases in whole seconds.
+func (c *coordinator) ttlSeconds() int64 {
+	if c.ttl < time.Second {
+		return 1
+	}
+	return int64(c.ttl / time.Second)
+}
+
+// renew extends the lease on the map file key by its time to live.
+func (c *coordinator) renew(ctx context.Context, key string, l *lease) error {
+	in := map[string]interface{}{
+		"namespace": c.namespace,
+		"key":       key,
+		"token":     l.Token,
+		"ttl":       c.ttlSeconds(),
+	}
+	_, err := c.call(ctx, http.MethodPost, "/renew", in, nil)
+	return err
+}
+
+// hold renews the lease on the map file key every third of its time to live
+// until the returned function is called, so it does not expire while the map
+// file is uploaded. The returned context is cancelled if a renewal fails, to
+// abort the upload before another client can obtain the lease. The returned
+// function returns the error of the failed renewal.
+func (c *coordinator) hold(ctx context.Context, key string, l *lease) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	var lost error
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(c.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := c.renew(ctx, key, l); err != nil {
+				lost = fmt.Errorf("lease on %q lost during the write: %w", key, err)
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(stop)
+		<-stopped
+		cancel()
+		return lost
+	}
+}
+
+// release releases the lease on the map file key, publishing generation as
+// its new generation unless it is 0.
+func (c *coordinator) release(ctx context.Context, key string, l *lease, generation int64) {
+	in := map[string]interface{}{
+		"namespace":  c.namespace,
+		"key":        key,
+		"token":      l.Token,
+		"generation": generation,
+	}
+	if _, err := c.call(ctx, http.MethodPost, "/release", in, nil); err != nil {
+		// The lease expires on its own.
+		fs.Errorf(nil, "failed to release lease on %q: %v", key, err)
+		return
+	}
+	if generation != 0 {
+		c.mu.Lock()
+		c.seen[key] = generation
+		c.mu.Unlock()
+	}
+}
+
+// observeMap records the generation of the map file at remote in the base
+// before it is loaded, if a coordinator is configured.
+func (f *Fs) observeMap(ctx context.Context, remote string) error {
+	if f.coord == nil {
+		return nil
+	}
+	return f.coord.observe(ctx, remote)
+}
@@ -0,0 +1,146 @@
+package hashmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCoordinator implements the coordination service in memory.
+type fakeCoordinator struct {
+	mu sync.Mutex
+	// generations are the generations of the map files by key.
+	generations map[string]int64
+	// leases are the expiry times of the leases by key and token.
+	leases map[string]map[string]time.Time
+	// renewals is the number of successful renewals.
+	renewals int
+	// refuseRenew makes the renewals fail as if the lease expired.
+	refuseRenew bool
+	tokens      int
+}
+
+func newFakeCoordinator(t *testing.T) (*fakeCoordinator, string) {
+	c := &fakeCoordinator{
+		generations: make(map[string]int64),
+		leases:      make(map[string]map[string]time.Time),
+	}
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return c, srv.URL
+}
+
+func (c *fakeCoordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var in struct {
+		Key        string `json:"key"`
+		Token      string `json:"token"`
+		TTL        int64  `json:"ttl"`
+		Generation int64  `json:"generation"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	held := func() bool {
+		for token, expiry := range c.leases[in.Key] {
+			if time.Now().Before(expiry) && (in.Token == "" || token == in.Token) {
+				return true
+			}
+		}
+		return false
+	}
+	switch r.URL.Path {
+	case "/generation":
+		_ = json.NewEncoder(w).Encode(map[string]int64{"generation": c.generations[r.URL.Query().Get("key")]})
+	case "/lease":
+		if held() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		c.tokens++
+		token := fmt.Sprint(c.tokens)
+		c.leases[in.Key] = map[string]time.Time{token: time.Now().Add(time.Duration(in.TTL) * time.Second)}
+		_ = json.NewEncoder(w).Encode(lease{Token: token, Generation: c.generations[in.Key]})
+	case "/renew":
+		if c.refuseRenew || !held() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		c.renewals++
+		c.leases[in.Key][in.Token] = time.Now().Add(time.Duration(in.TTL) * time.Second)
+	case "/release":
+		if !held() {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(c.leases, in.Key)
+		if in.Generation != 0 {
+			c.generations[in.Key] = in.Generation
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	ctx := context.Background()
+	c, url := newFakeCoordinator(t)
+	// Uploading the map file takes about a second.
+	f := newTestFs(t, t.TempDir(), configmap.Simple{"coordinator_url": url, "metadata_bwlimit": "10k"})
+	f.coord.ttl = 300 * time.Millisecond
+	data := []byte(strings.Repeat("x", 20*1024))
+
+	_, err := f.putMap(ctx, "slow/map", data)
+	require.NoError(t, err)
+	c.mu.Lock()
+	assert.Greater(t, c.renewals, 0)
+	assert.Equal(t, int64(1), c.generations["slow/map"])
+	c.refuseRenew = true
+	c.mu.Unlock()
+
+	// The upload is aborted once the lease can't be renewed.
+	_, err = f.putMap(ctx, "slow/map", data)
+	assert.ErrorContains(t, err, "lost during the write")
+	c.mu.Lock()
+	assert.Equal(t, int64(1), c.generations["slow/map"])
+	c.mu.Unlock()
+}
+
+func TestWriteConflict(t *testing.T) {
+	ctx := context.Background()
+	_, url := newFakeCoordinator(t)
+	dir := t.TempDir()
+	a := newTestFs(t, dir, configmap.Simple{"coordinator_url": url})
+	require.NoError(t, a.Mkdir(ctx, "d"))
+	b := newTestFs(t, dir, configmap.Simple{"coordinator_url": url})
+	entry, ok := b.dirMap.get("d")
+	require.True(t, ok)
+	_, err := entry.Files(ctx)
+	require.NoError(t, err)
+
+	putTestFile(t, a, "d/a.txt", "a")
+	require.NoError(t, entry.addFile(ctx, "b.txt", b.fileHash("d", "b.txt")))
+	assert.ErrorIs(t, entry.write(ctx), ErrMapConflict)
+	entry.mu.Lock()
+	assert.Nil(t, entry.files)
+	assert.Nil(t, entry.types)
+	assert.Equal(t, entry.requested, entry.written, "the dropped changes are not pending")
+	entry.mu.Unlock()
+	assert.Equal(t, 0, b.pendingMapWrites())
+
+	// The map file of the other client is loaded again.
+	files, err := entry.Files(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, files, "a.txt")
+	assert.NotContains(t, files, "b.txt")
+	putTestFile(t, b, "d/b.txt", "b")
+}
@@ -0,0 +1,203 @@
+package hashmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"path"
+	"sort"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/random"
+)
+
+const (
+	// decoyIndexName is hashed to the hash directory whose map file lists
+	// the decoy directories. No overlay path hashes to it, as they never
+	// start with a slash.
+	decoyIndexName = "/decoys"
+	// decoyMaxFiles is the maximum number of files in a decoy directory.
+	decoyMaxFiles = 4
+	// decoyMaxSize is the maximum size of the data object of a decoy file.
+	decoyMaxSize = 1024 * 1024
+)
+
+// randomInt returns a uniform random number in [0, n).
+func randomInt(n int64) (int64, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0, err
+	}
+	return i.Int64(), nil
+}
+
+// randomHash returns a random string looking like the output of the hasher.
+func (f *Fs) randomHash() (string, error) {
+	buf := make([]byte, len(f.hasher(""))/2)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// decoyIndex returns the path of the map file listing the decoy directories.
+// It is stored and encoded like the map file of a decoy directory, so it is
+// indistinguishable from the map files of the real directories.
+func (f *Fs) decoyIndex() string {
+	return path.Join(f.decoyBase(f.hasher(decoyIndexName)), "map")
+}
+
+// loadDecoys fills f.decoys from the decoy index in the base.
+func (f *Fs) loadDecoys(ctx context.Context) error {
+	f.decoysMu.Lock()
+	defer f.decoysMu.Unlock()
+	return f.loadDecoysLocked(ctx)
+}
+
+// isDecoy reports whether dirHash is the hash directory of a decoy or of the
+// decoy index. The decoys must have been loaded with loadDecoys.
+func (f *Fs) isDecoy(dirHash string) bool {
+	if f.opt.HashType != "none" && dirHash == path.Dir(f.decoyIndex()) {
+		return true
+	}
+	f.decoysMu.Lock()
+	defer f.decoysMu.Unlock()
+	_, ok := f.decoys[dirHash]
+	return ok
+}
+
+// loadDecoysLocked is loadDecoys with decoysMu held.
+func (f *Fs) loadDecoysLocked(ctx context.Context) error {
+	if f.decoys != nil {
+		return nil
+	}
+	decoys := make(map[string]struct{})
+	if f.opt.HashType == "none" {
+		// Decoys are not supported.
+		f.decoys = decoys
+		return nil
+	}
+	in, err := f.openMeta(ctx, f.decoyIndex())
+	switch {
+	case errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound):
+		f.decoys = decoys
+		return nil
+	case err != nil:
+		return fmt.Errorf("error opening decoy index: %w", err)
+	}
+	defer in.Close()
+	records, err := unmarshalRecords(in)
+	if err != nil {
+		return fmt.Errorf("error reading decoy index: %w", err)
+	}
+	for _, record := range records {
+		decoys[f.decoyBase(record.hash)] = struct{}{}
+	}
+	f.decoys = decoys
+	return nil
+}
+
+// writeDecoys writes f.decoys to the decoy index in the base. Every decoy is
+// a record with its hash and a random name. It must be called with decoysMu
+// held.
+func (f *Fs) writeDecoys(ctx context.Context) error {
+	records := make([]mapRecord, 0, len(f.decoys))
+	for dirHash := range f.decoys {
+		records = append(records, mapRecord{hash: path.Base(dirHash), name: random.String(12)})
+	}
+	sortRecords(records)
+	_, err := f.putBytes(ctx, f.decoyIndex(), marshalRecords(records))
+	return err
+}
+
+// sortRecords sorts records by name like the records of the map files.
+func sortRecords(records []mapRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].name < records[j].name
+	})
+}
+
+// makeDecoy creates a single decoy directory with a random number of files
+// with plausible looking name and data objects and a map file listing them,
+// and returns its path in the base.
+func (f *Fs) makeDecoy(ctx context.Context) (string, error) {
+	hash, err := f.randomHash()
+	if err != nil {
+		return "", err
+	}
+	dirHash := f.decoyBase(hash)
+	files, err := randomInt(decoyMaxFiles)
+	if err != nil {
+		return "", err
+	}
+	var records []mapRecord
+	for i := int64(0); i <= files; i++ {
+		fileHash, err := f.randomHash()
+		if err != nil {
+			return "", err
+		}
+		size, err := randomInt(decoyMaxSize)
+		if err != nil {
+			return "", err
+		}
+		name := path.Join(random.String(8), random.String(12))
+		if err := f.prepareDest(ctx, nil, name, dirHash, fileHash); err != nil {
+			return "", err
+		}
+		dataSrc := fakeObjInfo{
+			remote: f.fileKey(path.Join(dirHash, fileHash), dataLeaf),
+			fs:     f,
+			size:   size,
+		}
+		if _, err := f.base.Put(ctx, io.LimitReader(rand.Reader, size), dataSrc); err != nil {
+			return "", fmt.Errorf("error creating decoy data file: %w", err)
+		}
+		records = append(records, mapRecord{hash: fileHash, name: path.Base(name)})
+	}
+	// Real hash directories have a map file listing their files.
+	sortRecords(records)
+	if _, err := f.putBytes(ctx, path.Join(dirHash, "map"), marshalRecords(records)); err != nil {
+		return "", fmt.Errorf("error creating decoy map file: %w", err)
+	}
+	return dirHash, nil
+}
+
+// makeDecoys tops up the number of decoy directories to count and returns the
+// number of decoys created.
+func (f *Fs) makeDecoys(ctx context.Context, count int) (int, error) {
+	if f.opt.HashType == "none" {
+		return 0, errors.New("decoys are not supported with hash type none")
+	}
+	f.decoysMu.Lock()
+	defer f.decoysMu.Unlock()
+	if err := f.loadDecoysLocked(ctx); err != nil {
+		return 0, err
+	}
+	created := 0
+	var err error
+	var p *progress
+	if len(f.decoys) < count {
+		p = newProgress(ctx, "decoys", count-len(f.decoys))
+		defer p.finish()
+	}
+	for len(f.decoys) < count {
+		var dirHash string
+		dirHash, err = f.makeDecoy(ctx)
+		p.scan(dirHash, err)
+		if err != nil {
+			break
+		}
+		f.decoys[dirHash] = struct{}{}
+		created++
+	}
+	if created > 0 {
+		if writeErr := f.writeDecoys(ctx); writeErr != nil {
+			return created, writeErr
+		}
+	}
+	return created, err
+}
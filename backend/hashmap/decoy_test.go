@@ -0,0 +1,53 @@
+package hashmap
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecoys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"decoy_count": "2"})
+	require.NoError(t, f.loadDecoys(ctx))
+	assert.Len(t, f.decoys, 2, "decoys are topped up when the remote is opened")
+
+	// Writing the map doesn't create more decoys.
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	assert.Len(t, f.decoys, 2)
+	lost, err := f.lostDirs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, lost, "decoys are not lost directories")
+
+	created, err := f.makeDecoys(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+
+	// The decoys and the index look like the real hash directories.
+	assert.NoFileExists(t, filepath.Join(dir, "map.decoys"))
+	assert.FileExists(t, filepath.Join(dir, filepath.FromSlash(f.decoyIndex())))
+	assert.Equal(t, "map", path.Base(f.decoyIndex()))
+	for dirHash := range f.decoys {
+		files, err := f.readFileMap(ctx, dirHash)
+		require.NoError(t, err)
+		assert.NotEmpty(t, files, "decoys have map files")
+	}
+	assert.True(t, f.isDecoy(path.Dir(f.decoyIndex())))
+
+	// The decoys are read from the index by the next instance.
+	f = newTestFs(t, dir, configmap.Simple{"decoy_count": "2"})
+	require.NoError(t, f.loadDecoys(ctx))
+	assert.Len(t, f.decoys, 3)
+	lost, err = f.lostDirs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, lost)
+
+	_, err = f.Command(ctx, "decoys", []string{"-1"}, nil)
+	assert.ErrorContains(t, err, "must not be negative")
+}
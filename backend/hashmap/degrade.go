@@ -0,0 +1,48 @@
+package hashmap
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// errDegraded is returned by all operations modifying the overlay after it
+// degraded to read only.
+var errDegraded = errors.New("hashmap is read only after repeated failures to write the map")
+
+// checkWritable returns errDegraded if the overlay degraded to read only
+// and errHalted if it stopped writing after a quota or permission error.
+func (f *Fs) checkWritable() error {
+	if atomic.LoadInt32(&f.degraded) != 0 {
+		return errDegraded
+	}
+	if atomic.LoadInt32(&f.halted) != 0 {
+		return errHalted
+	}
+	return nil
+}
+
+// recordMapWrite records the result of a write of a map file. After
+// max_map_failures consecutive failures, the overlay degrades to read only so
+// no more data objects are uploaded which would never be reachable. It
+// becomes writable again once a write succeeds, e.g. a retry.
+func (f *Fs) recordMapWrite(err error) {
+	f.checkHalt(err)
+	if err == nil {
+		atomic.StoreInt64(&f.lastMapWrite, time.Now().UnixNano())
+		atomic.StoreInt32(&f.mapFailures, 0)
+		if atomic.CompareAndSwapInt32(&f.degraded, 1, 0) {
+			fs.Logf(f, "Writing the map succeeded again, the remote is writable again")
+		}
+		return
+	}
+	failures := atomic.AddInt32(&f.mapFailures, 1)
+	if f.opt.MaxMapFailures <= 0 || int(failures) < f.opt.MaxMapFailures {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&f.degraded, 0, 1) {
+		fs.Errorf(f, "Writing the map failed %d times in a row, the remote is read only from now on to protect the data: %v", failures, err)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
 	"github.com/rclone/rclone/fs/operations"
 )
 
@@ -18,13 +20,35 @@ import (
 // dir should be "" to list the root, and should not have trailing slashes.
 //
 // This should return ErrorDirNotFound if the directory isn't found.
-func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
-	dir = path.Join(f.root, dir)
-	entry, ok := f.dirMap.Path[dir]
+func (f *Fs) List(ctx context.Context, dir string) (_ fs.DirEntries, err error) {
+	defer func(dir string) { err = annotate(dir, err) }(dir)
+	if f.isLostFound(dir) {
+		return f.listLostFound(ctx, dir)
+	}
+	entry, ok := f.findDir(path.Join(f.root, dir))
+	if !ok {
+		var err error
+		entry, ok, err = f.findUnmappedDir(ctx, path.Join(f.root, dir))
+		if err != nil {
+			return nil, err
+		}
+	}
 	if !ok {
+		if f.readThrough() {
+			return f.listPlain(ctx, dir, nil, false)
+		}
 		return nil, fs.ErrorDirNotFound
 	}
-	return f.list(ctx, entry)
+	entries, err := f.list(ctx, entry)
+	if err == nil && f.readThrough() {
+		entries, err = f.listPlain(ctx, dir, entries, true)
+	}
+	if err == nil && path.Join(f.root, dir) == "" && f.hasLostFound() {
+		entries = append(entries, fs.NewDir(lostFoundDir, time.Time{}))
+	}
+	// Return the entries sorted so listings don't change from run to run.
+	sort.Sort(entries)
+	return entries, err
 }
 
 // ListR lists the objects and directories of the Fs starting from dir
@@ -33,11 +57,19 @@ func (f *Fs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
 // This should return ErrDirNotFound if the directory isn't found.
 //
 // It should call callback for each tranche of entries read. These need not be
-// returned in any particular order.  If callback returns an error then the
-// listing will stop immediately.
+// returned in any particular order, but are sorted by directory and name so
+// listings don't change from run to run.  If callback returns an error then
+// the listing will stop immediately.
 func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) error {
 	dir = path.Join(f.root, dir)
-	entry, ok := f.dirMap.Path[dir]
+	entry, ok := f.findDir(dir)
+	if !ok {
+		var err error
+		entry, ok, err = f.findUnmappedDir(ctx, dir)
+		if err != nil {
+			return err
+		}
+	}
 	if !ok {
 		return fs.ErrorDirNotFound
 	}
@@ -47,10 +79,15 @@ func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) e
 		if err != nil {
 			return err
 		}
+		sort.Sort(entries)
 		if err := callback(entries); err != nil {
 			return err
 		}
-		for _, child := range e.Children {
+		children := f.dirMap.children(e)
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].Path < children[j].Path
+		})
+		for _, child := range children {
 			if err := recurse(child); err != nil {
 				return err
 			}
@@ -64,23 +101,44 @@ func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) e
 // recognizes.
 func (f *Fs) list(ctx context.Context, entry *dirEntry) (fs.DirEntries, error) {
 	// List directories and files.
-	subdirNames := make(map[string]*dirEntry, len(entry.Children))
-	for _, child := range entry.Children {
+	children := f.dirMap.children(entry)
+	subdirNames := make(map[string]*dirEntry, len(children))
+	for _, child := range children {
 		subdirNames[child.Hash] = child
 	}
+	if err := f.scanUnmapped(ctx, entry); err != nil {
+		return nil, err
+	}
 	files, err := entry.Files(ctx)
 	if err != nil {
 		return nil, err
 	}
-	subpathNames := make(map[string]struct{}, len(files))
-	for path := range files {
-		subpathNames[path] = struct{}{}
+	// With --files-from only the files in the list are looked up.
+	fi := filter.GetConfig(ctx)
+	filesFrom := filter.GetUseFilter(ctx) && fi.HaveFilesFrom()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if filesFrom {
+			if _, ok := fi.Files()[f.relative(path.Join(entry.Path, name))]; !ok {
+				continue
+			}
+		}
+		names = append(names, name)
 	}
 	// Create fs.DirEntry.
-	entries := make(fs.DirEntries, 0, len(entry.Children)+len(files))
-	if len(subdirNames) > 0 {
-		// Locate the entries from base.
-		baseEntries, err := f.base.List(ctx, "")
+	entries := make(fs.DirEntries, 0, len(children)+len(files))
+	// Locate the entries from base, grouped by the parent of the hash
+	// directories in the layout.
+	baseParents := make(map[string]struct{})
+	for hash := range subdirNames {
+		baseParent, _ := path.Split(hash)
+		baseParents[strings.TrimSuffix(baseParent, "/")] = struct{}{}
+	}
+	for baseParent := range baseParents {
+		baseEntries, err := f.base.List(ctx, baseParent)
+		if errors.Is(err, fs.ErrorDirNotFound) {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -102,49 +160,47 @@ func (f *Fs) list(ctx context.Context, entry *dirEntry) (fs.DirEntries, error) {
 			entry: v,
 		})
 	}
-	for k := range subpathNames {
-		filePath := path.Join(entry.Path, k)
-		// Make path relative to root of FS.
-		filePath = strings.TrimPrefix(filePath, f.root)
-		filePath = strings.TrimPrefix(filePath, "/")
-		obj, err := f.NewObject(ctx, filePath)
-		if err != nil {
-			// Don't fail listing due to one file. Just report a warning and
-			// drop the file.
-			fs.LogPrintf(fs.LogLevelWarning, obj, "error fetching object %q: %v", filePath, err)
-			continue
-		}
-		entries = append(entries, obj)
+	objects, err := f.newObjects(ctx, entry, names)
+	if err != nil {
+		return nil, err
 	}
-	return entries, nil
+	return append(entries, objects...), nil
 }
 
 // Mkdir makes the specified directory. It should not return an error if it
 // already exists.
-func (f *Fs) Mkdir(ctx context.Context, dir string) error {
-	dir = path.Join(f.root, dir)
-	if _, ok := f.dirMap.Path[dir]; ok {
+func (f *Fs) Mkdir(ctx context.Context, dir string) (err error) {
+	defer func(dir string) { err = annotate(dir, err) }(dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	if f.isLostFound(dir) {
+		return errors.New("can't create directories in lost+found")
+	}
+	dir = f.normalize(path.Join(f.root, dir))
+	if _, ok := f.findDir(dir); ok {
 		return nil
 	}
-	if strings.Contains(dir, "\n") {
-		return fmt.Errorf("directory name may not contain newline: %q", dir)
+	entry := f.dirMap.newDirEntry(dir)
+	if err := f.mkdirMeta(ctx, entry.Hash); err != nil {
+		return err
 	}
-	f.dirMap.newDirEntry(dir)
-	entry := f.dirMap.Path[dir]
-	if f.base.Features().CanHaveEmptyDirectories {
-		err := f.base.Mkdir(ctx, entry.Hash)
-		if err != nil {
-			return err
-		}
+	if err := f.dirMap.write(ctx); err != nil {
+		return err
 	}
-	return f.dirMap.write(ctx)
+	f.notifyChange(opMkdir, dir, "")
+	return nil
 }
 
 // Rmdir removes the specified directory. It should return an error if the
 // directory is not empty or it does not exist.
-func (f *Fs) Rmdir(ctx context.Context, dir string) error {
+func (f *Fs) Rmdir(ctx context.Context, dir string) (err error) {
+	defer func(dir string) { err = annotate(dir, err) }(dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
 	dir = path.Join(f.root, dir)
-	entry, ok := f.dirMap.Path[dir]
+	entry, ok := f.findDir(dir)
 	if !ok {
 		return fs.ErrorDirNotFound
 	}
@@ -152,82 +208,172 @@ func (f *Fs) Rmdir(ctx context.Context, dir string) error {
 	if err != nil {
 		return fmt.Errorf("directory in a bad state, refusing to modify: %w", err)
 	}
-	if len(files) > 0 || len(entry.Children) > 0 {
+	if len(files) > 0 || len(f.dirMap.children(entry)) > 0 {
 		return fs.ErrorDirectoryNotEmpty
 	}
-	f.dirMap.removeEntry(dir)
+	f.dirMap.removeEntry(entry.Path)
 	err = f.dirMap.write(ctx)
 	if err != nil {
 		return err
 	}
+	f.notifyChange(opRmdir, dir, "")
 	err = operations.Purge(ctx, f.base, entry.Hash)
+	f.mirrorDir(entry.Hash)
 	if errors.Is(err, fs.ErrorDirNotFound) {
 		return nil
 	}
 	return err
 }
 
-// ChangeNotify invokes notify with the overlayed path when it receives a
-// notification from the base FS.
+// ChangeNotify invokes notify with the overlayed path relative to the root
+// when it receives a notification from the base FS. Changes outside the root
+// are ignored.
 func (f *Fs) ChangeNotify(ctx context.Context, notify func(string, fs.EntryType), interval <-chan time.Duration) {
 	do := f.base.Features().ChangeNotify
 	if do == nil {
 		return
 	}
-	wrappedNotify := func(path string, typ fs.EntryType) {
-		split := strings.Split(path, "/")
-		if split[len(split)-1] != "data" {
+	wrappedNotify := func(changed string, typ fs.EntryType) {
+		basePath, leaf, ok := f.splitFileKey(changed)
+		if !ok || leaf != dataLeaf {
 			// Fire on "data" file modification only.
 			return
 		}
-		if len(split) < 3 {
+		split := strings.Split(basePath, "/")
+		if len(split) < 2 {
 			// Something is wrong with this event. Skip it.
 			return
 		}
-		dirHash := strings.Join(split[:len(split)-2], "/")
-		fileHash := split[len(split)-2]
-		entry, ok := f.dirMap.Hash[dirHash]
+		dirHash := strings.Join(split[:len(split)-1], "/")
+		fileHash := split[len(split)-1]
+		entry, ok := f.dirMap.byHash(dirHash)
+		f.trace("notify %q: dir hash %q, file hash %q, in map %v", changed, dirHash, fileHash, ok)
 		if !ok {
-			fs.LogPrintf(fs.LogLevelWarning, nil, "cannot map change notification for path %q", path)
+			fs.LogPrintf(fs.LogLevelWarning, nil, "cannot map change notification for path %q", changed)
 			return
 		}
-		files, err := entry.Files(ctx)
+		name, ok, err := entry.nameOf(ctx, fileHash)
 		if err != nil {
-			fs.LogPrintf(fs.LogLevelError, nil, "cannot fetch map file for path %q: %w", path, err)
+			fs.LogPrintf(fs.LogLevelError, nil, "cannot fetch map file for path %q: %v", changed, err)
 			return
 		}
-		for path, hash := range files {
-			if hash == fileHash {
-				notify(path, typ)
-				return
-			}
+		if !ok {
+			fs.LogPrintf(fs.LogLevelWarning, nil, "no file matches while mapping change notification for path %q", changed)
+			return
 		}
-		fs.LogPrintf(fs.LogLevelWarning, nil, "no file matches while mapping change notification for path %q", path)
+		remote, ok := f.underRoot(path.Join(entry.Path, name))
+		if !ok {
+			f.trace("notify %q -> %q: outside the root", fileHash, path.Join(entry.Path, name))
+			return
+		}
+		f.trace("notify %q -> %q", fileHash, remote)
+		notify(remote, typ)
 	}
 	do(ctx, wrappedNotify, interval)
 }
 
 // DirMove moves the specified directory from srcRemote to dstRemote after
-// mapping both remotes.
-func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) error {
-	do := f.base.Features().DirMove
-	if do == nil {
+// mapping both remotes. With dir_move_merge it is merged into an existing
+// destination directory. With resumable_operations, an interrupted move
+// continues where it stopped when it is run again.
+//
+// The source may use another hash type than f, in which case the files are
+// moved to the hashes of f after their directory was moved.
+func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) (err error) {
+	defer func(remote string) { err = annotate(remote, err) }(srcRemote)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	if f.base.Features().DirMove == nil {
+		return fs.ErrorCantDirMove
+	}
+	srcFs, ok := src.(*Fs)
+	if !ok {
+		fs.Debugf(src, "Can't move directory - not same remote type")
 		return fs.ErrorCantDirMove
 	}
-	srcFs := src.(*Fs)
 	srcRemote = path.Join(srcFs.root, srcRemote)
 	dstRemote = path.Join(f.root, dstRemote)
-	srcEntry, ok := srcFs.dirMap.Path[srcRemote]
+	srcEntry, ok := srcFs.findDir(srcRemote)
 	if !ok {
 		return fs.ErrorDirNotFound
 	}
-	if _, ok := f.dirMap.Path[dstRemote]; ok {
-		return fs.ErrorDirExists
+	_, merge := f.findDir(dstRemote)
+	if merge {
+		if !f.opt.DirMoveMerge {
+			return fs.ErrorDirExists
+		}
+		if !f.sharesLayout(srcFs) {
+			fs.Debugf(srcFs, "Can't move directory - incompatible overlays")
+			return fs.ErrorCantDirMove
+		}
+	}
+	op, err := f.beginOperation(ctx, opNameDirMove, srcRemote, dstRemote)
+	if err != nil {
+		return err
+	}
+	if merge {
+		err = f.mergeDir(ctx, srcFs, srcEntry, dstRemote, op)
+	} else {
+		err = f.dirMove(ctx, srcFs, srcEntry, dstRemote, op)
+	}
+	if err != nil {
+		if saveErr := op.save(ctx); saveErr != nil {
+			fs.Errorf(f, "failed to save the progress of the move: %v", saveErr)
+		}
+		return err
+	}
+	return op.finish(ctx)
+}
+
+// dirMove moves the directory entry of srcFs to the absolute overlay path
+// dstRemote, which must not exist. The directories moved are recorded in op,
+// and those recorded in an earlier run only have their map entries updated.
+func (f *Fs) dirMove(ctx context.Context, srcFs *Fs, srcEntry *dirEntry, dstRemote string, op *operation) error {
+	do := f.base.Features().DirMove
+	srcRemote := srcEntry.Path
+	rehash := false
+	switch {
+	case f.sharesLayout(srcFs):
+	case f.sharesLayoutButHash(srcFs) && !f.nested():
+		// The hash directories are moved to the hashes of f and their
+		// files are rehashed within them. With nested layouts, the hash
+		// directories of the children would keep the hashes of srcFs.
+		rehash = true
+	default:
+		// The hash directories are only valid in a base with the same
+		// hashing parameters.
+		fs.Debugf(srcFs, "Can't move directory - incompatible overlays")
+		return fs.ErrorCantDirMove
+	}
+	if f.layout == layoutSalted {
+		// The hashes of all files and directories below a salted directory
+		// depend on its path, so they all need to be moved one by one.
+		return fs.ErrorCantDirMove
+	}
+	if f.nested() && srcFs.mixedHashes(srcEntry) {
+		// The hash directories of the children would not end up below the
+		// one of their parent.
+		return fs.ErrorCantDirMove
+	}
+	if f.nested() && !op.Moved {
+		// The hash directories of the children move with their parent.
+		err := do(ctx, srcFs.base, srcEntry.Hash, f.dirBase(dstRemote))
+		if err != nil && !op.applied(err) && !isDirMissing(err) {
+			// A missing hash directory was dropped by the base as it
+			// was empty, so there is nothing to move.
+			return err
+		}
+		f.mirrorDir(srcEntry.Hash)
+		f.mirrorDir(f.dirBase(dstRemote))
+		if err := op.markMoved(ctx); err != nil {
+			return err
+		}
 	}
 	var recurse func(entry *dirEntry) error
 	recurse = func(entry *dirEntry) error {
 		// Process children first to be sure parent directories always exist.
-		for _, child := range entry.Children {
+		for _, child := range srcFs.dirMap.children(entry) {
 			if err := recurse(child); err != nil {
 				return err
 			}
@@ -236,16 +382,34 @@ func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string
 		srcRelative := strings.TrimPrefix(entry.Path, srcRemote)
 		srcRelative = strings.TrimPrefix(srcRelative, "/")
 		dstLocation := path.Join(dstRemote, srcRelative)
-		srcHash := srcFs.hasher(entry.Path)
-		dstHash := f.hasher(dstLocation)
-		if err := do(ctx, srcFs.base, srcHash, dstHash); err != nil {
-			return err
+		if !f.nested() && !op.isDone(entry.Path) {
+			srcHash := entry.Hash
+			dstHash := f.dirBase(dstLocation)
+			err := do(ctx, srcFs.base, srcHash, dstHash)
+			if err != nil && !op.applied(err) && !isDirMissing(err) {
+				return err
+			}
+			f.mirrorDir(srcHash)
+			f.mirrorDir(dstHash)
 		}
 		// Modify the directory maps.
 		f.dirMap.newDirEntry(dstLocation)
 		srcFs.dirMap.removeEntry(entry.Path)
+		if f.otherInstance(srcFs) || rehash {
+			// Keep the maps of both instances of the overlay in sync as
+			// both write the same directory map.
+			f.mirrorEntry(srcFs, dstLocation)
+			f.dirMap.removeEntry(entry.Path)
+		}
 		// Rewrite the name files.
-		return f.rewriteNameFiles(ctx, dstLocation)
+		rewrite := f.rewriteNameFiles
+		if rehash {
+			rewrite = f.rehashFiles
+		}
+		if err := rewrite(ctx, dstLocation); err != nil {
+			return err
+		}
+		return op.markDone(ctx, entry.Path)
 	}
 	recurseErr := recurse(srcEntry)
 	if err := f.dirMap.write(ctx); err != nil {
@@ -254,14 +418,94 @@ func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string
 	if err := srcFs.dirMap.write(ctx); err != nil {
 		return err
 	}
+	f.notifyChange(opDirMove, dstRemote, srcRemote)
 	return recurseErr
 }
 
+// mergeDir merges the directory entry of srcFs into the existing absolute
+// overlay path dstRemote. The directories which don't exist in the
+// destination are moved as a whole, the files are moved one by one,
+// replacing the files of the same name in the destination. The source
+// directory is removed once it is empty.
+func (f *Fs) mergeDir(ctx context.Context, srcFs *Fs, srcEntry *dirEntry, dstRemote string, op *operation) error {
+	for _, child := range srcFs.dirMap.children(srcEntry) {
+		childDst := path.Join(dstRemote, path.Base(child.Path))
+		if _, ok := f.findDir(childDst); ok {
+			if err := f.mergeDir(ctx, srcFs, child, childDst, op); err != nil {
+				return err
+			}
+			continue
+		}
+		err := f.dirMove(ctx, srcFs, child, childDst, op)
+		if !errors.Is(err, fs.ErrorCantDirMove) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// The hash directories can't be moved as they are, e.g. with the
+		// salted layout, so move the files one by one.
+		if err := f.Mkdir(ctx, f.relative(childDst)); err != nil {
+			return err
+		}
+		if err := f.mergeDir(ctx, srcFs, child, childDst, op); err != nil {
+			return err
+		}
+	}
+	files, err := srcEntry.Files(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot merge directory with invalid map file: %w", err)
+	}
+	for name := range files {
+		srcObj, err := srcFs.NewObject(ctx, srcFs.relative(path.Join(srcEntry.Path, name)))
+		if err != nil {
+			return err
+		}
+		if _, err := operations.Move(ctx, f, nil, f.relative(path.Join(dstRemote, name)), srcObj); err != nil {
+			return err
+		}
+	}
+	return srcFs.Rmdir(ctx, srcFs.relative(srcEntry.Path))
+}
+
+// relative returns the absolute overlay path p relative to the root of f.
+func (f *Fs) relative(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, f.root), "/")
+}
+
+// underRoot returns the absolute overlay path p relative to the root of f.
+// It returns false if p is not below the root.
+func (f *Fs) underRoot(p string) (string, bool) {
+	switch {
+	case f.root == "":
+		return p, true
+	case p == f.root:
+		return "", true
+	case strings.HasPrefix(p, f.root+"/"):
+		return strings.TrimPrefix(p, f.root+"/"), true
+	}
+	return "", false
+}
+
+// mixedHashes reports whether the directory entry or any directory below it
+// has a hash directory created with another hash type than the one of f.
+func (f *Fs) mixedHashes(entry *dirEntry) bool {
+	if entry.Hash != f.dirBase(entry.Path) {
+		return true
+	}
+	for _, child := range f.dirMap.children(entry) {
+		if f.mixedHashes(child) {
+			return true
+		}
+	}
+	return false
+}
+
 // rewriteNameFiles rewrites the name files in the specified directory.
 // dstLocation is the absolute location. It does not write name files
 // recursively.
 func (f *Fs) rewriteNameFiles(ctx context.Context, dstLocation string) error {
-	entry := f.dirMap.Path[dstLocation]
+	entry, _ := f.dirMap.lookup(dstLocation)
 	// Fetch list of files to rewrite name files.
 	files, err := entry.Files(ctx)
 	if err != nil {
@@ -269,20 +513,67 @@ func (f *Fs) rewriteNameFiles(ctx context.Context, dstLocation string) error {
 	}
 	// Rewrite name files to fit new path.
 	for fileName, hash := range files {
-		obj, err := f.base.NewObject(ctx, path.Join(entry.Hash, hash, "name"))
-		if err != nil {
-			return fmt.Errorf("cannot find name file to delete: %w", err)
+		if _, empty, err := entry.emptyFile(ctx, fileName); err != nil || empty {
+			// Empty files only stored in the map file have no name file.
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		if err := obj.Remove(ctx); err != nil {
+		n := nameFile{size: -1}
+		if f.opt.NameFileAttributes || f.opt.StoreModTimes {
+			// Keep the recorded attributes.
+			recorded, err := f.readNameAttributes(ctx, entry.Hash, hash)
+			if err != nil && !errors.Is(err, fs.ErrorObjectNotFound) {
+				return fmt.Errorf("cannot read name file: %w", err)
+			}
+			if err == nil {
+				n = recorded
+			}
+		}
+		if err := f.removeMeta(ctx, f.fileKey(path.Join(entry.Hash, hash), nameLeaf)); err != nil {
 			return fmt.Errorf("cannot delete name file: %w", err)
 		}
-		fileDst := path.Join(dstLocation, fileName)
-		objInfo := fakeObjInfo{
-			remote: path.Join(entry.Hash, hash, "name"),
-			fs:     f,
-			size:   int64(len(fileDst) + 1),
+		n.path = path.Join(dstLocation, fileName)
+		if err := f.writeNameFile(ctx, nil, entry.Hash, hash, n); err != nil {
+			return err
 		}
-		if _, err := f.base.Put(ctx, strings.NewReader(fileDst+"\n"), objInfo); err != nil {
+	}
+	return nil
+}
+
+// rehashFiles moves the files of the directory at the absolute overlay path
+// dstLocation, which was moved from an overlay with another hash type, to
+// the hashes of their names with the hash type of f and rewrites their name
+// files and map file. Files already at their hash, e.g. moved in an earlier
+// run of an interrupted move, only have their name file repaired.
+func (f *Fs) rehashFiles(ctx context.Context, dstLocation string) error {
+	entry, _ := f.dirMap.lookup(dstLocation)
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot rehash files with invalid map file: %w", err)
+	}
+	// Copy the records as moving the files modifies them.
+	entry.mu.Lock()
+	stored := make(map[string]string, len(files))
+	types := make(map[string]string, len(entry.types))
+	for name, hash := range files {
+		stored[name] = hash
+		types[name] = entry.types[name]
+	}
+	entry.mu.Unlock()
+	for name, hash := range stored {
+		expected := f.fileHash(dstLocation, name)
+		if hash != expected {
+			if _, err := f.fixFileHash(ctx, entry, name, types[name], hash, expected); err != nil {
+				return fmt.Errorf("cannot rehash %q: %w", name, err)
+			}
+			continue
+		}
+		if _, empty := parseEmptyType(types[name]); empty {
+			continue
+		}
+		if _, err := f.repairNameFile(ctx, entry.Hash, hash, path.Join(dstLocation, name)); err != nil {
 			return err
 		}
 	}
@@ -290,40 +581,66 @@ func (f *Fs) rewriteNameFiles(ctx context.Context, dstLocation string) error {
 }
 
 // Purge purges all files in the directory specified by recursively going into
-// directories and invoking Purge on all subdirectories.
-func (f *Fs) Purge(ctx context.Context, dir string) error {
+// directories and invoking Purge on all subdirectories. With
+// resumable_operations, an interrupted purge skips the directories it
+// already purged when it is run again.
+func (f *Fs) Purge(ctx context.Context, dir string) (err error) {
+	defer func(dir string) { err = annotate(dir, err) }(dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
 	do := f.base.Features().Purge
 	if do == nil {
 		return fs.ErrorCantPurge
 	}
 	dir = path.Join(f.root, dir)
-	entry, ok := f.dirMap.Path[dir]
+	entry, ok := f.findDir(dir)
 	if !ok {
 		return fs.ErrorDirNotFound
 	}
+	op, err := f.beginOperation(ctx, opNamePurge, dir, "")
+	if err != nil {
+		return err
+	}
 	var purge func(*dirEntry) error
 	purge = func(entry *dirEntry) error {
 		// Purge subdirectories.
-		for _, v := range entry.Children {
+		for _, v := range f.dirMap.children(entry) {
 			if err := purge(v); err != nil {
 				return err
 			}
 		}
 		// Remove the directory from the backing Fs.
-		if err := do(ctx, entry.Hash); err != nil {
-			return err
+		if !op.isDone(entry.Path) {
+			err := do(ctx, entry.Hash)
+			f.mirrorDir(entry.Hash)
+			if err != nil && !op.applied(err) && !isDirMissing(err) {
+				// A missing hash directory was dropped by the base as
+				// it was empty, so there is nothing to purge.
+				return err
+			}
 		}
-		// Remove from internal buffer.
-		delete(f.dirMap.Path, entry.Path)
-		delete(f.dirMap.Hash, entry.Hash)
-		return nil
+		// Remove from internal buffer. The root directory stays in the
+		// map, only its purged map file is dropped.
+		if entry.Parent == nil {
+			drop([]*dirEntry{entry})
+		} else {
+			f.dirMap.removeEntry(entry.Path)
+		}
+		return op.markDone(ctx, entry.Path)
 	}
 	purgeErr := purge(entry)
-	err := f.dirMap.write(ctx)
-	if err != nil {
+	if err := f.dirMap.write(ctx); err != nil {
 		return err
 	}
-	return purgeErr
+	f.notifyChange(opPurge, dir, "")
+	if purgeErr != nil {
+		if err := op.save(ctx); err != nil {
+			fs.Errorf(f, "failed to save the progress of the purge: %v", err)
+		}
+		return purgeErr
+	}
+	return op.finish(ctx)
 }
 
 // directory is an implementation of DirEntry that represents a directory.
@@ -338,12 +655,12 @@ var _ fs.Directory = directory{}
 
 // String returns the string representation of the directory.
 func (d directory) String() string {
-	return d.entry.Path
+	return d.Remote()
 }
 
-// Remote returns the actual path of the directory.
+// Remote returns the path of the directory relative to the root of the Fs.
 func (d directory) Remote() string {
-	return d.entry.Path
+	return d.entry.fs.relative(d.entry.Path)
 }
 
 // ModTime returns the modification time as reported by the base directory.
@@ -366,7 +683,10 @@ func (d directory) Size() int64 {
 func (d directory) Items() int64 {
 	// Note: d.entry.files is directly accessed here to use the cached version
 	// if available. Fetching file list is expensive for this operation.
-	return int64(len(d.entry.Children) + len(d.entry.files))
+	d.entry.mu.Lock()
+	files := len(d.entry.files)
+	d.entry.mu.Unlock()
+	return int64(len(d.entry.fs.dirMap.children(d.entry)) + files)
 }
 
 // ID returns an empty string to represent that the internal ID of the
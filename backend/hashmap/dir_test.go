@@ -0,0 +1,69 @@
+package hashmap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, t.TempDir(), nil)
+	require.NoError(t, f.Mkdir(ctx, "a/b/c"))
+	putTestFile(t, f, "a/b/c/d.txt", "hello")
+	putTestFile(t, f, "a/e.txt", "world")
+
+	require.NoError(t, f.Purge(ctx, "a/b"))
+	for _, dir := range []string{"a/b", "a/b/c"} {
+		_, ok := f.dirMap.get(dir)
+		assert.False(t, ok, dir)
+	}
+	a, ok := f.dirMap.get("a")
+	require.True(t, ok)
+	assert.Empty(t, f.dirMap.children(a), "purged directories are unlinked from their parent")
+	entries, err := f.List(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a/e.txt", entries[0].Remote())
+
+	// The directory can be created again.
+	require.NoError(t, f.Mkdir(ctx, "a/b"))
+	entries, err = f.List(ctx, "a")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Purging the root keeps it in the map.
+	require.NoError(t, f.Purge(ctx, ""))
+	assert.Equal(t, 1, f.dirMap.size())
+	entries, err = f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestListWhilePut(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, t.TempDir(), nil)
+	require.NoError(t, f.Mkdir(ctx, "d"))
+	putTestFile(t, f, "d/file0.txt", "0")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 20; i++ {
+			putTestFile(t, f, fmt.Sprintf("d/file%d.txt", i), "x")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		entries, err := f.List(ctx, "d")
+		require.NoError(t, err)
+		assert.NotEmpty(t, entries)
+	}
+	wg.Wait()
+	entries, err := f.List(ctx, "d")
+	require.NoError(t, err)
+	assert.Len(t, entries, 21)
+}
@@ -0,0 +1,238 @@
+package hashmap
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// diskCache keeps copies of the map files of the directories on local disk
+// with cache_disk_max_size, so map files dropped from memory or read by a
+// later run are not downloaded again while they are unchanged. The least
+// recently used copies are removed to stay within the maximum size.
+//
+// Every copy starts with a line with the fingerprint of the map file in the
+// base it was made from. A copy is only used while the fingerprint of the
+// map file in the base is the same, so changes of other clients are seen.
+type diskCache struct {
+	// dir is the local directory of the copies.
+	dir string
+	// max is the maximum size of the copies in bytes.
+	max int64
+	// mu protects size, lru and elems.
+	mu sync.Mutex
+	// size is the size of the copies in bytes.
+	size int64
+	// lru lists the copies, the least recently used first.
+	lru *list.List
+	// elems maps the names of the copies to their element in lru.
+	elems map[string]*list.Element
+}
+
+// diskCacheItem is an element of diskCache.lru.
+type diskCacheItem struct {
+	name string
+	size int64
+}
+
+// newDiskCache returns a diskCache holding at most max bytes in the local
+// directory dir, with the copies left there by previous runs. It returns nil
+// if max is not positive.
+func newDiskCache(dir string, max int64) (*diskCache, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating map cache directory: %w", err)
+	}
+	infos, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading map cache directory: %w", err)
+	}
+	c := &diskCache{
+		dir:   dir,
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[string]*list.Element),
+	}
+	var found []os.FileInfo
+	for _, entry := range infos {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			// Left over by an interrupted write.
+			_ = os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		found = append(found, info)
+	}
+	// The modification time of a copy is the time it was last used.
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ModTime().Before(found[j].ModTime())
+	})
+	for _, info := range found {
+		c.elems[info.Name()] = c.lru.PushBack(&diskCacheItem{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// name returns the name of the copy of the map file remote.
+func (c *diskCache) name(remote string) string {
+	return hashMD5(remote)
+}
+
+// get returns the copy of the map file remote if it was made from the map
+// file with the given fingerprint.
+func (c *diskCache) get(remote, fingerprint string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	name := c.name(remote)
+	c.mu.Lock()
+	elem, ok := c.elems[name]
+	if ok {
+		c.lru.MoveToBack(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	// The copy may be removed or replaced concurrently, which is detected
+	// by the failed read or the fingerprint.
+	p := filepath.Join(c.dir, name)
+	content, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	header, data, ok := bytes.Cut(content, []byte("\n"))
+	if !ok || string(header) != fingerprint {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return data, true
+}
+
+// put stores data as the copy of the map file remote with the given
+// fingerprint. Failures are only logged, as the map file can always be read
+// from the base.
+func (c *diskCache) put(remote, fingerprint string, data []byte) {
+	if c == nil || fingerprint == "" {
+		return
+	}
+	name := c.name(remote)
+	p := filepath.Join(c.dir, name)
+	tmp, err := os.CreateTemp(c.dir, name+"-*.tmp")
+	if err != nil {
+		fs.Errorf(nil, "map cache: failed to store %q: %v", remote, err)
+		return
+	}
+	w := bufio.NewWriter(tmp)
+	_, _ = w.WriteString(fingerprint + "\n")
+	_, _ = w.Write(data)
+	err = w.Flush()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		fs.Errorf(nil, "map cache: failed to store %q: %v", remote, err)
+		return
+	}
+	size := int64(len(fingerprint) + 1 + len(data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[name]; ok {
+		c.size -= elem.Value.(*diskCacheItem).size
+		c.lru.Remove(elem)
+	}
+	c.elems[name] = c.lru.PushBack(&diskCacheItem{name: name, size: size})
+	c.size += size
+	c.evict()
+}
+
+// evict removes the least recently used copies until the copies fit within
+// the maximum size. It must be called with c.mu held.
+func (c *diskCache) evict() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.removeOldest()
+	}
+}
+
+// removeOldest removes the least recently used copy. It must be called with
+// c.mu held.
+func (c *diskCache) removeOldest() {
+	item := c.lru.Remove(c.lru.Front()).(*diskCacheItem)
+	delete(c.elems, item.name)
+	c.size -= item.size
+	if err := os.Remove(filepath.Join(c.dir, item.name)); err != nil && !os.IsNotExist(err) {
+		fs.Errorf(nil, "map cache: failed to remove %q: %v", item.name, err)
+	}
+}
+
+// clear removes all copies and returns their number.
+func (c *diskCache) clear() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	for c.lru.Len() > 0 {
+		c.removeOldest()
+	}
+	return n
+}
+
+// mapCacheDir returns the local directory of the copies of the map files of
+// the Fs. It is unique for the name of the Fs and its base.
+func (f *Fs) mapCacheDir() string {
+	return filepath.Join(f.cacheDir(), f.name+"-"+hashMD5(f.opt.Remote)+".maps")
+}
+
+// openCachedMeta is like openMeta for map files, but reads the copy on local
+// disk instead if the map file in the base did not change since it was made.
+func (f *Fs) openCachedMeta(ctx context.Context, remote string) (io.ReadCloser, error) {
+	if f.diskCache == nil {
+		return f.openMeta(ctx, remote)
+	}
+	f.limitMeta(ctx)
+	obj, err := f.newBaseObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := fs.Fingerprint(ctx, obj, true)
+	if data, ok := f.diskCache.get(remote, fingerprint); ok {
+		f.trace("map file %q: read from disk cache", remote)
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	in, err := f.openMetaObject(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return nil, err
+	}
+	f.diskCache.put(remote, fingerprint, data)
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
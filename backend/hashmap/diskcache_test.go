@@ -0,0 +1,81 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newDiskCache(dir, 10)
+	require.NoError(t, err)
+	c.put("a/map", "fp", []byte("123"))
+	data, ok := c.get("a/map", "fp")
+	assert.True(t, ok)
+	assert.Equal(t, "123", string(data))
+	_, ok = c.get("a/map", "other")
+	assert.False(t, ok, "copies of changed map files are not used")
+
+	// The least recently used copies are removed.
+	c.put("b/map", "fp", []byte("456"))
+	_, ok = c.get("a/map", "fp")
+	assert.False(t, ok)
+	_, ok = c.get("b/map", "fp")
+	assert.True(t, ok)
+	copies, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, copies, 1)
+
+	// The copies of previous runs are used.
+	c, err = newDiskCache(dir, 10)
+	require.NoError(t, err)
+	_, ok = c.get("b/map", "fp")
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.clear())
+	copies, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, copies)
+}
+
+func TestDiskCacheMapFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"cache_dir": t.TempDir(), "cache_disk_max_size": "1M"})
+	require.NoError(t, f.Mkdir(ctx, "d"))
+	putTestFile(t, f, "d/file1.txt", "one")
+	entry, ok := f.dirMap.get("d")
+	require.True(t, ok)
+	remote := path.Join(entry.Hash, "map")
+	copyPath := filepath.Join(f.mapCacheDir(), f.diskCache.name(remote))
+	assert.FileExists(t, copyPath, "written map files are cached")
+
+	// The copy is used instead of the map file in the base.
+	content, err := os.ReadFile(copyPath)
+	require.NoError(t, err)
+	fake := string(content) + f.fileHash("d", "fake.txt") + " fake.txt\n"
+	require.NoError(t, os.WriteFile(copyPath, []byte(fake), 0600))
+	f.clearMapCache()
+	files, err := entry.Files(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, files, "fake.txt")
+
+	// Changes of other clients are seen.
+	g := newTestFs(t, dir, nil)
+	putTestFile(t, g, "d/file2.txt", "two")
+	f.clearMapCache()
+	files, err = entry.Files(ctx)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Contains(t, files, "file2.txt")
+
+	_, err = f.Command(ctx, "cache-clear", nil, nil)
+	require.NoError(t, err)
+	assert.NoFileExists(t, copyPath)
+}
@@ -0,0 +1,17 @@
+package hashmap
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// skipBase reports whether the operation action on the object or directory
+// remote of the base is to be skipped, as --dry-run is set or it was declined
+// with --interactive. The maintenance commands check every operation on the
+// base with it, so a dry run lists the exact operations they would perform.
+func (f *Fs) skipBase(ctx context.Context, action, remote string) bool {
+	return operations.SkipDestructive(ctx, fspath.JoinRootPath(fs.ConfigString(f.base), remote), action)
+}
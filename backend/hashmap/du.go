@@ -0,0 +1,120 @@
+package hashmap
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// dirUsage is the usage of an overlay directory reported by the du command.
+type dirUsage struct {
+	// Path is the overlay path of the directory.
+	Path string `json:"path"`
+	// Bytes is the size of the data objects of the files in the directory.
+	Bytes int64 `json:"bytes"`
+	// Count is the number of files in the directory.
+	Count int64 `json:"count"`
+	// TotalBytes is Bytes including all subdirectories.
+	TotalBytes int64 `json:"totalBytes"`
+	// TotalCount is Count including all subdirectories.
+	TotalCount int64 `json:"totalCount"`
+}
+
+// dirSize returns the size and number of the data objects of the files in
+// the map file of the directory entry. It only lists the hash directory of
+// the entry and does not read the data objects.
+func (f *Fs) dirSize(ctx context.Context, entry *dirEntry) (size, count int64, err error) {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	fileHashes := make(map[string]struct{}, len(files))
+	for name, fileHash := range files {
+		_, empty, err := entry.emptyFile(ctx, name)
+		if err != nil {
+			return 0, 0, err
+		}
+		if empty {
+			// Empty files only stored in the map file have no data object.
+			count++
+			continue
+		}
+		fileHashes[fileHash] = struct{}{}
+	}
+	err = walk.ListR(ctx, f.base, entry.Hash, true, 2, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(o fs.Object) {
+			fileDir, leaf, ok := f.splitFileKey(o.Remote())
+			if !ok || leaf != dataLeaf {
+				return
+			}
+			if path.Dir(fileDir) != entry.Hash {
+				return
+			}
+			if _, ok := fileHashes[path.Base(fileDir)]; ok {
+				size += o.Size()
+				count++
+			}
+		})
+		return nil
+	})
+	return size, count, err
+}
+
+// du returns the usage of the directory dir and all its subdirectories,
+// sorted by path.
+func (f *Fs) du(ctx context.Context, dir string) ([]dirUsage, error) {
+	root, ok := f.findDir(path.Join(f.root, dir))
+	if !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	var usage []dirUsage
+	p := newProgress(ctx, "du", 0)
+	defer p.finish()
+	var recurse func(entry *dirEntry) (dirUsage, error)
+	recurse = func(entry *dirEntry) (u dirUsage, err error) {
+		p.add(1)
+		u.Path = strings.TrimPrefix(strings.TrimPrefix(entry.Path, f.root), "/")
+		u.Bytes, u.Count, err = f.dirSize(ctx, entry)
+		p.scan(entry.Path, err)
+		if err != nil {
+			return u, err
+		}
+		u.TotalBytes, u.TotalCount = u.Bytes, u.Count
+		for _, child := range f.dirMap.children(entry) {
+			childUsage, err := recurse(child)
+			if err != nil {
+				return u, err
+			}
+			u.TotalBytes += childUsage.TotalBytes
+			u.TotalCount += childUsage.TotalCount
+		}
+		usage = append(usage, u)
+		return u, nil
+	}
+	if _, err := recurse(root); err != nil {
+		return nil, err
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Path < usage[j].Path
+	})
+	return usage, nil
+}
+
+// formatUsage formats the usage as a table.
+func formatUsage(usage []dirUsage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%14s %10s %14s %11s  %s\n", "bytes", "count", "total bytes", "total count", "path")
+	for _, u := range usage {
+		p := u.Path
+		if p == "" {
+			p = "."
+		}
+		fmt.Fprintf(&b, "%14d %10d %14d %11d  %s\n", u.Bytes, u.Count, u.TotalBytes, u.TotalCount, p)
+	}
+	return b.String()
+}
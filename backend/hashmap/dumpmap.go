@@ -0,0 +1,98 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// dumpedDir is a directory of the directory map reported by the dump-map
+// command.
+type dumpedDir struct {
+	// Path is the overlay path of the directory.
+	Path string `json:"path"`
+	// Hash is the hash directory of the directory in the base.
+	Hash string `json:"hash"`
+	// Parent is the overlay path of the parent directory. It is empty for
+	// the root directory.
+	Parent string `json:"parent"`
+	// Children is the number of subdirectories.
+	Children int `json:"children"`
+	// Files is the number of files in the map file.
+	Files int `json:"files"`
+	// FileMap maps the names of the files to their hashes, with -o files.
+	FileMap map[string]string `json:"fileMap,omitempty"`
+}
+
+// dumpMap returns the directories of the loaded directory map below the
+// overlay directory dir, sorted by path. If withFiles is set, their map
+// files are included.
+func (f *Fs) dumpMap(ctx context.Context, dir string, withFiles bool) ([]dumpedDir, error) {
+	dir = path.Join(f.root, dir)
+	if _, ok := f.findDir(dir); !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	var dirs []dumpedDir
+	for _, entry := range f.dirMap.sortedEntries() {
+		p := entry.Path
+		if dir != "" && p != dir && !strings.HasPrefix(p, dir+"/") {
+			continue
+		}
+		files, err := entry.Files(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d := dumpedDir{
+			Path:     p,
+			Hash:     entry.Hash,
+			Children: len(f.dirMap.children(entry)),
+			Files:    len(files),
+		}
+		if entry.Parent != nil {
+			d.Parent = entry.Parent.Path
+		}
+		if withFiles {
+			d.FileMap = make(map[string]string, len(files))
+			for name, fileHash := range files {
+				d.FileMap[name] = fileHash
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// formatDumpMap formats the directories of dump-map as CSV. The files of
+// the map files follow their directory as rows of type file, with the
+// directory as parent.
+func formatDumpMap(dirs []dumpedDir) (string, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	_ = w.Write([]string{"type", "path", "hash", "parent", "children", "files"})
+	for _, d := range dirs {
+		_ = w.Write([]string{
+			"dir",
+			d.Path,
+			d.Hash,
+			d.Parent,
+			strconv.Itoa(d.Children),
+			strconv.Itoa(d.Files),
+		})
+		names := make([]string, 0, len(d.FileMap))
+		for name := range d.FileMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			_ = w.Write([]string{"file", path.Join(d.Path, name), d.FileMap[name], d.Path, "", ""})
+		}
+	}
+	w.Flush()
+	return b.String(), w.Error()
+}
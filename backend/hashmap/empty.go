@@ -0,0 +1,203 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// putEmpty records the empty file src with the given hash in the directory
+// entry with empty_files_in_map, without creating any object in the base.
+// The objects of a non-empty file it replaces are removed.
+func (f *Fs) putEmpty(ctx context.Context, entry *dirEntry, fileHash string, src fs.ObjectInfo) (fs.Object, error) {
+	base := path.Base(src.Remote())
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replaced, hasReplaced := entry.recordedHash(files, base)
+	if hasReplaced {
+		if _, empty, err := entry.emptyFile(ctx, base); err != nil || empty {
+			hasReplaced = false
+		}
+	}
+	modTime := src.ModTime(ctx)
+	if err := entry.addEmptyFile(ctx, base, fileHash, modTime); err != nil {
+		return nil, err
+	}
+	o := &emptyObject{
+		fs:       f,
+		remote:   src.Remote(),
+		entry:    entry,
+		fileHash: fileHash,
+		modTime:  modTime,
+	}
+	if err := entry.write(ctx); err != nil {
+		return o, err
+	}
+	if hasReplaced {
+		basePath := path.Join(entry.Hash, replaced)
+		if err := f.purgeFile(ctx, basePath); err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+			fs.Errorf(f, "failed to remove replaced file %q: %v", basePath, err)
+		}
+	}
+	f.removePlain(ctx, src.Remote())
+	f.notifyChangeRel(opPut, src.Remote(), "")
+	return o, nil
+}
+
+// dropEmpty removes the empty files which are only stored in the map file
+// from files, given the hash types recorded for them.
+func dropEmpty(files, types map[string]string) {
+	for name, ht := range types {
+		if _, ok := parseEmptyType(ht); ok {
+			delete(files, name)
+		}
+	}
+}
+
+// emptyObject is an empty file which is only recorded in the map file with
+// empty_files_in_map. Once it is written to, its objects are created in the
+// base and it refers to the object in the overlay instead.
+type emptyObject struct {
+	fs     *Fs
+	remote string
+	entry  *dirEntry
+	// fileHash is the hash the objects of the file are stored at once it
+	// is written to.
+	fileHash string
+	modTime  time.Time
+	// obj is the object in the overlay after the file was written to, or
+	// nil while it is empty.
+	obj fs.Object
+}
+
+// String returns the string representation of the object.
+func (o *emptyObject) String() string {
+	return o.remote
+}
+
+// Remote returns the path of the object.
+func (o *emptyObject) Remote() string {
+	return o.remote
+}
+
+// ModTime returns the modification time of the object.
+func (o *emptyObject) ModTime(ctx context.Context) time.Time {
+	if o.obj != nil {
+		return o.obj.ModTime(ctx)
+	}
+	return o.modTime
+}
+
+// Size returns the size of the object.
+func (o *emptyObject) Size() int64 {
+	if o.obj != nil {
+		return o.obj.Size()
+	}
+	return 0
+}
+
+// Fs returns the Fs the object belongs to.
+func (o *emptyObject) Fs() fs.Info {
+	return o.fs
+}
+
+// Hash returns the selected checksum of the object, which is the one of
+// empty content while it is empty.
+func (o *emptyObject) Hash(ctx context.Context, ty hash.Type) (string, error) {
+	if o.obj != nil {
+		return o.obj.Hash(ctx, ty)
+	}
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(ty))
+	if err != nil {
+		return "", err
+	}
+	return hasher.Sums()[ty], nil
+}
+
+// Storable returns whether the object is storable.
+func (o *emptyObject) Storable() bool {
+	return true
+}
+
+// SetModTime sets the modification time of the object, which is recorded in
+// the map file while it is empty.
+func (o *emptyObject) SetModTime(ctx context.Context, t time.Time) error {
+	if o.obj != nil {
+		return o.obj.SetModTime(ctx, t)
+	}
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := o.entry.addEmptyFile(ctx, path.Base(o.remote), o.fileHash, t); err != nil {
+		return err
+	}
+	if err := o.entry.write(ctx); err != nil {
+		return err
+	}
+	o.modTime = t
+	return nil
+}
+
+// Open opens the object for reading.
+func (o *emptyObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	if o.obj != nil {
+		return o.obj.Open(ctx, options...)
+	}
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+// Update writes the object. It stays in the map file if src is empty and is
+// written to the base otherwise.
+func (o *emptyObject) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	if o.obj != nil {
+		return o.obj.Update(ctx, in, src, options...)
+	}
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	src = operations.NewOverrideRemote(src, o.remote)
+	if src.Size() == 0 {
+		obj, err := o.fs.putEmpty(ctx, o.entry, o.fileHash, src)
+		if err != nil {
+			return err
+		}
+		o.modTime = obj.ModTime(ctx)
+		return nil
+	}
+	obj, err := o.fs.put(ctx, o.fs.base.Put, in, src, options...)
+	if err != nil {
+		return err
+	}
+	o.obj = obj
+	return nil
+}
+
+// Remove removes the object.
+func (o *emptyObject) Remove(ctx context.Context) error {
+	if o.obj != nil {
+		return o.obj.Remove(ctx)
+	}
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := o.entry.removeFile(ctx, path.Base(o.remote)); err != nil {
+		return err
+	}
+	if err := o.entry.write(ctx); err != nil {
+		return err
+	}
+	o.fs.notifyChangeRel(opRemove, o.remote, "")
+	return nil
+}
+
+// Check that interfaces are implemented.
+var _ fs.Object = (*emptyObject)(nil)
@@ -1,7 +1,6 @@
 package hashmap
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -9,144 +8,357 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rclone/rclone/fs"
 )
 
-// loadDirectoryMap creates a directory map from the provided input.
+// loadDirectoryMap creates a directory map from the provided input. The map
+// is malformed if it has a truncated or invalid entry, a directory listed
+// twice or a hash which is not the one of its directory with any hash type.
+// In that case the map of the entries before the first problem is returned
+// with an error wrapping ErrMapCorrupt.
 func loadDirectoryMap(fs *Fs, in io.Reader) (*dirMap, error) {
 	dMap := newDirMap(fs)
 	if in == nil {
 		return dMap, nil
 	}
-	r := bufio.NewReader(in)
-	for {
-		entry, err := r.ReadString('\n')
-		if errors.Is(err, io.EOF) {
-			break
+	records, err := unmarshalRecords(in)
+	seen := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		if _, ok := seen[record.name]; ok {
+			return dMap, fmt.Errorf("%w: directory %q is listed twice", ErrMapCorrupt, record.name)
 		}
-		if err != nil {
-			return nil, fmt.Errorf("error reading map file entry: %w", err)
-		}
-		entry = strings.TrimSuffix(entry, "\n")
-		if entry == "" {
-			continue
+		seen[record.name] = struct{}{}
+		if _, ok := fs.dirHashType(record.name, record.hash); !ok {
+			return dMap, fmt.Errorf("%w: hash %q does not match directory %q", ErrMapCorrupt, record.hash, record.name)
 		}
-		split := strings.SplitN(entry, " ", 2)
-		if len(split) < 2 {
-			return nil, fmt.Errorf("malformed map file, refusing to load: invalid entry %q", entry)
+		entry := dMap.newDirEntry(record.name)
+		if record.hash != entry.Hash {
+			// Keep the hash directories created with another hash type.
+			dMap.setHash(entry, record.hash)
 		}
-		dMap.newDirEntry(split[1])
 	}
-	return dMap, nil
+	return dMap, err
 }
 
 // fillFiles fills the file list from the map file stored in the base.
-func (d *dirEntry) fillFiles(ctx context.Context) (err error) {
+func (d *dirEntry) fillFiles(ctx context.Context) error {
+	// Drop the map files evicted from the cache after d is unlocked.
+	var evicted []*dirEntry
+	defer func() { drop(evicted) }()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.files != nil {
+		evicted = d.fs.mapCache.use(d, d.files)
+		atomic.AddInt64(&d.fs.cacheHits, 1)
+		metrics.cacheHits.WithLabelValues(d.fs.name).Inc()
+		count(ctx, statCacheHits, 1)
+		d.fs.trace("map file of %q: cache hit", d.Path)
 		return nil
 	}
-	defer func() {
-		// If there is an error, do not set files.
-		if err != nil {
-			d.files = nil
-		}
-	}()
-	d.files = make(map[string]string)
-	obj, err := d.fs.base.NewObject(ctx, path.Join(d.Hash, "map"))
-	switch {
-	case errors.Is(err, fs.ErrorObjectNotFound):
-		// Just create a new directory if it is not present.
-		return nil
-	case err != nil:
+	atomic.AddInt64(&d.fs.cacheMisses, 1)
+	metrics.cacheMisses.WithLabelValues(d.fs.name).Inc()
+	d.fs.trace("map file of %q: loading %q", d.Path, path.Join(d.Hash, "map"))
+	if err := d.fs.observeMap(ctx, path.Join(d.Hash, "map")); err != nil {
 		return err
 	}
-	in, err := obj.Open(ctx)
+	files, types, err := d.fs.readCachedFileMap(ctx, d.Hash)
 	if err != nil {
-		return fmt.Errorf("error opening map file: %w", err)
+		return err
 	}
-	defer in.Close()
-	r := bufio.NewReader(in)
-	for {
-		entry, err := r.ReadString('\n')
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading map file entry: %w", err)
-		}
-		entry = strings.TrimSuffix(entry, "\n")
-		if entry == "" {
+	// Detect the hash type of entries created before it was recorded, e.g.
+	// before hash_type was changed.
+	for name, hash := range files {
+		if _, ok := types[name]; ok {
 			continue
 		}
-		split := strings.SplitN(entry, " ", 2)
-		if len(split) < 2 {
-			return fmt.Errorf("malformed map file, refusing to load: invalid entry %q", entry)
+		if ht, ok := d.fs.fileHashType(d.Path, name, hash); ok && ht != d.fs.opt.HashType {
+			types[name] = ht
 		}
-		d.files[split[1]] = split[0]
 	}
+	d.files, d.types, d.names, d.index = files, types, nil, nil
+	evicted = d.fs.mapCache.add(d, filesSize(files))
 	return nil
 }
 
+// readFileMap reads the map file of the directory with the given hash from
+// the base. It returns an empty map if the map file does not exist.
+func (f *Fs) readFileMap(ctx context.Context, dirHash string) (map[string]string, error) {
+	files, _, err := f.readTypedFileMap(ctx, dirHash)
+	return files, err
+}
+
+// readTypedFileMap is like readFileMap but also returns the hash types
+// recorded for the entries whose hash type is not the one of the Fs.
+func (f *Fs) readTypedFileMap(ctx context.Context, dirHash string) (files, types map[string]string, err error) {
+	return f.parseFileMap(f.openMeta(ctx, path.Join(dirHash, "map")))
+}
+
+// readCachedFileMap is like readTypedFileMap but reads the copy of the map
+// file on local disk with cache_disk_max_size if it is unchanged.
+func (f *Fs) readCachedFileMap(ctx context.Context, dirHash string) (files, types map[string]string, err error) {
+	return f.parseFileMap(f.openCachedMeta(ctx, path.Join(dirHash, "map")))
+}
+
+// parseFileMap parses the map file in opened with err like readTypedFileMap.
+func (f *Fs) parseFileMap(in io.ReadCloser, err error) (files, types map[string]string, _ error) {
+	files = make(map[string]string)
+	types = make(map[string]string)
+	switch {
+	case errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound):
+		// Just create a new directory if it is not present, also if the
+		// base dropped its empty hash directory.
+		return files, types, nil
+	case err != nil:
+		return nil, nil, fmt.Errorf("error opening map file: %w", err)
+	}
+	defer in.Close()
+	metrics.mapLoads.WithLabelValues(f.name, kindDir).Inc()
+	records, err := unmarshalRecords(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		ht, hash := splitTypedHash(record.hash)
+		files[record.name] = hash
+		if ht != "" && ht != f.opt.HashType {
+			types[record.name] = ht
+		}
+	}
+	return files, types, nil
+}
+
 // Files returns a map mapping from the filename to the hashed path.
+//
+// The map is a copy, so it can be iterated while files are added to the
+// directory concurrently. The map file may be dropped from the cache until
+// the entry is locked, in which case it is loaded again, like in lockFiles.
 func (d *dirEntry) Files(ctx context.Context) (map[string]string, error) {
+	for {
+		if err := d.fillFiles(ctx); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		if d.files != nil {
+			files := make(map[string]string, len(d.files))
+			for name, hash := range d.files {
+				files[name] = hash
+			}
+			d.mu.Unlock()
+			return files, nil
+		}
+		d.mu.Unlock()
+	}
+}
+
+// lookupFile returns the name under which the file is recorded in the file
+// list. With case_insensitive, it also finds names which differ in case.
+func (d *dirEntry) lookupFile(files map[string]string, file string) (string, bool) {
+	file = d.fs.normalizeName(file)
+	if _, ok := files[file]; ok || !d.fs.opt.CaseInsensitive {
+		return file, ok
+	}
+	for name := range files {
+		if strings.EqualFold(name, file) {
+			return name, true
+		}
+	}
+	return file, false
+}
+
+// nameOf returns the name of the file with the given hash in the directory,
+// e.g. to translate change notifications of the base.
+func (d *dirEntry) nameOf(ctx context.Context, fileHash string) (string, bool, error) {
 	if err := d.fillFiles(ctx); err != nil {
-		return nil, err
+		return "", false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.names == nil {
+		d.names = make(map[string]string, len(d.files))
+		for name, hash := range d.files {
+			d.names[hash] = name
+		}
 	}
-	return d.files, nil
+	name, ok := d.names[fileHash]
+	return name, ok, nil
+}
+
+// recordedHash returns the hash recorded in files for the file with the
+// given name, which may have been created with another hash type than the
+// one of the Fs.
+func (d *dirEntry) recordedHash(files map[string]string, file string) (string, bool) {
+	file, ok := d.lookupFile(files, file)
+	return files[file], ok
 }
 
-// addFile adds the specified file to the directory entry.
+// addFile adds the specified file to the directory entry, replacing a file
+// whose name only differs in case with case_insensitive.
 func (d *dirEntry) addFile(ctx context.Context, file, hash string) error {
-	if err := d.fillFiles(ctx); err != nil {
-		return fmt.Errorf("refusing to modify map file in bad state: %w", err)
+	return d.addRecord(ctx, file, hash, "")
+}
+
+// addEmptyFile adds the specified empty file to the directory entry, which
+// is only stored in the map file, like addFile.
+func (d *dirEntry) addEmptyFile(ctx context.Context, file, hash string, modTime time.Time) error {
+	return d.addRecord(ctx, file, hash, emptyType(modTime))
+}
+
+// addRecord adds the specified file to the directory entry with the hash type
+// ht, or the one it was created with if ht is empty.
+func (d *dirEntry) addRecord(ctx context.Context, file, hash, ht string) error {
+	if err := d.lockFiles(ctx); err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	d.requested++
+	file = d.fs.normalizeName(file)
+	if existing, ok := d.lookupFile(d.files, file); ok {
+		delete(d.files, existing)
+		delete(d.types, existing)
 	}
 	d.files[file] = hash
+	d.names = nil
+	if ht == "" {
+		ht, _ = d.fs.fileHashType(d.Path, file, hash)
+	}
+	if ht != "" && ht != d.fs.opt.HashType {
+		d.types[file] = ht
+	}
 	return nil
 }
 
+// emptyFile returns the modification time of the file with the given name
+// in the directory entry if it is an empty file only stored in the map file.
+func (d *dirEntry) emptyFile(ctx context.Context, file string) (time.Time, bool, error) {
+	for {
+		if err := d.fillFiles(ctx); err != nil {
+			return time.Time{}, false, err
+		}
+		d.mu.Lock()
+		if d.files != nil {
+			break
+		}
+		d.mu.Unlock()
+	}
+	defer d.mu.Unlock()
+	file, _ = d.lookupFile(d.files, file)
+	modTime, ok := parseEmptyType(d.types[file])
+	return modTime, ok, nil
+}
+
+// lockFiles loads the map file of the directory entry to modify it and
+// locks the entry. The map file may be dropped from the cache until the
+// entry is locked, in which case it is loaded again.
+func (d *dirEntry) lockFiles(ctx context.Context) error {
+	for {
+		if err := d.fillFiles(ctx); err != nil {
+			return fmt.Errorf("refusing to modify map file in bad state: %w", err)
+		}
+		d.mu.Lock()
+		if d.files != nil {
+			return nil
+		}
+		d.mu.Unlock()
+	}
+}
+
 // removeFile deletes the specified file from the directory entry.
 func (d *dirEntry) removeFile(ctx context.Context, file string) error {
-	if err := d.fillFiles(ctx); err != nil {
-		return fmt.Errorf("refusing to modify map file in bad state: %w", err)
+	if err := d.lockFiles(ctx); err != nil {
+		return err
 	}
+	defer d.mu.Unlock()
+	d.requested++
+	file, _ = d.lookupFile(d.files, file)
 	delete(d.files, file)
+	delete(d.types, file)
+	d.names = nil
 	return nil
 }
 
+// write writes the map file of the directory entry to the base.
+//
+// Concurrent writes of the same map file are batched: a write which had to
+// wait for another one to finish is skipped if a write started in the
+// meantime already included its changes.
 func (d *dirEntry) write(ctx context.Context) error {
+	d.mu.Lock()
 	if d.files == nil {
+		d.mu.Unlock()
 		return fmt.Errorf("map file is not loaded")
 	}
+	d.requested++
+	want := d.requested
+	d.mu.Unlock()
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.mu.Lock()
+	if want <= d.dropped || d.files == nil {
+		// A write which had to wait for this one failed with the changes.
+		d.mu.Unlock()
+		return fmt.Errorf("%q: %w", path.Join(d.Hash, "map"), ErrMapConflict)
+	}
+	if d.written >= want {
+		d.mu.Unlock()
+		d.fs.trace("map file of %q: write batched", d.Path)
+		return nil
+	}
+	snapshot := d.requested
+	records := fileRecords(d.files, d.types)
+	d.mu.Unlock()
+
+	defer observeSince(metrics.mapWriteTime.WithLabelValues(d.fs.name, kindDir), time.Now())
+	metrics.mapWrites.WithLabelValues(d.fs.name, kindDir).Inc()
+	count(ctx, statMapWrites, 1)
+	data := marshalRecords(records)
+	obj, err := d.fs.putMap(ctx, path.Join(d.Hash, "map"), data)
+	if err != nil {
+		if errors.Is(err, ErrMapConflict) {
+			// Drop the changes and reload the map file on the next access.
+			d.mu.Lock()
+			d.files, d.types, d.names = nil, nil, nil
+			d.written, d.dropped = d.requested, d.requested
+			d.mu.Unlock()
+		}
+		return err
+	}
+	d.mu.Lock()
+	d.written = snapshot
+	d.mu.Unlock()
+	if obj != nil {
+		d.fs.diskCache.put(path.Join(d.Hash, "map"), fs.Fingerprint(ctx, obj, true), data)
+	}
+	drop(d.fs.mapCache.add(d, int64(len(data))))
+	return nil
+}
+
+// fileRecords returns the records of the map file of a directory with the
+// given files and the hash types recorded for them.
+func fileRecords(files, types map[string]string) []mapRecord {
 	// Sort the paths to make the file deterministic.
-	fileNames := make([]string, 0, len(d.files))
-	for f := range d.files {
+	fileNames := make([]string, 0, len(files))
+	for f := range files {
 		fileNames = append(fileNames, f)
 	}
 	sort.Strings(fileNames)
-	// Write.
-	pr, pw := io.Pipe()
-	objInfo := fakeObjInfo{
-		remote: path.Join(d.Hash, "map"),
-		fs:     d.fs,
-		size:   -1,
-	}
-	go func() {
-		for _, fileName := range fileNames {
-			hash := d.files[fileName]
-			pw.Write([]byte(hash + " " + fileName + "\n"))
-		}
-		pw.Close()
-	}()
-	_, err := d.fs.base.Put(ctx, pr, objInfo)
-	return err
+	records := make([]mapRecord, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		records = append(records, mapRecord{hash: typedHash(types[fileName], files[fileName]), name: fileName})
+	}
+	return records
 }
 
 // dirEntry is a node in the tree of directories.
 type dirEntry struct {
 	// Path is the path of the node from root.
 	Path string
-	// Hash is the associated hash with the node.
+	// Hash is the hash directory of the node in the base. Depending on the
+	// layout, it may be nested below other directories.
 	Hash string
 	// Parent is the parent directory of this directory. It is nil if the
 	// dirEntry represents the root directory.
@@ -158,6 +370,31 @@ type dirEntry struct {
 	// path.
 	// TODO: Replace with a higher performance map.
 	files map[string]string
+	// types maps the names of the files whose hash was created with another
+	// hash type than the one of the Fs to that hash type. It is loaded
+	// together with files.
+	types map[string]string
+	// names maps the hashes in files back to the names of the files. It is
+	// built on first use by nameOf and dropped whenever files changes.
+	names map[string]string
+	// mu protects files, types, names, requested, written and dropped.
+	mu sync.Mutex
+	// writeMu serializes the writes of the map file.
+	writeMu sync.Mutex
+	// requested counts the calls to write and the changes of files. The map
+	// file has changes which are not written yet while it is larger than
+	// written.
+	requested uint64
+	// written is the value of requested when the map file was last written
+	// successfully.
+	written uint64
+	// dropped is the value of requested when the changes of files were last
+	// dropped because another client wrote the map file concurrently.
+	dropped uint64
+	// index is the existence index of the directory: the sorted digests of
+	// the names in the map file, kept with existence_index while the map
+	// file is dropped from the cache. It is nil while files is loaded.
+	index []uint64
 
 	// fs is the implementation of hashmap that the directory entry belongs to.
 	fs *Fs
@@ -165,9 +402,15 @@ type dirEntry struct {
 
 // dirMap is a map containing directory entries of a filesystem.
 // TODO: Replace with a higher performance map.
+//
+// The maps and the children of the entries are only accessed through the
+// methods of the dirMap, which hold mu, as they are read by background tasks
+// and rc calls while the foreground operations modify them.
 type dirMap struct {
 	// fs is the implementation of the hashmap.
 	fs *Fs
+	// mu protects Hash, Path and the Children of the entries.
+	mu sync.RWMutex
 	// Hash contains a lookup from the hash of the directory to the actual
 	// directory.
 	Hash map[string]*dirEntry
@@ -188,27 +431,113 @@ func newDirMap(f *Fs) *dirMap {
 	return dMap
 }
 
-// newDirEntry creates an entry of the directory inside the map. It creates
-// parent directory automatically if they do not exist.
-func (d dirMap) newDirEntry(overlayPath string) {
-	if _, ok := d.Path[overlayPath]; ok {
+// replace replaces the directories of the map with the ones of other, e.g.
+// after the directory map was loaded again. other must not be used
+// afterwards.
+func (d *dirMap) replace(other *dirMap) {
+	other.mu.RLock()
+	hashes, paths := other.Hash, other.Path
+	other.mu.RUnlock()
+	d.mu.Lock()
+	d.Hash, d.Path = hashes, paths
+	d.mu.Unlock()
+}
+
+// get returns the entry of the directory overlayPath.
+func (d *dirMap) get(overlayPath string) (*dirEntry, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entry, ok := d.Path[overlayPath]
+	return entry, ok
+}
+
+// byHash returns the entry of the directory stored in the hash directory
+// dirHash.
+func (d *dirMap) byHash(dirHash string) (*dirEntry, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entry, ok := d.Hash[dirHash]
+	return entry, ok
+}
+
+// size returns the number of directories in the map, including the root.
+func (d *dirMap) size() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.Path)
+}
+
+// entries returns the entries of all directories in no particular order.
+func (d *dirMap) entries() []*dirEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entries := make([]*dirEntry, 0, len(d.Path))
+	for _, entry := range d.Path {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// sortedEntries returns the entries of all directories sorted by path, so
+// parents come before their children.
+func (d *dirMap) sortedEntries() []*dirEntry {
+	entries := d.entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// children returns the subdirectories of the directory entry.
+func (d *dirMap) children(entry *dirEntry) []*dirEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]*dirEntry(nil), entry.Children...)
+}
+
+// lookup finds the entry of the directory overlayPath. With
+// case_insensitive, it also finds directories whose path differs in case.
+func (d *dirMap) lookup(overlayPath string) (*dirEntry, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.lookupLocked(overlayPath)
+}
+
+// lookupLocked is lookup with mu held.
+func (d *dirMap) lookupLocked(overlayPath string) (*dirEntry, bool) {
+	entry, ok := d.Path[overlayPath]
+	if !ok && d.fs.opt.CaseInsensitive {
+		entry, ok = d.Hash[d.fs.dirBase(overlayPath)]
+	}
+	return entry, ok
+}
+
+// newDirEntry creates an entry of the directory inside the map and returns
+// it. It creates parent directory automatically if they do not exist.
+func (d *dirMap) newDirEntry(overlayPath string) *dirEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.newDirEntryLocked(overlayPath)
+}
+
+// newDirEntryLocked is newDirEntry with mu held.
+func (d *dirMap) newDirEntryLocked(overlayPath string) *dirEntry {
+	if entry, ok := d.lookupLocked(overlayPath); ok {
 		// Do nothing. The directory is already created.
 		// This may happen in DirMove where the children are moved first.
-		return
+		return entry
 	}
 	var parent *dirEntry
 	if overlayPath != "" {
-		var ok bool
 		parentPath, _ := path.Split(overlayPath)
 		parentPath = strings.TrimSuffix(parentPath, "/")
-		parent, ok = d.Path[parentPath]
-		if !ok {
-			// Create the parent directory if it does not exist.
-			d.newDirEntry(parentPath)
-			parent = d.Path[parentPath]
-		}
+		// Create the parent directory if it does not exist.
+		parent = d.newDirEntryLocked(parentPath)
+		// Keep the case of the existing parent.
+		overlayPath = path.Join(parent.Path, path.Base(overlayPath))
 	}
-	hashed := d.fs.hasher(overlayPath)
+	hashed := d.fs.dirBase(overlayPath)
+	d.fs.trace("new dir %q -> %q", overlayPath, hashed)
 	entry := &dirEntry{
 		Path:     overlayPath,
 		Hash:     hashed,
@@ -221,9 +550,21 @@ func (d dirMap) newDirEntry(overlayPath string) {
 	if parent != nil {
 		parent.Children = append(parent.Children, entry)
 	}
+	return entry
 }
 
-func (d dirMap) removeEntry(path string) {
+// setHash changes the hash directory of the entry to dirHash.
+func (d *dirMap) setHash(entry *dirEntry, dirHash string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.Hash, entry.Hash)
+	entry.Hash = dirHash
+	d.Hash[dirHash] = entry
+}
+
+func (d *dirMap) removeEntry(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	entry, ok := d.Path[path]
 	if !ok {
 		return
@@ -249,27 +590,58 @@ func (d dirMap) removeEntry(path string) {
 	delete(d.Hash, entry.Hash)
 }
 
-func (d dirMap) write(ctx context.Context) error {
+// forget deletes the entry from the lookups of the map without unlinking it
+// from its parent.
+func (d *dirMap) forget(entry *dirEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.Path, entry.Path)
+	delete(d.Hash, entry.Hash)
+}
+
+// bytes returns the serialized form of the directory map.
+func (d *dirMap) bytes() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	// Sort the paths to make the file deterministic.
 	path := make([]string, 0, len(d.Path))
 	for p := range d.Path {
 		path = append(path, p)
 	}
 	sort.Strings(path)
-	// Write.
-	pr, pw := io.Pipe()
-	objInfo := fakeObjInfo{
-		remote: "map",
-		fs:     d.fs,
-		size:   -1,
-	}
-	go func() {
-		for _, p := range path {
-			entry := d.Path[p]
-			pw.Write([]byte(entry.Hash + " " + p + "\n"))
+	records := make([]mapRecord, 0, len(path))
+	for _, p := range path {
+		records = append(records, mapRecord{hash: d.Path[p].Hash, name: p})
+	}
+	return marshalRecords(records)
+}
+
+func (d *dirMap) write(ctx context.Context) error {
+	defer observeSince(metrics.mapWriteTime.WithLabelValues(d.fs.name, kindRoot), time.Now())
+	metrics.mapWrites.WithLabelValues(d.fs.name, kindRoot).Inc()
+	count(ctx, statMapWrites, 1)
+	if err := d.fs.markLayout(ctx); err != nil {
+		return err
+	}
+	data := d.bytes()
+	obj, err := d.fs.putMap(ctx, "map", data)
+	if errors.Is(err, ErrMapConflict) {
+		// Drop the change and continue with the current map.
+		if loadErr := d.fs.loadDirMap(ctx); loadErr != nil {
+			fs.Errorf(d.fs, "failed to reload directory map: %v", loadErr)
 		}
-		pw.Close()
-	}()
-	_, err := d.fs.base.Put(ctx, pr, objInfo)
-	return err
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// The object is nil if the write was queued for retry.
+	if obj != nil && d.fs.opt.MapHistory > 0 {
+		if err := d.fs.recordMapVersion(ctx, data); err != nil {
+			// The map itself was written successfully so don't fail the
+			// operation because of the history.
+			fs.Errorf(d.fs, "failed to record map version: %v", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,132 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Errors returned by the hashmap backend. They are wrapped with the details,
+// so they should be checked with errors.Is.
+var (
+	// ErrMapCorrupt is returned for map files which are malformed, e.g.
+	// truncated or listing a directory twice, and refused to be loaded.
+	ErrMapCorrupt = errors.New("malformed map file, refusing to load")
+	// ErrMapConflict is returned when a map file was changed by another
+	// client since it was loaded.
+	ErrMapConflict = errors.New("map file was changed by another client")
+	// ErrNameFileMissing is returned when the name file of a file does not
+	// exist. It also matches fs.ErrorObjectNotFound.
+	ErrNameFileMissing = errors.New("name file not found")
+	// ErrHashCollision is returned when a file would be stored at the hash
+	// of another file with a different name in the same directory.
+	ErrHashCollision = errors.New("hash collision")
+	// ErrDataMissing is returned when the data object of a file in the map
+	// does not exist. It also matches fs.ErrorObjectNotFound.
+	ErrDataMissing = errors.New("data object not found")
+	// ErrWriteVerification is returned with verify_writes when a written
+	// name file or map file does not hold what was written.
+	ErrWriteVerification = errors.New("written object failed verification")
+)
+
+// nameFileMissingError is the error returned when a name file does not
+// exist. It matches ErrNameFileMissing as well as the error of the base.
+type nameFileMissingError struct {
+	err error
+}
+
+// Error returns the message of the error.
+func (e nameFileMissingError) Error() string {
+	return ErrNameFileMissing.Error() + ": " + e.err.Error()
+}
+
+// Unwrap returns the error of the base.
+func (e nameFileMissingError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is ErrNameFileMissing.
+func (e nameFileMissingError) Is(target error) bool {
+	return target == ErrNameFileMissing
+}
+
+// dataMissingError is the error returned when the data object of a file in
+// the map does not exist. It matches ErrDataMissing as well as the error of
+// the base.
+type dataMissingError struct {
+	err error
+}
+
+// Error returns the message of the error.
+func (e dataMissingError) Error() string {
+	return ErrDataMissing.Error() + ": " + e.err.Error()
+}
+
+// Unwrap returns the error of the base.
+func (e dataMissingError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is ErrDataMissing.
+func (e dataMissingError) Is(target error) bool {
+	return target == ErrDataMissing
+}
+
+// pathError annotates an error with the overlay path of the file or
+// directory it occurred for, as the errors of the base only name the hashed
+// paths in the base.
+type pathError struct {
+	overlay string
+	err     error
+}
+
+// Error returns the message of the error with the overlay path.
+func (e pathError) Error() string {
+	return fmt.Sprintf("%v (overlay path %q)", e.err, e.overlay)
+}
+
+// Unwrap returns the annotated error.
+func (e pathError) Unwrap() error {
+	return e.err
+}
+
+// plainErrors are the errors which are returned as they are, as rclone
+// compares them directly in places.
+var plainErrors = []error{
+	fs.ErrorObjectNotFound,
+	fs.ErrorDirNotFound,
+	fs.ErrorDirExists,
+	fs.ErrorIsFile,
+	fs.ErrorIsDir,
+	fs.ErrorDirectoryNotEmpty,
+	fs.ErrorCantCopy,
+	fs.ErrorCantMove,
+	fs.ErrorCantDirMove,
+	fs.ErrorCantPurge,
+	fs.ErrorCantSetModTime,
+	fs.ErrorCantSetModTimeWithoutDelete,
+	fs.ErrorNotImplemented,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
+
+// annotate returns err annotated with the overlay path remote. It returns
+// nil for nil and err itself if it is annotated already or one of
+// plainErrors.
+func annotate(remote string, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, plain := range plainErrors {
+		if err == plain {
+			return err
+		}
+	}
+	var annotated pathError
+	if errors.As(err, &annotated) {
+		return err
+	}
+	return pathError{overlay: remote, err: err}
+}
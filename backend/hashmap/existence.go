@@ -0,0 +1,57 @@
+package hashmap
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// nameDigest returns the digest of the name of a file recorded in the
+// existence index of its directory.
+func (f *Fs) nameDigest(name string) uint64 {
+	name = f.normalizeName(name)
+	if f.opt.CaseInsensitive {
+		name = strings.ToLower(name)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// nameIndex returns the sorted digests of the names of the map file files,
+// which are kept as the existence index of a directory once its map file is
+// dropped from the cache with existence_index.
+func (f *Fs) nameIndex(files map[string]string) []uint64 {
+	index := make([]uint64, 0, len(files))
+	for name := range files {
+		index = append(index, f.nameDigest(name))
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return index[i] < index[j]
+	})
+	return index
+}
+
+// lacksFile reports whether the file is definitely not in the map file of
+// the directory entry according to its existence index, without loading the
+// map file. It returns false if the map file is cached or the directory has
+// no existence index, and for names whose digest collides with the one of a
+// recorded file.
+func (d *dirEntry) lacksFile(file string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files != nil || d.index == nil {
+		return false
+	}
+	digest := d.fs.nameDigest(file)
+	i := sort.Search(len(d.index), func(i int) bool {
+		return d.index[i] >= digest
+	})
+	if i < len(d.index) && d.index[i] == digest {
+		return false
+	}
+	atomic.AddInt64(&d.fs.indexMisses, 1)
+	d.fs.trace("map file of %q: %q ruled out by existence index", d.Path, file)
+	return true
+}
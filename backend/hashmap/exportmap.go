@@ -0,0 +1,186 @@
+package hashmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// exportedMap is the mapping state written by the export-map command and
+// read by the import-map command.
+type exportedMap struct {
+	// HashType is the hash type of the exporting Fs.
+	HashType string `json:"hashType"`
+	// Layout is the layout of the exporting Fs.
+	Layout string `json:"layout"`
+	// Time is the time of the export.
+	Time time.Time `json:"time"`
+	// Dirs are the directories of the directory map, sorted by path.
+	Dirs []exportedDir `json:"dirs"`
+}
+
+// exportedDir is a directory of the directory map with its map file.
+type exportedDir struct {
+	// Path is the absolute overlay path of the directory.
+	Path string `json:"path"`
+	// Hash is the hash directory of the directory in the base.
+	Hash string `json:"hash"`
+	// Files are the files of the map file, sorted by name.
+	Files []exportedFile `json:"files,omitempty"`
+}
+
+// exportedFile is a record of a map file.
+type exportedFile struct {
+	// Name is the name of the file.
+	Name string `json:"name"`
+	// Hash is the hash of the file directory in the base.
+	Hash string `json:"hash"`
+	// Type is the hash type of files created with another hash type, or
+	// the type of the empty files only stored in the map file.
+	Type string `json:"type,omitempty"`
+}
+
+// mapImportReport is the result of the import-map command.
+type mapImportReport struct {
+	// Dirs is the number of directories imported.
+	Dirs int `json:"dirs"`
+	// Files is the number of files added to the map files.
+	Files int `json:"files"`
+	// Added are the directories which were not in the directory map.
+	Added []string `json:"added"`
+	// Rejected are the directories and files whose hash doesn't match
+	// their path with any hash type and which were not imported.
+	Rejected []string `json:"rejected"`
+}
+
+// exportMap returns the directory map and the map files of all directories.
+func (f *Fs) exportMap(ctx context.Context) (*exportedMap, error) {
+	exported := &exportedMap{
+		HashType: f.opt.HashType,
+		Layout:   f.layout,
+		Time:     time.Now(),
+		Dirs:     make([]exportedDir, 0, f.dirMap.size()),
+	}
+	for _, entry := range f.dirMap.sortedEntries() {
+		files, err := entry.Files(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error reading map file of %q: %w", entry.Path, err)
+		}
+		dir := exportedDir{Path: entry.Path, Hash: entry.Hash}
+		entry.mu.Lock()
+		for name, fileHash := range files {
+			dir.Files = append(dir.Files, exportedFile{Name: name, Hash: fileHash, Type: entry.types[name]})
+		}
+		entry.mu.Unlock()
+		sort.Slice(dir.Files, func(i, j int) bool {
+			return dir.Files[i].Name < dir.Files[j].Name
+		})
+		exported.Dirs = append(exported.Dirs, dir)
+	}
+	return exported, nil
+}
+
+// exportMapFile writes the mapping state returned by exportMap to the local
+// file dst.
+func (f *Fs) exportMapFile(ctx context.Context, dst string) (*exportedMap, error) {
+	exported, err := f.exportMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(exported, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	// The map reveals the names of all files.
+	if err := os.WriteFile(dst, data, 0600); err != nil {
+		return nil, fmt.Errorf("error writing exported map: %w", err)
+	}
+	return exported, nil
+}
+
+// importMapFile reads the mapping state exported by exportMapFile from the
+// local file src and merges it into the directory map and the map files.
+//
+// The directories and files whose hash doesn't match their path with any
+// hash type are rejected. The records of the current map files take
+// precedence, as they are newer than the export.
+func (f *Fs) importMapFile(ctx context.Context, src string) (*mapImportReport, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("error reading exported map: %w", err)
+	}
+	exported := &exportedMap{}
+	if err := json.Unmarshal(data, exported); err != nil {
+		return nil, fmt.Errorf("error parsing exported map: %w", err)
+	}
+	if exported.Layout != f.layout {
+		return nil, fmt.Errorf("the map was exported with layout %q, not %q", exported.Layout, f.layout)
+	}
+	report := &mapImportReport{}
+	valid := make([]exportedDir, 0, len(exported.Dirs))
+	// Parents first, so they are created with their recorded hash.
+	sort.Slice(exported.Dirs, func(i, j int) bool {
+		return exported.Dirs[i].Path < exported.Dirs[j].Path
+	})
+	for _, dir := range exported.Dirs {
+		if _, ok := f.dirHashType(dir.Path, dir.Hash); !ok {
+			report.Rejected = append(report.Rejected, dir.Path)
+			continue
+		}
+		files := dir.Files[:0:0]
+		for _, file := range dir.Files {
+			if _, ok := f.fileHashType(dir.Path, file.Name, file.Hash); !ok {
+				report.Rejected = append(report.Rejected, path.Join(dir.Path, file.Name))
+				continue
+			}
+			files = append(files, file)
+		}
+		dir.Files = files
+		valid = append(valid, dir)
+	}
+	report.Dirs = len(valid)
+	if f.skipBase(ctx, "import directory map", "map") {
+		return report, nil
+	}
+	for _, dir := range valid {
+		entry, ok := f.dirMap.get(dir.Path)
+		if !ok {
+			entry = f.dirMap.newDirEntry(dir.Path)
+			if entry.Hash != dir.Hash {
+				f.dirMap.setHash(entry, dir.Hash)
+			}
+			report.Added = append(report.Added, dir.Path)
+		}
+		current, err := entry.Files(ctx)
+		if err != nil {
+			return report, fmt.Errorf("cannot import into invalid map file of %q: %w", entry.Path, err)
+		}
+		added := 0
+		for _, file := range dir.Files {
+			if _, ok := entry.recordedHash(current, file.Name); ok {
+				continue
+			}
+			if err := entry.addRecord(ctx, file.Name, file.Hash, file.Type); err != nil {
+				return report, err
+			}
+			added++
+		}
+		if added > 0 {
+			if err := entry.write(ctx); err != nil {
+				return report, err
+			}
+			fs.Infof(entry.Path, "imported %d files into the map file", added)
+		}
+		report.Files += added
+	}
+	return report, f.dirMap.write(ctx)
+}
@@ -1,7 +1,9 @@
 package hashmap
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
@@ -11,6 +13,7 @@ import (
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/hash"
 	"github.com/rclone/rclone/fs/operations"
+	"golang.org/x/sync/errgroup"
 )
 
 // NewObject finds the Object at remote. If it can't be found, it returns the
@@ -18,24 +21,67 @@ import (
 //
 // If remote points to a directory then it should return ErrorIsDir if possible
 // without doing any extra work, otherwise ErrorObjectNotFound.
-func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
-	if _, ok := f.dirMap.Path[remote]; ok {
+func (f *Fs) NewObject(ctx context.Context, remote string) (_ fs.Object, err error) {
+	defer func(remote string) { err = annotate(remote, err) }(remote)
+	if f.isLostFound(remote) {
+		if remote == lostFoundDir {
+			return nil, fs.ErrorIsDir
+		}
+		return f.newLostObject(ctx, remote)
+	}
+	if _, ok := f.findDir(path.Join(f.root, remote)); ok {
 		return nil, fs.ErrorIsDir
 	}
 	base := path.Base(remote)
 	entry, fileHash, ok := f.toHash(remote)
 	if !ok {
-		return nil, fs.ErrorObjectNotFound
+		var err error
+		entry, ok, err = f.findUnmappedDir(ctx, path.Dir(path.Join(f.root, remote)))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return f.newPlainObject(ctx, remote)
+		}
 	}
-	files, err := entry.Files(ctx)
+	recorded, ok := "", false
+	if !entry.lacksFile(base) {
+		files, err := entry.Files(ctx)
+		if err != nil {
+			return nil, err
+		}
+		recorded, ok = entry.recordedHash(files, base)
+	}
+	if ok {
+		fileHash = recorded
+	} else {
+		adopted, err := f.findUnmapped(ctx, entry, fileHash)
+		if err != nil {
+			return nil, err
+		}
+		if !adopted {
+			return f.newPlainObject(ctx, remote)
+		}
+	}
+	modTime, empty, err := entry.emptyFile(ctx, base)
 	if err != nil {
 		return nil, err
 	}
-	if _, ok := files[base]; !ok {
-		return nil, fs.ErrorObjectNotFound
+	if empty {
+		return &emptyObject{
+			fs:       f,
+			remote:   remote,
+			entry:    entry,
+			fileHash: fileHash,
+			modTime:  modTime,
+		}, nil
 	}
 	basePath := path.Join(entry.Hash, fileHash)
-	dataObj, err := f.base.NewObject(ctx, path.Join(basePath, "data"))
+	f.trace("object %q -> %q", remote, basePath)
+	dataObj, err := f.newBaseObject(ctx, f.fileKey(basePath, dataLeaf))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, f.handleMissingData(ctx, entry, base, basePath, dataMissingError{err: err})
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error fetching base object: %w", err)
 	}
@@ -48,32 +94,98 @@ func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
 	}, nil
 }
 
-// OpenWriterAt opens a handle for random access writes.
-func (f *Fs) OpenWriterAt(ctx context.Context, remote string, size int64) (fs.WriterAtCloser, error) {
+// OpenWriterAt opens a handle for random access writes to the data object
+// of the file in the base, e.g. for multi-thread copies.
+func (f *Fs) OpenWriterAt(ctx context.Context, remote string, size int64) (_ fs.WriterAtCloser, err error) {
+	defer func(remote string) { err = annotate(remote, err) }(remote)
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
 	do := f.base.Features().OpenWriterAt
 	if do == nil {
 		return nil, fs.ErrorNotImplemented
 	}
-	remote = path.Join(f.root, remote)
-	dir, base := path.Split(remote)
-	dir = strings.TrimSuffix(dir, "/")
-	if err := f.Mkdir(ctx, dir); err != nil {
+	parent := path.Dir(remote)
+	if parent == "." {
+		parent = ""
+	}
+	if err := f.Mkdir(ctx, parent); err != nil {
 		return nil, fmt.Errorf("error creating parent directory: %w", err)
 	}
 	entry, fileHash, ok := f.toHash(remote)
 	if !ok {
-		panic("parent directory does not exist")
+		return nil, fs.ErrorDirNotFound
+	}
+	base := path.Base(remote)
+	if err := f.checkCollision(ctx, entry, base, fileHash); err != nil {
+		return nil, err
 	}
 	files, err := entry.Files(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("refusing to edit files in directory with corrupted map file: %w", err)
 	}
-	if _, ok := files[base]; !ok {
-		if err := f.prepareDest(ctx, nil, remote, entry.Hash, fileHash); err != nil {
+	recorded, ok := entry.recordedHash(files, base)
+	if ok {
+		fileHash = recorded
+	}
+	_, empty, err := entry.emptyFile(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || empty {
+		if err := f.prepareDest(ctx, nil, path.Join(f.root, remote), entry.Hash, fileHash); err != nil {
 			return nil, err
 		}
 	}
-	return do(ctx, path.Join(entry.Hash, fileHash, "data"), size)
+	key := f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf)
+	w, err := do(ctx, key, size)
+	if err != nil {
+		return nil, f.checkHalt(err)
+	}
+	f.noteWrite(key)
+	if ok && !empty {
+		return w, nil
+	}
+	// The new file, or the empty file only stored in the map file, is
+	// recorded with its data object once it was written.
+	return &writerAt{
+		WriterAtCloser: w,
+		fs:             f,
+		entry:          entry,
+		remote:         remote,
+		fileHash:       fileHash,
+	}, nil
+}
+
+// writerAt is the handle returned by OpenWriterAt for a file which is not in
+// the map file with a data object yet. The file is recorded in the map file
+// once the handle is closed, so it only shows up once it was written
+// completely.
+type writerAt struct {
+	fs.WriterAtCloser
+	fs       *Fs
+	entry    *dirEntry
+	remote   string
+	fileHash string
+}
+
+// Close closes the handle and records the file in the map file.
+func (w *writerAt) Close() error {
+	if err := w.WriterAtCloser.Close(); err != nil {
+		return err
+	}
+	// The context of OpenWriterAt is usually canceled once all parts were
+	// written.
+	ctx := context.Background()
+	if err := w.entry.addFile(ctx, path.Base(w.remote), w.fileHash); err != nil {
+		return err
+	}
+	if err := w.entry.write(ctx); err != nil {
+		return err
+	}
+	w.fs.removePlain(ctx, w.remote)
+	w.fs.notifyChangeRel(opPut, w.remote, "")
+	return nil
 }
 
 // Put puts in to the remote path with the modTime given of the given size.
@@ -99,116 +211,342 @@ func (f *Fs) PutUnchecked(ctx context.Context, in io.Reader, src fs.ObjectInfo,
 }
 
 // Copy copies the specified file to the specified path.
-func (f *Fs) Copy(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+func (f *Fs) Copy(ctx context.Context, src fs.Object, remote string) (_ fs.Object, err error) {
+	defer func(remote string) { err = annotate(remote, err) }(remote)
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
 	do := f.base.Features().Copy
 	if do == nil {
 		return nil, fs.ErrorCantCopy
 	}
-	if strings.Contains(remote, "\n") {
-		return nil, fmt.Errorf("file name may not contain newline: %q", src.Remote())
+	srcObj, ok := f.serverSideSource(src)
+	if !ok {
+		return nil, fs.ErrorCantCopy
+	}
+	if err := f.makeParent(ctx, remote, srcObj.fs); err != nil {
+		return nil, err
 	}
 	entry, fileHash, ok := f.toHash(remote)
 	if !ok {
 		return nil, fs.ErrorDirNotFound
 	}
-	if err := f.prepareDest(ctx, src, remote, entry.Hash, fileHash); err != nil {
+	if err := f.checkCollision(ctx, entry, path.Base(remote), fileHash); err != nil {
+		return nil, err
+	}
+	if err := f.prepareDest(ctx, src, path.Join(f.root, remote), entry.Hash, fileHash); err != nil {
 		return nil, err
 	}
 	base := path.Base(remote)
+	replaced := f.replacedHash(ctx, entry, base, fileHash)
+	obj, err := do(ctx, srcObj.UnWrap(), f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf))
+	if err != nil {
+		return nil, f.checkHalt(err)
+	}
+	f.noteWrite(obj.Remote())
 	if err := entry.addFile(ctx, base, fileHash); err != nil {
 		return nil, err
 	}
+	obj = object{
+		obj:      obj,
+		path:     remote,
+		basePath: path.Join(entry.Hash, fileHash),
+		fs:       f,
+		dirEntry: entry,
+	}
 	if err := entry.write(ctx); err != nil {
-		return nil, err
+		return obj, err
+	}
+	f.purgeReplaced(ctx, entry, replaced)
+	f.removePlain(ctx, remote)
+	f.notifyChangeRel(opCopy, remote, "")
+	return obj, nil
+}
+
+// serverSideSource returns src as an object of the overlay if its data
+// object can be copied or moved server-side to the base of f. This is the
+// case for objects of overlays over the same base, possibly with a
+// different root.
+func (f *Fs) serverSideSource(src fs.Object) (object, bool) {
+	srcObj, ok := src.(object)
+	if !ok {
+		return object{}, false
+	}
+	srcBase := srcObj.fs.base
+	if operations.SameConfig(srcBase, f.base) {
+		return srcObj, true
 	}
-	return do(ctx, src.(object).UnWrap(), path.Join(entry.Hash, fileHash, "data"))
+	if operations.SameRemoteType(srcBase, f.base) && f.base.Features().ServerSideAcrossConfigs {
+		return srcObj, true
+	}
+	return object{}, false
 }
 
 // Move moves the specified file to the specified path.
-func (f *Fs) Move(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+func (f *Fs) Move(ctx context.Context, src fs.Object, remote string) (_ fs.Object, err error) {
+	defer func(remote string) { err = annotate(remote, err) }(remote)
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
 	do := f.base.Features().Move
 	if do == nil {
 		return nil, fs.ErrorCantMove
 	}
-	if strings.Contains(remote, "\n") {
-		return nil, fmt.Errorf("file name may not contain newline: %q", src.Remote())
+	srcObj, ok := f.serverSideSource(src)
+	if !ok {
+		return nil, fs.ErrorCantMove
+	}
+	if err := f.makeParent(ctx, remote, srcObj.fs); err != nil {
+		return nil, err
 	}
 	// Modify destination entry.
 	entry, fileHash, ok := f.toHash(remote)
 	if !ok {
 		return nil, fs.ErrorDirNotFound
 	}
-	if err := f.prepareDest(ctx, src, remote, entry.Hash, fileHash); err != nil {
+	if srcObj.dirEntry == entry {
+		return f.rename(ctx, srcObj, remote)
+	}
+	if err := f.checkCollision(ctx, entry, path.Base(remote), fileHash); err != nil {
+		return nil, err
+	}
+	if err := f.prepareDest(ctx, src, path.Join(f.root, remote), entry.Hash, fileHash); err != nil {
 		return nil, err
 	}
 	base := path.Base(remote)
+	dstBase := path.Join(entry.Hash, fileHash)
+	replaced := f.replacedHash(ctx, entry, base, fileHash)
+	sameBase := operations.Same(srcObj.fs.base, f.base)
+	if sameBase && path.Join(entry.Hash, replaced) == srcObj.basePath {
+		// The source is the file replaced, e.g. renamed in case only.
+		replaced = ""
+	}
+	srcEntry := srcObj.dirEntry
 	if err := entry.addFile(ctx, base, fileHash); err != nil {
 		return nil, err
 	}
 	if err := entry.write(ctx); err != nil {
 		return nil, err
 	}
-	// Modify source entry.
-	srcBase := path.Base(src.Remote())
-	srcEntry, srcHash, ok := f.toHash(src.Remote())
-	if !ok {
-		return nil, fs.ErrorDirNotFound
-	}
-	if err := srcEntry.removeFile(ctx, srcBase); err != nil {
-		return nil, err
+	// Modify source entry. Objects in lost+found are not in any map file.
+	if srcEntry != nil {
+		if err := srcEntry.removeFile(ctx, path.Base(src.Remote())); err != nil {
+			return nil, err
+		}
+		if err := srcEntry.write(ctx); err != nil {
+			return nil, err
+		}
 	}
-	if err := srcEntry.write(ctx); err != nil {
-		return nil, err
+	f.purgeReplaced(ctx, entry, replaced)
+	f.removePlain(ctx, remote)
+	f.notifyChange(opMove, path.Join(f.root, remote), path.Join(srcObj.fs.root, srcObj.path))
+	if sameBase && srcObj.basePath == dstBase {
+		// Only the case of the name changed, the data stays where it is.
+		return object{
+			obj:      srcObj.obj,
+			path:     remote,
+			basePath: dstBase,
+			fs:       f,
+			dirEntry: entry,
+		}, nil
 	}
 	// Move data file.
-	obj, objErr := do(ctx, src.(object).UnWrap(), path.Join(entry.Hash, fileHash, "data"))
+	obj, objErr := do(ctx, srcObj.UnWrap(), f.fileKey(dstBase, dataLeaf))
+	objErr = f.checkHalt(objErr)
 	if obj != nil {
+		f.noteWrite(obj.Remote())
 		// Always wrap the object returned.
 		obj = object{
 			obj:      obj,
 			path:     remote,
-			basePath: path.Join(entry.Hash, fileHash),
+			basePath: dstBase,
 			fs:       f,
 			dirEntry: entry,
 		}
 	}
-	// Remove source directory, including name metadata.
-	if err := operations.Purge(ctx, f.base, path.Join(srcEntry.Hash, srcHash)); err != nil {
+	// Remove source directory, including name metadata, from the base of
+	// the source which may differ from the one of f.
+	if err := srcObj.fs.purgeFile(ctx, srcObj.basePath); err != nil {
 		fs.LogPrintf(fs.LogLevelWarning, src, "error purging old location")
 		return obj, err
 	}
 	return obj, objErr
 }
 
+// replacedHash returns the hash recorded for the file name in the directory
+// entry if it differs from fileHash, i.e. the file was created with another
+// hash type or renamed in place and its objects are left behind when it is
+// replaced. It returns
+// an empty string otherwise.
+func (f *Fs) replacedHash(ctx context.Context, entry *dirEntry, name, fileHash string) string {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return ""
+	}
+	recorded, ok := entry.recordedHash(files, name)
+	if !ok || recorded == fileHash {
+		return ""
+	}
+	return recorded
+}
+
+// purgeReplaced removes the objects of the file with the hash replaced in
+// the directory entry once it was replaced by a file with another hash.
+func (f *Fs) purgeReplaced(ctx context.Context, entry *dirEntry, replaced string) {
+	if replaced == "" {
+		return
+	}
+	basePath := path.Join(entry.Hash, replaced)
+	if err := f.purgeFile(ctx, basePath); err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		fs.Errorf(f, "failed to remove replaced file %q: %v", basePath, err)
+	}
+}
+
+// makeParent creates the parent directory of remote if it does not exist.
+//
+// src is the Fs of the source of a server-side transfer. If it is another
+// instance of the same overlay, e.g. the destination of a sync with
+// --backup-dir, the directory is recorded in its directory map as well so
+// its own later writes of the map don't drop it.
+func (f *Fs) makeParent(ctx context.Context, remote string, src *Fs) error {
+	parent := path.Dir(remote)
+	if parent == "." {
+		parent = ""
+	}
+	if err := f.Mkdir(ctx, parent); err != nil {
+		return fmt.Errorf("error creating parent directory: %w", err)
+	}
+	if f.otherInstance(src) {
+		src.dirMap.newDirEntry(path.Join(f.root, parent))
+	}
+	return nil
+}
+
+// sharesLayout reports whether other stores its hash directories in the same
+// base as f with the same hashing parameters, so they can be moved between
+// both as they are.
+func (f *Fs) sharesLayout(other *Fs) bool {
+	return operations.Same(f.base, other.base) &&
+		f.opt.HashType == other.opt.HashType &&
+		f.layout == other.layout &&
+		f.keySeparator == other.keySeparator &&
+		f.opt.CaseInsensitive == other.opt.CaseInsensitive
+}
+
+// sharesLayoutButHash reports whether other only differs from f in the hash
+// type, so its hash directories can be moved to f once they are renamed to
+// the hashes of f.
+func (f *Fs) sharesLayoutButHash(other *Fs) bool {
+	return operations.Same(f.base, other.base) &&
+		f.opt.HashType != other.opt.HashType &&
+		f.layout == other.layout &&
+		f.keySeparator == other.keySeparator &&
+		f.opt.CaseInsensitive == other.opt.CaseInsensitive
+}
+
+// otherInstance reports whether other is another instance of the same
+// overlay as f, e.g. with a different root, holding its own directory map.
+func (f *Fs) otherInstance(other *Fs) bool {
+	return other != f && other.name == f.name && other.opt.Remote == f.opt.Remote
+}
+
+// mirrorEntry records the directory at the absolute overlay path p and its
+// parents in the directory map of other with the hash directories they have
+// in f, which may use another hash type.
+func (f *Fs) mirrorEntry(other *Fs, p string) {
+	entry, ok := f.dirMap.lookup(p)
+	if !ok {
+		return
+	}
+	if entry.Parent != nil {
+		f.mirrorEntry(other, entry.Parent.Path)
+	}
+	mirrored := other.dirMap.newDirEntry(p)
+	if mirrored.Hash != entry.Hash {
+		other.dirMap.setHash(mirrored, entry.Hash)
+	}
+}
+
 type putFn func(context.Context, io.Reader, fs.ObjectInfo, ...fs.OpenOption) (fs.Object, error)
 
-func (f *Fs) put(ctx context.Context, do putFn, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
-	if strings.Contains(src.Remote(), "\n") {
-		return nil, fmt.Errorf("file name may not contain newline: %q", src.Remote())
+func (f *Fs) put(ctx context.Context, do putFn, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (_ fs.Object, err error) {
+	defer func(remote string) { err = annotate(remote, err) }(src.Remote())
+	if err := f.checkWritable(); err != nil {
+		return nil, err
 	}
 	_, base := path.Split(src.Remote())
 	entry, fileHash, ok := f.toHash(src.Remote())
+	if !ok && f.readThrough() {
+		if err := f.mkdirPlainParent(ctx, src.Remote()); err != nil {
+			return nil, err
+		}
+		entry, fileHash, ok = f.toHash(src.Remote())
+	}
+	if !ok {
+		// Like the other backends, the missing parents are created.
+		if err := f.makeParent(ctx, src.Remote(), f); err != nil {
+			return nil, err
+		}
+		entry, fileHash, ok = f.toHash(src.Remote())
+	}
 	if !ok {
 		return nil, fs.ErrorDirNotFound
 	}
-	if err := f.prepareDest(ctx, src, src.Remote(), entry.Hash, fileHash); err != nil {
+	if err := f.checkCollision(ctx, entry, base, fileHash); err != nil {
 		return nil, err
 	}
-	// Create the data file.
-	dataSrc := fakeObjInfo{
-		objInfo: src,
-		remote:  path.Join(entry.Hash, fileHash, "data"),
-		fs:      f,
+	if f.opt.EmptyFilesInMap && src.Size() == 0 {
+		return f.putEmpty(ctx, entry, fileHash, src)
 	}
-	obj, err := do(ctx, in, dataSrc, options...)
-	if err != nil {
-		return nil, fmt.Errorf("error creating data file: %w", err)
+	if err := f.makeDestDirs(ctx, entry.Hash, fileHash); err != nil {
+		return nil, err
 	}
-	files, err := entry.Files(ctx)
+	replaced := f.replacedHash(ctx, entry, base, fileHash)
+	_, recorded, err := entry.nameOf(ctx, fileHash)
 	if err != nil {
 		return nil, err
 	}
-	files[base] = fileHash
+	if f.opt.PendingMarkers {
+		if err := f.putPending(ctx, entry.Hash, fileHash); err != nil {
+			return nil, err
+		}
+	}
+	// Create the name file and the data file concurrently.
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := f.putNameFile(gCtx, src, entry.Hash, fileHash, path.Join(f.root, src.Remote())); err != nil {
+			return fmt.Errorf("error creating name file: %w", err)
+		}
+		return nil
+	})
+	var obj fs.Object
+	g.Go(func() error {
+		dataSrc := fakeObjInfo{
+			objInfo: src,
+			remote:  f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf),
+			fs:      f,
+		}
+		var err error
+		obj, err = do(gCtx, in, dataSrc, options...)
+		if err != nil {
+			return fmt.Errorf("error creating data file: %w", err)
+		}
+		f.noteWrite(dataSrc.remote)
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		if !recorded {
+			// Don't leave the name file of a new file behind.
+			basePath := path.Join(entry.Hash, fileHash)
+			if purgeErr := f.purgeFile(ctx, basePath); purgeErr != nil && !errors.Is(purgeErr, fs.ErrorDirNotFound) {
+				fs.Errorf(src, "failed to remove %q after failed upload: %v", basePath, purgeErr)
+			}
+		}
+		return nil, f.checkHalt(err)
+	}
+	if err := entry.addFile(ctx, base, fileHash); err != nil {
+		return nil, err
+	}
 	// Wrap the object.
 	obj = object{
 		obj:      obj,
@@ -221,38 +559,180 @@ func (f *Fs) put(ctx context.Context, do putFn, in io.Reader, src fs.ObjectInfo,
 	if err := entry.write(ctx); err != nil {
 		return obj, err
 	}
+	if f.opt.PendingMarkers {
+		if err := f.clearPending(ctx, entry.Hash, fileHash); err != nil {
+			fs.Errorf(obj, "failed to remove pending marker: %v", err)
+		}
+	}
+	f.purgeReplaced(ctx, entry, replaced)
+	f.removePlain(ctx, src.Remote())
+	f.notifyChangeRel(opPut, src.Remote(), "")
 	return obj, nil
 }
 
 // prepareDest is a helper function that creates the directory structure for a
 // given file creation. It does not create the "data" file.
 func (f *Fs) prepareDest(ctx context.Context, src fs.ObjectInfo, destOverlay, dirHash, fileHash string) error {
-	// Create the directory for the file.
-	err := f.base.Mkdir(ctx, dirHash)
+	if err := f.makeDestDirs(ctx, dirHash, fileHash); err != nil {
+		return err
+	}
+	// Create the name file.
+	if err := f.putNameFile(ctx, src, dirHash, fileHash, destOverlay); err != nil {
+		return fmt.Errorf("error creating name file: %w", err)
+	}
+	return nil
+}
+
+// checkCollision returns ErrHashCollision if another file than name is
+// recorded with fileHash in the directory entry. Names which only differ in
+// case share their hash with case_insensitive. A file renamed in place which
+// still occupies fileHash is moved to the hash of its new name.
+func (f *Fs) checkCollision(ctx context.Context, entry *dirEntry, name, fileHash string) error {
+	recorded, ok, err := entry.nameOf(ctx, fileHash)
+	if err != nil || !ok || recorded == name {
+		return err
+	}
+	if f.opt.CaseInsensitive && strings.EqualFold(recorded, name) {
+		return nil
+	}
+	if f.renamedInPlace(entry, recorded, fileHash) {
+		return f.relocateRenamed(ctx, entry, recorded, map[string]bool{name: true})
+	}
+	return fmt.Errorf("%w: %q and %q in %q both hash to %q", ErrHashCollision, recorded, name, entry.Path, fileHash)
+}
+
+// makeDestDirs creates the hash directory and file directory of the file with
+// the given hashes.
+func (f *Fs) makeDestDirs(ctx context.Context, dirHash, fileHash string) error {
+	err := f.mkdirMeta(ctx, dirHash)
 	if err != nil {
 		return err
 	}
-	err = f.base.Mkdir(ctx, path.Join(dirHash, fileHash))
+	if f.joinedKeys() {
+		return nil
+	}
+	err = f.mkdirMeta(ctx, path.Join(dirHash, fileHash))
 	if err != nil {
 		return fmt.Errorf("error creating directory for file: %w", err)
 	}
-	// Create the name file.
+	return nil
+}
+
+// nameFileContent returns the content of the name file n, padded as
+// configured.
+func (f *Fs) nameFileContent(n nameFile) []byte {
+	content := marshalNameFile(n)
+	if pad := int(f.opt.NamePadding); pad > 0 && len(content)%pad != 0 {
+		padded := make([]byte, (len(content)/pad+1)*pad)
+		copy(padded, content)
+		content = padded
+	}
+	return content
+}
+
+// readNameFile reads the overlay path recorded in the name file of the file
+// with the given hashes.
+func (f *Fs) readNameFile(ctx context.Context, dirHash, fileHash string) (string, error) {
+	n, err := f.readNameAttributes(ctx, dirHash, fileHash)
+	return n.path, err
+}
+
+// readNameAttributes reads the name file of the file with the given hashes,
+// including the attributes recorded with name_file_attributes.
+func (f *Fs) readNameAttributes(ctx context.Context, dirHash, fileHash string) (nameFile, error) {
+	in, err := f.openMeta(ctx, f.fileKey(path.Join(dirHash, fileHash), nameLeaf))
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return nameFile{}, nameFileMissingError{err: err}
+	}
+	if err != nil {
+		return nameFile{}, err
+	}
+	defer in.Close()
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return nameFile{}, fmt.Errorf("error reading name file: %w", err)
+	}
+	return parseNameFile(content), nil
+}
+
+// repairNameFile rewrites the name file of the file with the given hashes if
+// it is missing or does not record overlayPath. It returns whether the name
+// file was rewritten.
+func (f *Fs) repairNameFile(ctx context.Context, dirHash, fileHash, overlayPath string) (bool, error) {
+	recorded, err := f.readNameAttributes(ctx, dirHash, fileHash)
+	switch {
+	case err == nil && recorded.path == overlayPath:
+		return false, nil
+	case err != nil && !errors.Is(err, fs.ErrorObjectNotFound):
+		return false, err
+	}
+	// Keep the attributes of a name file recording another path.
+	n := nameFile{path: overlayPath, size: -1}
+	if err == nil {
+		n = recorded
+		n.path = overlayPath
+	}
+	if err := f.writeNameFile(ctx, nil, dirHash, fileHash, n); err != nil {
+		return false, fmt.Errorf("error repairing name file: %w", err)
+	}
+	fs.Infof(overlayPath, "repaired name file %q", f.fileKey(path.Join(dirHash, fileHash), nameLeaf))
+	return true, nil
+}
+
+// putNameFile writes the name file recording overlayPath in the hash
+// directory of the file. With name_file_attributes the size, modification
+// time and checksums of src are recorded as well, with store_mod_times the
+// modification time.
+func (f *Fs) putNameFile(ctx context.Context, src fs.ObjectInfo, dirHash, fileHash, overlayPath string) error {
+	n := nameFile{path: overlayPath, size: -1}
+	if f.opt.StoreModTimes && src != nil {
+		n.modTime = src.ModTime(ctx)
+	}
+	if f.opt.NameFileAttributes && src != nil {
+		n.size = src.Size()
+		n.modTime = src.ModTime(ctx)
+		for _, ht := range f.base.Hashes().Array() {
+			if sum, err := src.Hash(ctx, ht); err == nil && sum != "" {
+				if n.hashes == nil {
+					n.hashes = make(map[hash.Type]string)
+				}
+				n.hashes[ht] = sum
+			}
+		}
+	}
+	return f.writeNameFile(ctx, src, dirHash, fileHash, n)
+}
+
+// writeNameFile writes the name file n in the hash directory of the file.
+func (f *Fs) writeNameFile(ctx context.Context, src fs.ObjectInfo, dirHash, fileHash string, n nameFile) error {
+	content := f.nameFileContent(n)
 	nameSrc := fakeObjInfo{
 		objInfo: src,
-		remote:  path.Join(dirHash, fileHash, "name"),
+		remote:  f.fileKey(path.Join(dirHash, fileHash), nameLeaf),
 		fs:      f,
-		size:    int64(len(destOverlay) + 1),
+		size:    int64(len(content)),
+		meta:    true,
 	}
-	_, err = f.base.Put(ctx, strings.NewReader(destOverlay+"\n"), nameSrc)
+	metrics.nameFileWrites.WithLabelValues(f.name).Inc()
+	obj, err := f.putMeta(ctx, bytes.NewReader(content), nameSrc)
 	if err != nil {
-		return fmt.Errorf("error creating name file: %w", err)
+		return err
+	}
+	f.noteWrite(nameSrc.remote)
+	count(ctx, statNameFiles, 1)
+	count(ctx, statMetadataBytes, nameSrc.size)
+	if err := f.verifyWrite(ctx, obj, content); err != nil {
+		return err
 	}
+	f.mirrorObject(nameSrc.remote)
 	return nil
 }
 
 var (
 	_ fs.FullObject = object{}
 	_ fs.ObjectInfo = fakeObjInfo{}
+	_ fs.MimeTyper  = fakeObjInfo{}
+	_ fs.GetTierer  = fakeObjInfo{}
 )
 
 // object is an implementation of DirEntry that represents an object.
@@ -265,7 +745,8 @@ type object struct {
 	basePath string
 	// fs is the Fs that created the object.
 	fs *Fs
-	// dirEntry is the directory that the object belongs to.
+	// dirEntry is the directory that the object belongs to. It is nil for
+	// objects in lost+found.
 	dirEntry *dirEntry
 }
 
@@ -279,8 +760,14 @@ func (o object) Remote() string {
 	return o.path
 }
 
-// ModTime returns the modification time as reported by the base object.
+// ModTime returns the modification time as reported by the base object, or
+// as recorded in the name file with store_mod_times.
 func (o object) ModTime(ctx context.Context) time.Time {
+	if o.fs.opt.StoreModTimes {
+		if t, ok := o.fs.recordedModTime(ctx, o.basePath); ok {
+			return t
+		}
+	}
 	return o.obj.ModTime(ctx)
 }
 
@@ -314,14 +801,23 @@ func (o object) Storable() bool {
 	return o.obj.Storable()
 }
 
-// SetModTime sets the modification time of the base object.
-func (o object) SetModTime(ctx context.Context, t time.Time) error {
-	return o.obj.SetModTime(ctx, t)
+// SetModTime sets the modification time of the base object. With
+// store_mod_times it is recorded in the name file instead.
+func (o object) SetModTime(ctx context.Context, t time.Time) (err error) {
+	defer func() { err = annotate(o.path, err) }()
+	if !o.fs.opt.StoreModTimes {
+		return o.obj.SetModTime(ctx, t)
+	}
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	return o.fs.recordModTime(ctx, o.basePath, path.Join(o.fs.root, o.path), t)
 }
 
 // Open opens the file for read.  Call Close() on the returned io.ReadCloser
 func (o object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
-	return o.obj.Open(ctx, options...)
+	in, err := o.obj.Open(ctx, options...)
+	return in, annotate(o.path, err)
 }
 
 // Update in to the object with the modTime given of the given size
@@ -330,21 +826,66 @@ func (o object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadClos
 // But for unknown-sized objects (indicated by src.Size() == -1), Upload should
 // either return an error or update the object properly (rather than e.g.
 // calling panic).
-func (o object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
-	return o.obj.Update(ctx, in, src, options...)
+func (o object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (err error) {
+	defer func() { err = annotate(o.path, err) }()
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if err := o.obj.Update(ctx, in, src, options...); err != nil {
+		return o.fs.checkHalt(err)
+	}
+	o.fs.noteWrite(o.obj.Remote())
+	dirHash, fileHash := path.Split(o.basePath)
+	overlay := path.Join(o.fs.root, o.path)
+	switch {
+	case o.fs.opt.NameFileAttributes || o.fs.opt.StoreModTimes:
+		// Record the attributes of the new content.
+		if err := o.fs.putNameFile(ctx, src, path.Clean(dirHash), fileHash, overlay); err != nil {
+			fs.Errorf(o, "failed to update name file: %v", err)
+		}
+	case o.fs.opt.RepairNameFiles:
+		if _, err := o.fs.repairNameFile(ctx, path.Clean(dirHash), fileHash, overlay); err != nil {
+			fs.Errorf(o, "failed to repair name file: %v", err)
+		}
+	}
+	return nil
 }
 
 // Remove removes the object and metadata associated with it.
-func (o object) Remove(ctx context.Context) error {
-	err := operations.Purge(ctx, o.fs.base, o.basePath)
-	if err != nil {
+func (o object) Remove(ctx context.Context) (err error) {
+	defer func() { err = annotate(o.path, err) }()
+	if err := o.fs.checkWritable(); err != nil {
 		return err
 	}
+	if err := o.fs.purgeFile(ctx, o.basePath); err != nil {
+		return err
+	}
+	if o.dirEntry == nil {
+		// The object is in lost+found and not part of any map file.
+		return nil
+	}
 	base := path.Base(o.path)
 	if err := o.dirEntry.removeFile(ctx, base); err != nil {
 		return err
 	}
-	return o.dirEntry.write(ctx)
+	var cancelled error
+	if window := time.Duration(o.fs.opt.RemoveBatchWindow); window > 0 {
+		// Wait for the other removals of a burst so the map file is written
+		// once for all of them.
+		select {
+		case <-time.After(window):
+		case <-ctx.Done():
+			// The file is already gone from the base, so the map file is
+			// still written before the cancellation is returned.
+			cancelled = ctx.Err()
+			ctx = context.Background()
+		}
+	}
+	if err := o.dirEntry.write(ctx); err != nil {
+		return err
+	}
+	o.fs.notifyChangeRel(opRemove, o.path, "")
+	return cancelled
 }
 
 // UnWrap returns the "data" file of the Object.
@@ -383,6 +924,9 @@ type fakeObjInfo struct {
 	remote  string
 	fs      *Fs
 	size    int64
+	// meta is set for the metadata objects of a file, which take the tier
+	// but not the content type of the file.
+	meta bool
 }
 
 // String returns the string representation of the object info.
@@ -412,10 +956,10 @@ func (f fakeObjInfo) ModTime(ctx context.Context) time.Time {
 	return f.objInfo.ModTime(ctx)
 }
 
-// Size returns the faked size if it is set (non-zero) and the base object's
-// size otherwise.
+// Size returns the faked size if it is set (non-zero) or there is no base
+// object info and the base object's size otherwise.
 func (f fakeObjInfo) Size() int64 {
-	if f.size != 0 {
+	if f.size != 0 || f.objInfo == nil {
 		return f.size
 	}
 	return f.objInfo.Size()
@@ -436,3 +980,22 @@ func (f fakeObjInfo) Storable() bool {
 	}
 	return f.objInfo.Storable()
 }
+
+// MimeType returns the content type of the base object info, which is
+// detected from its name if it doesn't know it, so data objects are stored
+// with the content type of the file. It returns "" for metadata objects.
+func (f fakeObjInfo) MimeType(ctx context.Context) string {
+	if f.objInfo == nil || f.meta {
+		return ""
+	}
+	return fs.MimeType(ctx, f.objInfo)
+}
+
+// GetTier returns the storage tier of the base object info, so the objects
+// of a file are stored in the same tier, or "" if it is not known.
+func (f fakeObjInfo) GetTier() string {
+	if getTierer, ok := f.objInfo.(fs.GetTierer); ok {
+		return getTierer.GetTier()
+	}
+	return ""
+}
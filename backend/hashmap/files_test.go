@@ -0,0 +1,69 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	fsobject "github.com/rclone/rclone/fs/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReader returns a reader failing after the first bytes.
+func failingReader() io.Reader {
+	return io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("boom")))
+}
+
+func TestPutFailureRemovesNameFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, nil)
+	require.NoError(t, f.Mkdir(ctx, "a"))
+
+	src := fsobject.NewStaticObjectInfo("a/new.txt", time.Now(), -1, true, nil, nil)
+	_, err := f.Put(ctx, failingReader(), src)
+	require.Error(t, err)
+	entry, fileHash, ok := f.toHash("a/new.txt")
+	require.True(t, ok)
+	assert.NoDirExists(t, filepath.Join(dir, entry.Hash, fileHash))
+	_, err = f.NewObject(ctx, "a/new.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	// The name file of a file which is replaced is kept.
+	putTestFile(t, f, "a/old.txt", "hello")
+	src = fsobject.NewStaticObjectInfo("a/old.txt", time.Now(), -1, true, nil, nil)
+	_, err = f.Put(ctx, failingReader(), src)
+	require.Error(t, err)
+	entry, fileHash, ok = f.toHash("a/old.txt")
+	require.True(t, ok)
+	name, err := f.readNameFile(ctx, entry.Hash, fileHash)
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(f.root, "a/old.txt"), name)
+}
+
+func TestRemoveCancelledWait(t *testing.T) {
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"remove_batch_window": "1h"})
+	obj := putTestFile(t, f, "a/file.txt", "hello")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	assert.ErrorIs(t, obj.Remove(ctx), context.Canceled)
+
+	// The removal is written to the map file anyway.
+	g := newTestFs(t, dir, nil)
+	entry, ok := g.dirMap.get("a")
+	require.True(t, ok)
+	files, err := entry.Files(context.Background())
+	require.NoError(t, err)
+	assert.NotContains(t, files, "file.txt")
+}
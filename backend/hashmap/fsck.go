@@ -0,0 +1,302 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Classes of problems found by the fsck command, which can be repaired
+// separately.
+const (
+	// fsckMissingData is a file in the map whose data object is missing.
+	fsckMissingData = "missing-data"
+	// fsckDangling is a file in the map whose file directory is missing
+	// altogether.
+	fsckDangling = "dangling"
+	// fsckOrphaned is a hash directory or file directory in the base which
+	// is not referenced by the maps.
+	fsckOrphaned = "orphaned"
+	// fsckNames is a name file which is missing or records another path
+	// than the map.
+	fsckNames = "names"
+)
+
+// fsckClasses are all classes of problems in the order they are checked.
+var fsckClasses = []string{fsckMissingData, fsckDangling, fsckOrphaned, fsckNames}
+
+// fsckFinding is a problem found by the fsck command.
+type fsckFinding struct {
+	// Class is the class of the problem.
+	Class string `json:"class"`
+	// Path is the overlay path concerned.
+	Path string `json:"path"`
+	// Base is the base path concerned.
+	Base string `json:"base"`
+	// Problem describes the problem.
+	Problem string `json:"problem"`
+	// Repaired is set if the problem was repaired.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// fsckReport is the result of the fsck command.
+type fsckReport struct {
+	// Dirs is the number of directories checked.
+	Dirs int `json:"dirs"`
+	// Findings are the problems found.
+	Findings []fsckFinding `json:"findings"`
+	// Repaired is the number of problems repaired.
+	Repaired int `json:"repaired"`
+}
+
+// parseFsckFix parses the comma separated classes of problems to repair.
+// "all" repairs all of them.
+func parseFsckFix(value string) (map[string]bool, error) {
+	fix := make(map[string]bool)
+	for _, class := range strings.Split(value, ",") {
+		class = strings.TrimSpace(class)
+		switch {
+		case class == "":
+		case class == "all":
+			for _, c := range fsckClasses {
+				fix[c] = true
+			}
+		case fsckKnown(class):
+			fix[class] = true
+		default:
+			return nil, fmt.Errorf("unknown class of problems %q, expecting one of %s or all", class, strings.Join(fsckClasses, ", "))
+		}
+	}
+	return fix, nil
+}
+
+// fsckKnown reports whether class is a class of problems of fsck.
+func fsckKnown(class string) bool {
+	for _, c := range fsckClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// fsck cross-verifies the directory map, the map files, the name files and
+// the data objects and repairs the classes of problems in fix.
+//
+// Unlike scrub it works on the in-memory state of the maps, so the repairs
+// are made through the same paths as the other operations.
+func (f *Fs) fsck(ctx context.Context, fix map[string]bool) (*fsckReport, error) {
+	if len(fix) > 0 {
+		if err := f.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	report := &fsckReport{}
+	entries := f.dirMap.sortedEntries()
+	p := newProgress(ctx, "fsck", len(entries))
+	defer p.finish()
+	add := func(finding fsckFinding) {
+		fs.Errorf(finding.Path, "fsck: %s (%s)", finding.Problem, finding.Base)
+		report.Findings = append(report.Findings, finding)
+		if finding.Repaired {
+			report.Repaired++
+			p.fix(finding.Path)
+		}
+	}
+	for _, entry := range entries {
+		err := f.fsckDir(ctx, entry, fix, add)
+		p.scan(entry.Path, err)
+		if err != nil {
+			return report, fmt.Errorf("error checking %q: %w", entry.Path, err)
+		}
+		report.Dirs++
+	}
+	// Hash directories which are not in the directory map.
+	lost, err := f.lostDirs(ctx)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return report, err
+	}
+	for _, dirHash := range lost {
+		add(fsckFinding{
+			Class:   fsckOrphaned,
+			Path:    path.Join(lostFoundDir, lostName(dirHash)),
+			Base:    dirHash,
+			Problem: "unreferenced hash directory",
+		})
+	}
+	if len(lost) > 0 && fix[fsckOrphaned] {
+		// The name files of the files in them tell their directories.
+		rebuilt, dMap, found, err := f.planRebuild(ctx)
+		if err != nil {
+			return report, err
+		}
+		if !f.skipBase(ctx, "rebuild directory map", "map") {
+			if err := f.applyRebuild(ctx, dMap, found); err != nil {
+				return report, err
+			}
+			fs.Infof(f, "fsck: added %d directories to the directory map", len(rebuilt.Added))
+			for i := len(report.Findings) - len(lost); i < len(report.Findings); i++ {
+				report.Findings[i].Repaired = true
+				report.Repaired++
+				p.fix(report.Findings[i].Path)
+			}
+		}
+	}
+	return report, nil
+}
+
+// fsckDir checks the map file of the directory entry against the file
+// directories, name files and data objects in its hash directory and
+// repairs the classes of problems in fix.
+func (f *Fs) fsckDir(ctx context.Context, entry *dirEntry, fix map[string]bool, add func(fsckFinding)) error {
+	files, types, err := f.readTypedFileMap(ctx, entry.Hash)
+	if err != nil {
+		add(fsckFinding{Class: fsckDangling, Path: entry.Path, Base: path.Join(entry.Hash, "map"), Problem: err.Error()})
+		return nil
+	}
+	dropEmpty(files, types)
+	baseEntries, err := f.base.List(ctx, entry.Hash)
+	if isDirMissing(err) {
+		// The base dropped the empty hash directory.
+		baseEntries, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	fileDirs := make(map[string]struct{})
+	for _, fileHash := range f.fileHashes(baseEntries) {
+		fileDirs[fileHash] = struct{}{}
+	}
+	// The hash directories of the children may be nested by the layout.
+	for _, child := range f.dirMap.children(entry) {
+		if path.Dir(child.Hash) == entry.Hash {
+			delete(fileDirs, path.Base(child.Hash))
+		}
+	}
+	var objects map[string]fs.Object
+	if len(fileDirs) > 0 {
+		objects, err = f.dataObjects(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+	changed := false
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fileHash := files[name]
+		overlay := path.Join(entry.Path, name)
+		basePath := path.Join(entry.Hash, fileHash)
+		finding := fsckFinding{Path: overlay, Base: basePath}
+		_, hasDir := fileDirs[fileHash]
+		delete(fileDirs, fileHash)
+		_, hasData := objects[fileHash]
+		switch {
+		case !hasDir:
+			finding.Class, finding.Problem = fsckDangling, "file directory missing"
+		case !hasData:
+			finding.Class, finding.Problem = fsckMissingData, "data object missing"
+		}
+		if finding.Class != "" {
+			if fix[finding.Class] && !f.skipBase(ctx, "remove "+name+" from map file", path.Join(entry.Hash, "map")) {
+				if err := entry.removeFile(ctx, name); err != nil {
+					return err
+				}
+				if hasDir {
+					if err := f.purgeFile(ctx, basePath); err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+						return err
+					}
+				}
+				changed = true
+				finding.Repaired = true
+				f.notifyChange(opRemove, overlay, "")
+			}
+			add(finding)
+			continue
+		}
+		recorded, err := f.readNameFile(ctx, entry.Hash, fileHash)
+		switch {
+		case errors.Is(err, fs.ErrorObjectNotFound):
+			finding.Problem = "name file missing"
+		case err != nil:
+			return err
+		case recorded != overlay:
+			finding.Problem = "name file mismatch: " + recorded
+		default:
+			continue
+		}
+		finding.Class = fsckNames
+		if fix[fsckNames] && !f.skipBase(ctx, "repair name file", f.fileKey(basePath, nameLeaf)) {
+			if _, err := f.repairNameFile(ctx, entry.Hash, fileHash, overlay); err != nil {
+				return err
+			}
+			finding.Repaired = true
+		}
+		add(finding)
+	}
+	unreferenced := make([]string, 0, len(fileDirs))
+	for fileHash := range fileDirs {
+		unreferenced = append(unreferenced, fileHash)
+	}
+	sort.Strings(unreferenced)
+	for _, fileHash := range unreferenced {
+		basePath := path.Join(entry.Hash, fileHash)
+		since, pending, err := f.pendingSince(ctx, entry.Hash, fileHash)
+		if err != nil {
+			return err
+		}
+		if pending && time.Since(since) <= pendingGrace {
+			// The upload is probably still in progress.
+			continue
+		}
+		finding := fsckFinding{Class: fsckOrphaned, Path: entry.Path, Base: basePath, Problem: "unreferenced file directory"}
+		if pending {
+			finding.Problem = "interrupted upload"
+		}
+		if !fix[fsckOrphaned] {
+			add(finding)
+			continue
+		}
+		// Files whose name file records a path in this directory are added
+		// to the map again, the left overs of interrupted uploads removed.
+		recorded, err := f.readNameFile(ctx, entry.Hash, fileHash)
+		if err != nil && !errors.Is(err, fs.ErrorObjectNotFound) {
+			return err
+		}
+		_, hasData := objects[fileHash]
+		name := path.Base(recorded)
+		_, recordedName := files[name]
+		switch {
+		case err == nil && hasData && !recordedName && path.Dir(recorded) == entry.Path:
+			if !f.skipBase(ctx, "add "+name+" to map file", path.Join(entry.Hash, "map")) {
+				if err := entry.addFile(ctx, name, fileHash); err != nil {
+					return err
+				}
+				changed = true
+				finding.Repaired = true
+				f.notifyChange(opPut, recorded, "")
+			}
+		case pending:
+			if !f.skipBase(ctx, "delete interrupted upload", basePath) {
+				if err := f.purgeFile(ctx, basePath); err != nil {
+					return err
+				}
+				finding.Repaired = true
+			}
+		}
+		add(finding)
+	}
+	if changed {
+		return entry.write(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// gcMinAge is the default minimum age of the unreferenced hash directories
+// and file directories deleted by the gc command.
+const gcMinAge = 24 * time.Hour
+
+// Kinds of the trees deleted by the gc command.
+const (
+	gcKindDir  = "hash directory"
+	gcKindFile = "file directory"
+)
+
+// gcItem is an unreferenced tree in the base found by the gc command.
+type gcItem struct {
+	// Kind is gcKindDir or gcKindFile.
+	Kind string `json:"kind"`
+	// Base is the path of the tree in the base.
+	Base string `json:"base"`
+	// Size is the total size of the objects in the tree.
+	Size int64 `json:"size"`
+	// ModTime is the modification time of the newest object in the tree.
+	ModTime time.Time `json:"modTime"`
+	// Deleted is set if the tree was deleted.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// gcReport is the result of the gc command.
+type gcReport struct {
+	// Items are the unreferenced trees older than the minimum age.
+	Items []gcItem `json:"items"`
+	// Skipped is the number of unreferenced trees younger than the minimum
+	// age.
+	Skipped int `json:"skipped"`
+	// Freed is the total size of the trees deleted.
+	Freed int64 `json:"freed"`
+}
+
+// gc deletes the hash directories and file directories in the base which
+// no map references and whose newest object is older than minAge, e.g. the
+// left overs of failed uploads and interrupted purges. With --dry-run they
+// are only listed.
+func (f *Fs) gc(ctx context.Context, minAge time.Duration) (*gcReport, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	report := &gcReport{Items: make([]gcItem, 0)}
+	entries := f.dirMap.sortedEntries()
+	p := newProgress(ctx, "gc", len(entries))
+	defer p.finish()
+	collect := func(kind, basePath string, remove func() error) error {
+		size, modTime, err := f.treeStats(ctx, basePath, kind == gcKindFile)
+		if err != nil {
+			return err
+		}
+		if time.Since(modTime) < minAge {
+			report.Skipped++
+			return nil
+		}
+		item := gcItem{Kind: kind, Base: basePath, Size: size, ModTime: modTime}
+		if !f.skipBase(ctx, "delete unreferenced "+kind, basePath) {
+			if err := remove(); err != nil {
+				return f.checkHalt(err)
+			}
+			item.Deleted = true
+			report.Freed += size
+			p.fix(basePath)
+		}
+		report.Items = append(report.Items, item)
+		return nil
+	}
+	lost, err := f.lostDirs(ctx)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, err
+	}
+	sort.Strings(lost)
+	parent := ""
+	for _, dirHash := range lost {
+		if parent != "" && strings.HasPrefix(dirHash, parent+"/") {
+			// Nested in the tree of an unreferenced hash directory.
+			continue
+		}
+		if f.holdsHashDirs(dirHash) {
+			// The nested hash directories of referenced directories are
+			// kept along with it.
+			continue
+		}
+		parent = dirHash
+		dirHash := dirHash
+		err := collect(gcKindDir, dirHash, func() error {
+			err := operations.Purge(ctx, f.base, dirHash)
+			f.mirrorDir(dirHash)
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, entry := range entries {
+		unreferenced, err := f.unreferencedFiles(ctx, entry)
+		if err == nil {
+			for _, basePath := range unreferenced {
+				basePath := basePath
+				if err = collect(gcKindFile, basePath, func() error {
+					return f.purgeFile(ctx, basePath)
+				}); err != nil {
+					break
+				}
+			}
+		}
+		p.scan(entry.Path, err)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// holdsHashDirs reports whether the hash directories of directories in the
+// directory map are nested below dirHash.
+func (f *Fs) holdsHashDirs(dirHash string) bool {
+	for _, entry := range f.dirMap.entries() {
+		if strings.HasPrefix(entry.Hash, dirHash+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unreferencedFiles returns the file directories in the hash directory of
+// the directory entry which its map file does not reference, except the
+// ones of uploads which are probably still in progress.
+func (f *Fs) unreferencedFiles(ctx context.Context, entry *dirEntry) ([]string, error) {
+	files, err := f.readFileMap(ctx, entry.Hash)
+	if err != nil {
+		// The map file can't tell which files are referenced.
+		fs.Errorf(entry.Path, "gc: skipping directory with unreadable map file: %v", err)
+		return nil, nil
+	}
+	baseEntries, err := f.base.List(ctx, entry.Hash)
+	if isDirMissing(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]struct{}, len(files))
+	for _, fileHash := range files {
+		referenced[fileHash] = struct{}{}
+	}
+	// The hash directories of the children may be nested by the layout.
+	for _, child := range f.dirMap.children(entry) {
+		if path.Dir(child.Hash) == entry.Hash {
+			referenced[path.Base(child.Hash)] = struct{}{}
+		}
+	}
+	var unreferenced []string
+	for _, fileHash := range f.fileHashes(baseEntries) {
+		if _, ok := referenced[fileHash]; ok {
+			continue
+		}
+		since, pending, err := f.pendingSince(ctx, entry.Hash, fileHash)
+		if err != nil {
+			return nil, err
+		}
+		if pending && time.Since(since) <= pendingGrace {
+			// The upload is probably still in progress.
+			continue
+		}
+		unreferenced = append(unreferenced, path.Join(entry.Hash, fileHash))
+	}
+	sort.Strings(unreferenced)
+	return unreferenced, nil
+}
+
+// treeStats returns the total size and the modification time of the newest
+// object of the tree basePath in the base. If file is set, it is the file
+// directory of a file, which is only a prefix of its objects with joined
+// keys.
+func (f *Fs) treeStats(ctx context.Context, basePath string, file bool) (size int64, modTime time.Time, err error) {
+	add := func(o fs.Object) {
+		size += o.Size()
+		if t := o.ModTime(ctx); t.After(modTime) {
+			modTime = t
+		}
+	}
+	if file && f.joinedKeys() {
+		for _, leaf := range fileLeaves {
+			o, err := f.base.NewObject(ctx, f.fileKey(basePath, leaf))
+			if errors.Is(err, fs.ErrorObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+			add(o)
+		}
+		return size, modTime, nil
+	}
+	// The filters, e.g. --min-age, apply to the overlay and not to the
+	// objects of the base.
+	unfiltered, err := filter.NewFilter(nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	ctx = filter.ReplaceConfig(ctx, unfiltered)
+	err = walk.ListR(ctx, f.base, basePath, true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(add)
+		return nil
+	})
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		err = nil
+	}
+	return size, modTime, err
+}
@@ -0,0 +1,163 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// Classes of errors of the base after which no more writes are issued as
+// they would keep failing.
+const (
+	// failureQuota is the class of errors for an exceeded quota or a full
+	// disk.
+	failureQuota = "quota"
+	// failurePermission is the class of errors for revoked permissions.
+	failurePermission = "permission"
+)
+
+// statusCoder is implemented by the errors of the bases which carry the
+// HTTP status of the response, e.g. the ones of the AWS SDK.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// errHalted is returned by all operations modifying the overlay after the
+// base refused a write with a quota or permission error.
+var errHalted = errors.New("hashmap stopped writing after the base refused a write")
+
+// haltReport is the recovery summary of the Fs once it stopped writing.
+type haltReport struct {
+	// Class is the class of the error which stopped the writes.
+	Class string `json:"class"`
+	// Error is the error which stopped the writes.
+	Error string `json:"error"`
+	// Time is the time the writes were stopped.
+	Time time.Time `json:"time"`
+	// Flushed are the directories whose map file was written afterwards.
+	Flushed []string `json:"flushed"`
+	// Unflushed are the directories whose map file could not be written
+	// afterwards, so their files may differ from the map.
+	Unflushed []string `json:"unflushed"`
+	// QueuedRetries is the number of failed map writes queued for retry.
+	QueuedRetries int `json:"queuedRetries"`
+}
+
+// failureClass returns the class of err if the base refuses writes for the
+// foreseeable future, e.g. as the disk is full or the permissions were
+// revoked. It returns "" for all other errors.
+//
+// Only typed errors are classified, as the messages of the bases are too
+// ambiguous, e.g. rate limits are reported as exceeded quotas. Errors which
+// rclone would retry are never classified.
+func failureClass(err error) string {
+	if err == nil || fserrors.ShouldRetry(err) || fserrors.IsRetryError(err) {
+		return ""
+	}
+	if fserrors.IsErrNoSpace(err) {
+		return failureQuota
+	}
+	if errors.Is(err, fs.ErrorPermissionDenied) || errors.Is(err, os.ErrPermission) {
+		return failurePermission
+	}
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		switch sc.StatusCode() {
+		case http.StatusInsufficientStorage:
+			return failureQuota
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return failurePermission
+		}
+	}
+	return ""
+}
+
+// checkHalt stops all further writes if err is a write error of the base of
+// one of the failure classes, with halt_on_write_failure. It returns err.
+//
+// The map files with changes which are not written yet are flushed in the
+// background, as far as the base still accepts them, and a recovery summary
+// is logged for the following scrub.
+func (f *Fs) checkHalt(err error) error {
+	if !f.opt.HaltOnWriteFailure {
+		return err
+	}
+	class := failureClass(err)
+	if class == "" || !atomic.CompareAndSwapInt32(&f.halted, 0, 1) {
+		return err
+	}
+	report := &haltReport{
+		Class: class,
+		Error: err.Error(),
+		Time:  time.Now(),
+	}
+	fs.Errorf(f, "The base refused a write with a %s error, no more writes are issued: %v", class, err)
+	f.haltWG.Add(1)
+	go func() {
+		defer f.haltWG.Done()
+		f.flushAfterHalt(context.Background(), report)
+	}()
+	return err
+}
+
+// flushAfterHalt writes the map files with changes which are not written
+// yet and logs the recovery summary.
+func (f *Fs) flushAfterHalt(ctx context.Context, report *haltReport) {
+	var dirty []*dirEntry
+	for _, entry := range f.dirMap.entries() {
+		entry.mu.Lock()
+		if entry.files != nil && entry.requested > entry.written {
+			dirty = append(dirty, entry)
+		}
+		entry.mu.Unlock()
+	}
+	for _, entry := range dirty {
+		if err := entry.write(ctx); err != nil {
+			fs.Errorf(entry.Path, "failed to flush map file after stopping writes: %v", err)
+			report.Unflushed = append(report.Unflushed, entry.Path)
+			continue
+		}
+		report.Flushed = append(report.Flushed, entry.Path)
+	}
+	if err := f.dirMap.write(ctx); err != nil {
+		fs.Errorf(f, "failed to flush directory map after stopping writes: %v", err)
+	}
+	if q := f.retries; q != nil {
+		q.mu.Lock()
+		report.QueuedRetries = len(q.writes)
+		q.mu.Unlock()
+	}
+	sort.Strings(report.Flushed)
+	sort.Strings(report.Unflushed)
+	f.haltMu.Lock()
+	f.haltReport = report
+	f.haltMu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Stopped writing after a %s error at %s: %s\n", report.Class, report.Time.Format(time.RFC3339), report.Error)
+	fmt.Fprintf(&b, "Flushed %d map files, %d map writes are queued for retry\n", len(report.Flushed), report.QueuedRetries)
+	if len(report.Unflushed) > 0 {
+		fmt.Fprintf(&b, "The map files of these directories could not be written and may not match their files:\n")
+		for _, dir := range report.Unflushed {
+			fmt.Fprintf(&b, "  %q\n", dir)
+		}
+	}
+	b.WriteString(`Once the base accepts writes again, run "rclone backend scrub" and "rclone backend orphans" to find the files whose data and map diverged`)
+	fs.Errorf(f, "%s", b.String())
+}
+
+// halt returns the recovery summary if the Fs stopped writing and the map
+// files were flushed, or nil.
+func (f *Fs) halt() *haltReport {
+	f.haltMu.Lock()
+	defer f.haltMu.Unlock()
+	return f.haltReport
+}
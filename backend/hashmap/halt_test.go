@@ -0,0 +1,71 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusError is an error carrying an HTTP status.
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e statusError) StatusCode() int {
+	return int(e)
+}
+
+func TestFailureClass(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{errors.New("boom"), ""},
+		{errors.New("Quota exceeded for quota metric"), ""},
+		{errors.New("permission denied"), ""},
+		{fs.ErrorPermissionDenied, failurePermission},
+		{fmt.Errorf("upload: %w", os.ErrPermission), failurePermission},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, failureQuota},
+		{statusError(http.StatusInsufficientStorage), failureQuota},
+		{fmt.Errorf("upload: %w", statusError(http.StatusForbidden)), failurePermission},
+		{statusError(http.StatusUnauthorized), failurePermission},
+		{statusError(http.StatusNotFound), ""},
+		{fserrors.RetryError(statusError(http.StatusForbidden)), ""},
+	} {
+		assert.Equal(t, test.want, failureClass(test.err), fmt.Sprintf("%v", test.err))
+	}
+}
+
+func TestCheckHalt(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, t.TempDir(), nil)
+	assert.Equal(t, fs.ErrorPermissionDenied, f.checkHalt(fs.ErrorPermissionDenied))
+	assert.NoError(t, f.checkWritable(), "halt_on_write_failure is off by default")
+
+	f = newTestFs(t, t.TempDir(), configmap.Simple{"halt_on_write_failure": "true"})
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	putTestFile(t, f, "a/b.txt", "hello")
+	f.checkHalt(errors.New("quota exceeded"))
+	assert.NoError(t, f.checkWritable())
+	f.checkHalt(fs.ErrorPermissionDenied)
+	assert.Equal(t, errHalted, f.checkWritable())
+	assert.ErrorIs(t, f.Mkdir(ctx, "c"), errHalted)
+	f.haltWG.Wait()
+	report := f.halt()
+	require.NotNil(t, report)
+	assert.Equal(t, failurePermission, report.Class)
+	assert.Empty(t, report.Unflushed)
+}
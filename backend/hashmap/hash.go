@@ -7,8 +7,22 @@ import (
 	"encoding/hex"
 	"path"
 	"strings"
+
+	"github.com/rclone/rclone/fs"
 )
 
+// hashTypes are the supported hash types, in the order they are tried when
+// detecting the hash type of a map entry.
+var hashTypes = []string{"md5", "sha1", "sha256", "none"}
+
+// hashers maps the hash types to their hash functions.
+var hashers = map[string]func(string) string{
+	"none":   hashNone,
+	"md5":    hashMD5,
+	"sha1":   hashSHA1,
+	"sha256": hashSHA256,
+}
+
 func hashNone(a string) string {
 	return a
 }
@@ -28,14 +42,73 @@ func hashSHA256(s string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// fileHashType returns the hash type the hash of the file with the given
+// name in the absolute overlay directory dir was created with. The hash type
+// of the Fs is tried first.
+func (f *Fs) fileHashType(dir, name, hash string) (string, bool) {
+	if f.fileHash(dir, name) == hash {
+		return f.opt.HashType, true
+	}
+	for _, ht := range hashTypes {
+		if ht != f.opt.HashType && f.fileHashWith(hashers[ht], dir, name) == hash {
+			return ht, true
+		}
+	}
+	return "", false
+}
+
+// dirHashType returns the hash type the hash directory dirHash of the
+// absolute overlay directory dir was created with. The hash type of the Fs
+// is tried first.
+func (f *Fs) dirHashType(dir, dirHash string) (string, bool) {
+	if f.dirBase(dir) == dirHash {
+		return f.opt.HashType, true
+	}
+	for _, ht := range hashTypes {
+		if ht != f.opt.HashType && f.dirBaseWith(hashers[ht], dir) == dirHash {
+			return ht, true
+		}
+	}
+	return "", false
+}
+
+// trace logs a mapping decision if the trace option is set.
+func (f *Fs) trace(format string, args ...interface{}) {
+	if f.opt.Trace {
+		fs.Debugf(f, "trace: "+format, args...)
+	}
+}
+
+// fold returns the case folded form of the overlay path p if
+// case_insensitive is set and p otherwise.
+func (f *Fs) fold(p string) string {
+	if f.opt.CaseInsensitive {
+		return strings.ToLower(p)
+	}
+	return p
+}
+
+// findDir looks up the directory entry of the absolute overlay path dir.
+func (f *Fs) findDir(dir string) (*dirEntry, bool) {
+	dir = f.normalize(dir)
+	entry, ok := f.dirMap.lookup(dir)
+	if ok {
+		f.trace("dir %q -> %q", dir, entry.Hash)
+	} else {
+		f.trace("dir %q -> not in map", dir)
+	}
+	return entry, ok
+}
+
 // toHash converts the provided remote to directory hash and file hash.
 // It treats remote as relative to the root of the hashmap.
 func (f *Fs) toHash(remote string) (*dirEntry, string, bool) {
-	parent, base := path.Split(remote)
+	parent, base := path.Split(f.normalize(remote))
 	parent = strings.TrimSuffix(parent, "/")
 	parent = path.Join(f.root, parent)
-	fileHash := f.hasher(base)
-	entry, ok := f.dirMap.Path[parent]
+	fileHash := f.fileHash(parent, base)
+	f.trace("file %q: parent %q, name %q -> %q", remote, parent, base, fileHash)
+	entry, ok := f.findDir(parent)
 	if !ok {
 		return nil, fileHash, false
 	}
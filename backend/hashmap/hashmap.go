@@ -8,6 +8,7 @@ import (
 	"io"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rclone/rclone/fs"
@@ -15,6 +16,7 @@ import (
 	"github.com/rclone/rclone/fs/config/configmap"
 	"github.com/rclone/rclone/fs/config/configstruct"
 	"github.com/rclone/rclone/fs/hash"
+	"golang.org/x/time/rate"
 )
 
 func init() {
@@ -22,6 +24,8 @@ func init() {
 		Name:        "hashmap",
 		Description: "Transparently hash file names",
 		NewFs:       NewFs,
+		Config:      configure,
+		CommandHelp: commandHelp,
 		Options: []fs.Option{{
 			Name:     "remote",
 			Required: true,
@@ -35,7 +39,12 @@ Normally should contain a ':' and a path, e.g. "myremote:path/to/dir",
 			Default:  "md5",
 			Help: `Choose how hasher hashes filenames.
 
-All modes but "none" require metadata.`,
+All modes but "none" require metadata.
+
+The hash type can be changed on an existing overlay. Files and directories
+created with the previous hash type stay where they are and the hash type of
+their entries is recorded in the map files, so both can be mixed during a
+migration. Overwritten files are stored with the new hash type.`,
 			Examples: []fs.OptionExample{{
 				Value: "md5",
 			}, {
@@ -48,6 +57,657 @@ All modes but "none" require metadata.`,
 				Value: "sha256",
 				Help:  `SHA256 for hashes.`,
 			}},
+		}, {
+			Name:     "layout",
+			Advanced: true,
+			Default:  "",
+			Help: `Layout of the hash directories in the base.
+
+The layout is recorded in the base when the overlay is created and detected
+automatically afterwards, so this only needs to be set when creating a new
+overlay. Leave empty to use the recorded layout, or "flat" for a new overlay.`,
+			Examples: []fs.OptionExample{{
+				Value: "flat",
+				Help:  `Every directory is a hash directory at the root of the base.`,
+			}, {
+				Value: "sharded",
+				Help:  `Hash directories are grouped by the first two characters of the hash.`,
+			}, {
+				Value: "mirrored",
+				Help:  `Hash directories are nested like the directories, hashing each path segment.`,
+			}, {
+				Value: "salted",
+				Help:  `Like mirrored, but names are salted with their parent so equal names hash differently.`,
+			}},
+		}, {
+			Name:     "key_separator",
+			Advanced: true,
+			Default:  "",
+			Help: `Separator between the hash of a file and the names of its objects.
+
+With "/", every file has a directory in the hash directory of its parent
+holding its "name" and "data" objects. Any other separator, e.g. ".", stores
+them as single keys like "<filehash>.data" in the hash directory instead,
+which saves a level of directories on bases without real directories or
+which penalize deep keys.
+
+Like the layout, the separator is recorded in the base when the overlay is
+created. Leave empty to use the recorded separator, or "/" for a new
+overlay.`,
+			Examples: []fs.OptionExample{{
+				Value: "/",
+				Help:  `Every file has a directory holding its objects.`,
+			}, {
+				Value: ".",
+				Help:  `The objects of a file are keys like "<filehash>.data".`,
+			}},
+		}, {
+			Name:     "case_insensitive",
+			Advanced: true,
+			Default:  false,
+			Help: `Treat names which only differ in case as the same.
+
+If set, paths are case folded before they are hashed and looked up, so the
+overlay behaves like a case insensitive file system, e.g. Windows or SMB,
+while keeping the case of the names as they were created.
+
+This changes the location of names containing upper case characters in
+the base, so it must not be changed for an existing overlay.`,
+		}, {
+			Name:     "normalize_paths",
+			Advanced: true,
+			Default:  normalizeOff,
+			Help: `Normalize paths written by Windows clients.
+
+Paths using backslashes as separators or starting with a drive letter hash
+differently than their canonical form, so the same file may end up mapped
+twice. If set, paths are normalized before they are hashed, looked up and
+recorded in the map.
+
+Like case_insensitive this changes the location of the affected names in
+the base, so it should be set when creating the overlay.`,
+			Examples: []fs.OptionExample{{
+				Value: normalizeOff,
+				Help:  `Use the paths as they are.`,
+			}, {
+				Value: normalizeSeparators,
+				Help:  `Turn backslashes into slashes and remove drive letter prefixes.`,
+			}, {
+				Value: normalizeWindows,
+				Help:  `Also trim the trailing dots and spaces Windows ignores from every path segment.`,
+			}},
+		}, {
+			Name:     "unmapped_objects",
+			Advanced: true,
+			Default:  unmappedIgnore,
+			Help: `What to do with base objects which are not in the map.
+
+Objects may exist at a hashed location in the base which the map file of
+the directory doesn't know about, e.g. after restoring the base from a
+backup. They are found when listing their directory or looking them up.
+
+Likewise, the hash directory of a directory which is not in the directory
+map, e.g. after the directory map was partially lost, is found when the
+directory or a file in it is looked up. It is adopted if it has a map file
+or its name files record paths in that directory.`,
+			Examples: []fs.OptionExample{{
+				Value: unmappedIgnore,
+				Help:  `Leave the objects unreachable.`,
+			}, {
+				Value: unmappedWarn,
+				Help:  `Log the objects but leave them unreachable.`,
+			}, {
+				Value: unmappedAdopt,
+				Help:  `Add the objects to the map using their name file.`,
+			}},
+		}, {
+			Name:     "missing_data",
+			Advanced: true,
+			Default:  missingWarn,
+			Help: `What to do with files in the map whose data object is missing.
+
+The data object of a file may be gone from the base while the file is still
+in the map, e.g. after it was deleted directly in the base or its upload
+was interrupted. Such files are found when listing their directory or
+looking them up.`,
+			Examples: []fs.OptionExample{{
+				Value: missingWarn,
+				Help:  `Drop the files from listings with a warning.`,
+			}, {
+				Value: missingError,
+				Help:  `Fail the listings of directories containing such files.`,
+			}, {
+				Value: missingClean,
+				Help:  `Remove the files from the map together with their name file.`,
+			}},
+		}, {
+			Name:     "map_retry_interval",
+			Advanced: true,
+			Default:  fs.Duration(0),
+			Help: `Interval between retries of failed writes of map files.
+
+If set and writing a map file fails, e.g. because of rate limiting, the
+write is queued and retried in the background so the files just uploaded
+don't become unreachable. The queue is saved in the cache directory so it
+is replayed the next time the remote is used if rclone exits before the
+writes succeed. A queued write is dropped instead if the map file was
+changed since, e.g. by another client, so that change isn't lost.
+
+Note that the operation succeeds once its write is queued, although its
+change has not reached the base yet, so other clients don't see it until
+a retry succeeds. The queued writes are logged as errors, counted as
+hashmapQueuedWrites in the stats and reported as pending writes by
+hashmap/health.
+
+0 disables the retries, so the operation fails instead.`,
+		}, {
+			Name:     "max_map_failures",
+			Advanced: true,
+			Default:  10,
+			Help: `Number of consecutive failures to write the map before going read only.
+
+If writing the map fails repeatedly, e.g. because the quota is exceeded or
+the permissions were revoked, the remote refuses all modifications with an
+error instead of uploading data objects which would not be reachable. It
+becomes writable again as soon as a queued write of the map succeeds.
+
+Set to 0 to never go read only.`,
+		}, {
+			Name:     "halt_on_write_failure",
+			Advanced: true,
+			Default:  false,
+			Help: `Stop writing as soon as the base refuses a write for quota or permissions.
+
+If the base starts failing writes because the quota is exceeded, the disk is
+full or the permissions were revoked, e.g. partway through a sync, further
+uploads would only leave more data objects and map files out of step. If
+set, the remote refuses all modifications after the first such error,
+writes the map files with changes which are not written yet as far as the
+base accepts them and logs a recovery summary listing the directories to
+check with the scrub command.
+
+Only the errors the base reports as a full disk, a refused permission or
+the HTTP status 401, 403 or 507 count, and none which rclone would retry.
+
+The remote stays read only until it is restarted.`,
+		}, {
+			Name:     "pending_markers",
+			Advanced: true,
+			Default:  false,
+			Help: `Mark uploads in progress in the base.
+
+If set, a pending marker is written to the hash directory of a file before
+its data is uploaded and removed once the file is recorded in the map. The
+scrub command can then tell interrupted uploads apart from corruption and
+remove them with -o clean.
+
+This costs two more requests to the base per uploaded file.`,
+		}, {
+			Name:     "map_history",
+			Advanced: true,
+			Default:  0,
+			Help: `Number of previous versions of the directory map to keep.
+
+Every write of the directory map is recorded as a new generation. The
+previous versions can be listed and restored with the "map-versions" and
+"map-restore" backend commands.
+
+The versions are copies of the directory map kept next to it in the base.
+The object versioning of the base, e.g. of a versioned S3 or GCS bucket,
+is not used, as rclone has no way to read the versions of an object on
+all bases. So the history works with all bases, but each write of the
+directory map also writes its copy and the index of the versions,
+tripling the writes of the directory map.
+
+0 disables the history.`,
+		}, {
+			Name:     "map_history_max_age",
+			Advanced: true,
+			Default:  fs.Duration(0),
+			Help: `Maximum age of the previous versions of the directory map.
+
+Versions older than this are removed when the directory map is written or
+"rclone cleanup" is run, in addition to the versions exceeding map_history.
+The newest version is always kept, so the directory map can be restored.
+
+0 keeps the versions regardless of their age.`,
+		}, {
+			Name:     "name_padding",
+			Advanced: true,
+			Default:  fs.SizeSuffix(0),
+			Help: `Pad name files to a multiple of this size.
+
+Name files normally have the size of the original path plus one, which
+leaks the length of the file names to anyone who can list the base.
+Setting this pads every name file to the next multiple of the given size.
+Setting it larger than any path in use makes all name files the same size.
+
+0 disables the padding.`,
+		}, {
+			Name:     "decoy_count",
+			Advanced: true,
+			Default:  0,
+			Help: `Number of decoy directories to keep in the base.
+
+Decoy directories are hash directories with plausible looking map files,
+name and data objects which are not part of the overlay. They make it
+harder to infer the real number of files and the directory structure from
+the layout of the base. They are listed in the map file of another such
+directory. Missing decoys are created when the remote is opened, or with
+the "decoys" backend command.
+
+0 disables the generation of decoys.`,
+		}, {
+			Name:     "metadata_tps",
+			Advanced: true,
+			Default:  0.0,
+			Help: `Limit the transactions per second for internal metadata.
+
+Every file written through the overlay causes several requests to the base
+besides the upload of the data (directories, name files and map files).
+This limits only those metadata requests, leaving data transfers alone.
+
+The global --tpslimit applies to all requests to the base as usual.
+
+0 disables the limit.`,
+		}, {
+			Name:     "metadata_bwlimit",
+			Advanced: true,
+			Default:  fs.SizeSuffix(-1),
+			Help: `Bandwidth limit for internal metadata in bytes/s.
+
+The name files, map files and the directory map are read and written as a
+class of their own: they are not counted against the --bwlimit applied to
+the transfers by rclone, so small metadata uploads don't wait behind large
+files and the map is published without delay. This sets a separate limit
+for them instead.
+
+With bases using HTTP connections, the limit of --bwlimit on the
+connections themselves still applies to all requests.
+
+"off" leaves the metadata unlimited.`,
+		}, {
+			Name:     "trace",
+			Advanced: true,
+			Default:  false,
+			Help: `Log every translation of an overlay path to a base path.
+
+This logs the hash inputs, the resulting hashes and whether the map files
+were served from memory at debug level (-vv), prefixed with "trace:". It
+helps to find out why a file which exists in the base cannot be found.`,
+		}, {
+			Name:     "coordinator_url",
+			Advanced: true,
+			Default:  "",
+			Help: `URL of a coordination service for concurrent writers.
+
+Object stores offer no locking, so concurrent writers on several hosts may
+overwrite each other's changes to the same map file. If set, every map file
+is only written while holding a lease on it from this HTTP service, which
+also records the generation of each map file so a write based on an
+outdated map fails instead of losing the other writer's changes. The lease
+is renewed while the map file is uploaded, and the upload is aborted if it
+can't be renewed.
+
+Failed map writes are not retried in the background with a coordinator.`,
+		}, {
+			Name:     "coordinator_namespace",
+			Advanced: true,
+			Default:  "",
+			Help: `Namespace of the overlay on the coordination service.
+
+All clients writing to the same overlay must use the same namespace. Leave
+empty to use the remote option, which only works if all clients configure
+the base the same way.`,
+		}, {
+			Name:     "webhook_url",
+			Advanced: true,
+			Default:  "",
+			Help: `URL to notify of changes to the map.
+
+Every change of the map, e.g. a file being uploaded, moved or removed or a
+directory being created, is posted to this URL as a JSON object like
+
+    {"path": "dir/file.txt", "src": "old/file.txt", "operation": "move",
+     "client": "host", "generation": 42, "time": "2006-01-02T15:04:05Z"}
+
+"generation" numbers the events sent by the client since it started.
+Events are delivered in the background in order and are dropped with an
+error if the webhook can't keep up or fails.`,
+		}, {
+			Name:     "metadata_mirror",
+			Advanced: true,
+			Default:  "",
+			Help: `Remote to mirror the metadata of the overlay to.
+
+The directory map, the map files and the name files are copied to this
+remote in the background after they change, with the same paths as in the
+base. Data objects are not copied. If the metadata in the base is lost, e.g.
+to a lifecycle rule or a mistaken delete, it can be copied back from the
+mirror with "rclone copy" to make the data reachable again.
+
+Changes made while the mirror can't be reached are logged and only copied
+when they change again.`,
+		}, {
+			Name:     "read_through",
+			Advanced: true,
+			Default:  readThroughOff,
+			Help: `Show the plain objects of the base next to the files of the overlay.
+
+This allows to put the overlay over a remote which already contains files
+without moving them first. Files of the overlay are looked up first and
+objects of the base at the same path are shown if there are none, e.g.
+"dir/file.txt" of the base is shown as "dir/file.txt" in the overlay.
+Files written are always stored in the overlay and replace the plain
+object.
+
+The hash directories and metadata of the overlay are never shown, so plain
+directories named like a hash directory are hidden.`,
+			Examples: []fs.OptionExample{{
+				Value: readThroughOff,
+				Help:  "Only show the files of the overlay.",
+			}, {
+				Value: readThroughRead,
+				Help:  "Also show the plain objects of the base.",
+			}, {
+				Value: readThroughMigrate,
+				Help:  "Also show the plain objects of the base and move them into the overlay\nwhen they are opened, using server-side moves.",
+			}},
+		}, {
+			Name:     "snapshot",
+			Advanced: true,
+			Default:  false,
+			Help: `Load all map files when the remote is opened and keep using them.
+
+By default the map file of a directory is loaded when the directory is first
+used, so a long running operation like "rclone sync" may see the changes
+made by other clients to some directories but not to others. With this set,
+the map files of all directories below the root of the remote are loaded up
+front and all listings and lookups are served from them, so the operation
+sees the overlay as it was when it started. Changes made by the operation
+itself are seen as usual.
+
+This can be set for a single operation with --hashmap-snapshot or in the
+connection string, e.g. "hashmap,snapshot:path".`,
+		}, {
+			Name:     "name_file_attributes",
+			Advanced: true,
+			Default:  false,
+			Help: `Record the size, modification time and checksums in the name files.
+
+If set, the name file of a file records the size, modification time and
+the checksums supported by the base of the file as written, in addition to
+its path. The name file is rewritten when the file is updated.
+
+When the directory map is rebuilt from the name files, files whose data
+object does not match the recorded size or checksums are skipped. The
+attributes follow the path in the name file, so they are ignored by
+versions which do not know them.`,
+		}, {
+			Name:     "store_mod_times",
+			Advanced: true,
+			Default:  false,
+			Help: `Record the modification times in the name files.
+
+Use this if the base can't set modification times, or only with a coarse
+precision. The modification time of a file is recorded in its name file
+when it is written and when it is set, and served from there in
+nanosecond precision instead of the one of the base.
+
+Reading the modification time of a file reads its name file, so this costs
+one request to the base per file whose modification time is used, e.g. by
+sync. Files written before this was set keep the modification time of
+their data object.`,
+		}, {
+			Name:     "verify_writes",
+			Advanced: true,
+			Default:  verifyOff,
+			Help: `Verify the name files and map files after writing them.
+
+Eventually consistent or flaky bases may accept a write and still not store
+it as written. If set, every name file and map file is checked after it was
+written and the write fails if it doesn't hold what was written, so it is
+retried like any other failed write.`,
+			Examples: []fs.OptionExample{{
+				Value: verifyOff,
+				Help:  `Trust the base to store what it accepted.`,
+			}, {
+				Value: verifyHash,
+				Help:  `Compare the size and checksum reported by the base, without extra requests.`,
+			}, {
+				Value: verifyRead,
+				Help:  `Read the written objects back and compare them, at the cost of one request each.`,
+			}},
+		}, {
+			Name:     "consistency_window",
+			Advanced: true,
+			Default:  fs.Duration(0),
+			Help: `How long objects may take to show up in the base after writing them.
+
+On eventually consistent bases, an object may not be found for a while after
+it was written, so rclone fails to verify a file it just uploaded. If set,
+looking up an object which was written less than this long ago is retried
+with backoff until it is found or the time passed. Lookups of other objects
+are not retried.`,
+		}, {
+			Name:     "recover_map",
+			Advanced: true,
+			Default:  false,
+			Help: `Salvage a malformed directory map instead of refusing to load it.
+
+The directory map is malformed if its last entry is truncated, an entry is
+invalid, a directory is listed twice or the hash of a directory does not
+match its path. Normally the overlay refuses to start then.
+
+If set, the entries before the first problem are used as the directory
+map and saved to "map.recovered" in the base. The directories after it
+are dropped from the directory map when it is written next, but their
+hash directories stay in the base, so they can be recovered with
+auto_rebuild or lost_and_found.`,
+		}, {
+			Name:     "cache_dir",
+			Advanced: true,
+			Default:  "",
+			Help: `Directory for the local state of the overlay.
+
+This is where the queue of map writes retried with map_retry_interval and
+the map files cached on disk with cache_disk_max_size are kept. Leave empty
+to use the "hashmap" directory in the rclone cache directory, see
+--cache-dir.`,
+		}, {
+			Name:     "cache_max_size",
+			Advanced: true,
+			Default:  fs.SizeSuffix(0),
+			Help: `Maximum size of the map files cached in memory.
+
+The map files of the directories are cached in memory once they are read.
+If set, the map files used least recently are dropped from the cache when
+their total size exceeds this, and read from the base again when they are
+used next. This bounds the memory used by mounts of large overlays at the
+cost of more reads of map files.
+
+The cache can be cleared with the cache-clear command. It can't be set
+together with snapshot.
+
+0 does not limit the cache.`,
+		}, {
+			Name:     "cache_disk_max_size",
+			Advanced: true,
+			Default:  fs.SizeSuffix(0),
+			Help: `Maximum size of the map files cached on local disk.
+
+If set, the map files read from or written to the base are also kept in
+cache_dir, so map files dropped from memory with cache_max_size, or read
+again by a later run, are not downloaded again. Before a copy is used, the
+map file in the base is looked up to check it did not change, e.g. by
+another client, so this saves the download but not the lookup. The copies
+used least recently are removed when their total size exceeds this.
+
+The cache can be cleared with the cache-clear command.
+
+0 does not cache the map files on disk.`,
+		}, {
+			Name:     "existence_index",
+			Advanced: true,
+			Default:  false,
+			Help: `Keep an index of the names of the map files dropped from the cache.
+
+With cache_max_size, looking up a file which does not exist, e.g. when sync
+probes the paths of the destination, reads the map file of its directory
+again once it was dropped from the cache. If set, a digest of every name
+in the map file is kept when it is dropped, about 8 bytes per file, so
+lookups of names which are definitely not in it are answered from memory.
+Like the cached map files, the index does not see files added by other
+clients until the cache is cleared with the cache-clear command.
+
+Has no effect without cache_max_size.`,
+		}, {
+			Name:     "remove_batch_window",
+			Advanced: true,
+			Default:  fs.Duration(0),
+			Help: `Time to wait before writing the map file after removing a file.
+
+Every removal of a file rewrites the map file of its directory. Removals
+which wait for the map file to be written at the same time are written
+together, so when many files are removed concurrently, e.g. by rclone
+delete or sync with --checkers, waiting a little longer lets more of them
+share a write. This saves requests at the cost of the latency of each
+removal.
+
+0 writes the map file right away.`,
+		}, {
+			Name:     "min_hash_strength",
+			Advanced: true,
+			Default:  strengthAny,
+			Help: `Minimum strength of the hashing of the names.
+
+The overlay refuses to start if its hash type and layout are weaker than
+this, e.g. to make sure a shared config never stores names in a form in
+which they can be read or guessed with little effort.`,
+			Examples: []fs.OptionExample{{
+				Value: strengthAny,
+				Help:  `Accept every hash type and layout.`,
+			}, {
+				Value: strengthHashed,
+				Help:  `Require the names to be hashed, i.e. reject hash type none.`,
+			}, {
+				Value: strengthCollisionResistant,
+				Help:  `Also reject md5 and sha1, which have practical collisions.`,
+			}, {
+				Value: strengthSalted,
+				Help:  `Also require the salted layout, so names can't be guessed with a single dictionary of hashes.`,
+			}},
+		}, {
+			Name:     "allow_weak_hashes",
+			Advanced: true,
+			Default:  false,
+			Help: `Only warn if the hashing is weaker than min_hash_strength.
+
+The hash type and layout of an existing overlay can't be changed without
+rewriting it, so this lets legacy overlays be used with a stricter
+min_hash_strength set for new ones.`,
+		}, {
+			Name:     "dir_move_merge",
+			Advanced: true,
+			Default:  false,
+			Help: `Merge moved directories into existing destination directories.
+
+Server-side moves of directories fail if the destination exists, so rclone
+moves the files one by one instead. With this set, the directories of the
+source which don't exist in the destination are still moved as a whole and
+the files of the others are moved server-side into the existing
+directories, replacing the files of the same name. The source directories
+are removed once they are empty.`,
+		}, {
+			Name:     "resumable_operations",
+			Advanced: true,
+			Default:  false,
+			Help: `Record the progress of purges and directory moves in the base.
+
+Purging or moving a huge tree takes one operation on the base per
+directory. With this set, the directories done are recorded in the
+map.operation object at the root of the base, so a run which was
+interrupted skips them when the same purge or move is run again, instead of
+failing on the directories which are already gone. The progress of an
+interrupted run is reported when the overlay is opened.`,
+		}, {
+			Name:     "empty_files_in_map",
+			Advanced: true,
+			Default:  false,
+			Help: `Store empty files in the map file only.
+
+Empty files are recorded in the map file of their directory with their
+modification time, without a file directory, name file or data object in
+the base. This saves the requests and objects of directories with many
+empty files, e.g. marker files. Once an empty file is written to, its
+objects are created as for any other file.
+
+As they have no name file, empty files stored this way are lost when the
+map is rebuilt from the name files. Versions which don't know the option
+can't read them.`,
+		}, {
+			Name:     "scrub_interval",
+			Advanced: true,
+			Default:  fs.Duration(0),
+			Help: `Interval of the background scrubber.
+
+If set, a part of the namespace is verified in the background at this
+interval: the map files are checked against the name files and data
+objects in the base, and inconsistencies are logged. The result of the
+last run can be seen with "rclone backend scrub hashmap: -o status".
+
+0 disables the background scrubber.`,
+		}, {
+			Name:     "scrub_batch",
+			Advanced: true,
+			Default:  100,
+			Help:     "Number of directories verified per run of the background scrubber.",
+		}, {
+			Name:     "repair_name_files",
+			Advanced: true,
+			Default:  false,
+			Help: `Repair missing or stale name files when they are encountered.
+
+If set, the name file of a file is checked after it is updated and
+rewritten from the map if it is missing or records a different path.
+The scrubber and the scrub command repair the name files they find to be
+missing or stale as well.`,
+		}, {
+			Name:     "auto_rebuild",
+			Advanced: true,
+			Default:  false,
+			Help: `Rebuild a missing directory map from the name files at startup.
+
+If the directory map is missing or empty but the base contains hash
+directories with name files, the directory map and the map files of the
+directories are reconstructed from the name files. Without this option
+only a warning is logged, and the remote appears empty.
+
+Directories which do not contain any files cannot be recovered.`,
+		}, {
+			Name:     "lost_and_found",
+			Advanced: true,
+			Default:  false,
+			Help: `Show hash directories missing from the map in "lost+found".
+
+Hash directories present in the base but absent from the directory map are
+normally invisible. If set, they are shown in a synthetic "lost+found"
+directory at the root of the overlay, as one directory per hash directory
+containing its files named after their name files. The files can be
+inspected, copied or moved out of lost+found to rescue them.
+
+Listing the root recursively in a single request (ListR) is disabled with
+this option.`,
+		}, {
+			Name:     "raw",
+			Advanced: true,
+			Default:  false,
+			Help: `Show the layout of the base read only instead of the overlay.
+
+If set, the remote shows the hash directories, name files, map files and
+data objects as they are stored in the base, without allowing any
+modification. This is most useful in a connection string to inspect or
+back up the base of an existing remote, e.g. "myhashmap,raw:".`,
 		}},
 	})
 }
@@ -61,9 +721,92 @@ type Fs struct {
 	// hasher is the function mapping the name of directories and files to the
 	// hashed version.
 	hasher func(string) string
+	// layout is the layout of the hash directories in the base.
+	layout string
+	// keySeparator separates the hash of a file from the names of its
+	// objects in the base.
+	keySeparator string
+	// layoutMarked is set once the layout marker exists in the base.
+	layoutMarked bool
 	// dirMap is the map containing information on the directory structure of
 	// the FS.
 	dirMap *dirMap
+	// historyMu protects history and serializes the writes of the history.
+	historyMu sync.Mutex
+	// history is the list of recorded versions of the directory map. It is
+	// nil until loaded from the base.
+	history []mapVersion
+	// decoysMu protects decoys and serializes the creation of decoys.
+	decoysMu sync.Mutex
+	// decoys is the set of hashes of decoy directories. It is nil until
+	// loaded from the base.
+	decoys map[string]struct{}
+	// metaLimiter limits the rate of metadata requests to the base. It is nil
+	// if there is no limit.
+	metaLimiter *rate.Limiter
+	// metaBandwidth limits the bandwidth used by metadata objects. It is nil
+	// if there is no limit.
+	metaBandwidth *rate.Limiter
+
+	// mapFailures is the number of consecutive failed writes of map files.
+	// It is accessed atomically.
+	mapFailures int32
+	// degraded is 1 if the overlay degraded to read only after too many
+	// failed writes of map files. It is accessed atomically.
+	degraded int32
+	// halted is 1 if the overlay stopped writing after a quota or
+	// permission error of the base. It is accessed atomically.
+	halted int32
+	// haltWG waits for the map files to be flushed after halting.
+	haltWG sync.WaitGroup
+	// haltMu protects haltReport.
+	haltMu sync.Mutex
+	// haltReport is the recovery summary once the map files were flushed
+	// after halting, or nil.
+	haltReport *haltReport
+	// lastMapWrite is the time of the last successful write of a map file
+	// in Unix nanoseconds, or 0. It is accessed atomically.
+	lastMapWrite int64
+	// cacheHits and cacheMisses count the uses of the cached map files. They
+	// are accessed atomically.
+	cacheHits   int64
+	cacheMisses int64
+	// indexMisses counts the lookups of files answered as missing by the
+	// existence index. It is accessed atomically.
+	indexMisses int64
+	// retries is the queue of failed map writes. It is nil if the writes
+	// are not retried.
+	retries *retryQueue
+	// coord is the client of the coordination service. It is nil if no
+	// coordinator is configured.
+	coord *coordinator
+	// events is the log of the recent change events.
+	events *eventLog
+	// hook delivers change events to the webhook. It is nil if no webhook
+	// is configured.
+	hook *webhook
+	// mirror copies the metadata to the metadata mirror. It is nil if no
+	// mirror is configured.
+	mirror *metaMirror
+	// mapCache bounds the size of the cached map files. It is nil if
+	// cache_max_size is not set.
+	mapCache *mapCache
+	// diskCache keeps copies of the map files on local disk. It is nil if
+	// cache_disk_max_size is not set.
+	diskCache *diskCache
+	// writesMu protects recentWrites.
+	writesMu sync.Mutex
+	// recentWrites are the times the objects of the base were written
+	// within consistency_window, by their path.
+	recentWrites map[string]time.Time
+
+	// scrubMu protects scrubStop and lastScrub.
+	scrubMu sync.Mutex
+	// scrubStop stops the background scrubber when closed. It is nil if the
+	// scrubber is not running.
+	scrubStop chan struct{}
+	// lastScrub is the report of the last run of the background scrubber.
+	lastScrub *scrubReport
 
 	// name is the name of the Fs as passed into NewFs.
 	name string
@@ -77,8 +820,52 @@ type Fs struct {
 
 // Options is the configuration for the backend.
 type Options struct {
-	Remote   string `config:"remote"`
-	HashType string `config:"hash_type"`
+	Remote               string        `config:"remote"`
+	HashType             string        `config:"hash_type"`
+	Layout               string        `config:"layout"`
+	KeySeparator         string        `config:"key_separator"`
+	CaseInsensitive      bool          `config:"case_insensitive"`
+	NormalizePaths       string        `config:"normalize_paths"`
+	UnmappedObjects      string        `config:"unmapped_objects"`
+	MissingData          string        `config:"missing_data"`
+	MapRetryInterval     fs.Duration   `config:"map_retry_interval"`
+	MaxMapFailures       int           `config:"max_map_failures"`
+	HaltOnWriteFailure   bool          `config:"halt_on_write_failure"`
+	PendingMarkers       bool          `config:"pending_markers"`
+	MapHistory           int           `config:"map_history"`
+	MapHistoryMaxAge     fs.Duration   `config:"map_history_max_age"`
+	NamePadding          fs.SizeSuffix `config:"name_padding"`
+	DecoyCount           int           `config:"decoy_count"`
+	MetadataTPS          float64       `config:"metadata_tps"`
+	MetadataBwLimit      fs.SizeSuffix `config:"metadata_bwlimit"`
+	Trace                bool          `config:"trace"`
+	ScrubInterval        fs.Duration   `config:"scrub_interval"`
+	ScrubBatch           int           `config:"scrub_batch"`
+	RepairNameFiles      bool          `config:"repair_name_files"`
+	AutoRebuild          bool          `config:"auto_rebuild"`
+	LostAndFound         bool          `config:"lost_and_found"`
+	CoordinatorURL       string        `config:"coordinator_url"`
+	CoordinatorNamespace string        `config:"coordinator_namespace"`
+	WebhookURL           string        `config:"webhook_url"`
+	MetadataMirror       string        `config:"metadata_mirror"`
+	ReadThrough          string        `config:"read_through"`
+	Snapshot             bool          `config:"snapshot"`
+	NameFileAttributes   bool          `config:"name_file_attributes"`
+	StoreModTimes        bool          `config:"store_mod_times"`
+	VerifyWrites         string        `config:"verify_writes"`
+	ConsistencyWindow    fs.Duration   `config:"consistency_window"`
+	RecoverMap           bool          `config:"recover_map"`
+	CacheDir             string        `config:"cache_dir"`
+	CacheMaxSize         fs.SizeSuffix `config:"cache_max_size"`
+	CacheDiskMaxSize     fs.SizeSuffix `config:"cache_disk_max_size"`
+	ExistenceIndex       bool          `config:"existence_index"`
+	RemoveBatchWindow    fs.Duration   `config:"remove_batch_window"`
+	MinHashStrength      string        `config:"min_hash_strength"`
+	AllowWeakHashes      bool          `config:"allow_weak_hashes"`
+	DirMoveMerge         bool          `config:"dir_move_merge"`
+	ResumableOperations  bool          `config:"resumable_operations"`
+	EmptyFilesInMap      bool          `config:"empty_files_in_map"`
+	Raw                  bool          `config:"raw"`
 }
 
 // NewFs constructs a hashmap.Fs with the provided configuration.
@@ -92,6 +879,9 @@ func NewFs(ctx context.Context, name, rpath string, m configmap.Mapper) (fs.Fs,
 	if strings.HasPrefix(opt.Remote, name+":") {
 		return nil, errors.New("can't point remote at itself - check the value of the remote setting")
 	}
+	if opt.Raw {
+		return newRawFs(ctx, name, rpath, opt)
+	}
 	baseFs, err := cache.Get(ctx, opt.Remote)
 	if err != fs.ErrorIsFile && err != nil {
 		return nil, fmt.Errorf("failed to make remote %q to wrap: %w", opt.Remote, err)
@@ -99,10 +889,25 @@ func NewFs(ctx context.Context, name, rpath string, m configmap.Mapper) (fs.Fs,
 
 	// Construct the actual FS.
 	f := &Fs{
-		base: baseFs,
-		opt:  *opt,
-		name: name,
-		root: rpath,
+		base:   baseFs,
+		opt:    *opt,
+		name:   name,
+		root:   rpath,
+		events: newEventLog(),
+	}
+	if opt.CacheMaxSize > 0 && opt.Snapshot {
+		return nil, errors.New("cache_max_size can't be used with snapshot")
+	}
+	f.mapCache = newMapCache(int64(opt.CacheMaxSize))
+	f.diskCache, err = newDiskCache(f.mapCacheDir(), int64(opt.CacheDiskMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if opt.MetadataTPS > 0 {
+		f.metaLimiter = rate.NewLimiter(rate.Limit(opt.MetadataTPS), 1)
+	}
+	if opt.MetadataBwLimit > 0 {
+		f.metaBandwidth = rate.NewLimiter(rate.Limit(opt.MetadataBwLimit), int(opt.MetadataBwLimit))
 	}
 	switch opt.HashType {
 	case "none":
@@ -116,6 +921,58 @@ func NewFs(ctx context.Context, name, rpath string, m configmap.Mapper) (fs.Fs,
 	default:
 		return nil, fmt.Errorf("unknown hash type %q", opt.HashType)
 	}
+	switch opt.Layout {
+	case "", layoutFlat, layoutSharded, layoutMirrored:
+	case layoutSalted:
+		if opt.HashType == "none" {
+			return nil, errors.New("the salted layout is not supported with hash type none")
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout %q", opt.Layout)
+	}
+	if err := checkKeySeparator(opt.KeySeparator); err != nil {
+		return nil, err
+	}
+	switch opt.ReadThrough {
+	case "":
+		f.opt.ReadThrough = readThroughOff
+	case readThroughOff:
+	case readThroughRead, readThroughMigrate:
+		if opt.HashType == "none" {
+			return nil, errors.New("read_through is not supported with hash type none")
+		}
+	default:
+		return nil, fmt.Errorf("unknown read through mode %q", opt.ReadThrough)
+	}
+	switch opt.NormalizePaths {
+	case "":
+		f.opt.NormalizePaths = normalizeOff
+	case normalizeOff, normalizeSeparators, normalizeWindows:
+	default:
+		return nil, fmt.Errorf("unknown path normalization %q", opt.NormalizePaths)
+	}
+	f.root = f.normalize(f.root)
+	switch opt.UnmappedObjects {
+	case "":
+		f.opt.UnmappedObjects = unmappedIgnore
+	case unmappedIgnore, unmappedWarn, unmappedAdopt:
+	default:
+		return nil, fmt.Errorf("unknown unmapped objects policy %q", opt.UnmappedObjects)
+	}
+	switch opt.VerifyWrites {
+	case "":
+		f.opt.VerifyWrites = verifyOff
+	case verifyOff, verifyHash, verifyRead:
+	default:
+		return nil, fmt.Errorf("unknown write verification mode %q", opt.VerifyWrites)
+	}
+	switch opt.MissingData {
+	case "":
+		f.opt.MissingData = missingWarn
+	case missingWarn, missingError, missingClean:
+	default:
+		return nil, fmt.Errorf("unknown missing data policy %q", opt.MissingData)
+	}
 
 	feat := &fs.Features{
 		CaseInsensitive:         false,
@@ -130,34 +987,155 @@ func NewFs(ctx context.Context, name, rpath string, m configmap.Mapper) (fs.Fs,
 	// We always create a map file so the base FS doesn't need to actually
 	// support empty directories.
 	feat.CanHaveEmptyDirectories = true
+	if opt.CaseInsensitive {
+		feat.CaseInsensitive = true
+	}
+	if opt.LostAndFound || f.readThrough() {
+		// ListR does not know about lost+found and the plain objects.
+		feat.ListR = nil
+	}
+	if opt.MapHistory > 0 {
+		// CleanUp prunes the map versions even if the base has nothing to
+		// clean up.
+		feat.CleanUp = f.CleanUp
+	}
 	f.feat = feat
 
+	if err := f.followRelocation(ctx); err != nil {
+		return nil, err
+	}
 	// Keep baseFs alive until this FS is garbage-collected.
 	cache.PinUntilFinalized(f.base, f)
 
+	f.coord = newCoordinator(ctx, opt)
+	// Replay the map writes which failed before loading the map.
+	if err := f.loadRetries(ctx); err != nil {
+		return nil, err
+	}
 	// Load the directory map.
-	var r io.ReadCloser
-	obj, err := f.base.NewObject(ctx, "map")
-	if err == nil {
-		r, err = obj.Open(ctx)
-		switch {
-		case errors.Is(err, fs.ErrorObjectNotFound):
-			// Just create an empty map.
-			r = nil
-		case err != nil:
+	if err := f.detectLayout(ctx); err != nil {
+		return nil, err
+	}
+	if err := f.checkHashStrength(); err != nil {
+		return nil, err
+	}
+	if err := f.loadDirMap(ctx); err != nil {
+		return nil, err
+	}
+	if f.dirMap.size() == 1 {
+		if err := f.recoverDirMap(ctx); err != nil {
 			return nil, err
-		default:
-			defer r.Close()
 		}
 	}
-	f.dirMap, err = loadDirectoryMap(f, r)
-	if err != nil {
+	if err := f.checkOperation(ctx); err != nil {
 		return nil, err
 	}
+	if opt.Snapshot {
+		if err := f.loadSnapshot(ctx); err != nil {
+			return nil, fmt.Errorf("failed to load snapshot of the map: %w", err)
+		}
+	}
+	if err := f.startMirror(ctx); err != nil {
+		return nil, err
+	}
+	if opt.DecoyCount > 0 {
+		if _, err := f.makeDecoys(ctx, opt.DecoyCount); err != nil {
+			fs.Errorf(f, "failed to create decoys: %v", err)
+		}
+	}
+	// If the root is a file, the Fs points to its parent.
+	isFile := false
+	if _, ok := f.findDir(f.root); !ok && f.root != "" {
+		root := f.root
+		f.root = path.Dir(root)
+		if f.root == "." {
+			f.root = ""
+		}
+		if _, err := f.NewObject(ctx, path.Base(root)); err == nil {
+			isFile = true
+		} else {
+			f.root = root
+		}
+	}
+	// Start the background tasks once nothing can fail any more, so they
+	// are not left running for an Fs which is never returned.
+	f.startScrubber()
+	f.startRetries()
+	f.startWebhook(ctx)
 
+	if isFile {
+		return f, fs.ErrorIsFile
+	}
 	return f, nil
 }
 
+// loadDirMap (re)loads the directory map from the base.
+func (f *Fs) loadDirMap(ctx context.Context) error {
+	if err := f.observeMap(ctx, "map"); err != nil {
+		return err
+	}
+	dMap, err := f.readDirMap(ctx, true)
+	if err != nil {
+		return err
+	}
+	f.setDirMap(dMap)
+	return nil
+}
+
+// setDirMap makes dMap the directory map of the Fs. Once loaded, the
+// directory map is replaced in place, as the background tasks and the rc
+// commands keep using it.
+func (f *Fs) setDirMap(dMap *dirMap) {
+	if f.dirMap == nil {
+		f.dirMap = dMap
+		return
+	}
+	f.dirMap.replace(dMap)
+}
+
+// readDirMap reads the directory map from the base. It returns an empty map
+// if there is none. If salvage is set, a malformed directory map is salvaged
+// with recover_map, otherwise readDirMap never writes to the base.
+func (f *Fs) readDirMap(ctx context.Context, salvage bool) (*dirMap, error) {
+	var r io.Reader
+	in, err := f.openMeta(ctx, "map")
+	switch {
+	case errors.Is(err, fs.ErrorObjectNotFound):
+		// Just create an empty map.
+	case err != nil:
+		return nil, err
+	default:
+		defer in.Close()
+		r = in
+	}
+	dMap, err := loadDirectoryMap(f, r)
+	switch {
+	case errors.Is(err, ErrMapCorrupt) && salvage && f.opt.RecoverMap:
+		err = f.salvageDirMap(ctx, dMap, err)
+	case errors.Is(err, ErrMapCorrupt) && salvage:
+		err = fmt.Errorf("%w (set recover_map to salvage it)", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		metrics.mapLoads.WithLabelValues(f.name, kindRoot).Inc()
+	}
+	return dMap, nil
+}
+
+// salvageDirMap writes the directory map dMap salvaged from the malformed
+// directory map to recoveredMap, so it is kept when the directory map is
+// written next, and reports the problem.
+func (f *Fs) salvageDirMap(ctx context.Context, dMap *dirMap, loadErr error) error {
+	if _, err := f.putBytes(ctx, recoveredMap, dMap.bytes()); err != nil {
+		return fmt.Errorf("failed to write %q after %v: %w", recoveredMap, loadErr, err)
+	}
+	f.mirrorObject(recoveredMap)
+	fs.Errorf(f, "Salvaged the directory map: %v: using the %d directories before the problem, saved to %q", loadErr, dMap.size()-1, recoveredMap)
+	return nil
+}
+
 // Name returns the name of the Fs as passed into NewFs.
 func (f *Fs) Name() string {
 	return f.name
@@ -175,6 +1153,10 @@ func (f *Fs) String() string {
 
 // Precision returns the mod time precision of the FS.
 func (f *Fs) Precision() time.Duration {
+	if f.opt.StoreModTimes {
+		// The name files record the modification times in nanoseconds.
+		return time.Nanosecond
+	}
 	// We just pass on the mod time. Therefore, it's reliant on the base Fs.
 	return f.base.Precision()
 }
@@ -204,8 +1186,18 @@ func (f *Fs) UnWrap() fs.Fs {
 	return f.base
 }
 
-// Shutdown triggers shutdown on the base FS.
+// stop stops the background tasks of the Fs.
+func (f *Fs) stop(ctx context.Context) {
+	f.haltWG.Wait()
+	f.stopScrubber()
+	f.stopRetries(ctx)
+	f.stopWebhook()
+	f.stopMirror()
+}
+
+// Shutdown stops the background tasks and triggers shutdown on the base FS.
 func (f *Fs) Shutdown(ctx context.Context) error {
+	f.stop(ctx)
 	do := f.base.Features().Shutdown
 	if do == nil {
 		return nil
@@ -216,10 +1208,17 @@ func (f *Fs) Shutdown(ctx context.Context) error {
 // CleanUp removes trash in the Fs. It is implemented if the Fs has a way of
 // emptying the trash or otherwise cleaning up old versions of files.
 //
-// This is implemented by delegating to the base FS.
+// This is implemented by delegating to the base FS, after removing the map
+// versions exceeding map_history or map_history_max_age.
 func (f *Fs) CleanUp(ctx context.Context) error {
+	if err := f.cleanUpHistory(ctx); err != nil {
+		return fmt.Errorf("error pruning map versions: %w", err)
+	}
 	do := f.base.Features().CleanUp
 	if do == nil {
+		if f.opt.MapHistory > 0 {
+			return nil
+		}
 		return errors.New("can't CleanUp")
 	}
 	return do(ctx)
@@ -235,14 +1234,43 @@ func (f *Fs) SetWrapper(wrapper fs.Fs) {
 	f.wrapper = wrapper
 }
 
-// DirCacheFlush flushes the file listing cache in the Fs. It is used for
-// testing purposes.
+// DirCacheFlush drops the cached map files and reloads the directory map
+// from the base, so changes of other clients show up, e.g. after "rclone rc
+// vfs/refresh". The directory map is kept while map files have changes
+// which are not written yet. It does nothing with the snapshot option.
 func (f *Fs) DirCacheFlush() {
-	for _, v := range f.dirMap.Path {
-		v.files = nil
+	if f.opt.Snapshot {
+		return
+	}
+	f.clearMapCache()
+	if pending := f.pendingMapWrites(); pending > 0 {
+		fs.Debugf(f, "not reloading the directory map with %d map files not written yet", pending)
+		return
+	}
+	if err := f.loadDirMap(context.Background()); err != nil {
+		fs.Errorf(f, "failed to reload directory map: %v", err)
 	}
 }
 
+// pendingMapWrites returns the number of map files with changes which are
+// not written yet, including the writes queued for retry.
+func (f *Fs) pendingMapWrites() int {
+	pending := 0
+	for _, entry := range f.dirMap.entries() {
+		entry.mu.Lock()
+		if entry.requested > entry.written {
+			pending++
+		}
+		entry.mu.Unlock()
+	}
+	if q := f.retries; q != nil {
+		q.mu.Lock()
+		pending += len(q.writes)
+		q.mu.Unlock()
+	}
+	return pending
+}
+
 // Disconnect disconnects the current user in the base Fs.
 func (f *Fs) Disconnect(ctx context.Context) error {
 	do := f.base.Features().Disconnect
@@ -269,10 +1297,17 @@ func (f *Fs) PublicLink(ctx context.Context, remote string, expire fs.Duration,
 	if err != nil {
 		return "", err
 	}
-	if _, ok := files[base]; !ok {
+	fileHash, ok = entry.recordedHash(files, base)
+	if !ok {
 		return "", fs.ErrorObjectNotFound
 	}
-	return do(ctx, path.Join(entry.Hash, fileHash, "data"), expire, unlink)
+	if _, empty, err := entry.emptyFile(ctx, base); err != nil || empty {
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("can't link empty files only stored in the map file")
+	}
+	return do(ctx, f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf), expire, unlink)
 }
 
 // UserInfo returns the user info of the base Fs.
@@ -289,11 +1324,13 @@ var (
 	_ fs.Abouter         = (*Fs)(nil)
 	_ fs.ChangeNotifier  = (*Fs)(nil)
 	_ fs.CleanUpper      = (*Fs)(nil)
+	_ fs.Commander       = (*Fs)(nil)
 	_ fs.Copier          = (*Fs)(nil)
 	_ fs.DirCacheFlusher = (*Fs)(nil)
 	_ fs.DirMover        = (*Fs)(nil)
 	_ fs.Disconnecter    = (*Fs)(nil)
 	_ fs.ListRer         = (*Fs)(nil)
+	_ fs.MergeDirser     = (*Fs)(nil)
 	_ fs.Mover           = (*Fs)(nil)
 	_ fs.OpenWriterAter  = (*Fs)(nil)
 	_ fs.PublicLinker    = (*Fs)(nil)
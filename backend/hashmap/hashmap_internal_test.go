@@ -0,0 +1,36 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	fsobject "github.com/rclone/rclone/fs/object"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestFs creates a hashmap with the md5 hash type on top of the local
+// directory dir, with the options in extra.
+func newTestFs(t *testing.T, dir string, extra configmap.Simple) *Fs {
+	m := configmap.Simple{"type": "hashmap", "remote": dir, "hash_type": "md5"}
+	for k, v := range extra {
+		m[k] = v
+	}
+	f, err := NewFs(context.Background(), "TestHashmapInternal", "", m)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.(*Fs).Shutdown(context.Background()))
+	})
+	return f.(*Fs)
+}
+
+// putTestFile uploads a file with contents to the overlay path remote.
+func putTestFile(t *testing.T, f fs.Fs, remote, contents string) fs.Object {
+	src := fsobject.NewStaticObjectInfo(remote, time.Now(), int64(len(contents)), true, nil, nil)
+	o, err := f.Put(context.Background(), bytes.NewBufferString(contents), src)
+	require.NoError(t, err)
+	return o
+}
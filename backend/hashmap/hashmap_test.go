@@ -0,0 +1,35 @@
+// Test the hashmap filesystem interface
+package hashmap_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rclone/rclone/backend/all" // for integration tests
+	"github.com/rclone/rclone/fstest"
+	"github.com/rclone/rclone/fstest/fstests"
+)
+
+// TestIntegration runs integration tests against a concrete remote
+// set by the -remote flag. If the flag is not set, it creates a
+// dynamic hashmap overlay wrapping a local temporary directory.
+func TestIntegration(t *testing.T) {
+	opt := fstests.Opt{
+		RemoteName: *fstest.RemoteName,
+		UnimplementableObjectMethods: []string{
+			"MimeType",
+		},
+	}
+	if *fstest.RemoteName == "" {
+		name := "TestHashmap"
+		opt.RemoteName = name + ":"
+		tempDir := filepath.Join(os.TempDir(), "rclone-hashmap-test-standard")
+		opt.ExtraConfig = []fstests.ExtraConfigItem{
+			{Name: name, Key: "type", Value: "hashmap"},
+			{Name: name, Key: "remote", Value: tempDir},
+			{Name: name, Key: "hash_type", Value: "md5"},
+		}
+	}
+	fstests.Run(t, &opt)
+}
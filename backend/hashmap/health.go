@@ -0,0 +1,148 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs/rc"
+)
+
+func init() {
+	rc.Add(rc.Call{
+		Path:  "hashmap/health",
+		Fn:    rcHealth,
+		Title: "Show the health of a hashmap remote",
+		Help: `Show a summary of the state of a hashmap remote in use, e.g. by a mount or
+serve, for readiness probes.
+
+Params:
+  - fs = the hashmap remote, e.g. "hashmap:"
+
+It returns:
+  - healthy = false if the remote degraded to read only or stopped writing
+  - halted = the recovery summary if the remote stopped writing after a
+    quota or permission error of the base
+  - mapGeneration = generation of the directory map, if known
+  - pendingWrites = map files with changes which are not written yet
+  - mapWriteFailures = consecutive failed writes of map files
+  - lastMapWrite = time of the last successful write of a map file
+  - coordinator = the coordination service and the client ID used with it
+  - cachedMaps, cacheHits, cacheMisses, cacheHitRate = use of the map cache
+  - indexMisses = lookups of missing files answered by the existence index
+  - lastScrub, scrubFindings = time and findings of the last background scrub
+
+Eg
+
+    rclone rc hashmap/health fs=hashmap:
+`,
+	})
+}
+
+// health is the summary of the state of the Fs returned by hashmap/health.
+type health struct {
+	// Healthy is false if the overlay degraded to read only or stopped
+	// writing.
+	Healthy bool `json:"healthy"`
+	// Halted is the recovery summary if the overlay stopped writing after a
+	// quota or permission error of the base.
+	Halted *haltReport `json:"halted,omitempty"`
+	// MapGeneration is the generation of the directory map, if known from
+	// the coordinator or map_history.
+	MapGeneration int64 `json:"mapGeneration,omitempty"`
+	// PendingWrites is the number of map files with changes which are not
+	// written yet, including the queued retries.
+	PendingWrites int `json:"pendingWrites"`
+	// MapWriteFailures is the number of consecutive failed writes of map
+	// files.
+	MapWriteFailures int32 `json:"mapWriteFailures"`
+	// LastMapWrite is the time of the last successful write of a map file.
+	LastMapWrite *time.Time `json:"lastMapWrite,omitempty"`
+	// Coordinator is the coordination service in use, if any.
+	Coordinator *coordinatorHealth `json:"coordinator,omitempty"`
+	// CachedMaps is the number of map files cached in memory.
+	CachedMaps int `json:"cachedMaps"`
+	// CacheHits and CacheMisses count the uses of the map files served
+	// from memory and read from the base.
+	CacheHits   int64 `json:"cacheHits"`
+	CacheMisses int64 `json:"cacheMisses"`
+	// CacheHitRate is the ratio of CacheHits to all uses.
+	CacheHitRate float64 `json:"cacheHitRate"`
+	// IndexMisses counts the lookups of missing files answered by the
+	// existence index without reading the map file.
+	IndexMisses int64 `json:"indexMisses"`
+	// LastScrub is the time the last background scrub finished.
+	LastScrub *time.Time `json:"lastScrub,omitempty"`
+	// ScrubFindings is the number of findings of the last background scrub.
+	ScrubFindings int `json:"scrubFindings"`
+}
+
+// coordinatorHealth describes the coordination service in use. Leases are
+// only held while a map file is written, so there is no lease to report.
+type coordinatorHealth struct {
+	URL    string `json:"url"`
+	Client string `json:"client"`
+}
+
+// rcHealth implements the hashmap/health rc call.
+func rcHealth(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	fsys, err := rc.GetFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fsys.(*Fs)
+	if !ok {
+		return nil, errors.New("not a hashmap remote")
+	}
+	out = rc.Params{}
+	err = rc.Reshape(&out, f.health())
+	return out, err
+}
+
+// health returns the summary of the state of the Fs.
+func (f *Fs) health() health {
+	h := health{
+		Healthy:          f.checkWritable() == nil,
+		Halted:           f.halt(),
+		MapWriteFailures: atomic.LoadInt32(&f.mapFailures),
+		CacheHits:        atomic.LoadInt64(&f.cacheHits),
+		CacheMisses:      atomic.LoadInt64(&f.cacheMisses),
+		IndexMisses:      atomic.LoadInt64(&f.indexMisses),
+	}
+	if total := h.CacheHits + h.CacheMisses; total > 0 {
+		h.CacheHitRate = float64(h.CacheHits) / float64(total)
+	}
+	if t := atomic.LoadInt64(&f.lastMapWrite); t != 0 {
+		last := time.Unix(0, t)
+		h.LastMapWrite = &last
+	}
+	for _, entry := range f.dirMap.entries() {
+		entry.mu.Lock()
+		if entry.files != nil {
+			h.CachedMaps++
+		}
+		entry.mu.Unlock()
+	}
+	h.PendingWrites = f.pendingMapWrites()
+	if c := f.coord; c != nil {
+		h.Coordinator = &coordinatorHealth{URL: c.url, Client: c.client}
+		c.mu.Lock()
+		h.MapGeneration = c.seen["map"]
+		c.mu.Unlock()
+	} else {
+		f.historyMu.Lock()
+		if len(f.history) > 0 {
+			h.MapGeneration = f.history[len(f.history)-1].Generation
+		}
+		f.historyMu.Unlock()
+	}
+	f.scrubMu.Lock()
+	if r := f.lastScrub; r != nil {
+		last := r.Time
+		h.LastScrub = &last
+		h.ScrubFindings = len(r.Findings)
+	}
+	f.scrubMu.Unlock()
+	return h
+}
@@ -0,0 +1,309 @@
+package hashmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// historyIndex is the name of the object recording the versions of the
+// directory map.
+const historyIndex = "map.versions"
+
+// mapVersion describes a recorded version of the directory map. Its content
+// is a copy of the map written next to it, as the object versions of the
+// bases can't be read through the Fs interface.
+type mapVersion struct {
+	// Generation is the sequence number of the write of the map.
+	Generation int64 `json:"generation"`
+	// Time is the time the map was written.
+	Time time.Time `json:"time"`
+}
+
+// remote returns the path of the copy of the map version in the base.
+func (v mapVersion) remote() string {
+	return fmt.Sprintf("map.v%d", v.Generation)
+}
+
+// mapVersions returns the recorded versions of the directory map, oldest
+// first.
+func (f *Fs) mapVersions(ctx context.Context) ([]mapVersion, error) {
+	f.historyMu.Lock()
+	defer f.historyMu.Unlock()
+	if err := f.loadHistory(ctx); err != nil {
+		return nil, err
+	}
+	return append([]mapVersion{}, f.history...), nil
+}
+
+// loadHistory fills f.history from the history index in the base. It must
+// be called with historyMu held.
+func (f *Fs) loadHistory(ctx context.Context) error {
+	if f.history != nil {
+		return nil
+	}
+	history := make([]mapVersion, 0)
+	in, err := f.openMeta(ctx, historyIndex)
+	switch {
+	case errors.Is(err, fs.ErrorObjectNotFound):
+		f.history = history
+		return nil
+	case err != nil:
+		return fmt.Errorf("error opening map history: %w", err)
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	for {
+		entry, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading map history entry: %w", err)
+		}
+		entry = strings.TrimSuffix(entry, "\n")
+		if entry == "" {
+			continue
+		}
+		split := strings.Split(entry, " ")
+		if len(split) != 2 {
+			return fmt.Errorf("malformed map history: invalid entry %q", entry)
+		}
+		generation, err := strconv.ParseInt(split[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed map history: invalid generation in %q: %w", entry, err)
+		}
+		t, err := time.Parse(time.RFC3339Nano, split[1])
+		if err != nil {
+			return fmt.Errorf("malformed map history: invalid time in %q: %w", entry, err)
+		}
+		history = append(history, mapVersion{
+			Generation: generation,
+			Time:       t,
+		})
+	}
+	f.history = history
+	return nil
+}
+
+// writeHistory writes f.history to the history index in the base. It must
+// be called with historyMu held.
+func (f *Fs) writeHistory(ctx context.Context) error {
+	var buf bytes.Buffer
+	for _, v := range f.history {
+		fmt.Fprintf(&buf, "%d %s\n", v.Generation, v.Time.UTC().Format(time.RFC3339Nano))
+	}
+	_, err := f.putBytes(ctx, historyIndex, buf.Bytes())
+	return err
+}
+
+// recordMapVersion records the freshly written directory map with the given
+// content as a new version in the history and prunes versions exceeding the
+// configured limit. It writes a copy of the map and the history index.
+func (f *Fs) recordMapVersion(ctx context.Context, data []byte) error {
+	f.historyMu.Lock()
+	defer f.historyMu.Unlock()
+	if err := f.loadHistory(ctx); err != nil {
+		return err
+	}
+	v := mapVersion{
+		Generation: 1,
+		Time:       time.Now(),
+	}
+	if len(f.history) > 0 {
+		v.Generation = f.history[len(f.history)-1].Generation + 1
+	}
+	// Keep a copy of the map so the version can be restored.
+	if _, err := f.putBytes(ctx, v.remote(), data); err != nil {
+		return fmt.Errorf("error creating copy of map version: %w", err)
+	}
+	f.history = append(f.history, v)
+	f.pruneHistory(ctx)
+	return f.writeHistory(ctx)
+}
+
+// pruneHistory removes the versions exceeding map_history or older than
+// map_history_max_age from the loaded history, oldest first. The newest
+// version is always kept, so there is a copy of the map to restore. It
+// returns the number of removed versions. It must be called with historyMu
+// held.
+func (f *Fs) pruneHistory(ctx context.Context) int {
+	cutoff := time.Time{}
+	if f.opt.MapHistoryMaxAge > 0 {
+		cutoff = time.Now().Add(-time.Duration(f.opt.MapHistoryMaxAge))
+	}
+	pruned := 0
+	for len(f.history) > 1 {
+		old := f.history[0]
+		if len(f.history) <= f.opt.MapHistory && !old.Time.Before(cutoff) {
+			break
+		}
+		if f.skipBase(ctx, fmt.Sprintf("remove map version %d", old.Generation), old.remote()) {
+			break
+		}
+		if err := f.removeMeta(ctx, old.remote()); err != nil {
+			fs.Errorf(f, "failed to remove map version %d: %v", old.Generation, err)
+		}
+		f.history = f.history[1:]
+		pruned++
+	}
+	return pruned
+}
+
+// cleanUpHistory applies the retention of map_history and
+// map_history_max_age to the recorded versions of the directory map.
+func (f *Fs) cleanUpHistory(ctx context.Context) error {
+	if f.opt.MapHistory <= 0 {
+		return nil
+	}
+	f.historyMu.Lock()
+	defer f.historyMu.Unlock()
+	if err := f.loadHistory(ctx); err != nil {
+		return err
+	}
+	pruned := f.pruneHistory(ctx)
+	if pruned == 0 {
+		return nil
+	}
+	fs.Infof(f, "Removed %d map versions", pruned)
+	return f.writeHistory(ctx)
+}
+
+// restoreMapVersion replaces the directory map with the version with the
+// given generation and reloads it.
+func (f *Fs) restoreMapVersion(ctx context.Context, generation int64) error {
+	versions, err := f.mapVersions(ctx)
+	if err != nil {
+		return err
+	}
+	var version *mapVersion
+	for i := range versions {
+		if versions[i].Generation == generation {
+			version = &versions[i]
+		}
+	}
+	if version == nil {
+		return fmt.Errorf("map version %d not found", generation)
+	}
+	in, err := f.openMeta(ctx, version.remote())
+	if err != nil {
+		return fmt.Errorf("error opening map version %d: %w", generation, err)
+	}
+	dMap, err := loadDirectoryMap(f, in)
+	_ = in.Close()
+	if err != nil {
+		return fmt.Errorf("refusing to restore map version %d: %w", generation, err)
+	}
+	if f.skipBase(ctx, fmt.Sprintf("restore map version %d", generation), "map") {
+		return nil
+	}
+	f.setDirMap(dMap)
+	return f.dirMap.write(ctx)
+}
+
+// currentGeneration is the argument of map-diff selecting the directory
+// map currently in use.
+const currentGeneration = "current"
+
+// mapMove is a directory recorded with the same hash directory at another
+// path in the newer directory map.
+type mapMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// mapDiff is the difference between two versions of the directory map.
+type mapDiff struct {
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	Moved   []mapMove `json:"moved"`
+}
+
+// readMapVersion returns the version of the directory map selected by
+// generation, which is the generation of a recorded version or
+// currentGeneration.
+func (f *Fs) readMapVersion(ctx context.Context, generation string) (*dirMap, error) {
+	if generation == currentGeneration {
+		return f.dirMap, nil
+	}
+	g, err := strconv.ParseInt(generation, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation %q: %w", generation, err)
+	}
+	versions, err := f.mapVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Generation != g {
+			continue
+		}
+		in, err := f.openMeta(ctx, v.remote())
+		if err != nil {
+			return nil, fmt.Errorf("error opening map version %d: %w", g, err)
+		}
+		defer in.Close()
+		return loadDirectoryMap(f, in)
+	}
+	return nil, fmt.Errorf("map version %d not found", g)
+}
+
+// diffMapVersions compares the directory maps selected by the generations
+// older and newer, see readMapVersion. A directory recorded with the same
+// hash directory at another path is reported as moved, all other changes
+// as added and removed directories.
+func (f *Fs) diffMapVersions(ctx context.Context, older, newer string) (*mapDiff, error) {
+	a, err := f.readMapVersion(ctx, older)
+	if err != nil {
+		return nil, err
+	}
+	b, err := f.readMapVersion(ctx, newer)
+	if err != nil {
+		return nil, err
+	}
+	diff := &mapDiff{
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+		Moved:   make([]mapMove, 0),
+	}
+	for _, entry := range a.entries() {
+		p := entry.Path
+		if _, ok := b.get(p); ok {
+			continue
+		}
+		if moved, ok := b.byHash(entry.Hash); ok && moved.Path != p {
+			if _, ok := a.get(moved.Path); !ok {
+				diff.Moved = append(diff.Moved, mapMove{From: p, To: moved.Path})
+				continue
+			}
+		}
+		diff.Removed = append(diff.Removed, p)
+	}
+	for _, entry := range b.entries() {
+		p := entry.Path
+		if _, ok := a.get(p); ok {
+			continue
+		}
+		if moved, ok := a.byHash(entry.Hash); ok && moved.Path != p {
+			if _, ok := b.get(moved.Path); !ok {
+				continue
+			}
+		}
+		diff.Added = append(diff.Added, p)
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Moved, func(i, j int) bool {
+		return diff.Moved[i].From < diff.Moved[j].From
+	})
+	return diff, nil
+}
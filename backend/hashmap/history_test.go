@@ -0,0 +1,59 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"map_history": "2"})
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	require.NoError(t, f.Mkdir(ctx, "b"))
+	require.NoError(t, f.Mkdir(ctx, "c"))
+
+	versions, err := f.mapVersions(ctx)
+	require.NoError(t, err)
+	require.Len(t, versions, 2, "versions exceeding map_history are pruned")
+	assert.Equal(t, int64(2), versions[0].Generation)
+	assert.Equal(t, int64(3), versions[1].Generation)
+	assert.NoFileExists(t, filepath.Join(dir, "map.v1"))
+	assert.Equal(t, int64(3), f.health().MapGeneration)
+
+	diff, err := f.diffMapVersions(ctx, "2", currentGeneration)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, diff.Added)
+	assert.Empty(t, diff.Removed)
+
+	// Restoring replaces the map in place and records a new version.
+	dMap := f.dirMap
+	require.NoError(t, f.restoreMapVersion(ctx, 2))
+	assert.Same(t, dMap, f.dirMap)
+	_, ok := f.dirMap.get("c")
+	assert.False(t, ok)
+	_, ok = f.dirMap.get("b")
+	assert.True(t, ok)
+	versions, err = f.mapVersions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), versions[len(versions)-1].Generation)
+
+	assert.Error(t, f.restoreMapVersion(ctx, 1), "pruned versions can't be restored")
+}
+
+func TestLoadHistoryMalformed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, index := range []string{"1\n", "1 2022-01-02T03:04:05Z extra\n", "x 2022-01-02T03:04:05Z\n", "1 yesterday\n"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, historyIndex), []byte(index), 0600))
+		f := newTestFs(t, dir, configmap.Simple{"map_history": "2"})
+		_, err := f.mapVersions(ctx)
+		assert.ErrorContains(t, err, "malformed map history", index)
+	}
+}
@@ -0,0 +1,105 @@
+package hashmap
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// importReport is the result of importing a crypt remote.
+type importReport struct {
+	// Directories is the number of directories created in the overlay.
+	Directories int `json:"directories"`
+	// Moved is the number of files moved server-side as their content is
+	// not encrypted.
+	Moved int `json:"moved"`
+	// Copied is the number of files decrypted and uploaded again.
+	Copied int `json:"copied"`
+}
+
+// importCrypt moves all files of the crypt remote src into the overlay
+// below dir, with the names decrypted by the crypt remote.
+//
+// The content of crypt remotes with no_data_encryption over a remote with
+// the same configuration as the base is moved server-side into the hash
+// directories. All other files are decrypted, uploaded to the overlay and
+// removed from the crypt remote.
+func (f *Fs) importCrypt(ctx context.Context, src, dir string) (*importReport, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	fsInfo, _, _, _, err := fs.ParseRemote(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid crypt remote %q: %w", src, err)
+	}
+	if fsInfo.Name != "crypt" {
+		return nil, fmt.Errorf("%q is a %s remote, not a crypt remote", src, fsInfo.Name)
+	}
+	srcFs, err := cache.Get(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make crypt remote %q: %w", src, err)
+	}
+	report := &importReport{}
+	var files []fs.Object
+	err = walk.ListR(ctx, srcFs, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			switch x := entry.(type) {
+			case fs.Object:
+				files = append(files, x)
+			case fs.Directory:
+				if err := operations.Mkdir(ctx, f, path.Join(dir, x.Remote())); err != nil {
+					return fmt.Errorf("error creating directory %q: %w", x.Remote(), err)
+				}
+				report.Directories++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, o := range files {
+		remote := path.Join(dir, o.Remote())
+		if base, ok := f.plainContent(o); ok {
+			if operations.SkipDestructive(ctx, o, "move into the overlay") {
+				continue
+			}
+			if _, err := f.adoptObject(ctx, base, remote); err != nil {
+				return report, fmt.Errorf("error importing %q: %w", o.Remote(), err)
+			}
+			report.Moved++
+			continue
+		}
+		if _, err := operations.Move(ctx, f, nil, remote, o); err != nil {
+			return report, fmt.Errorf("error importing %q: %w", o.Remote(), err)
+		}
+		report.Copied++
+	}
+	return report, nil
+}
+
+// plainContent returns the object wrapped by the object o of a crypt remote
+// if it can be moved server-side into the base as it is, i.e. its content is
+// not encrypted and it is stored in a remote with the same configuration as
+// the base.
+func (f *Fs) plainContent(o fs.Object) (fs.Object, bool) {
+	if f.base.Features().Move == nil {
+		return nil, false
+	}
+	unwrapper, ok := o.(fs.ObjectUnWrapper)
+	if !ok {
+		return nil, false
+	}
+	base := unwrapper.UnWrap()
+	if base == nil || !operations.SameConfig(base.Fs(), f.base) {
+		return nil, false
+	}
+	// The size of encrypted content always differs by the size of the
+	// header.
+	return base, base.Size() == o.Size()
+}
@@ -0,0 +1,186 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// inventoryItem is a file reported by the inventory command.
+type inventoryItem struct {
+	// Path is the overlay path of the file.
+	Path string `json:"path"`
+	// Base is the path of the data object of the file in the base. It is
+	// empty for the empty files only stored in the map file.
+	Base string `json:"base"`
+	// Size is the size of the data object.
+	Size int64 `json:"size"`
+	// ModTime is the modification time of the data object.
+	ModTime time.Time `json:"modTime"`
+	// Hash is the checksum of the data object as stored by the base.
+	Hash string `json:"hash,omitempty"`
+	// Missing is set if the data object does not exist.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// dataObjects returns the data objects in the hash directory of the
+// directory entry, indexed by the hash of their file.
+func (f *Fs) dataObjects(ctx context.Context, entry *dirEntry) (map[string]fs.Object, error) {
+	// The filters, e.g. --files-from, apply to the overlay and not to the
+	// objects of the base.
+	unfiltered, err := filter.NewFilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx = filter.ReplaceConfig(ctx, unfiltered)
+	objects := make(map[string]fs.Object)
+	err = walk.ListR(ctx, f.base, entry.Hash, true, 2, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(o fs.Object) {
+			fileDir, leaf, ok := f.splitFileKey(o.Remote())
+			if !ok || leaf != dataLeaf || path.Dir(fileDir) != entry.Hash {
+				return
+			}
+			objects[path.Base(fileDir)] = o
+		})
+		return nil
+	})
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return objects, nil
+	}
+	return objects, err
+}
+
+// inventory returns all files in the directory dir and its subdirectories,
+// sorted by path. The checksums of type ht are included if the base supports
+// them.
+func (f *Fs) inventory(ctx context.Context, dir string, ht hash.Type) ([]inventoryItem, error) {
+	root, ok := f.findDir(path.Join(f.root, dir))
+	if !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	var items []inventoryItem
+	p := newProgress(ctx, "inventory", 0)
+	defer p.finish()
+	var recurse func(entry *dirEntry) error
+	recurse = func(entry *dirEntry) error {
+		p.add(1)
+		err := f.inventoryDir(ctx, entry, ht, &items)
+		p.scan(entry.Path, err)
+		if err != nil {
+			return err
+		}
+		for _, child := range f.dirMap.children(entry) {
+			if err := recurse(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := recurse(root); err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Path < items[j].Path
+	})
+	return items, nil
+}
+
+// inventoryDir appends the files in the map file of the directory entry to
+// items.
+func (f *Fs) inventoryDir(ctx context.Context, entry *dirEntry, ht hash.Type, items *[]inventoryItem) error {
+	files, err := entry.Files(ctx)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	objects, err := f.dataObjects(ctx, entry)
+	if err != nil {
+		return err
+	}
+	for name, fileHash := range files {
+		item := inventoryItem{
+			Path: strings.TrimPrefix(strings.TrimPrefix(path.Join(entry.Path, name), f.root), "/"),
+			Base: f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf),
+		}
+		modTime, empty, err := entry.emptyFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		if empty {
+			item.Base = ""
+			item.ModTime = modTime
+			if ht != hash.None {
+				item.Hash, _ = (&emptyObject{}).Hash(ctx, ht)
+			}
+			*items = append(*items, item)
+			continue
+		}
+		o, ok := objects[fileHash]
+		if !ok {
+			item.Missing = true
+			*items = append(*items, item)
+			continue
+		}
+		item.Size = o.Size()
+		item.ModTime = o.ModTime(ctx)
+		if ht != hash.None {
+			item.Hash, err = o.Hash(ctx, ht)
+			if err != nil {
+				return fmt.Errorf("error reading checksum of %q: %w", item.Base, err)
+			}
+		}
+		*items = append(*items, item)
+	}
+	return nil
+}
+
+// inventoryHash returns the type of the checksums to include in the
+// inventory: the one named by name, or the first one supported by the base
+// if name is empty.
+func (f *Fs) inventoryHash(name string) (hash.Type, error) {
+	if name == "" {
+		return f.base.Hashes().GetOne(), nil
+	}
+	var ht hash.Type
+	if err := ht.Set(name); err != nil {
+		return hash.None, err
+	}
+	if !f.base.Hashes().Contains(ht) {
+		return hash.None, fmt.Errorf("the base does not support %v checksums", ht)
+	}
+	return ht, nil
+}
+
+// formatInventory formats the inventory as CSV with a header row.
+func formatInventory(items []inventoryItem) (string, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	_ = w.Write([]string{"path", "base", "size", "modtime", "hash", "missing"})
+	for _, item := range items {
+		modTime := ""
+		if !item.Missing {
+			modTime = item.ModTime.UTC().Format(time.RFC3339Nano)
+		}
+		_ = w.Write([]string{
+			item.Path,
+			item.Base,
+			strconv.FormatInt(item.Size, 10),
+			modTime,
+			item.Hash,
+			strconv.FormatBool(item.Missing),
+		})
+	}
+	w.Flush()
+	return b.String(), w.Error()
+}
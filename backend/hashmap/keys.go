@@ -0,0 +1,139 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultKeySeparator stores the objects of every file in a file directory
+// named after the hash of the file.
+const defaultKeySeparator = "/"
+
+// Names of the objects of a file in the base.
+const (
+	dataLeaf    = "data"
+	nameLeaf    = "name"
+	pendingLeaf = "pending"
+)
+
+// fileLeaves are the names of all objects a file may have in the base.
+var fileLeaves = []string{nameLeaf, dataLeaf, pendingLeaf}
+
+// checkKeySeparator returns an error if sep can't separate the hash of a file
+// from the names of its objects.
+func checkKeySeparator(sep string) error {
+	if sep == "" || sep == defaultKeySeparator {
+		return nil
+	}
+	if strings.Contains(sep, "/") {
+		return fmt.Errorf("key separator %q must be \"/\" or not contain \"/\"", sep)
+	}
+	for _, r := range sep {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || unicode.IsSpace(r) {
+			return fmt.Errorf("key separator %q must not contain letters, digits or spaces", sep)
+		}
+	}
+	return nil
+}
+
+// joinedKeys reports whether the objects of a file are stored as single keys
+// in the hash directory instead of in a file directory.
+func (f *Fs) joinedKeys() bool {
+	return f.keySeparator != defaultKeySeparator
+}
+
+// fileKey returns the path of the object leaf of the file at basePath, the
+// path of the file directory in the base.
+func (f *Fs) fileKey(basePath, leaf string) string {
+	return basePath + f.keySeparator + leaf
+}
+
+// splitFileKey splits the path of an object of a file in the base into the
+// path of the file directory and the name of the object.
+func (f *Fs) splitFileKey(remote string) (basePath, leaf string, ok bool) {
+	for _, leaf := range fileLeaves {
+		suffix := f.keySeparator + leaf
+		if strings.HasSuffix(remote, suffix) && len(remote) > len(suffix) {
+			return strings.TrimSuffix(remote, suffix), leaf, true
+		}
+	}
+	return "", "", false
+}
+
+// fileHashes returns the hashes of the files found in the listing of a hash
+// directory, in the order of the listing. With the default key separator
+// these are all subdirectories, which includes the nested hash directories
+// of the children in nested layouts.
+func (f *Fs) fileHashes(entries fs.DirEntries) []string {
+	var hashes []string
+	if !f.joinedKeys() {
+		entries.ForDir(func(d fs.Directory) {
+			hashes = append(hashes, path.Base(d.Remote()))
+		})
+		return hashes
+	}
+	seen := make(map[string]struct{})
+	entries.ForObject(func(o fs.Object) {
+		basePath, _, ok := f.splitFileKey(o.Remote())
+		if !ok {
+			return
+		}
+		fileHash := path.Base(basePath)
+		if _, ok := seen[fileHash]; ok {
+			return
+		}
+		seen[fileHash] = struct{}{}
+		hashes = append(hashes, fileHash)
+	})
+	return hashes
+}
+
+// purgeFile removes all objects of the file at basePath from the base.
+func (f *Fs) purgeFile(ctx context.Context, basePath string) error {
+	for _, leaf := range fileLeaves {
+		f.forgetWrite(f.fileKey(basePath, leaf))
+	}
+	if !f.joinedKeys() {
+		err := operations.Purge(ctx, f.base, basePath)
+		f.mirrorDir(basePath)
+		return err
+	}
+	// Remove the objects concurrently as the base has no way to remove
+	// several objects in one request.
+	var found int32
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, leaf := range fileLeaves {
+		remote := f.fileKey(basePath, leaf)
+		g.Go(func() error {
+			obj, err := f.base.NewObject(gCtx, remote)
+			if errors.Is(err, fs.ErrorObjectNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			atomic.StoreInt32(&found, 1)
+			if err := obj.Remove(gCtx); err != nil {
+				return err
+			}
+			f.mirrorObject(remote)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if found == 0 {
+		return fs.ErrorDirNotFound
+	}
+	return nil
+}
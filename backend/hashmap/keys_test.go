@@ -0,0 +1,78 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKeySeparator(t *testing.T) {
+	for _, sep := range []string{"", "/", ".", "_", "--", "~"} {
+		assert.NoError(t, checkKeySeparator(sep), "%q", sep)
+	}
+	for _, sep := range []string{"a/", "/.", "x", "9", " ", ".a"} {
+		assert.Error(t, checkKeySeparator(sep), "%q", sep)
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	for _, test := range []struct {
+		sep  string
+		want string
+	}{
+		{defaultKeySeparator, "dir/file/data"},
+		{".", "dir/file.data"},
+		{"--", "dir/file--data"},
+	} {
+		f := &Fs{keySeparator: test.sep}
+		assert.Equal(t, test.sep != defaultKeySeparator, f.joinedKeys())
+		key := f.fileKey("dir/file", dataLeaf)
+		assert.Equal(t, test.want, key)
+		basePath, leaf, ok := f.splitFileKey(key)
+		require.True(t, ok, test.sep)
+		assert.Equal(t, "dir/file", basePath)
+		assert.Equal(t, dataLeaf, leaf)
+		_, _, ok = f.splitFileKey("dir/file" + test.sep + "other")
+		assert.False(t, ok, "unknown leaves are not split")
+		_, _, ok = f.splitFileKey(test.sep + nameLeaf)
+		assert.False(t, ok, "the file hash can't be empty")
+	}
+}
+
+func TestJoinedKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"key_separator": "."})
+	require.NoError(t, f.Mkdir(ctx, "d"))
+	putTestFile(t, f, "d/file.txt", "hello")
+	dirHash := f.dirBase("d")
+	fileHash := f.fileHash("d", "file.txt")
+	assert.FileExists(t, filepath.Join(dir, dirHash, fileHash+".data"))
+	assert.FileExists(t, filepath.Join(dir, dirHash, fileHash+".name"))
+	assert.NoDirExists(t, filepath.Join(dir, dirHash, fileHash))
+	data, err := os.ReadFile(filepath.Join(dir, layoutMarker))
+	require.NoError(t, err)
+	assert.Equal(t, layoutFlat+"\n"+separatorPrefix+".\n", string(data))
+
+	baseEntries, err := f.base.List(ctx, dirHash)
+	require.NoError(t, err)
+	assert.Equal(t, []string{fileHash}, f.fileHashes(baseEntries))
+
+	// The separator is detected without the option, but can't be changed.
+	g := newTestFs(t, dir, nil)
+	assert.Equal(t, ".", g.keySeparator)
+	o, err := g.NewObject(ctx, "d/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), o.Size())
+	_, err = NewFs(ctx, "TestHashmapInternal", "", configmap.Simple{"type": "hashmap", "remote": dir, "hash_type": "md5", "key_separator": "_"})
+	assert.ErrorContains(t, err, "was created with key separator")
+
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(dir, dirHash, fileHash+".data"))
+	assert.NoFileExists(t, filepath.Join(dir, dirHash, fileHash+".name"))
+}
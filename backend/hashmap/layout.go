@@ -0,0 +1,282 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// layoutMarker is the object in the base recording the layout the overlay
+// was created with. Its first line is the layout, followed by the key
+// separator if it is not the default one. At the old location of a
+// relocated overlay it records the new location instead.
+const layoutMarker = "map.layout"
+
+// recoveredMap is the object at the root of the base to which recover_map
+// saves the directory map salvaged from a malformed one.
+const recoveredMap = "map.recovered"
+
+// separatorPrefix prefixes the line of the layout marker recording the key
+// separator.
+const separatorPrefix = "separator "
+
+// Layouts of the hash directories in the base.
+const (
+	// layoutFlat stores every directory as a hash directory at the root of
+	// the base.
+	layoutFlat = "flat"
+	// layoutSharded stores every directory as a hash directory inside a
+	// shard directory named after the first characters of the hash.
+	layoutSharded = "sharded"
+	// layoutMirrored stores every directory inside the hash directory of its
+	// parent, hashing each path segment separately.
+	layoutMirrored = "mirrored"
+	// layoutSalted is like layoutMirrored but hashes each path segment and
+	// file name salted with the path of the hash directory of its parent, so
+	// equal names hash differently in different directories.
+	layoutSalted = "salted"
+)
+
+// shardLength is the number of characters of the hash used to name the shard
+// directories of the sharded layout.
+const shardLength = 2
+
+// dirBase returns the path of the hash directory of the absolute overlay
+// directory dir in the base.
+func (f *Fs) dirBase(dir string) string {
+	return f.dirBaseWith(f.hasher, dir)
+}
+
+// dirBaseWith is like dirBase with the hash function h.
+func (f *Fs) dirBaseWith(h func(string) string, dir string) string {
+	dir = f.fold(dir)
+	switch f.layout {
+	case layoutSharded:
+		return f.shardBase(h(dir))
+	case layoutMirrored, layoutSalted:
+		base := h("")
+		if dir != "" {
+			for _, segment := range strings.Split(dir, "/") {
+				base = path.Join(base, f.segmentHash(h, base, segment))
+			}
+		}
+		return base
+	default:
+		return h(dir)
+	}
+}
+
+// segmentHash returns the hash with h of the path segment or file name in
+// the hash directory parentBase. It is salted with parentBase in the salted
+// layout.
+func (f *Fs) segmentHash(h func(string) string, parentBase, segment string) string {
+	if f.layout == layoutSalted {
+		return h(parentBase + "/" + segment)
+	}
+	return h(segment)
+}
+
+// fileHash returns the hash of the file with the given name in the absolute
+// overlay directory dir.
+func (f *Fs) fileHash(dir, name string) string {
+	return f.fileHashWith(f.hasher, dir, name)
+}
+
+// fileHashWith is like fileHash with the hash function h.
+func (f *Fs) fileHashWith(h func(string) string, dir, name string) string {
+	dir, name = f.fold(dir), f.fold(name)
+	if f.layout == layoutSalted {
+		return f.segmentHash(h, f.dirBaseWith(h, dir), name)
+	}
+	return h(name)
+}
+
+// nested reports whether the hash directories of the layout are nested
+// inside the hash directories of their parents.
+func (f *Fs) nested() bool {
+	return f.layout == layoutMirrored || f.layout == layoutSalted
+}
+
+// shardBase returns the path of the hash directory with the given hash in the
+// sharded layout.
+func (f *Fs) shardBase(hash string) string {
+	if len(hash) <= shardLength {
+		return hash
+	}
+	return path.Join(hash[:shardLength], hash)
+}
+
+// decoyBase returns the path of a decoy directory with the given random hash
+// so that it is indistinguishable from the real hash directories.
+func (f *Fs) decoyBase(hash string) string {
+	switch f.layout {
+	case layoutSharded:
+		return f.shardBase(hash)
+	case layoutMirrored, layoutSalted:
+		return path.Join(f.hasher(""), hash)
+	default:
+		return hash
+	}
+}
+
+// baseDirs returns the paths of all hash directories in the base, including
+// the ones which are not in the directory map.
+func (f *Fs) baseDirs(ctx context.Context) ([]string, error) {
+	var dirs []string
+	switch f.layout {
+	case layoutSharded:
+		shards, err := f.base.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range shards {
+			if _, ok := shard.(fs.Directory); !ok {
+				continue
+			}
+			entries, err := f.base.List(ctx, shard.Remote())
+			if err != nil {
+				return nil, err
+			}
+			entries.ForDir(func(d fs.Directory) {
+				dirs = append(dirs, d.Remote())
+			})
+		}
+	case layoutMirrored, layoutSalted:
+		var walk func(dir string) error
+		walk = func(dir string) error {
+			entries, err := f.base.List(ctx, dir)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dir)
+			for _, entry := range entries {
+				if _, ok := entry.(fs.Directory); !ok {
+					continue
+				}
+				// File directories contain a name file or a data object.
+				isFile := false
+				for _, leaf := range []string{nameLeaf, dataLeaf} {
+					_, err := f.base.NewObject(ctx, path.Join(entry.Remote(), leaf))
+					if err == nil {
+						isFile = true
+						break
+					}
+					if !errors.Is(err, fs.ErrorObjectNotFound) {
+						return err
+					}
+				}
+				if isFile {
+					continue
+				}
+				if err := walk(entry.Remote()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(f.hasher("")); err != nil {
+			return nil, err
+		}
+	default:
+		entries, err := f.base.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		entries.ForDir(func(d fs.Directory) {
+			dirs = append(dirs, d.Remote())
+		})
+	}
+	return dirs, nil
+}
+
+// detectLayout sets the layout and key separator of the Fs from the layout
+// marker in the base, falling back to the options for new overlays. Overlays
+// created before the layout marker was introduced are flat.
+func (f *Fs) detectLayout(ctx context.Context) error {
+	recorded, recordedSep := "", ""
+	in, err := f.openMeta(ctx, layoutMarker)
+	switch {
+	case err == nil:
+		data, err := io.ReadAll(in)
+		_ = in.Close()
+		if err != nil {
+			return fmt.Errorf("error reading layout marker: %w", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		recorded, recordedSep = strings.TrimSpace(lines[0]), defaultKeySeparator
+		for _, line := range lines[1:] {
+			if !strings.HasPrefix(line, separatorPrefix) {
+				return fmt.Errorf("unknown setting %q recorded in the layout marker", line)
+			}
+			recordedSep = strings.TrimPrefix(line, separatorPrefix)
+			if err := checkKeySeparator(recordedSep); err != nil {
+				return fmt.Errorf("invalid layout marker: %w", err)
+			}
+		}
+		f.layoutMarked = true
+	case errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound):
+		f.limitMeta(ctx)
+		_, err := f.base.NewObject(ctx, "map")
+		if err == nil {
+			recorded, recordedSep = layoutFlat, defaultKeySeparator
+		} else if !errors.Is(err, fs.ErrorObjectNotFound) && !errors.Is(err, fs.ErrorDirNotFound) {
+			return err
+		}
+	default:
+		return fmt.Errorf("error opening layout marker: %w", err)
+	}
+	switch recorded {
+	case "":
+		f.layout = f.opt.Layout
+		if f.layout == "" {
+			f.layout = layoutFlat
+		}
+	case layoutFlat, layoutSharded, layoutMirrored, layoutSalted:
+		if f.opt.Layout != "" && f.opt.Layout != recorded {
+			return fmt.Errorf("the overlay was created with layout %q, not %q", recorded, f.opt.Layout)
+		}
+		f.layout = recorded
+	default:
+		return fmt.Errorf("unknown layout %q recorded in the base", recorded)
+	}
+	switch {
+	case recordedSep == "":
+		f.keySeparator = f.opt.KeySeparator
+		if f.keySeparator == "" {
+			f.keySeparator = defaultKeySeparator
+		}
+	case f.opt.KeySeparator != "" && f.opt.KeySeparator != recordedSep:
+		return fmt.Errorf("the overlay was created with key separator %q, not %q", recordedSep, f.opt.KeySeparator)
+	default:
+		f.keySeparator = recordedSep
+	}
+	f.trace("layout %q (recorded %q), key separator %q", f.layout, recorded, f.keySeparator)
+	return nil
+}
+
+// markLayout writes the layout marker to the base if it is not there yet.
+func (f *Fs) markLayout(ctx context.Context) error {
+	if f.layoutMarked {
+		return nil
+	}
+	if _, err := f.putBytes(ctx, layoutMarker, f.layoutContent()); err != nil {
+		return fmt.Errorf("error writing layout marker: %w", err)
+	}
+	f.mirrorObject(layoutMarker)
+	f.layoutMarked = true
+	return nil
+}
+
+// layoutContent returns the content of the layout marker of the Fs.
+func (f *Fs) layoutContent() []byte {
+	content := f.layout + "\n"
+	if f.joinedKeys() {
+		content += separatorPrefix + f.keySeparator + "\n"
+	}
+	return []byte(content)
+}
@@ -0,0 +1,86 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirBase(t *testing.T) {
+	root, a, b := hashMD5(""), hashMD5("a"), hashMD5("b")
+	for _, test := range []struct {
+		layout string
+		dir    string
+		want   string
+	}{
+		{layoutFlat, "", root},
+		{layoutFlat, "a/b", hashMD5("a/b")},
+		{layoutSharded, "", path.Join(root[:shardLength], root)},
+		{layoutSharded, "a/b", path.Join(hashMD5("a/b")[:shardLength], hashMD5("a/b"))},
+		{layoutMirrored, "", root},
+		{layoutMirrored, "a", path.Join(root, a)},
+		{layoutMirrored, "a/b", path.Join(root, a, b)},
+	} {
+		f := &Fs{layout: test.layout, hasher: hashMD5}
+		assert.Equal(t, test.want, f.dirBase(test.dir), "%s %q", test.layout, test.dir)
+		assert.Equal(t, test.layout == layoutMirrored, f.nested())
+		assert.Equal(t, hashMD5("file"), f.fileHash(test.dir, "file"))
+	}
+}
+
+func TestLayoutMarker(t *testing.T) {
+	ctx := context.Background()
+	for _, layout := range []string{layoutFlat, layoutSharded, layoutMirrored} {
+		t.Run(layout, func(t *testing.T) {
+			dir := t.TempDir()
+			f := newTestFs(t, dir, configmap.Simple{"layout": layout})
+			require.NoError(t, f.Mkdir(ctx, "a/b"))
+			data, err := os.ReadFile(filepath.Join(dir, layoutMarker))
+			require.NoError(t, err)
+			assert.Equal(t, layout+"\n", string(data))
+			assert.DirExists(t, filepath.Join(dir, filepath.FromSlash(f.dirBase("a/b"))))
+
+			// The layout is detected without the option.
+			g := newTestFs(t, dir, nil)
+			assert.Equal(t, layout, g.layout)
+			_, ok := g.findDir("a/b")
+			assert.True(t, ok)
+			dirs, err := g.baseDirs(ctx)
+			require.NoError(t, err)
+			assert.Contains(t, dirs, g.dirBase("a/b"))
+
+			// Another layout can't be used on the overlay.
+			other := layoutFlat
+			if layout == layoutFlat {
+				other = layoutSharded
+			}
+			_, err = NewFs(ctx, "TestHashmapInternal", "", configmap.Simple{"type": "hashmap", "remote": dir, "hash_type": "md5", "layout": other})
+			assert.ErrorContains(t, err, "was created with layout")
+		})
+	}
+}
+
+func TestLayoutLegacy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, nil)
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	// Overlays created before the layout marker are flat.
+	require.NoError(t, os.Remove(filepath.Join(dir, layoutMarker)))
+	g := newTestFs(t, dir, nil)
+	assert.Equal(t, layoutFlat, g.layout)
+	assert.False(t, g.layoutMarked)
+	_, ok := g.findDir("a")
+	assert.True(t, ok)
+
+	// Unknown layouts are refused.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, layoutMarker), []byte("spiral\n"), 0600))
+	_, err := NewFs(ctx, "TestHashmapInternal", "", configmap.Simple{"type": "hashmap", "remote": dir, "hash_type": "md5"})
+	assert.ErrorContains(t, err, "unknown layout")
+}
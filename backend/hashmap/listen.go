@@ -0,0 +1,184 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs/rc"
+)
+
+// eventLogSize is the number of recent change events kept for
+// hashmap/listen.
+const eventLogSize = 1024
+
+// defaultListenTimeout is the time hashmap/listen waits for new events by
+// default.
+const defaultListenTimeout = 30 * time.Second
+
+func init() {
+	rc.Add(rc.Call{
+		Path:  "hashmap/listen",
+		Fn:    rcListen,
+		Title: "Wait for changes of the map of a hashmap remote",
+		Help: `Return the changes of the map of a hashmap remote in use, e.g. by a mount
+or serve, after the given generation, waiting for the next change if there
+is none yet. Calling it again with the returned generation follows the
+changes as they happen, without notifications of the base.
+
+Only the changes made through this remote are reported, the last 1024 of
+them are kept.
+
+Params:
+  - fs = the hashmap remote, e.g. "hashmap:"
+  - since = the generation of the last event seen, defaults to the
+    current generation, i.e. only new events are returned
+  - timeout = how long to wait for an event, defaults to 30s
+
+It returns:
+  - events = the events after since, each with the path, the source path
+    of moves, the operation, the client, the generation and the time
+  - generation = the generation of the last event, to pass as since
+  - lost = true if events after since were dropped from the log already
+
+Eg
+
+    rclone rc hashmap/listen fs=hashmap: since=42 timeout=1m
+`,
+	})
+}
+
+// eventLog keeps the recent change events of the map.
+type eventLog struct {
+	// client is the host name of the client making the changes.
+	client string
+	// mu protects the fields below.
+	mu sync.Mutex
+	// generation is the generation of the last event.
+	generation int64
+	// events are the last eventLogSize events, oldest first.
+	events []changeEvent
+	// wake is closed and replaced when an event is added.
+	wake chan struct{}
+}
+
+// newEventLog returns an empty event log.
+func newEventLog() *eventLog {
+	client, err := os.Hostname()
+	if err != nil {
+		client = "unknown"
+	}
+	return &eventLog{
+		client: client,
+		wake:   make(chan struct{}),
+	}
+}
+
+// add records the change of the absolute overlay path p by operation op and
+// returns the event. src is the previous path of moves and empty otherwise.
+func (l *eventLog) add(op, p, src string) changeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generation++
+	event := changeEvent{
+		Path:       p,
+		Src:        src,
+		Operation:  op,
+		Client:     l.client,
+		Generation: l.generation,
+		Time:       time.Now().UTC(),
+	}
+	if len(l.events) >= eventLogSize {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, event)
+	close(l.wake)
+	l.wake = make(chan struct{})
+	return event
+}
+
+// listenResult is the result of hashmap/listen.
+type listenResult struct {
+	// Events are the events after the generation asked for.
+	Events []changeEvent `json:"events"`
+	// Generation is the generation of the last event.
+	Generation int64 `json:"generation"`
+	// Lost is set if events after the generation asked for were dropped
+	// from the log.
+	Lost bool `json:"lost"`
+}
+
+// since returns the events after the generation since. If there are none,
+// it returns the channel which is closed on the next event.
+func (l *eventLog) since(since int64) (*listenResult, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := &listenResult{
+		Events:     make([]changeEvent, 0),
+		Generation: l.generation,
+	}
+	for _, event := range l.events {
+		if event.Generation > since {
+			result.Events = append(result.Events, event)
+		}
+	}
+	if len(l.events) > 0 && l.events[0].Generation > since+1 {
+		result.Lost = true
+	}
+	return result, l.wake
+}
+
+// listen returns the events after the generation since, waiting up to
+// timeout for the next event if there are none. A negative since selects
+// the current generation.
+func (l *eventLog) listen(ctx context.Context, since int64, timeout time.Duration) *listenResult {
+	if since < 0 {
+		l.mu.Lock()
+		since = l.generation
+		l.mu.Unlock()
+	}
+	result, wake := l.since(since)
+	if len(result.Events) > 0 || result.Lost {
+		return result
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wake:
+		result, _ = l.since(since)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return result
+}
+
+// rcListen implements the hashmap/listen rc call.
+func rcListen(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	fsys, err := rc.GetFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fsys.(*Fs)
+	if !ok {
+		return nil, errors.New("not a hashmap remote")
+	}
+	since, err := in.GetInt64("since")
+	if rc.IsErrParamNotFound(err) {
+		since, err = -1, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := in.GetDuration("timeout")
+	if rc.IsErrParamNotFound(err) {
+		timeout, err = defaultListenTimeout, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out = rc.Params{}
+	err = rc.Reshape(&out, f.events.listen(ctx, since, timeout))
+	return out, err
+}
@@ -0,0 +1,94 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// newObjects returns the objects of the files with the given names in the
+// directory entry. The map file is read once and the data objects are found
+// with a single listing of the hash directory instead of a lookup per file,
+// which matters for large directories and long --files-from lists.
+//
+// The files which can't be resolved this way, e.g. as their data object is
+// missing, are looked up with NewObject. If that fails too, a warning is
+// logged and they are dropped, so a single file does not fail the listing,
+// unless missing_data is error.
+func (f *Fs) newObjects(ctx context.Context, entry *dirEntry, names []string) (fs.DirEntries, error) {
+	entries := make(fs.DirEntries, 0, len(names))
+	if len(names) == 0 {
+		return entries, nil
+	}
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := f.dataObjects(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		remote := f.relative(path.Join(entry.Path, name))
+		if obj, ok, err := f.resolveObject(ctx, entry, files, objects, name, remote); err != nil {
+			return nil, err
+		} else if ok {
+			entries = append(entries, obj)
+			continue
+		}
+		obj, err := f.NewObject(ctx, remote)
+		switch {
+		case errors.Is(err, ErrDataMissing) && f.opt.MissingData == missingError:
+			return nil, fmt.Errorf("error fetching object %q: %w", remote, err)
+		case errors.Is(err, ErrDataMissing) || !errors.Is(err, fs.ErrorObjectNotFound):
+			fs.LogPrintf(fs.LogLevelWarning, obj, "error fetching object %q: %v", remote, err)
+			continue
+		case err != nil:
+			// The stale entry was removed with missing_data clean.
+			continue
+		}
+		entries = append(entries, obj)
+	}
+	return entries, nil
+}
+
+// resolveObject returns the object of the file name in the directory entry
+// from its map file files and the data objects of its hash directory. It
+// returns false if the file can't be resolved from them.
+func (f *Fs) resolveObject(ctx context.Context, entry *dirEntry, files map[string]string, objects map[string]fs.Object, name, remote string) (fs.Object, bool, error) {
+	fileHash, ok := entry.recordedHash(files, name)
+	if !ok {
+		return nil, false, nil
+	}
+	if _, ok := f.findDir(path.Join(entry.Path, name)); ok {
+		// NewObject reports the conflict with the directory.
+		return nil, false, nil
+	}
+	modTime, empty, err := entry.emptyFile(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if empty {
+		return &emptyObject{
+			fs:       f,
+			remote:   remote,
+			entry:    entry,
+			fileHash: fileHash,
+			modTime:  modTime,
+		}, true, nil
+	}
+	dataObj, ok := objects[fileHash]
+	if !ok {
+		return nil, false, nil
+	}
+	return object{
+		obj:      dataObj,
+		path:     remote,
+		basePath: path.Join(entry.Hash, fileHash),
+		fs:       f,
+		dirEntry: entry,
+	}, true, nil
+}
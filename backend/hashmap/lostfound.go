@@ -0,0 +1,147 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// lostFoundDir is the name of the synthetic directory exposing the hash
+// directories of the base which are not in the directory map.
+const lostFoundDir = "lost+found"
+
+// hasLostFound reports whether the synthetic lost+found directory is shown.
+//
+// It is only shown at the root of the overlay and not if there is a real
+// directory of the same name.
+func (f *Fs) hasLostFound() bool {
+	if !f.opt.LostAndFound || f.root != "" {
+		return false
+	}
+	_, ok := f.dirMap.get(lostFoundDir)
+	return !ok
+}
+
+// isLostFound reports whether remote is in the synthetic lost+found
+// directory.
+func (f *Fs) isLostFound(remote string) bool {
+	return f.hasLostFound() && (remote == lostFoundDir || strings.HasPrefix(remote, lostFoundDir+"/"))
+}
+
+// lostDirs returns the hash directories in the base which are not in the
+// directory map.
+func (f *Fs) lostDirs(ctx context.Context) ([]string, error) {
+	dirHashes, err := f.baseDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.loadDecoys(ctx); err != nil {
+		return nil, err
+	}
+	var lost []string
+	for _, dirHash := range dirHashes {
+		if _, ok := f.dirMap.byHash(dirHash); ok {
+			continue
+		}
+		if f.isDecoy(dirHash) {
+			continue
+		}
+		lost = append(lost, dirHash)
+	}
+	return lost, nil
+}
+
+// lostName returns the name of the lost hash directory dirHash inside the
+// synthetic lost+found directory. Hash directories nested by the layout are
+// flattened into a single level.
+func lostName(dirHash string) string {
+	return strings.ReplaceAll(dirHash, "/", "-")
+}
+
+// lostObjects returns the objects in the lost hash directory dirHash. They
+// are named after the name file if there is one and after the hash of the
+// file otherwise.
+func (f *Fs) lostObjects(ctx context.Context, dirHash string) ([]fs.Object, error) {
+	fileDirs, err := f.base.List(ctx, dirHash)
+	if err != nil {
+		return nil, err
+	}
+	var objects []fs.Object
+	for _, fileHash := range f.fileHashes(fileDirs) {
+		dataObj, err := f.base.NewObject(ctx, f.fileKey(path.Join(dirHash, fileHash), dataLeaf))
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := fileHash
+		if recorded, err := f.readNameFile(ctx, dirHash, fileHash); err == nil && path.Base(recorded) != "" {
+			name = path.Base(recorded)
+		}
+		objects = append(objects, object{
+			obj:      dataObj,
+			path:     path.Join(lostFoundDir, lostName(dirHash), name),
+			basePath: path.Join(dirHash, fileHash),
+			fs:       f,
+		})
+	}
+	return objects, nil
+}
+
+// listLostFound lists dir inside the synthetic lost+found directory.
+func (f *Fs) listLostFound(ctx context.Context, dir string) (fs.DirEntries, error) {
+	lost, err := f.lostDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dir == lostFoundDir {
+		entries := make(fs.DirEntries, 0, len(lost))
+		for _, dirHash := range lost {
+			entries = append(entries, fs.NewDir(path.Join(lostFoundDir, lostName(dirHash)), time.Time{}))
+		}
+		return entries, nil
+	}
+	name := strings.TrimPrefix(dir, lostFoundDir+"/")
+	dirHash := ""
+	for _, d := range lost {
+		if lostName(d) == name {
+			dirHash = d
+			break
+		}
+	}
+	if dirHash == "" {
+		return nil, fs.ErrorDirNotFound
+	}
+	objects, err := f.lostObjects(ctx, dirHash)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(fs.DirEntries, 0, len(objects))
+	for _, obj := range objects {
+		entries = append(entries, obj)
+	}
+	return entries, nil
+}
+
+// newLostObject finds the object at remote inside the synthetic lost+found
+// directory.
+func (f *Fs) newLostObject(ctx context.Context, remote string) (fs.Object, error) {
+	entries, err := f.listLostFound(ctx, path.Dir(remote))
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if obj, ok := entry.(fs.Object); ok && obj.Remote() == remote {
+			return obj, nil
+		}
+	}
+	return nil, fs.ErrorObjectNotFound
+}
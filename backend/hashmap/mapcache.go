@@ -0,0 +1,141 @@
+package hashmap
+
+import (
+	"container/list"
+	"sync"
+)
+
+// mapCache bounds the size of the map files held in memory with
+// cache_max_size by dropping the least recently used ones. Dropped map files
+// are read from the base again when they are used next.
+type mapCache struct {
+	// max is the maximum size of the cached map files in bytes.
+	max int64
+	// mu protects size, lru and elems.
+	mu sync.Mutex
+	// size is the estimated size of the cached map files in bytes.
+	size int64
+	// lru lists the directories whose map file is cached, the least
+	// recently used first.
+	lru *list.List
+	// elems maps the directories to their element in lru.
+	elems map[*dirEntry]*list.Element
+}
+
+// mapCacheItem is an element of mapCache.lru.
+type mapCacheItem struct {
+	entry *dirEntry
+	size  int64
+}
+
+// newMapCache returns a mapCache holding at most max bytes, or nil if max
+// is not positive.
+func newMapCache(max int64) *mapCache {
+	if max <= 0 {
+		return nil
+	}
+	return &mapCache{
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[*dirEntry]*list.Element),
+	}
+}
+
+// filesSize estimates the memory used by the map file files.
+func filesSize(files map[string]string) int64 {
+	size := int64(0)
+	for name, hash := range files {
+		size += int64(len(name) + len(hash) + 2)
+	}
+	return size
+}
+
+// use marks the cached map file files of entry as used. It is added to the
+// cache if it is not tracked, e.g. because it could not be dropped, like
+// with add.
+func (c *mapCache) use(entry *dirEntry, files map[string]string) []*dirEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	elem, ok := c.elems[entry]
+	if ok {
+		c.lru.MoveToBack(elem)
+	}
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+	return c.add(entry, filesSize(files))
+}
+
+// add records that the map file of entry with the given size was loaded or
+// written and returns the directories whose map file must be dropped to stay within the
+// maximum size. They must be dropped with drop once the lock of entry is
+// released.
+func (c *mapCache) add(entry *dirEntry, size int64) []*dirEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[entry]; ok {
+		c.size -= elem.Value.(*mapCacheItem).size
+		c.lru.Remove(elem)
+	}
+	c.elems[entry] = c.lru.PushBack(&mapCacheItem{entry: entry, size: size})
+	c.size += size
+	var victims []*dirEntry
+	for c.size > c.max && c.lru.Len() > 1 {
+		item := c.lru.Remove(c.lru.Front()).(*mapCacheItem)
+		delete(c.elems, item.entry)
+		c.size -= item.size
+		victims = append(victims, item.entry)
+	}
+	return victims
+}
+
+// reset forgets all cached map files after they were dropped.
+func (c *mapCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = 0
+	c.lru.Init()
+	c.elems = make(map[*dirEntry]*list.Element)
+}
+
+// drop drops the cached map files of the given directories and returns the
+// number dropped. Map files with changes which are not written yet are kept.
+func drop(entries []*dirEntry) int {
+	dropped := 0
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if entry.files != nil && entry.requested <= entry.written {
+			if entry.fs.opt.ExistenceIndex {
+				entry.index = entry.fs.nameIndex(entry.files)
+			}
+			entry.files, entry.types, entry.names = nil, nil, nil
+			dropped++
+		}
+		entry.mu.Unlock()
+	}
+	return dropped
+}
+
+// clearMapCache drops all cached map files and returns their number.
+func (f *Fs) clearMapCache() int {
+	entries := f.dirMap.entries()
+	f.mapCache.reset()
+	dropped := drop(entries)
+	// The map files are read from the base again, so their existence index
+	// is dropped as well.
+	for _, entry := range entries {
+		entry.mu.Lock()
+		entry.index = nil
+		entry.mu.Unlock()
+	}
+	return dropped
+}
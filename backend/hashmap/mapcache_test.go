@@ -0,0 +1,38 @@
+package hashmap
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesEviction(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, t.TempDir(), configmap.Simple{"cache_max_size": "1B"})
+	dirs := []string{"a", "b"}
+	for _, dir := range dirs {
+		require.NoError(t, f.Mkdir(ctx, dir))
+		putTestFile(t, f, dir+"/file.txt", "contents")
+	}
+	// Every load of a map file evicts the one of the other directory.
+	var wg sync.WaitGroup
+	for _, dir := range dirs {
+		entry, ok := f.dirMap.get(dir)
+		require.True(t, ok)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				files, err := entry.Files(ctx)
+				if !assert.NoError(t, err) || !assert.Len(t, files, 1, entry.Path) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,278 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// MergeDirs merges the contents of all the directories passed in into the
+// first one and rmdirs the other directories.
+//
+// The duplicates of their hash directories in the base are merged first.
+// Bases like Google Drive allow several directories of the same name, which
+// concurrent writers may create for the same hash directory, and only one
+// of them is seen through the overlay.
+func (f *Fs) MergeDirs(ctx context.Context, dirs []fs.Directory) error {
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	listings := make(map[string]fs.DirEntries)
+	entries := make([]*dirEntry, 0, len(dirs))
+	for _, dir := range dirs {
+		entry, ok := f.findDir(path.Join(f.root, dir.Remote()))
+		if !ok {
+			return fs.ErrorDirNotFound
+		}
+		if _, err := f.mergeDuplicates(ctx, entry, listings); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) < 2 {
+		return nil
+	}
+	dst := entries[0]
+	for _, entry := range entries[1:] {
+		if entry == dst {
+			continue
+		}
+		fs.Infof(dst.Path, "merging %q", entry.Path)
+		op, err := f.beginOperation(ctx, opNameDirMove, entry.Path, dst.Path)
+		if err != nil {
+			return err
+		}
+		if err := f.mergeDir(ctx, f, entry, dst.Path, op); err != nil {
+			if saveErr := op.save(ctx); saveErr != nil {
+				fs.Errorf(f, "failed to save the progress of the merge: %v", saveErr)
+			}
+			return err
+		}
+		if err := op.finish(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeDuplicatesDir merges the duplicated hash directories of all
+// directories below the overlay directory dir. It returns the number of
+// duplicates removed.
+func (f *Fs) mergeDuplicatesDir(ctx context.Context, dir string) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+	dir = path.Join(f.root, dir)
+	if _, ok := f.findDir(dir); !ok {
+		return 0, fs.ErrorDirNotFound
+	}
+	var entries []*dirEntry
+	for _, entry := range f.dirMap.sortedEntries() {
+		if p := entry.Path; dir == "" || p == dir || strings.HasPrefix(p, dir+"/") {
+			entries = append(entries, entry)
+		}
+	}
+	listings := make(map[string]fs.DirEntries)
+	merged := 0
+	for _, entry := range entries {
+		n, err := f.mergeDuplicates(ctx, entry, listings)
+		merged += n
+		if err != nil {
+			return merged, fmt.Errorf("error merging duplicates of %q: %w", entry.Path, err)
+		}
+	}
+	return merged, nil
+}
+
+// mergeDuplicates merges the duplicates of the hash directory of the
+// directory entry in the base into one with the MergeDirs feature of the
+// base and reconciles their contents. It returns the number of duplicates
+// removed. listings caches the listings of the parents of the hash
+// directories in the base.
+func (f *Fs) mergeDuplicates(ctx context.Context, entry *dirEntry, listings map[string]fs.DirEntries) (int, error) {
+	parent := path.Dir(entry.Hash)
+	if parent == "." {
+		parent = ""
+	}
+	listing, ok := listings[parent]
+	if !ok {
+		var err error
+		listing, err = f.base.List(ctx, parent)
+		if isDirMissing(err) {
+			// The base dropped the empty hash directories.
+			listing, err = nil, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		listings[parent] = listing
+	}
+	var dups []fs.Directory
+	for _, e := range listing {
+		if dir, ok := e.(fs.Directory); ok && dir.Remote() == entry.Hash {
+			dups = append(dups, dir)
+		}
+	}
+	if len(dups) < 2 {
+		return 0, nil
+	}
+	fs.Logf(entry.Path, "merging %d duplicates of hash directory %q", len(dups), entry.Hash)
+	if err := f.mergeBaseDirs(ctx, dups); err != nil {
+		return 0, err
+	}
+	return len(dups) - 1, f.reconcileHashDir(ctx, entry)
+}
+
+// mergeBaseDirs merges the duplicated directories dirs of the base.
+func (f *Fs) mergeBaseDirs(ctx context.Context, dirs []fs.Directory) error {
+	do := f.base.Features().MergeDirs
+	if do == nil {
+		return errors.New("can't merge duplicate hash directories: the base doesn't support MergeDirs")
+	}
+	if err := do(ctx, dirs); err != nil {
+		return f.checkHalt(fmt.Errorf("error merging hash directories: %w", err))
+	}
+	f.noteWrite(dirs[0].Remote())
+	return nil
+}
+
+// reconcileHashDir reconciles the contents of the hash directory of the
+// directory entry after its duplicates were merged: the duplicated map files
+// are merged into one, duplicated file hash directories are merged, and of
+// duplicated objects the most recently modified one is kept.
+func (f *Fs) reconcileHashDir(ctx context.Context, entry *dirEntry) error {
+	listing, err := f.base.List(ctx, entry.Hash)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string][]fs.Directory)
+	objects := make(map[string][]fs.Object)
+	for _, e := range listing {
+		switch x := e.(type) {
+		case fs.Directory:
+			dirs[x.Remote()] = append(dirs[x.Remote()], x)
+		case fs.Object:
+			objects[x.Remote()] = append(objects[x.Remote()], x)
+		}
+	}
+	for remote, dups := range dirs {
+		if len(dups) < 2 {
+			continue
+		}
+		if err := f.mergeBaseDirs(ctx, dups); err != nil {
+			return err
+		}
+		if child, ok := f.dirMap.byHash(remote); ok {
+			// The hash directory of a child with nested layouts.
+			err = f.reconcileHashDir(ctx, child)
+		} else {
+			err = f.keepNewest(ctx, remote)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	mapRemote := path.Join(entry.Hash, "map")
+	for remote, dups := range objects {
+		if len(dups) < 2 {
+			continue
+		}
+		if remote == mapRemote {
+			err = f.mergeMapFiles(ctx, entry, dups)
+		} else {
+			err = removeOlder(ctx, dups)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepNewest removes all but the most recently modified of the duplicated
+// objects in the directory dir of the base.
+func (f *Fs) keepNewest(ctx context.Context, dir string) error {
+	listing, err := f.base.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	objects := make(map[string][]fs.Object)
+	for _, e := range listing {
+		if o, ok := e.(fs.Object); ok {
+			objects[o.Remote()] = append(objects[o.Remote()], o)
+		}
+	}
+	for _, dups := range objects {
+		if len(dups) < 2 {
+			continue
+		}
+		if err := removeOlder(ctx, dups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOlder removes all but the most recently modified of the duplicated
+// objects objs.
+func removeOlder(ctx context.Context, objs []fs.Object) error {
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].ModTime(ctx).After(objs[j].ModTime(ctx))
+	})
+	for _, o := range objs[1:] {
+		fs.Infof(o, "removing older duplicate")
+		if err := o.Remove(ctx); err != nil {
+			return fmt.Errorf("error removing duplicate %q: %w", o.Remote(), err)
+		}
+	}
+	return nil
+}
+
+// mergeMapFiles merges the duplicated map files maps of the directory entry
+// into one holding the files of all of them. Of the files recorded with
+// different hashes, the record of the most recently modified map file is
+// kept.
+func (f *Fs) mergeMapFiles(ctx context.Context, entry *dirEntry, maps []fs.Object) error {
+	sort.Slice(maps, func(i, j int) bool {
+		return maps[i].ModTime(ctx).After(maps[j].ModTime(ctx))
+	})
+	seen := make(map[string]struct{})
+	var records []mapRecord
+	for _, o := range maps {
+		in, err := o.Open(ctx)
+		if err != nil {
+			return fmt.Errorf("error opening map file: %w", err)
+		}
+		recorded, err := unmarshalRecords(in)
+		_ = in.Close()
+		if err != nil {
+			return fmt.Errorf("error reading map file: %w", err)
+		}
+		for _, record := range recorded {
+			if _, ok := seen[record.name]; ok {
+				continue
+			}
+			seen[record.name] = struct{}{}
+			records = append(records, record)
+		}
+	}
+	// Remove all but one map file, which the merged one replaces.
+	for _, o := range maps[1:] {
+		if err := o.Remove(ctx); err != nil {
+			return fmt.Errorf("error removing duplicate map file: %w", err)
+		}
+	}
+	for _, record := range records {
+		ht, hash := splitTypedHash(record.hash)
+		if err := entry.addRecord(ctx, record.name, hash, ht); err != nil {
+			return err
+		}
+	}
+	fs.Logf(entry.Path, "merged %d map files recording %d files", len(maps), len(records))
+	return entry.write(ctx)
+}
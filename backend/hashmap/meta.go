@@ -0,0 +1,145 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// limitMeta waits until the metadata transaction limiter allows another
+// request to the base. It does nothing if metadata_tps is not set.
+func (f *Fs) limitMeta(ctx context.Context) {
+	if f.metaLimiter == nil {
+		return
+	}
+	defer observeSince(metrics.metadataWait.WithLabelValues(f.name), time.Now())
+	if err := f.metaLimiter.Wait(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		fs.Errorf(f, "metadata token bucket error: %v", err)
+	}
+}
+
+// openMeta opens the internal metadata object at remote in the base. It
+// returns fs.ErrorObjectNotFound if the object does not exist.
+func (f *Fs) openMeta(ctx context.Context, remote string) (io.ReadCloser, error) {
+	f.limitMeta(ctx)
+	obj, err := f.newBaseObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return f.openMetaObject(ctx, obj)
+}
+
+// openMetaObject opens the internal metadata object obj of the base.
+func (f *Fs) openMetaObject(ctx context.Context, obj fs.Object) (io.ReadCloser, error) {
+	f.limitMeta(ctx)
+	in, err := obj.Open(ctx)
+	if err != nil || f.metaBandwidth == nil {
+		return in, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{f.metaReader(ctx, in), in}, nil
+}
+
+// putBytes writes data to the remote path in the base. It is used for
+// internal metadata objects.
+func (f *Fs) putBytes(ctx context.Context, remote string, data []byte) (fs.Object, error) {
+	objInfo := fakeObjInfo{
+		remote: remote,
+		fs:     f,
+		size:   int64(len(data)),
+	}
+	obj, err := f.putMeta(ctx, bytes.NewReader(data), objInfo)
+	if err != nil {
+		return nil, err
+	}
+	f.noteWrite(remote)
+	count(ctx, statMetadataBytes, objInfo.size)
+	if err := f.verifyWrite(ctx, obj, data); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// removeMeta removes the internal metadata object at remote in the base. It
+// does not return an error if the object does not exist.
+func (f *Fs) removeMeta(ctx context.Context, remote string) error {
+	f.limitMeta(ctx)
+	obj, err := f.base.NewObject(ctx, remote)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.limitMeta(ctx)
+	if err := obj.Remove(ctx); err != nil {
+		return err
+	}
+	f.forgetWrite(remote)
+	f.mirrorObject(remote)
+	return nil
+}
+
+// putMeta puts the internal metadata object src to the base. If the base
+// dropped the directory of the object, e.g. the hash directory of an empty
+// directory of the overlay, it is created again and the object put again.
+// The directories of the overlay are recorded in the map, so they don't
+// depend on the directories in the base.
+func (f *Fs) putMeta(ctx context.Context, in *bytes.Reader, src fakeObjInfo) (fs.Object, error) {
+	f.limitMeta(ctx)
+	obj, err := f.base.Put(ctx, f.metaReader(ctx, in), src)
+	if !isDirMissing(err) {
+		return obj, err
+	}
+	dir := path.Dir(src.remote)
+	if dir == "." {
+		return obj, err
+	}
+	fs.Debugf(f, "recreating directory %q dropped by the base", dir)
+	if err := f.mkdirMeta(ctx, dir); err != nil {
+		return nil, err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	f.limitMeta(ctx)
+	return f.base.Put(ctx, f.metaReader(ctx, in), src)
+}
+
+// metaReader returns in limited by metadata_bwlimit, if set.
+func (f *Fs) metaReader(ctx context.Context, in io.Reader) io.Reader {
+	if f.metaBandwidth == nil {
+		return in
+	}
+	return &limitedReader{ctx: ctx, in: in, limiter: f.metaBandwidth}
+}
+
+// isDirMissing reports whether err means that a directory in the base does
+// not exist. Not all bases translate the errors of the file system to
+// fs.ErrorDirNotFound.
+func isDirMissing(err error) bool {
+	return errors.Is(err, fs.ErrorDirNotFound) || errors.Is(err, os.ErrNotExist)
+}
+
+// mkdirMeta creates the internal directory dir in the base.
+//
+// It does nothing if the base can't have empty directories, e.g. on bucket
+// based remotes, as directories only exist implicitly through the objects
+// in them there. The existence of the directories of the overlay is
+// recorded in the map regardless.
+func (f *Fs) mkdirMeta(ctx context.Context, dir string) error {
+	if !f.base.Features().CanHaveEmptyDirectories {
+		f.trace("mkdir %q: skipped, base has no directories", dir)
+		return nil
+	}
+	f.limitMeta(ctx)
+	return f.base.Mkdir(ctx, dir)
+}
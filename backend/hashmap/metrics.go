@@ -0,0 +1,106 @@
+package hashmap
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// metrics are the Prometheus metrics of the overlay operations. They are
+// registered with the default registry and therefore served by the metrics
+// endpoint of the rc server.
+//
+// All metrics are labelled with the name of the remote.
+var metrics = struct {
+	mapLoads       *prometheus.CounterVec
+	mapWrites      *prometheus.CounterVec
+	mapWriteTime   *prometheus.HistogramVec
+	nameFileWrites *prometheus.CounterVec
+	cacheHits      *prometheus.CounterVec
+	cacheMisses    *prometheus.CounterVec
+	metadataWait   *prometheus.HistogramVec
+}{
+	mapLoads: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "map_loads_total",
+		Help:      "Number of map files loaded from the base.",
+	}, []string{"remote", "kind"}),
+	mapWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "map_writes_total",
+		Help:      "Number of map files written to the base.",
+	}, []string{"remote", "kind"}),
+	mapWriteTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "map_write_duration_seconds",
+		Help:      "Time taken to write map files to the base.",
+	}, []string{"remote", "kind"}),
+	nameFileWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "name_file_writes_total",
+		Help:      "Number of name files written to the base.",
+	}, []string{"remote"}),
+	cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "cache_hits_total",
+		Help:      "Number of lookups of directory map files served from memory.",
+	}, []string{"remote"}),
+	cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "cache_misses_total",
+		Help:      "Number of lookups of directory map files which had to load them.",
+	}, []string{"remote"}),
+	metadataWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rclone",
+		Subsystem: "hashmap",
+		Name:      "metadata_wait_seconds",
+		Help:      "Time spent waiting for the metadata transaction limiter.",
+	}, []string{"remote"}),
+}
+
+func init() {
+	prometheus.MustRegister(
+		metrics.mapLoads,
+		metrics.mapWrites,
+		metrics.mapWriteTime,
+		metrics.nameFileWrites,
+		metrics.cacheHits,
+		metrics.cacheMisses,
+		metrics.metadataWait,
+	)
+}
+
+// Kinds of map files used as label values.
+const (
+	kindRoot = "root"
+	kindDir  = "dir"
+)
+
+// Counters added to the stats of the job, so the overhead of the overlay
+// shows up in the end of run stats and in core/stats.
+const (
+	statNameFiles     = "hashmapNameFiles"
+	statMapWrites     = "hashmapMapWrites"
+	statMetadataBytes = "hashmapMetaBytes"
+	statCacheHits     = "hashmapCacheHits"
+	statQueuedWrites  = "hashmapQueuedWrites"
+	statFixed         = "hashmapFixed"
+)
+
+// count adds n to the counter name of the stats of the job running in ctx.
+func count(ctx context.Context, name string, n int64) {
+	accounting.Stats(ctx).Count(name, n)
+}
+
+// observeSince records the time elapsed since start in the histogram.
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,214 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// metaMirror copies the metadata of the overlay, i.e. the directory map, the
+// map files and the name files, to the remote configured with
+// metadata_mirror in the background.
+//
+// Only the paths which changed are queued. They are copied from the base
+// when the mirror gets to them, so a path changed many times is copied once
+// and the mirror converges to the state of the base even if the changes
+// are processed out of order.
+type metaMirror struct {
+	fs fs.Fs
+	// mu protects pending and closed.
+	mu     sync.Mutex
+	closed bool
+	// pending maps the paths in the base waiting to be mirrored to whether
+	// they are directories.
+	pending map[string]bool
+	// wake is signalled when paths are queued.
+	wake chan struct{}
+	// done is closed when the mirror has stopped.
+	done chan struct{}
+}
+
+// startMirror starts mirroring the metadata if metadata_mirror is set.
+func (f *Fs) startMirror(ctx context.Context) error {
+	if f.opt.MetadataMirror == "" {
+		return nil
+	}
+	if f.opt.MetadataMirror == f.opt.Remote {
+		return errors.New("metadata_mirror must not be the remote of the overlay")
+	}
+	mirrorFs, err := cache.Get(ctx, f.opt.MetadataMirror)
+	if err != nil && err != fs.ErrorIsFile {
+		return fmt.Errorf("failed to make metadata mirror %q: %w", f.opt.MetadataMirror, err)
+	}
+	m := &metaMirror{
+		fs:      mirrorFs,
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	// Keep the mirror alive until this Fs is garbage-collected.
+	cache.PinUntilFinalized(mirrorFs, m)
+	f.mirror = m
+	go f.runMirror(m)
+	return nil
+}
+
+// stopMirror mirrors the queued paths and stops the mirror.
+func (f *Fs) stopMirror() {
+	m := f.mirror
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.wake)
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+// mirrorObject queues the metadata object at remote in the base to be
+// copied to the mirror, or removed from it if it no longer exists.
+func (f *Fs) mirrorObject(remote string) {
+	f.queueMirror(remote, false)
+}
+
+// mirrorDir queues the metadata objects in the directory dir in the base and
+// below it to be copied to the mirror. Objects in the mirror which no longer
+// exist in the base are removed.
+func (f *Fs) mirrorDir(dir string) {
+	f.queueMirror(dir, true)
+}
+
+// queueMirror queues the path p of the base for mirroring.
+func (f *Fs) queueMirror(p string, isDir bool) {
+	m := f.mirror
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.pending[p] = m.pending[p] || isDir
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runMirror mirrors the queued paths until the mirror is stopped.
+func (f *Fs) runMirror(m *metaMirror) {
+	defer close(m.done)
+	ctx := context.Background()
+	for range m.wake {
+		f.mirrorPending(ctx, m)
+	}
+	// Mirror what was queued before the mirror was stopped.
+	f.mirrorPending(ctx, m)
+}
+
+// mirrorPending mirrors the paths queued so far.
+func (f *Fs) mirrorPending(ctx context.Context, m *metaMirror) {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[string]bool)
+	m.mu.Unlock()
+	for p, isDir := range pending {
+		var err error
+		if isDir {
+			err = f.mirrorDirNow(ctx, m, p)
+		} else {
+			err = f.mirrorObjectNow(ctx, m, p)
+		}
+		if err != nil {
+			fs.Errorf(f, "metadata mirror: failed to mirror %q: %v", p, err)
+		}
+	}
+}
+
+// mirrorObjectNow copies the object at remote from the base to the mirror,
+// or removes it from the mirror if it does not exist in the base.
+func (f *Fs) mirrorObjectNow(ctx context.Context, m *metaMirror, remote string) error {
+	in, err := f.openMeta(ctx, remote)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		dst, err := m.fs.NewObject(ctx, remote)
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return dst.Remove(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	// Read the object first as it may change while it is copied, in which
+	// case it is queued again.
+	data, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return err
+	}
+	src := fakeObjInfo{
+		remote: remote,
+		fs:     f,
+		size:   int64(len(data)),
+	}
+	_, err = m.fs.Put(ctx, bytes.NewReader(data), src)
+	return err
+}
+
+// mirrorDirNow replaces the directory dir in the mirror with the metadata
+// objects in the directory dir in the base.
+func (f *Fs) mirrorDirNow(ctx context.Context, m *metaMirror, dir string) error {
+	err := operations.Purge(ctx, m.fs, dir)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return err
+	}
+	f.limitMeta(ctx)
+	if _, err := f.base.List(ctx, dir); errors.Is(err, fs.ErrorDirNotFound) {
+		// The directory was removed.
+		return nil
+	}
+	var remotes []string
+	err = walk.ListR(ctx, f.base, dir, true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(o fs.Object) {
+			if f.isMirrored(o.Remote()) {
+				remotes = append(remotes, o.Remote())
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		if err := f.mirrorObjectNow(ctx, m, remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMirrored reports whether the object at remote in the base is metadata
+// which is mirrored.
+func (f *Fs) isMirrored(remote string) bool {
+	if path.Base(remote) == "map" || remote == layoutMarker || remote == recoveredMap {
+		return true
+	}
+	_, leaf, ok := f.splitFileKey(remote)
+	return ok && leaf == nameLeaf
+}
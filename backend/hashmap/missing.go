@@ -0,0 +1,44 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Policies for files in the map whose data object does not exist in the
+// base.
+const (
+	// missingWarn drops the files from listings with a warning.
+	missingWarn = "warn"
+	// missingError fails listings containing the files.
+	missingError = "error"
+	// missingClean removes the files from the map file together with their
+	// name file.
+	missingClean = "clean"
+)
+
+// handleMissingData applies the missing_data policy to the file name in the
+// directory entry stored at basePath, whose data object does not exist.
+// missing is the error returned for it unless it is removed, in which case
+// fs.ErrorObjectNotFound is returned.
+func (f *Fs) handleMissingData(ctx context.Context, entry *dirEntry, name, basePath string, missing error) error {
+	if f.opt.MissingData != missingClean || f.checkWritable() != nil {
+		return missing
+	}
+	overlay := path.Join(entry.Path, name)
+	fs.Infof(overlay, "removing file whose data object is missing from the map (%s)", basePath)
+	if err := entry.removeFile(ctx, name); err != nil {
+		return err
+	}
+	if err := entry.write(ctx); err != nil {
+		return err
+	}
+	if err := f.purgeFile(ctx, basePath); err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		fs.Errorf(overlay, "failed to remove name file of file whose data object is missing: %v", err)
+	}
+	f.notifyChange(opRemove, overlay, "")
+	return fs.ErrorObjectNotFound
+}
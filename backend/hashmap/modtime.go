@@ -0,0 +1,43 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// recordedModTime returns the modification time recorded in the name file of
+// the file at basePath with store_mod_times. It returns false if none is
+// recorded, e.g. for files written before it was set.
+func (f *Fs) recordedModTime(ctx context.Context, basePath string) (time.Time, bool) {
+	dirHash, fileHash := path.Split(basePath)
+	n, err := f.readNameAttributes(ctx, path.Clean(dirHash), fileHash)
+	if err != nil {
+		if !errors.Is(err, fs.ErrorObjectNotFound) {
+			fs.Debugf(f, "failed to read modification time of %q: %v", basePath, err)
+		}
+		return time.Time{}, false
+	}
+	return n.modTime, !n.modTime.IsZero()
+}
+
+// recordModTime records the modification time t in the name file of the
+// file at basePath with store_mod_times, keeping the other attributes
+// recorded. overlayPath is the absolute overlay path of the file.
+func (f *Fs) recordModTime(ctx context.Context, basePath, overlayPath string, t time.Time) error {
+	dirHash, fileHash := path.Split(basePath)
+	dirHash = path.Clean(dirHash)
+	n, err := f.readNameAttributes(ctx, dirHash, fileHash)
+	switch {
+	case errors.Is(err, fs.ErrorObjectNotFound):
+		n = nameFile{size: -1}
+	case err != nil:
+		return err
+	}
+	n.path = overlayPath
+	n.modTime = t
+	return f.writeNameFile(ctx, nil, dirHash, fileHash, n)
+}
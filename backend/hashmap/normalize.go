@@ -0,0 +1,58 @@
+package hashmap
+
+import (
+	"path"
+	"strings"
+)
+
+// Modes of normalize_paths.
+const (
+	// normalizeOff uses the paths as they are.
+	normalizeOff = "off"
+	// normalizeSeparators turns backslashes into slashes and removes drive
+	// letter prefixes.
+	normalizeSeparators = "separators"
+	// normalizeWindows also trims the trailing dots and spaces Windows
+	// ignores from every path segment.
+	normalizeWindows = "windows"
+)
+
+// normalize returns the canonical form of the overlay path p with
+// normalize_paths, so paths written by Windows clients map to the same
+// entries as their canonical equivalents.
+func (f *Fs) normalize(p string) string {
+	if f.opt.NormalizePaths == normalizeOff || f.opt.NormalizePaths == "" {
+		return p
+	}
+	p = strings.ReplaceAll(p, `\`, "/")
+	if len(p) >= 2 && p[1] == ':' && isDriveLetter(p[0]) {
+		p = p[2:]
+	}
+	segments := strings.Split(p, "/")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if f.opt.NormalizePaths == normalizeWindows && segment != "." && segment != ".." {
+			if trimmed := strings.TrimRight(segment, ". "); trimmed != "" {
+				segment = trimmed
+			}
+		}
+		if segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// normalizeName returns the canonical form of the name of a file, which is
+// the last segment of its normalized form.
+func (f *Fs) normalizeName(name string) string {
+	if f.opt.NormalizePaths == normalizeOff || f.opt.NormalizePaths == "" {
+		return name
+	}
+	return path.Base(f.normalize(name))
+}
+
+// isDriveLetter reports whether c is a letter of a Windows drive.
+func isDriveLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,197 @@
+package hashmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// operationMarker is the object at the root of the base recording the
+// progress of a long running namespace operation with resumable_operations.
+const operationMarker = "map.operation"
+
+// operationCheckpoint is the number of directories after which the progress
+// of an operation is written to the base. The steps of the operations can be
+// repeated, so the directories processed since the last checkpoint are
+// simply processed again when the operation is resumed.
+const operationCheckpoint = 100
+
+// Long running namespace operations.
+const (
+	opNamePurge    = "purge"
+	opNameDirMove  = "dirmove"
+	opNameReencode = "reencode"
+)
+
+// operation is the progress of a long running namespace operation. It is
+// persisted in the base so an interrupted run can be resumed by running the
+// same operation again.
+type operation struct {
+	// Op is the name of the operation.
+	Op string `json:"op"`
+	// Src is the absolute overlay path the operation applies to.
+	Src string `json:"src"`
+	// Dst is the absolute overlay destination path of moves.
+	Dst string `json:"dst,omitempty"`
+	// Started is the time the operation was started first.
+	Started time.Time `json:"started"`
+	// Moved is set once the hash directory of the whole tree was moved
+	// with nested layouts.
+	Moved bool `json:"moved,omitempty"`
+	// Done are the directories which were processed completely.
+	Done []string `json:"done"`
+
+	// f is the Fs the operation runs on. It is nil if the operation is not
+	// persisted.
+	f *Fs
+	// done is the set of Done.
+	done map[string]struct{}
+	// unsaved is the number of directories processed since the last
+	// checkpoint.
+	unsaved int
+	// resumed is set if the operation continues an interrupted run.
+	resumed bool
+}
+
+// readOperation reads the progress of the interrupted operation from the
+// base. It returns nil if there is none.
+func (f *Fs) readOperation(ctx context.Context) (*operation, error) {
+	in, err := f.openMeta(ctx, operationMarker)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening operation marker: %w", err)
+	}
+	data, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading operation marker: %w", err)
+	}
+	op := &operation{}
+	if err := json.Unmarshal(data, op); err != nil {
+		return nil, fmt.Errorf("error parsing operation marker: %w", err)
+	}
+	return op, nil
+}
+
+// checkOperation logs how to resume the operation which was interrupted in
+// a previous run, if any.
+func (f *Fs) checkOperation(ctx context.Context) error {
+	if !f.opt.ResumableOperations {
+		return nil
+	}
+	op, err := f.readOperation(ctx)
+	if err != nil || op == nil {
+		return err
+	}
+	fs.Logf(f, "Found a %s of %s which was interrupted after %d directories, run it again to resume it", op.Op, op.describe(), len(op.Done))
+	return nil
+}
+
+// describe returns the paths of the operation for log messages.
+func (op *operation) describe() string {
+	if op.Dst != "" {
+		return fmt.Sprintf("%q to %q started at %s", op.Src, op.Dst, op.Started.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%q started at %s", op.Src, op.Started.Format(time.RFC3339))
+}
+
+// beginOperation starts the operation name on the absolute overlay paths src
+// and dst. With resumable_operations, it continues the same operation if it
+// was interrupted in a previous run and persists its progress in the base.
+// Otherwise the operation is only tracked in memory.
+func (f *Fs) beginOperation(ctx context.Context, name, src, dst string) (*operation, error) {
+	op := &operation{
+		Op:      name,
+		Src:     src,
+		Dst:     dst,
+		Started: time.Now(),
+		done:    make(map[string]struct{}),
+	}
+	if !f.opt.ResumableOperations {
+		return op, nil
+	}
+	op.f = f
+	previous, err := f.readOperation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case previous == nil:
+	case previous.Op == name && previous.Src == src && previous.Dst == dst:
+		fs.Logf(f, "Resuming the %s of %s after %d directories", name, previous.describe(), len(previous.Done))
+		op.Started, op.Moved, op.Done = previous.Started, previous.Moved, previous.Done
+		for _, dir := range op.Done {
+			op.done[dir] = struct{}{}
+		}
+		op.resumed = true
+	default:
+		fs.Logf(f, "Discarding the progress of the interrupted %s of %s, run it again to finish it", previous.Op, previous.describe())
+	}
+	return op, op.save(ctx)
+}
+
+// isDone reports whether the directory dir was processed in an earlier run.
+func (op *operation) isDone(dir string) bool {
+	_, ok := op.done[dir]
+	return ok
+}
+
+// applied reports whether err of a step of the operation only means the
+// step was done in an earlier run already, after the last checkpoint: the
+// source of a move or the purged directory is gone, or the destination of a
+// move exists.
+func (op *operation) applied(err error) bool {
+	return op.resumed && (errors.Is(err, fs.ErrorDirNotFound) || errors.Is(err, fs.ErrorDirExists))
+}
+
+// markDone records that the directory dir was processed completely.
+func (op *operation) markDone(ctx context.Context, dir string) error {
+	op.done[dir] = struct{}{}
+	op.Done = append(op.Done, dir)
+	op.unsaved++
+	if op.unsaved < operationCheckpoint {
+		return nil
+	}
+	return op.save(ctx)
+}
+
+// markMoved records that the hash directory of the whole tree was moved.
+func (op *operation) markMoved(ctx context.Context) error {
+	op.Moved = true
+	return op.save(ctx)
+}
+
+// save writes the progress of the operation to the base.
+func (op *operation) save(ctx context.Context) error {
+	if op.f == nil {
+		return nil
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := op.f.putBytes(ctx, operationMarker, data); err != nil {
+		return fmt.Errorf("error writing operation marker: %w", err)
+	}
+	op.unsaved = 0
+	return nil
+}
+
+// finish removes the progress of the operation from the base once it
+// completed.
+func (op *operation) finish(ctx context.Context) error {
+	if op.f == nil {
+		return nil
+	}
+	if err := op.f.removeMeta(ctx, operationMarker); err != nil {
+		return fmt.Errorf("error removing operation marker: %w", err)
+	}
+	return nil
+}
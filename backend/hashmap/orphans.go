@@ -0,0 +1,160 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Severities of the orphans reported by the orphans command.
+const (
+	// severityError is data the map refers to but which is missing.
+	severityError = "error"
+	// severityWarning is data the map does not refer to, which may be lost
+	// files.
+	severityWarning = "warning"
+	// severityInfo is left over objects which are safe to remove.
+	severityInfo = "info"
+)
+
+// severityRank orders the severities from the most to the least severe.
+var severityRank = map[string]int{
+	severityError:   0,
+	severityWarning: 1,
+	severityInfo:    2,
+}
+
+// versionObject matches the names of the recorded versions of the map.
+var versionObject = regexp.MustCompile(`^map\.v[0-9]+$`)
+
+// orphan is an object in the base which is not referenced by the map, or a
+// map entry without data, reported by the orphans command.
+type orphan struct {
+	// Severity is one of error, warning or info.
+	Severity string `json:"severity"`
+	// Kind describes the orphan.
+	Kind string `json:"kind"`
+	// Base is the path in the base concerned.
+	Base string `json:"base"`
+	// Path is the overlay path concerned, if any.
+	Path string `json:"path,omitempty"`
+}
+
+// orphans returns the orphans in the base, the most severe first. It only
+// reads from the base and never deletes anything.
+func (f *Fs) orphans(ctx context.Context) ([]orphan, error) {
+	var found []orphan
+	report := func(severity, kind, base, overlay string) {
+		found = append(found, orphan{Severity: severity, Kind: kind, Base: base, Path: overlay})
+	}
+	// Objects at the root of the base.
+	rootEntries, err := f.base.List(ctx, "")
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, err
+	}
+	rootEntries.ForObject(func(o fs.Object) {
+		switch name := o.Remote(); {
+		case name == "map" || name == layoutMarker || name == recoveredMap || name == historyIndex || name == operationMarker || name == replicationMarker:
+		case versionObject.MatchString(name):
+		default:
+			report(severityInfo, "stray object", name, "")
+		}
+	})
+	// Hash directories which are not in the directory map.
+	lost, err := f.lostDirs(ctx)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, err
+	}
+	for _, dirHash := range lost {
+		report(severityWarning, "unreferenced hash directory", dirHash, path.Join(lostFoundDir, lostName(dirHash)))
+	}
+	// The hash directories of the directories in the map.
+	entries := f.dirMap.sortedEntries()
+	p := newProgress(ctx, "orphans", len(entries))
+	defer p.finish()
+	for _, entry := range entries {
+		err := f.dirOrphans(ctx, entry, report)
+		p.scan(entry.Path, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Severity != found[j].Severity {
+			return severityRank[found[i].Severity] < severityRank[found[j].Severity]
+		}
+		return found[i].Base < found[j].Base
+	})
+	return found, nil
+}
+
+// dirOrphans reports the orphans in the hash directory of the directory
+// entry.
+func (f *Fs) dirOrphans(ctx context.Context, entry *dirEntry, report func(severity, kind, base, overlay string)) error {
+	files, types, err := f.readTypedFileMap(ctx, entry.Hash)
+	if err != nil {
+		report(severityError, "unreadable map file", path.Join(entry.Hash, "map"), entry.Path)
+		return nil
+	}
+	dropEmpty(files, types)
+	baseEntries, err := f.base.List(ctx, entry.Hash)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		baseEntries, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	var objects map[string]fs.Object
+	if len(files) > 0 {
+		objects, err = f.dataObjects(ctx, entry)
+		if err != nil {
+			return err
+		}
+	}
+	referenced := make(map[string]struct{}, len(files))
+	for name, fileHash := range files {
+		referenced[fileHash] = struct{}{}
+		if _, ok := objects[fileHash]; !ok {
+			report(severityError, "missing data", f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf), path.Join(entry.Path, name))
+		}
+	}
+	// The hash directories of the children may be nested by the layout.
+	for _, child := range f.dirMap.children(entry) {
+		if path.Dir(child.Hash) == entry.Hash {
+			referenced[path.Base(child.Hash)] = struct{}{}
+		}
+	}
+	for _, fileHash := range f.fileHashes(baseEntries) {
+		if _, ok := referenced[fileHash]; ok {
+			continue
+		}
+		basePath := path.Join(entry.Hash, fileHash)
+		since, pending, err := f.pendingSince(ctx, entry.Hash, fileHash)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pending && time.Since(since) <= pendingGrace:
+			// The upload is probably still in progress.
+		case pending:
+			report(severityInfo, "interrupted upload", basePath, entry.Path)
+		default:
+			report(severityWarning, "unreferenced file directory", basePath, entry.Path)
+		}
+	}
+	baseEntries.ForObject(func(o fs.Object) {
+		if path.Base(o.Remote()) == "map" {
+			return
+		}
+		if _, _, ok := f.splitFileKey(o.Remote()); ok && f.joinedKeys() {
+			return
+		}
+		report(severityInfo, "stray object", o.Remote(), entry.Path)
+	})
+	return nil
+}
@@ -0,0 +1,63 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// pendingGrace is the age after which a pending marker is considered to be
+// left over by an interrupted upload rather than belong to an upload in
+// progress.
+const pendingGrace = time.Hour
+
+// pendingRemote returns the path of the pending marker of the file with the
+// given hashes.
+func (f *Fs) pendingRemote(dirHash, fileHash string) string {
+	return f.fileKey(path.Join(dirHash, fileHash), pendingLeaf)
+}
+
+// putPending writes the pending marker of the file with the given hashes,
+// recording the time the upload started.
+func (f *Fs) putPending(ctx context.Context, dirHash, fileHash string) error {
+	content := time.Now().UTC().Format(time.RFC3339) + "\n"
+	if _, err := f.putBytes(ctx, f.pendingRemote(dirHash, fileHash), []byte(content)); err != nil {
+		return fmt.Errorf("error creating pending marker: %w", err)
+	}
+	return nil
+}
+
+// clearPending removes the pending marker of the file with the given
+// hashes.
+func (f *Fs) clearPending(ctx context.Context, dirHash, fileHash string) error {
+	return f.removeMeta(ctx, f.pendingRemote(dirHash, fileHash))
+}
+
+// pendingSince returns the time the upload of the file with the given
+// hashes started if it has a pending marker.
+func (f *Fs) pendingSince(ctx context.Context, dirHash, fileHash string) (time.Time, bool, error) {
+	in, err := f.openMeta(ctx, f.pendingRemote(dirHash, fileHash))
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer in.Close()
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error reading pending marker: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+	if err != nil {
+		// Treat unreadable markers as old so they are cleaned up.
+		return time.Time{}, true, nil
+	}
+	return t, true, nil
+}
@@ -0,0 +1,73 @@
+package hashmap
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// progress reports the progress of long running backend commands through
+// the accounting stats, so it is shown with --progress and by core/stats.
+//
+// Scanned items are reported as checks, items still to be scanned as the
+// check queue and fixed items as the statFixed counter.
+type progress struct {
+	// stats is where the progress is reported to.
+	stats *accounting.StatsInfo
+	// what is the name of the operation, used for logging.
+	what string
+	// remaining is the number of items known but not scanned yet.
+	remaining int
+	// scanned is the number of items scanned.
+	scanned int
+	// fixed is the number of items fixed.
+	fixed int
+	// errors is the number of items which failed.
+	errors int
+}
+
+// newProgress starts reporting the progress of the operation what with total
+// items known up front.
+func newProgress(ctx context.Context, what string, total int) *progress {
+	p := &progress{
+		stats: accounting.Stats(ctx),
+		what:  what,
+	}
+	p.add(total)
+	return p
+}
+
+// add records n more items to scan.
+func (p *progress) add(n int) {
+	p.remaining += n
+	p.stats.SetCheckQueue(p.remaining, 0)
+}
+
+// scan records that the item remote was scanned with the result err.
+func (p *progress) scan(remote string, err error) {
+	p.scanned++
+	if p.remaining > 0 {
+		p.remaining--
+	}
+	p.stats.SetCheckQueue(p.remaining, 0)
+	p.stats.DoneChecking(remote)
+	if err != nil {
+		p.errors++
+		_ = p.stats.Error(err)
+		fs.Errorf(remote, "%s: %v", p.what, err)
+	}
+}
+
+// fix records that the item remote was fixed.
+func (p *progress) fix(remote string) {
+	p.fixed++
+	p.stats.Count(statFixed, 1)
+	fs.Infof(remote, "%s: fixed", p.what)
+}
+
+// finish logs the summary of the operation.
+func (p *progress) finish() {
+	p.stats.SetCheckQueue(0, 0)
+	fs.Infof(nil, "%s: %d scanned, %d fixed, %d errors", p.what, p.scanned, p.fixed, p.errors)
+}
@@ -0,0 +1,26 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	ctx := accounting.WithStatsGroup(context.Background(), "TestProgress")
+	stats := accounting.Stats(ctx)
+	p := newProgress(ctx, "test", 2)
+	p.add(1)
+	p.scan("a", nil)
+	p.fix("a")
+	p.scan("b", errors.New("boom"))
+	p.finish()
+	assert.Equal(t, 1, p.fixed)
+	assert.Equal(t, 1, p.errors)
+	assert.Equal(t, int64(1), stats.Count(statFixed, 0))
+	assert.Equal(t, int64(2), stats.GetChecks())
+	assert.Equal(t, int64(1), stats.GetErrors())
+}
@@ -0,0 +1,150 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fspath"
+)
+
+// errRawReadOnly is returned when trying to modify the raw view.
+var errRawReadOnly = errors.New("the raw view of the base is read only")
+
+// rawFs is a read only view of the base, exposing the hash directories,
+// name files, map files and data objects as they are stored.
+type rawFs struct {
+	fs.Fs
+	// name is the name of the Fs as passed into NewFs.
+	name string
+	// root is the path to the root of the Fs as passed into NewFs.
+	root string
+	// feat is the list of features supported by the FS computed in newRawFs.
+	feat *fs.Features
+}
+
+// newRawFs constructs the raw view of the base configured in opt.
+func newRawFs(ctx context.Context, name, rpath string, opt *Options) (fs.Fs, error) {
+	baseFs, err := cache.Get(ctx, fspath.JoinRootPath(opt.Remote, rpath))
+	if err != fs.ErrorIsFile && err != nil {
+		return nil, fmt.Errorf("failed to make remote %q to wrap: %w", opt.Remote, err)
+	}
+	f := &rawFs{
+		Fs:   baseFs,
+		name: name,
+		root: rpath,
+	}
+	f.feat = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+		ReadMimeType:            true,
+	}).Fill(ctx, f).Mask(ctx, baseFs)
+	cache.PinUntilFinalized(baseFs, f)
+	return f, err
+}
+
+// Name returns the name of the Fs as passed into NewFs.
+func (f *rawFs) Name() string {
+	return f.name
+}
+
+// Root returns the root of the Fs as passed into NewFs.
+func (f *rawFs) Root() string {
+	return f.root
+}
+
+// String returns a string description of the FS.
+func (f *rawFs) String() string {
+	return fmt.Sprintf("Hashmap raw view '%s:%s'", f.name, f.root)
+}
+
+// Features returns the list of features supported by the FS.
+func (f *rawFs) Features() *fs.Features {
+	return f.feat
+}
+
+// List lists the base directory dir.
+func (f *rawFs) List(ctx context.Context, dir string) (fs.DirEntries, error) {
+	entries, err := f.Fs.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if obj, ok := entry.(fs.Object); ok {
+			entries[i] = rawObject{Object: obj, fs: f}
+		}
+	}
+	return entries, nil
+}
+
+// NewObject finds the base object at remote.
+func (f *rawFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	obj, err := f.Fs.NewObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return rawObject{Object: obj, fs: f}, nil
+}
+
+// Put refuses to write to the raw view.
+func (f *rawFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return nil, errRawReadOnly
+}
+
+// Mkdir refuses to write to the raw view.
+func (f *rawFs) Mkdir(ctx context.Context, dir string) error {
+	return errRawReadOnly
+}
+
+// Rmdir refuses to write to the raw view.
+func (f *rawFs) Rmdir(ctx context.Context, dir string) error {
+	return errRawReadOnly
+}
+
+// UnWrap returns the base Fs.
+func (f *rawFs) UnWrap() fs.Fs {
+	return f.Fs
+}
+
+// rawObject is a read only base object of the raw view.
+type rawObject struct {
+	fs.Object
+	// fs is the raw view the object belongs to.
+	fs *rawFs
+}
+
+// Fs returns the raw view the object belongs to.
+func (o rawObject) Fs() fs.Info {
+	return o.fs
+}
+
+// SetModTime refuses to write to the raw view.
+func (o rawObject) SetModTime(ctx context.Context, t time.Time) error {
+	return errRawReadOnly
+}
+
+// Update refuses to write to the raw view.
+func (o rawObject) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	return errRawReadOnly
+}
+
+// Remove refuses to write to the raw view.
+func (o rawObject) Remove(ctx context.Context) error {
+	return errRawReadOnly
+}
+
+// UnWrap returns the base object.
+func (o rawObject) UnWrap() fs.Object {
+	return o.Object
+}
+
+// Check that interfaces are implemented.
+var (
+	_ fs.Fs              = (*rawFs)(nil)
+	_ fs.UnWrapper       = (*rawFs)(nil)
+	_ fs.Object          = rawObject{}
+	_ fs.ObjectUnWrapper = rawObject{}
+)
@@ -0,0 +1,263 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// Modes of read_through.
+const (
+	// readThroughOff only shows the files in the map.
+	readThroughOff = "off"
+	// readThroughRead also shows the plain objects of the base.
+	readThroughRead = "read"
+	// readThroughMigrate also shows the plain objects of the base and
+	// moves them into the overlay when they are opened.
+	readThroughMigrate = "migrate"
+)
+
+// readThrough reports whether the plain objects of the base are shown.
+func (f *Fs) readThrough() bool {
+	return f.opt.ReadThrough == readThroughRead || f.opt.ReadThrough == readThroughMigrate
+}
+
+// isHashName reports whether name looks like a hash directory of the layout
+// at the root of the base.
+func (f *Fs) isHashName(name string) bool {
+	n := len(f.hasher(""))
+	if f.layout == layoutSharded {
+		n = shardLength
+	}
+	if len(name) != n {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlain reports whether basePath is a plain object or directory of the
+// base, i.e. not one of the overlay.
+func (f *Fs) isPlain(basePath string) bool {
+	if f.isInternal(basePath) {
+		return false
+	}
+	first := strings.SplitN(basePath, "/", 2)[0]
+	return first != "" && !f.isHashName(first)
+}
+
+// newPlainObject returns the plain object of the base at the path of remote
+// if read_through is set. With read_through migrate it is moved into the
+// overlay first.
+func (f *Fs) newPlainObject(ctx context.Context, remote string) (fs.Object, error) {
+	basePath := path.Join(f.root, remote)
+	if !f.readThrough() || !f.isPlain(basePath) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	obj, err := f.base.NewObject(ctx, basePath)
+	if err != nil {
+		return nil, err
+	}
+	o := &plainObject{fs: f, remote: remote, obj: obj}
+	o.migrate(ctx)
+	return o, nil
+}
+
+// listPlain adds the plain objects and directories of the base at the path
+// of dir to the entries listed from the map. Entries of the map hide plain
+// entries of the same name. It returns fs.ErrorDirNotFound if the directory
+// is neither in the map nor in the base.
+func (f *Fs) listPlain(ctx context.Context, dir string, entries fs.DirEntries, mapped bool) (fs.DirEntries, error) {
+	baseEntries, err := f.base.List(ctx, path.Join(f.root, dir))
+	if errors.Is(err, fs.ErrorDirNotFound) && mapped {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		names[path.Base(entry.Remote())] = struct{}{}
+	}
+	for _, baseEntry := range baseEntries {
+		if _, ok := names[path.Base(baseEntry.Remote())]; ok || !f.isPlain(baseEntry.Remote()) {
+			continue
+		}
+		remote := strings.TrimPrefix(strings.TrimPrefix(baseEntry.Remote(), f.root), "/")
+		switch e := baseEntry.(type) {
+		case fs.Directory:
+			entries = append(entries, fs.NewDir(remote, e.ModTime(ctx)))
+		case fs.Object:
+			entries = append(entries, &plainObject{fs: f, remote: remote, obj: e})
+		}
+	}
+	return entries, nil
+}
+
+// mkdirPlainParent creates the parent directory of remote in the overlay if
+// it only exists as a plain directory of the base, so files can be written
+// to the directories shown by read_through.
+func (f *Fs) mkdirPlainParent(ctx context.Context, remote string) error {
+	parent := path.Dir(remote)
+	if parent == "." {
+		return nil
+	}
+	basePath := path.Join(f.root, parent)
+	if !f.isPlain(basePath) {
+		return nil
+	}
+	_, err := f.base.List(ctx, basePath)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Mkdir(ctx, parent)
+}
+
+// removePlain removes the plain object of the base at the path of remote
+// after remote was written to the overlay, so it does not show up again
+// once remote is removed.
+func (f *Fs) removePlain(ctx context.Context, remote string) {
+	basePath := path.Join(f.root, remote)
+	if !f.readThrough() || !f.isPlain(basePath) {
+		return
+	}
+	obj, err := f.base.NewObject(ctx, basePath)
+	if err != nil {
+		return
+	}
+	if err := obj.Remove(ctx); err != nil {
+		fs.Errorf(obj, "failed to remove plain object replaced in the overlay: %v", err)
+	}
+}
+
+// plainObject is an object at its plain path in the base shown with
+// read_through. Once it is written or migrated, it refers to the object in
+// the overlay instead.
+type plainObject struct {
+	fs     *Fs
+	remote string
+	// obj is the plain object, or the object in the overlay after it was
+	// written or migrated.
+	obj fs.Object
+}
+
+// migrate moves the plain object into the overlay with read_through
+// migrate. Failures are logged and leave the object where it is.
+func (o *plainObject) migrate(ctx context.Context) {
+	if o.fs.opt.ReadThrough != readThroughMigrate {
+		return
+	}
+	if _, ok := o.obj.(object); ok {
+		return
+	}
+	obj, err := o.fs.adoptBase(ctx, path.Join(o.fs.root, o.remote), o.remote)
+	if err != nil {
+		fs.Errorf(o, "failed to migrate plain object into the overlay: %v", err)
+		return
+	}
+	fs.Infof(o, "migrated plain object into the overlay")
+	o.obj = obj
+}
+
+// String returns the string representation of the object.
+func (o *plainObject) String() string {
+	return o.remote
+}
+
+// Remote returns the path of the object.
+func (o *plainObject) Remote() string {
+	return o.remote
+}
+
+// ModTime returns the modification time of the object.
+func (o *plainObject) ModTime(ctx context.Context) time.Time {
+	return o.obj.ModTime(ctx)
+}
+
+// Size returns the size of the object.
+func (o *plainObject) Size() int64 {
+	return o.obj.Size()
+}
+
+// Fs returns the Fs the object belongs to.
+func (o *plainObject) Fs() fs.Info {
+	return o.fs
+}
+
+// Hash returns the selected checksum of the object.
+func (o *plainObject) Hash(ctx context.Context, ty hash.Type) (string, error) {
+	return o.obj.Hash(ctx, ty)
+}
+
+// Storable returns whether the object is storable.
+func (o *plainObject) Storable() bool {
+	return o.obj.Storable()
+}
+
+// SetModTime sets the modification time of the object.
+func (o *plainObject) SetModTime(ctx context.Context, t time.Time) error {
+	return o.obj.SetModTime(ctx, t)
+}
+
+// Open opens the object for reading, migrating it first with read_through
+// migrate.
+func (o *plainObject) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	o.migrate(ctx)
+	return o.obj.Open(ctx, options...)
+}
+
+// Update writes the object to the overlay, replacing the plain object.
+func (o *plainObject) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	if _, ok := o.obj.(object); ok {
+		return o.obj.Update(ctx, in, src, options...)
+	}
+	parent := path.Dir(o.remote)
+	if parent == "." {
+		parent = ""
+	}
+	if err := o.fs.Mkdir(ctx, parent); err != nil {
+		return err
+	}
+	obj, err := o.fs.put(ctx, o.fs.base.Put, in, operations.NewOverrideRemote(src, o.remote), options...)
+	if err != nil {
+		return err
+	}
+	o.obj = obj
+	return nil
+}
+
+// Remove removes the object.
+func (o *plainObject) Remove(ctx context.Context) error {
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	return o.obj.Remove(ctx)
+}
+
+// UnWrap returns the underlying object of the base.
+func (o *plainObject) UnWrap() fs.Object {
+	if u, ok := o.obj.(fs.ObjectUnWrapper); ok {
+		return u.UnWrap()
+	}
+	return o.obj
+}
+
+// Check that interfaces are implemented.
+var (
+	_ fs.Object          = (*plainObject)(nil)
+	_ fs.ObjectUnWrapper = (*plainObject)(nil)
+)
@@ -0,0 +1,292 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// probeDirs is the number of directories of the base inspected when probing
+// whether the base contains an overlay.
+const probeDirs = 10
+
+// probeLayout reports whether the base looks like it contains an overlay,
+// i.e. has hash directories containing name files.
+func (f *Fs) probeLayout(ctx context.Context) (bool, error) {
+	dirHashes, err := f.baseDirs(ctx)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for i, dirHash := range dirHashes {
+		if i >= probeDirs {
+			break
+		}
+		fileDirs, err := f.base.List(ctx, dirHash)
+		if err != nil {
+			return false, err
+		}
+		for _, fileHash := range f.fileHashes(fileDirs) {
+			_, err := f.base.NewObject(ctx, f.fileKey(path.Join(dirHash, fileHash), nameLeaf))
+			if err == nil {
+				return true, nil
+			}
+			if !errors.Is(err, fs.ErrorObjectNotFound) {
+				return false, err
+			}
+			break
+		}
+	}
+	return false, nil
+}
+
+// rebuildDirMap reconstructs the directory map from the name files in the
+// base. It returns the map and the files found in each directory, indexed by
+// the hash of the directory.
+//
+// Directories which contain no files cannot be recovered.
+func (f *Fs) rebuildDirMap(ctx context.Context) (*dirMap, map[string]map[string]string, error) {
+	if f.opt.HashType == "none" {
+		return nil, nil, errors.New("rebuilding the map is not supported with hash type none")
+	}
+	dMap := newDirMap(f)
+	found := make(map[string]map[string]string)
+	baseDirs, err := f.baseDirs(ctx)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return dMap, found, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.loadDecoys(ctx); err != nil {
+		return nil, nil, err
+	}
+	var dirHashes []string
+	for _, dirHash := range baseDirs {
+		if !f.isDecoy(dirHash) {
+			dirHashes = append(dirHashes, dirHash)
+		}
+	}
+	p := newProgress(ctx, "rebuild", len(dirHashes))
+	defer p.finish()
+	for _, dirHash := range dirHashes {
+		err := f.rebuildDir(ctx, dMap, found, dirHash)
+		p.scan(dirHash, err)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return dMap, found, nil
+}
+
+// rebuildDir adds the files with name files in the hash directory dirHash to
+// dMap and found.
+func (f *Fs) rebuildDir(ctx context.Context, dMap *dirMap, found map[string]map[string]string, dirHash string) error {
+	fileDirs, err := f.base.List(ctx, dirHash)
+	if err != nil {
+		return err
+	}
+	for _, fileHash := range f.fileHashes(fileDirs) {
+		basePath := path.Join(dirHash, fileHash)
+		recorded, err := f.readNameAttributes(ctx, dirHash, fileHash)
+		name := recorded.path
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			fs.Debugf(basePath, "rebuild: skipping directory without name file")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, pending, err := f.pendingSince(ctx, dirHash, fileHash); err != nil {
+			return err
+		} else if pending {
+			fs.Logf(basePath, "rebuild: skipping interrupted upload of %q", name)
+			continue
+		}
+		parent, base := path.Split(name)
+		parent = strings.TrimSuffix(parent, "/")
+		_, dirOK := f.dirHashType(parent, dirHash)
+		_, fileOK := f.fileHashType(parent, base, fileHash)
+		if !dirOK || !fileOK {
+			fs.Logf(basePath, "rebuild: skipping name file recording %q which does not match its location", name)
+			continue
+		}
+		if err := f.checkAttributes(ctx, basePath, recorded); err != nil {
+			fs.Logf(basePath, "rebuild: skipping %q: %v", name, err)
+			continue
+		}
+		entry := dMap.newDirEntry(parent)
+		if entry.Hash != dirHash {
+			// The directory was created with another hash type.
+			if found[entry.Hash] != nil {
+				fs.Logf(basePath, "rebuild: skipping %q which is also stored in %q", name, entry.Hash)
+				continue
+			}
+			dMap.setHash(entry, dirHash)
+		}
+		if found[dirHash] == nil {
+			found[dirHash] = make(map[string]string)
+		}
+		found[dirHash][base] = fileHash
+	}
+	return nil
+}
+
+// applyRebuild replaces the directory map with dMap and adds the files found
+// to the map files of the directories.
+func (f *Fs) applyRebuild(ctx context.Context, dMap *dirMap, found map[string]map[string]string) error {
+	f.setDirMap(dMap)
+	for dirHash, files := range found {
+		entry, _ := f.dirMap.byHash(dirHash)
+		if _, err := entry.Files(ctx); err != nil {
+			return fmt.Errorf("cannot merge into invalid map file of %q: %w", entry.Path, err)
+		}
+		for name, fileHash := range files {
+			if err := entry.addFile(ctx, name, fileHash); err != nil {
+				return err
+			}
+		}
+		if err := entry.write(ctx); err != nil {
+			return err
+		}
+	}
+	return f.dirMap.write(ctx)
+}
+
+// recoverDirMap is called when the directory map is empty. If the base looks
+// like it contains an overlay, it rebuilds the directory map if auto_rebuild
+// is set and warns otherwise.
+func (f *Fs) recoverDirMap(ctx context.Context) error {
+	if f.opt.HashType == "none" {
+		return nil
+	}
+	ok, err := f.probeLayout(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	if !f.opt.AutoRebuild {
+		fs.Logf(f, "The directory map is empty but the base contains hash directories with name files. Set auto_rebuild to recover them.")
+		return nil
+	}
+	fs.Logf(f, "The directory map is empty, rebuilding it from the name files in the base")
+	dMap, found, err := f.rebuildDirMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild directory map: %w", err)
+	}
+	return f.applyRebuild(ctx, dMap, found)
+}
+
+// rebuildReport is the result of the rebuild-map command.
+type rebuildReport struct {
+	// Directories is the number of directories in the rebuilt map.
+	Directories int `json:"directories"`
+	// Files is the number of files found in the name files.
+	Files int `json:"files"`
+	// Added are the directories which are not in the current map.
+	Added []string `json:"added"`
+	// Dropped are the directories of the current map which have neither
+	// files nor a hash directory in the base.
+	Dropped []string `json:"dropped"`
+}
+
+// rebuildMap reconstructs the directory map from the name files in the base
+// and merges the files found into the map files of the directories, e.g.
+// after the directory map was lost. The directories of the current map
+// whose hash directory exists are kept, so empty directories are not lost.
+// With --dry-run only the report is returned.
+func (f *Fs) rebuildMap(ctx context.Context) (*rebuildReport, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	report, dMap, found, err := f.planRebuild(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.skipBase(ctx, "rebuild directory map", "map") {
+		return report, nil
+	}
+	return report, f.applyRebuild(ctx, dMap, found)
+}
+
+// planRebuild rebuilds the directory map for rebuildMap without applying
+// it. It returns the rebuilt map and the files found by directory for
+// applyRebuild.
+func (f *Fs) planRebuild(ctx context.Context) (*rebuildReport, *dirMap, map[string]map[string]string, error) {
+	dMap, found, err := f.rebuildDirMap(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to rebuild directory map: %w", err)
+	}
+	baseDirs, err := f.baseDirs(ctx)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, nil, nil, err
+	}
+	exists := make(map[string]struct{}, len(baseDirs))
+	for _, dirHash := range baseDirs {
+		exists[dirHash] = struct{}{}
+	}
+	report := &rebuildReport{}
+	// Parents first, so they keep their hash directories.
+	for _, current := range f.dirMap.sortedEntries() {
+		p, dirHash := current.Path, current.Hash
+		if _, ok := dMap.get(p); ok {
+			continue
+		}
+		if _, ok := exists[dirHash]; !ok {
+			report.Dropped = append(report.Dropped, p)
+			continue
+		}
+		entry := dMap.newDirEntry(p)
+		if entry.Hash != dirHash {
+			dMap.setHash(entry, dirHash)
+		}
+	}
+	for _, entry := range dMap.sortedEntries() {
+		if _, ok := f.dirMap.get(entry.Path); !ok {
+			report.Added = append(report.Added, entry.Path)
+		}
+	}
+	report.Directories = dMap.size()
+	for _, files := range found {
+		report.Files += len(files)
+	}
+	return report, dMap, found, nil
+}
+
+// checkAttributes checks the data object of the file at basePath against the
+// size and checksums recorded in its name file n, if any, so rebuild does
+// not map data which is not what was written. A missing data object is not
+// an error.
+func (f *Fs) checkAttributes(ctx context.Context, basePath string, n nameFile) error {
+	if n.size < 0 && len(n.hashes) == 0 {
+		return nil
+	}
+	obj, err := f.base.NewObject(ctx, f.fileKey(basePath, dataLeaf))
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n.size >= 0 && obj.Size() >= 0 && obj.Size() != n.size {
+		return fmt.Errorf("data object has size %d instead of the recorded %d", obj.Size(), n.size)
+	}
+	for ht, recorded := range n.hashes {
+		if !f.base.Hashes().Contains(ht) {
+			continue
+		}
+		sum, err := obj.Hash(ctx, ht)
+		if err != nil || sum == "" {
+			continue
+		}
+		if !strings.EqualFold(sum, recorded) {
+			return fmt.Errorf("data object has %v %s instead of the recorded %s", ht, sum, recorded)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package hashmap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// escapedHeader is the first line of map files and name files in which the
+// names are escaped. Names are only escaped if they can't be represented
+// otherwise, so the files stay readable by older versions in all other
+// cases. Older versions refuse to load escaped map files as the header is
+// not a valid record.
+const escapedHeader = "#escaped"
+
+// needsEscape reports whether name can't be represented in a record without
+// escaping.
+func needsEscape(name string) bool {
+	return strings.Contains(name, "\n")
+}
+
+// hashTypeSeparator separates the hash type from the hash in the records of
+// file map files. File hashes never contain it.
+const hashTypeSeparator = "/"
+
+// emptyPrefix starts the hash type recorded for the empty files which are
+// only stored in the map file with empty_files_in_map, followed by their
+// modification time in Unix nanoseconds. Their hash is the one their objects
+// are stored at once they are written to.
+const emptyPrefix = "empty."
+
+// emptyType returns the hash type recorded for an empty file with the given
+// modification time.
+func emptyType(modTime time.Time) string {
+	return emptyPrefix + strconv.FormatInt(modTime.UnixNano(), 10)
+}
+
+// parseEmptyType returns the modification time of the empty file with the
+// recorded hash type ht. It returns false if ht is not the one of an empty
+// file.
+func parseEmptyType(ht string) (time.Time, bool) {
+	if !strings.HasPrefix(ht, emptyPrefix) {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(strings.TrimPrefix(ht, emptyPrefix), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// typedHash returns the hash column of a file record for a hash of type ht.
+// The type is omitted if ht is empty, i.e. the hash type of the overlay.
+func typedHash(ht, hash string) string {
+	if ht == "" {
+		return hash
+	}
+	return ht + hashTypeSeparator + hash
+}
+
+// splitTypedHash splits the hash column of a file record into the hash type
+// and the hash. The hash type is empty if it is not recorded.
+func splitTypedHash(column string) (ht, hash string) {
+	if i := strings.Index(column, hashTypeSeparator); i >= 0 {
+		return column[:i], column[i+1:]
+	}
+	return "", column
+}
+
+// mapRecord is a record of a map file, mapping a name to its hash.
+type mapRecord struct {
+	hash string
+	name string
+}
+
+// marshalRecords serializes the records in the format of the map files.
+func marshalRecords(records []mapRecord) []byte {
+	escaped := false
+	for _, record := range records {
+		if needsEscape(record.name) {
+			escaped = true
+			break
+		}
+	}
+	var buf bytes.Buffer
+	if escaped {
+		buf.WriteString(escapedHeader + "\n")
+	}
+	for _, record := range records {
+		name := record.name
+		if escaped {
+			name = strconv.Quote(name)
+		}
+		buf.WriteString(record.hash + " " + name + "\n")
+	}
+	return buf.Bytes()
+}
+
+// unmarshalRecords reads the records of a map file from in. If the map file
+// is malformed, the records before the first malformed one are returned with
+// an error wrapping ErrMapCorrupt.
+func unmarshalRecords(in io.Reader) ([]mapRecord, error) {
+	var records []mapRecord
+	r := bufio.NewReader(in)
+	escaped := false
+	for first := true; ; first = false {
+		entry, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if entry != "" {
+				// The map files always end with a newline.
+				return records, fmt.Errorf("%w: truncated entry %q", ErrMapCorrupt, entry)
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading map file entry: %w", err)
+		}
+		entry = strings.TrimSuffix(entry, "\n")
+		if first && entry == escapedHeader {
+			escaped = true
+			continue
+		}
+		if entry == "" {
+			continue
+		}
+		split := strings.SplitN(entry, " ", 2)
+		if len(split) < 2 {
+			return records, fmt.Errorf("%w: invalid entry %q", ErrMapCorrupt, entry)
+		}
+		name := split[1]
+		if escaped {
+			name, err = strconv.Unquote(name)
+			if err != nil {
+				return records, fmt.Errorf("%w: invalid entry %q: %v", ErrMapCorrupt, entry, err)
+			}
+		}
+		records = append(records, mapRecord{hash: split[0], name: name})
+	}
+	return records, nil
+}
+
+// attributesHeader starts the optional attributes of a name file, followed
+// by the version of their format. It follows the line(s) of the overlay path
+// so older versions which only read the path ignore the attributes.
+const attributesHeader = "#attributes"
+
+// attributesVersion is the version of the attributes written.
+const attributesVersion = 1
+
+// nameFile is the content of a name file.
+type nameFile struct {
+	// path is the overlay path of the file.
+	path string
+	// size is the size of the file when it was written, or -1 if unknown.
+	size int64
+	// modTime is the modification time of the file when it was written, or
+	// zero if unknown.
+	modTime time.Time
+	// hashes are the checksums of the file when it was written.
+	hashes map[hash.Type]string
+}
+
+// hasAttributes reports whether any attributes besides the path are set.
+func (n nameFile) hasAttributes() bool {
+	return n.size >= 0 || !n.modTime.IsZero() || len(n.hashes) > 0
+}
+
+// marshalNameFile serializes n in the format of the name files.
+func marshalNameFile(n nameFile) []byte {
+	var b bytes.Buffer
+	if needsEscape(n.path) {
+		b.WriteString(escapedHeader + "\n" + strconv.Quote(n.path) + "\n")
+	} else {
+		b.WriteString(n.path + "\n")
+	}
+	if !n.hasAttributes() {
+		return b.Bytes()
+	}
+	fmt.Fprintf(&b, "%s %d\n", attributesHeader, attributesVersion)
+	if n.size >= 0 {
+		fmt.Fprintf(&b, "size %d\n", n.size)
+	}
+	if !n.modTime.IsZero() {
+		fmt.Fprintf(&b, "modtime %s\n", n.modTime.UTC().Format(time.RFC3339Nano))
+	}
+	types := make([]hash.Type, 0, len(n.hashes))
+	for ht := range n.hashes {
+		types = append(types, ht)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].String() < types[j].String()
+	})
+	for _, ht := range types {
+		fmt.Fprintf(&b, "hash %s %s\n", ht, n.hashes[ht])
+	}
+	return b.Bytes()
+}
+
+// parseNameFile returns the content of a name file. Attributes which can't
+// be parsed, of unknown types or of a newer version are ignored.
+func parseNameFile(content []byte) nameFile {
+	n := nameFile{size: -1}
+	lines := strings.Split(string(bytes.TrimRight(content, "\x00")), "\n")
+	rest := lines[1:]
+	n.path = lines[0]
+	if len(lines) >= 2 && lines[0] == escapedHeader && strings.HasPrefix(lines[1], `"`) {
+		if name, err := strconv.Unquote(lines[1]); err == nil {
+			n.path = name
+			rest = lines[2:]
+		}
+	}
+	if len(rest) == 0 {
+		return n
+	}
+	header := strings.Fields(rest[0])
+	if len(header) != 2 || header[0] != attributesHeader {
+		return n
+	}
+	if version, err := strconv.Atoi(header[1]); err != nil || version > attributesVersion {
+		return n
+	}
+	for _, line := range rest[1:] {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "size":
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				n.size = size
+			}
+		case len(fields) == 2 && fields[0] == "modtime":
+			if t, err := time.Parse(time.RFC3339Nano, fields[1]); err == nil {
+				n.modTime = t
+			}
+		case len(fields) == 3 && fields[0] == "hash":
+			var ht hash.Type
+			if err := ht.Set(fields[1]); err == nil && ht != hash.None {
+				if n.hashes == nil {
+					n.hashes = make(map[hash.Type]string)
+				}
+				n.hashes[ht] = fields[2]
+			}
+		}
+	}
+	return n
+}
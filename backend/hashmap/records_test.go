@@ -0,0 +1,117 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalRecords(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		records []mapRecord
+		escaped bool
+	}{
+		{"plain", []mapRecord{{"h1", "file.txt"}, {"h2", "with space"}}, false},
+		{"long", []mapRecord{{"h1", strings.Repeat("x", 4096)}}, false},
+		{"exotic", []mapRecord{{"h1", "tab\there"}, {"h2", "\"quoted\\\""}, {"h3", "ünïcödé ☃"}, {"h4", "#escaped"}}, false},
+		{"newline", []mapRecord{{"h1", "plain"}, {"h2", "line\nbreak"}, {"h3", "\n"}}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := marshalRecords(test.records)
+			assert.Equal(t, test.escaped, bytes.HasPrefix(data, []byte(escapedHeader+"\n")))
+			records, err := unmarshalRecords(bytes.NewReader(data))
+			require.NoError(t, err)
+			assert.Equal(t, test.records, records)
+		})
+	}
+}
+
+func TestUnmarshalRecordsCorrupt(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		in   string
+		want []mapRecord
+	}{
+		{"truncated", "h1 a\nh2 b", []mapRecord{{"h1", "a"}}},
+		{"no name", "h1 a\nh2\n", []mapRecord{{"h1", "a"}}},
+		{"bad quoting", escapedHeader + "\nh1 \"a\"\nh2 b\n", []mapRecord{{"h1", "a"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := unmarshalRecords(strings.NewReader(test.in))
+			assert.ErrorIs(t, err, ErrMapCorrupt)
+			assert.Equal(t, test.want, records)
+		})
+	}
+	// The header is only recognized on the first line.
+	records, err := unmarshalRecords(strings.NewReader("h1 a\n" + escapedHeader + "\n"))
+	assert.ErrorIs(t, err, ErrMapCorrupt)
+	assert.Equal(t, []mapRecord{{"h1", "a"}}, records)
+}
+
+func TestNameFile(t *testing.T) {
+	modTime := time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, test := range []struct {
+		name string
+		n    nameFile
+	}{
+		{"path only", nameFile{path: "dir/file.txt", size: -1}},
+		{"newline", nameFile{path: "dir/line\nbreak", size: -1}},
+		{"attributes", nameFile{path: "dir/file.txt", size: 42, modTime: modTime, hashes: map[hash.Type]string{hash.MD5: "abc", hash.SHA1: "def"}}},
+		{"newline attributes", nameFile{path: "a\nb", size: 0, modTime: modTime}},
+		{"long", nameFile{path: strings.Repeat("d/", 1000) + "f", size: -1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseNameFile(marshalNameFile(test.n))
+			assert.Equal(t, test.n.path, got.path)
+			assert.Equal(t, test.n.size, got.size)
+			assert.True(t, test.n.modTime.Equal(got.modTime))
+			assert.Equal(t, test.n.hashes, got.hashes)
+		})
+	}
+	// Padding and unknown attributes are ignored.
+	content := "dir/file.txt\n" + attributesHeader + " 1\nsize 7\ncolour blue\nhash nope x\n\x00\x00"
+	got := parseNameFile([]byte(content))
+	assert.Equal(t, "dir/file.txt", got.path)
+	assert.Equal(t, int64(7), got.size)
+	assert.Nil(t, got.hashes)
+	// Attributes of newer versions are ignored.
+	got = parseNameFile([]byte("dir/file.txt\n" + attributesHeader + " 99\nsize 7\n"))
+	assert.Equal(t, int64(-1), got.size)
+}
+
+func TestExoticNames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, nil)
+	require.NoError(t, f.Mkdir(ctx, "d"))
+	names := []string{"line\nbreak", "\"quoted\"", strings.Repeat("long", 200)}
+	for _, name := range names {
+		putTestFile(t, f, path.Join("d", name), name)
+	}
+	entry, ok := f.dirMap.get("d")
+	require.True(t, ok)
+	data, err := os.ReadFile(filepath.Join(dir, entry.Hash, "map"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte(escapedHeader+"\n")))
+
+	// A new Fs reads the names back from the map file.
+	g := newTestFs(t, dir, nil)
+	for _, name := range names {
+		o, err := g.NewObject(ctx, path.Join("d", name))
+		require.NoError(t, err, name)
+		assert.Equal(t, int64(len(name)), o.Size())
+	}
+	recorded, err := g.readNameFile(ctx, entry.Hash, g.fileHash("d", names[0]))
+	require.NoError(t, err)
+	assert.Equal(t, "d/"+names[0], recorded)
+}
@@ -0,0 +1,162 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"golang.org/x/sync/errgroup"
+)
+
+// reencodeReport is the result of the reencode command.
+type reencodeReport struct {
+	// Dirs is the number of map files rewritten.
+	Dirs int `json:"dirs"`
+	// NameFiles is the number of name files rewritten.
+	NameFiles int64 `json:"nameFiles"`
+}
+
+// reencode rewrites the directory map, the map files and the name files of
+// all directories below dir with the current metadata options, e.g. after
+// name_padding, name_file_attributes or store_mod_times were changed. The
+// name files of a directory are rewritten concurrently, bounded by
+// --checkers.
+//
+// With resumable_operations, an interrupted run skips the directories it
+// already rewrote when it is run again.
+func (f *Fs) reencode(ctx context.Context, dir string) (*reencodeReport, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	dir = path.Join(f.root, dir)
+	if _, ok := f.findDir(dir); !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	op, err := f.beginOperation(ctx, opNameReencode, dir, "")
+	if err != nil {
+		return nil, err
+	}
+	var entries []*dirEntry
+	for _, entry := range f.dirMap.sortedEntries() {
+		if p := entry.Path; dir == "" || p == dir || strings.HasPrefix(p, dir+"/") {
+			entries = append(entries, entry)
+		}
+	}
+	report := &reencodeReport{}
+	p := newProgress(ctx, "reencode", len(entries))
+	defer p.finish()
+	for _, entry := range entries {
+		if op.isDone(entry.Path) {
+			continue
+		}
+		err := f.reencodeDir(ctx, entry, &report.NameFiles)
+		p.scan(entry.Path, err)
+		if err == nil {
+			err = op.markDone(ctx, entry.Path)
+		}
+		if err != nil {
+			if saveErr := op.save(ctx); saveErr != nil {
+				fs.Errorf(f, "failed to save the progress of the reencode: %v", saveErr)
+			}
+			return report, fmt.Errorf("error rewriting metadata of %q: %w", entry.Path, err)
+		}
+		report.Dirs++
+	}
+	if !f.skipBase(ctx, "rewrite directory map", "map") {
+		if err := f.dirMap.write(ctx); err != nil {
+			return report, err
+		}
+	}
+	return report, op.finish(ctx)
+}
+
+// reencodeDir rewrites the name files of the files in the directory entry
+// and its map file. It counts the name files rewritten in nameFiles.
+func (f *Fs) reencodeDir(ctx context.Context, entry *dirEntry, nameFiles *int64) error {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return err
+	}
+	entry.mu.Lock()
+	hashes := make(map[string]string, len(files))
+	for name, fileHash := range files {
+		if _, empty := parseEmptyType(entry.types[name]); !empty {
+			// Empty files only stored in the map file have no name file.
+			hashes[name] = fileHash
+		}
+	}
+	entry.mu.Unlock()
+	checkers := fs.GetConfig(ctx).Checkers
+	if checkers < 1 {
+		checkers = 1
+	}
+	sem := make(chan struct{}, checkers)
+	g, gCtx := errgroup.WithContext(ctx)
+	for name, fileHash := range hashes {
+		name, fileHash := name, fileHash
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			if err := f.reencodeNameFile(gCtx, entry, name, fileHash); err != nil {
+				return fmt.Errorf("error rewriting name file of %q: %w", name, err)
+			}
+			atomic.AddInt64(nameFiles, 1)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if f.skipBase(ctx, "rewrite map file", path.Join(entry.Hash, "map")) {
+		return nil
+	}
+	return entry.write(ctx)
+}
+
+// reencodeNameFile rewrites the name file of the file name with the given
+// hash in the directory entry with the current options. The attributes are
+// dropped if they are no longer recorded and taken from the data object if
+// they are recorded now.
+func (f *Fs) reencodeNameFile(ctx context.Context, entry *dirEntry, name, fileHash string) error {
+	n, err := f.readNameAttributes(ctx, entry.Hash, fileHash)
+	if errors.Is(err, ErrNameFileMissing) {
+		n = nameFile{size: -1}
+	} else if err != nil {
+		return err
+	}
+	n.path = path.Join(entry.Path, name)
+	if !f.opt.NameFileAttributes {
+		n.size, n.hashes = -1, nil
+		if !f.opt.StoreModTimes {
+			n.modTime = time.Time{}
+		}
+	}
+	if f.opt.NameFileAttributes && !n.hasAttributes() || f.opt.StoreModTimes && n.modTime.IsZero() {
+		obj, err := f.base.NewObject(ctx, f.fileKey(path.Join(entry.Hash, fileHash), dataLeaf))
+		if err != nil {
+			return fmt.Errorf("error fetching data object: %w", err)
+		}
+		n.modTime = obj.ModTime(ctx)
+		if f.opt.NameFileAttributes {
+			n.size = obj.Size()
+			for _, ht := range f.base.Hashes().Array() {
+				if sum, err := obj.Hash(ctx, ht); err == nil && sum != "" {
+					if n.hashes == nil {
+						n.hashes = make(map[hash.Type]string)
+					}
+					n.hashes[ht] = sum
+				}
+			}
+		}
+	}
+	if f.skipBase(ctx, "rewrite name file", f.fileKey(path.Join(entry.Hash, fileHash), nameLeaf)) {
+		return nil
+	}
+	return f.writeNameFile(ctx, nil, entry.Hash, fileHash, n)
+}
@@ -0,0 +1,157 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/sync"
+)
+
+// relocatedPrefix starts the layout marker left at the old location of a
+// relocated overlay, followed by the path of the new location relative to
+// it. Versions which don't know it refuse to open the old location as the
+// layout is unknown.
+const relocatedPrefix = "relocated "
+
+// maxRelocations is the number of relocations followed when opening an
+// overlay, to stop on markers pointing at each other.
+const maxRelocations = 8
+
+// followRelocation replaces the base with the location the overlay was
+// relocated to, if the layout marker of the base records one. It
+// is called before the base is pinned.
+func (f *Fs) followRelocation(ctx context.Context) error {
+	for i := 0; ; i++ {
+		prefix, err := f.relocation(ctx)
+		if err != nil || prefix == "" {
+			return err
+		}
+		if i == maxRelocations {
+			return fmt.Errorf("the overlay was relocated more than %d times, check the layout markers", maxRelocations)
+		}
+		newBase, err := f.subBase(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		fs.Debugf(f, "following the relocation of the overlay to %q", prefix)
+		f.base = newBase
+	}
+}
+
+// relocation returns the path the overlay was relocated to, relative to the
+// base, or "" if it wasn't relocated.
+func (f *Fs) relocation(ctx context.Context) (string, error) {
+	in, err := f.openMeta(ctx, layoutMarker)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error opening layout marker: %w", err)
+	}
+	data, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return "", fmt.Errorf("error reading layout marker: %w", err)
+	}
+	first := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)[0]
+	if !strings.HasPrefix(first, relocatedPrefix) {
+		return "", nil
+	}
+	return strings.TrimSpace(strings.TrimPrefix(first, relocatedPrefix)), nil
+}
+
+// subBase returns the remote at the path prefix relative to the base.
+func (f *Fs) subBase(ctx context.Context, prefix string) (fs.Fs, error) {
+	remote := fspath.JoinRootPath(fs.ConfigString(f.base), prefix)
+	newBase, err := cache.Get(ctx, remote)
+	if err != nil && err != fs.ErrorIsFile {
+		return nil, fmt.Errorf("failed to make remote %q: %w", remote, err)
+	}
+	return newBase, nil
+}
+
+// relocate moves all objects of the overlay, the data objects as well as
+// the metadata, server-side to the path prefix relative to the base, and
+// leaves a layout marker pointing there. The overlay opened at the old
+// location uses the new one afterwards, so the remote doesn't need to be
+// reconfigured.
+//
+// The overlay should not be written while it is relocated.
+func (f *Fs) relocate(ctx context.Context, prefix string) error {
+	prefix = path.Clean(strings.Trim(prefix, "/"))
+	if prefix == "." || prefix == ".." || strings.HasPrefix(prefix, "../") {
+		return fmt.Errorf("invalid prefix %q, it must be a path below the base", prefix)
+	}
+	top := strings.SplitN(prefix, "/", 2)[0]
+	entries, err := f.base.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Remote() == top {
+			return fmt.Errorf("%q already exists in the base", top)
+		}
+	}
+	newBase, err := f.subBase(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	// Flush the map writes which failed so far, they would be written to
+	// the old location otherwise.
+	if f.retries != nil {
+		f.retryWrites(ctx)
+	}
+	for _, entry := range entries {
+		switch entry := entry.(type) {
+		case fs.Object:
+			if _, err := operations.Move(ctx, newBase, nil, entry.Remote(), entry); err != nil {
+				return fmt.Errorf("failed to move %q: %w", entry.Remote(), err)
+			}
+		case fs.Directory:
+			if err := f.relocateDir(ctx, newBase, entry.Remote()); err != nil {
+				return fmt.Errorf("failed to move %q: %w", entry.Remote(), err)
+			}
+		}
+	}
+	// The layout marker moved with the other objects, so it is written
+	// again to record the relocation.
+	if _, err := f.putBytes(ctx, layoutMarker, []byte(relocatedPrefix+prefix+"\n")); err != nil {
+		return fmt.Errorf("error writing layout marker: %w", err)
+	}
+	f.mirrorObject(layoutMarker)
+	fs.Logf(f, "Relocated the overlay to %q", fs.ConfigString(newBase))
+	// The old base stays pinned until f is finalized, so the new one is
+	// pinned for good.
+	cache.Pin(newBase)
+	f.base = newBase
+	return nil
+}
+
+// relocateDir moves the directory dir of the base to the same path in
+// newBase, server-side as a whole if possible and object by object
+// otherwise.
+func (f *Fs) relocateDir(ctx context.Context, newBase fs.Fs, dir string) error {
+	if do := newBase.Features().DirMove; do != nil {
+		err := do(ctx, f.base, dir, dir)
+		if !errors.Is(err, fs.ErrorCantDirMove) && !errors.Is(err, fs.ErrorNotImplemented) {
+			return err
+		}
+	}
+	srcDir, err := f.subBase(ctx, dir)
+	if err != nil {
+		return err
+	}
+	dstDir, err := cache.Get(ctx, fspath.JoinRootPath(fs.ConfigString(newBase), dir))
+	if err != nil && err != fs.ErrorIsFile {
+		return err
+	}
+	return sync.MoveDir(ctx, dstDir, srcDir, true, false)
+}
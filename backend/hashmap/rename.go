@@ -0,0 +1,162 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/lib/random"
+)
+
+// rename renames the file srcObj to remote in the same directory by only
+// rewriting its name file and the map file. The objects of the file stay at
+// the hash of its old name, so no data is moved, even on bases without
+// server-side moves. They are moved to the hash of the new name once
+// another file needs the old hash, see relocateRenamed.
+func (f *Fs) rename(ctx context.Context, srcObj object, remote string) (fs.Object, error) {
+	entry := srcObj.dirEntry
+	name := path.Base(remote)
+	srcHash := path.Base(srcObj.basePath)
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replaced, ok := entry.recordedHash(files, name)
+	if !ok || replaced == srcHash {
+		// Nothing is replaced, or only the case of the name changes.
+		replaced = ""
+	}
+	n, err := f.keptAttributes(ctx, entry.Hash, srcHash)
+	if err != nil {
+		return nil, err
+	}
+	n.path = path.Join(f.root, remote)
+	if err := f.writeNameFile(ctx, srcObj, entry.Hash, srcHash, n); err != nil {
+		return nil, fmt.Errorf("error rewriting name file: %w", err)
+	}
+	// Update the map file with a single write so there is no point where
+	// both or neither of the names exist. The source is removed first as
+	// it may only differ in case from the destination.
+	if err := entry.removeFile(ctx, path.Base(srcObj.path)); err != nil {
+		return nil, err
+	}
+	if err := entry.addFile(ctx, name, srcHash); err != nil {
+		return nil, err
+	}
+	if err := entry.write(ctx); err != nil {
+		return nil, err
+	}
+	f.purgeReplaced(ctx, entry, replaced)
+	f.removePlain(ctx, remote)
+	f.notifyChange(opMove, path.Join(f.root, remote), path.Join(f.root, srcObj.path))
+	return object{
+		obj:      srcObj.obj,
+		path:     remote,
+		basePath: srcObj.basePath,
+		fs:       f,
+		dirEntry: entry,
+	}, nil
+}
+
+// renamedInPlace reports whether the file name of the directory entry is
+// stored at fileHash although its name doesn't hash to it with any hash
+// type, i.e. it was renamed by rename.
+func (f *Fs) renamedInPlace(entry *dirEntry, name, fileHash string) bool {
+	_, ok := f.fileHashType(entry.Path, name, fileHash)
+	return !ok
+}
+
+// relocateRenamed moves the objects of the file name of the directory
+// entry, which was renamed in place, to the hash of its name. A file
+// renamed in place occupying that hash is relocated first.
+//
+// moving holds the names being relocated. Files which swapped their names
+// would wait for each other, so in such a cycle the occupant is parked at a
+// random hash instead, from where it is relocated once the cycle unwinds.
+func (f *Fs) relocateRenamed(ctx context.Context, entry *dirEntry, name string, moving map[string]bool) error {
+	moving[name] = true
+	defer delete(moving, name)
+	target := f.fileHash(entry.Path, name)
+	occupant, ok, err := entry.nameOf(ctx, target)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok || occupant == name:
+	case !f.renamedInPlace(entry, occupant, target):
+		return fmt.Errorf("%w: %q and %q in %q both hash to %q", ErrHashCollision, occupant, name, entry.Path, target)
+	case moving[occupant]:
+		if err := f.moveFileHash(ctx, entry, occupant, f.hasher(random.String(32))); err != nil {
+			return err
+		}
+	default:
+		if err := f.relocateRenamed(ctx, entry, occupant, moving); err != nil {
+			return err
+		}
+	}
+	return f.moveFileHash(ctx, entry, name, target)
+}
+
+// moveFileHash moves the objects of the file name of the directory entry
+// from its recorded hash to the hash to and records it in the map file.
+func (f *Fs) moveFileHash(ctx context.Context, entry *dirEntry, name, to string) error {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return err
+	}
+	from, ok := entry.recordedHash(files, name)
+	if !ok {
+		return fs.ErrorObjectNotFound
+	}
+	if from == to {
+		// Moved already as part of the relocation of another file.
+		return nil
+	}
+	fromPath, toPath := path.Join(entry.Hash, from), path.Join(entry.Hash, to)
+	fs.Debugf(f, "moving renamed file %q from %q to %q", path.Join(entry.Path, name), fromPath, toPath)
+	n, err := f.keptAttributes(ctx, entry.Hash, from)
+	if err != nil {
+		return err
+	}
+	n.path = path.Join(entry.Path, name)
+	if err := f.makeDestDirs(ctx, entry.Hash, to); err != nil {
+		return err
+	}
+	dataObj, err := f.base.NewObject(ctx, f.fileKey(fromPath, dataLeaf))
+	if err != nil {
+		return fmt.Errorf("error fetching data object of renamed file: %w", err)
+	}
+	// The base moves the data object server-side if it can and copies it
+	// otherwise.
+	if _, err := operations.Move(ctx, f.base, nil, f.fileKey(toPath, dataLeaf), dataObj); err != nil {
+		return f.checkHalt(err)
+	}
+	if err := f.writeNameFile(ctx, nil, entry.Hash, to, n); err != nil {
+		return err
+	}
+	if err := entry.addFile(ctx, name, to); err != nil {
+		return err
+	}
+	if err := entry.write(ctx); err != nil {
+		return err
+	}
+	f.purgeReplaced(ctx, entry, from)
+	return nil
+}
+
+// keptAttributes returns the attributes recorded in the name file of the
+// file with the given hashes with name_file_attributes or store_mod_times,
+// to keep them when the name file is rewritten.
+func (f *Fs) keptAttributes(ctx context.Context, dirHash, fileHash string) (nameFile, error) {
+	if !f.opt.NameFileAttributes && !f.opt.StoreModTimes {
+		return nameFile{size: -1}, nil
+	}
+	n, err := f.readNameAttributes(ctx, dirHash, fileHash)
+	if errors.Is(err, ErrNameFileMissing) {
+		return nameFile{size: -1}, nil
+	}
+	return n, err
+}
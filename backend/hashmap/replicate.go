@@ -0,0 +1,283 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/sync"
+	"golang.org/x/time/rate"
+)
+
+// replicationMarker is the object at the root of the destination of a
+// streamed replication recording its progress. It is removed once the
+// replication completed.
+const replicationMarker = "map.replication"
+
+// replicate copies the whole overlay, the data objects and all metadata, to
+// the remote dst with the same paths as in the base. An overlay with dst as
+// its remote and the same options contains the same files afterwards.
+//
+// The objects are copied server-side if the base and dst support it. With
+// stream, see replicateStream, the data objects are streamed and the
+// metadata is written anew instead, limited to bwlimit bytes per second if
+// it is not 0.
+func (f *Fs) replicate(ctx context.Context, dst string, stream bool, bwlimit fs.SizeSuffix) error {
+	dstFs, err := cache.Get(ctx, dst)
+	if err != nil && err != fs.ErrorIsFile {
+		return fmt.Errorf("failed to make remote %q to replicate to: %w", dst, err)
+	}
+	if operations.Overlapping(dstFs, f.base) {
+		return errors.New("can't replicate the overlay to a remote overlapping its base")
+	}
+	if !stream && bwlimit > 0 {
+		return errors.New("the bandwidth limit is only supported when streaming")
+	}
+	// Flush the map writes which failed so far, they would be missing from
+	// the replica otherwise.
+	if f.retries != nil {
+		f.retryWrites(ctx)
+	}
+	if stream {
+		return f.replicateStream(ctx, dstFs, bwlimit)
+	}
+	return sync.CopyDir(ctx, dstFs, f.base, true)
+}
+
+// replication is the progress of a streamed replication.
+type replication struct {
+	// Src is the remote of the overlay which is replicated.
+	Src string `json:"src"`
+	// Started is the time the replication was started first.
+	Started time.Time `json:"started"`
+	// Done are the directories which were replicated completely.
+	Done []string `json:"done"`
+}
+
+// replicateStream replicates the overlay to dstFs without copying any
+// object server-side, e.g. to another provider.
+//
+// The data objects are streamed to the same paths in dstFs, so their hashes
+// are preserved, and skipped if they exist with the same size already. The
+// directory map, the map files and the name files are generated from the
+// overlay, so nothing specific to the base is carried over, e.g. the map
+// versions, pending markers or decoys. The directory map is written last,
+// so an overlay over dstFs only shows the files once all are replicated.
+//
+// The progress is recorded in dstFs every operationCheckpoint directories,
+// so an interrupted replication continues where it stopped when it is run
+// again.
+func (f *Fs) replicateStream(ctx context.Context, dstFs fs.Fs, bwlimit fs.SizeSuffix) error {
+	var limiter *rate.Limiter
+	if bwlimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(bwlimit), int(bwlimit))
+	}
+	progress, err := f.readReplication(ctx, dstFs)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]struct{}, len(progress.Done))
+	for _, dir := range progress.Done {
+		done[dir] = struct{}{}
+	}
+	if len(done) > 0 {
+		fs.Logf(f, "Resuming the replication started at %s after %d directories", progress.Started.Format(time.RFC3339), len(done))
+	}
+	unsaved := 0
+	for _, entry := range f.dirMap.sortedEntries() {
+		dir := entry.Path
+		if _, ok := done[dir]; ok {
+			continue
+		}
+		if err := f.replicateDir(ctx, dstFs, entry, limiter); err != nil {
+			if saveErr := f.writeReplication(ctx, dstFs, progress); saveErr != nil {
+				fs.Errorf(f, "failed to save the progress of the replication: %v", saveErr)
+			}
+			return err
+		}
+		progress.Done = append(progress.Done, dir)
+		if unsaved++; unsaved >= operationCheckpoint {
+			if err := f.writeReplication(ctx, dstFs, progress); err != nil {
+				return err
+			}
+			unsaved = 0
+		}
+	}
+	if err := f.putReplica(ctx, dstFs, layoutMarker, f.layoutContent()); err != nil {
+		return err
+	}
+	if err := f.putReplica(ctx, dstFs, "map", f.dirMap.bytes()); err != nil {
+		return err
+	}
+	obj, err := dstFs.NewObject(ctx, replicationMarker)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return obj.Remove(ctx)
+}
+
+// replicateDir streams the data objects of the files in the directory entry
+// to dstFs and writes their name files and the map file there.
+func (f *Fs) replicateDir(ctx context.Context, dstFs fs.Fs, entry *dirEntry, limiter *rate.Limiter) error {
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return err
+	}
+	// Copy the files and their hash types as they may change while they are
+	// replicated.
+	entry.mu.Lock()
+	names := make([]string, 0, len(files))
+	hashes := make(map[string]string, len(files))
+	types := make(map[string]string, len(entry.types))
+	for name, fileHash := range files {
+		names = append(names, name)
+		hashes[name] = fileHash
+	}
+	for name, ht := range entry.types {
+		types[name] = ht
+	}
+	entry.mu.Unlock()
+	files = hashes
+	sort.Strings(names)
+	for _, name := range names {
+		if _, empty := parseEmptyType(types[name]); empty {
+			// Empty files are only recorded in the map file.
+			continue
+		}
+		basePath := path.Join(entry.Hash, files[name])
+		if err := f.streamObject(ctx, dstFs, f.fileKey(basePath, dataLeaf), limiter); err != nil {
+			return err
+		}
+		n, err := f.readNameAttributes(ctx, entry.Hash, files[name])
+		if errors.Is(err, ErrNameFileMissing) {
+			n = nameFile{path: path.Join(entry.Path, name), size: -1}
+		} else if err != nil {
+			return err
+		}
+		if err := f.putReplica(ctx, dstFs, f.fileKey(basePath, nameLeaf), f.nameFileContent(n)); err != nil {
+			return err
+		}
+	}
+	return f.putReplica(ctx, dstFs, path.Join(entry.Hash, "map"), marshalRecords(fileRecords(files, types)))
+}
+
+// streamObject streams the object at remote in the base to the same path in
+// dstFs, unless it exists there with the same size already.
+func (f *Fs) streamObject(ctx context.Context, dstFs fs.Fs, remote string, limiter *rate.Limiter) error {
+	src, err := f.base.NewObject(ctx, remote)
+	if err != nil {
+		return fmt.Errorf("error opening data object %q: %w", remote, err)
+	}
+	if dst, err := dstFs.NewObject(ctx, remote); err == nil && dst.Size() == src.Size() {
+		fs.Debugf(src, "Skipping data object already replicated")
+		return nil
+	}
+	tr := accounting.Stats(ctx).NewTransfer(src)
+	in, err := src.Open(ctx)
+	if err != nil {
+		tr.Done(ctx, err)
+		return err
+	}
+	acc := tr.Account(ctx, in)
+	_, err = dstFs.Put(ctx, &limitedReader{ctx: ctx, in: acc, limiter: limiter}, src)
+	_ = acc.Close()
+	tr.Done(ctx, err)
+	if err != nil {
+		return fmt.Errorf("error replicating data object %q: %w", remote, err)
+	}
+	return nil
+}
+
+// limitedReader limits the rate of the reads from in with limiter, if it
+// is not nil.
+type limitedReader struct {
+	ctx     context.Context
+	in      io.Reader
+	limiter *rate.Limiter
+}
+
+// Read reads from in, waiting for the limiter to allow the bytes read.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.limiter != nil && len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.in.Read(p)
+	if r.limiter != nil && n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// putReplica writes the metadata object at remote with data to dstFs.
+func (f *Fs) putReplica(ctx context.Context, dstFs fs.Fs, remote string, data []byte) error {
+	src := fakeObjInfo{
+		remote: remote,
+		fs:     f,
+		size:   int64(len(data)),
+		meta:   true,
+	}
+	if _, err := dstFs.Put(ctx, bytes.NewReader(data), src); err != nil {
+		return fmt.Errorf("error writing %q: %w", remote, err)
+	}
+	return nil
+}
+
+// readReplication reads the progress of an interrupted replication from
+// dstFs. It returns a new replication if there is none.
+func (f *Fs) readReplication(ctx context.Context, dstFs fs.Fs) (*replication, error) {
+	progress := &replication{
+		Src:     f.opt.Remote,
+		Started: time.Now(),
+	}
+	obj, err := dstFs.NewObject(ctx, replicationMarker)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening replication marker: %w", err)
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening replication marker: %w", err)
+	}
+	data, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading replication marker: %w", err)
+	}
+	previous := &replication{}
+	if err := json.Unmarshal(data, previous); err != nil {
+		return nil, fmt.Errorf("error parsing replication marker: %w", err)
+	}
+	if previous.Src != progress.Src {
+		return nil, fmt.Errorf("the remote is the destination of an interrupted replication of %q", previous.Src)
+	}
+	return previous, nil
+}
+
+// writeReplication writes the progress of the replication to dstFs.
+func (f *Fs) writeReplication(ctx context.Context, dstFs fs.Fs, progress *replication) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	if err := f.putReplica(ctx, dstFs, replicationMarker, data); err != nil {
+		return fmt.Errorf("error writing replication marker: %w", err)
+	}
+	return nil
+}
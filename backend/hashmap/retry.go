@@ -0,0 +1,352 @@
+package hashmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+)
+
+// retryQueue holds the map writes which failed and are retried in the
+// background. The queue is persisted locally so the writes survive a
+// crash.
+type retryQueue struct {
+	// mu protects writes, locks and stop. It is never held during writes
+	// to the base.
+	mu sync.Mutex
+	// writes maps the remote path of the map file in the base to its latest
+	// queued write.
+	writes map[string]*queuedWrite
+	// locks serialize the writes of each map file with its retries.
+	locks map[string]*remoteLock
+	// file is the local file the queue is persisted to.
+	file string
+	// stop stops the background retries when closed. It is nil if the
+	// retries are not running.
+	stop chan struct{}
+	// done is closed when the background retries have stopped.
+	done chan struct{}
+}
+
+// queuedWrite is a write of a map file queued for retry.
+type queuedWrite struct {
+	// Data is the latest content of the map file.
+	Data []byte `json:"data"`
+	// Queued is the time the first write of the map file failed. If the map
+	// file in the base was changed after this, another client wrote it and
+	// the queued write is dropped, as it would lose that change.
+	Queued time.Time `json:"queued"`
+}
+
+// remoteLock serializes the writes of a map file.
+type remoteLock struct {
+	mu sync.Mutex
+	// users is the number of writes holding or waiting for mu, so the lock
+	// is dropped once it is unused. It is protected by retryQueue.mu.
+	users int
+}
+
+// newRetryQueue creates an empty retry queue persisted to file.
+func newRetryQueue(file string) *retryQueue {
+	return &retryQueue{
+		writes: make(map[string]*queuedWrite),
+		locks:  make(map[string]*remoteLock),
+		file:   file,
+	}
+}
+
+// lock locks the map file remote and returns the function unlocking it.
+func (q *retryQueue) lock(remote string) (unlock func()) {
+	q.mu.Lock()
+	l, ok := q.locks[remote]
+	if !ok {
+		l = &remoteLock{}
+		q.locks[remote] = l
+	}
+	l.users++
+	q.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		q.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(q.locks, remote)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// cacheDir returns the directory for the local state of the Fs.
+func (f *Fs) cacheDir() string {
+	if f.opt.CacheDir != "" {
+		return f.opt.CacheDir
+	}
+	return filepath.Join(config.GetCacheDir(), "hashmap")
+}
+
+// retryFile returns the local file the retry queue of the Fs is persisted
+// to. It is unique for the name of the Fs and its base.
+func (f *Fs) retryFile() string {
+	return filepath.Join(f.cacheDir(), f.name+"-"+hashMD5(f.opt.Remote)+".json")
+}
+
+// loadRetries loads the retry queue persisted by a previous run and replays
+// it. Queued writes of map files which were changed since, e.g. by another
+// client, are dropped. It does nothing if map_retry_interval is not set or a coordinator is
+// configured, as retried writes would not hold a lease.
+func (f *Fs) loadRetries(ctx context.Context) error {
+	if f.opt.MapRetryInterval <= 0 || f.coord != nil {
+		return nil
+	}
+	q := newRetryQueue(f.retryFile())
+	data, err := os.ReadFile(q.file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("error reading map retry queue: %w", err)
+	default:
+		if err := json.Unmarshal(data, &q.writes); err != nil {
+			return fmt.Errorf("error parsing map retry queue %q: %w", q.file, err)
+		}
+		fs.Logf(f, "Replaying %d map writes which failed in a previous run", len(q.writes))
+	}
+	f.retries = q
+	f.retryWrites(ctx)
+	return nil
+}
+
+// startRetries starts retrying failed map writes in the background.
+func (f *Fs) startRetries() {
+	q := f.retries
+	if q == nil {
+		return
+	}
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+	go f.retrier(q.stop, q.done)
+}
+
+// stopRetries stops the background retries and makes a last attempt at the
+// queued writes.
+func (f *Fs) stopRetries(ctx context.Context) {
+	q := f.retries
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	stop := q.stop
+	q.stop = nil
+	q.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-q.done
+	f.retryWrites(ctx)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.writes) > 0 {
+		fs.Errorf(f, "%d map writes are still failing, they will be retried when the remote is used next (%s)", len(q.writes), q.file)
+	}
+}
+
+// retrier retries the queued writes every map_retry_interval until stop is
+// closed.
+func (f *Fs) retrier(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Duration(f.opt.MapRetryInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		f.retryWrites(context.Background())
+	}
+}
+
+// putMap writes the map file data to remote in the base. With a
+// coordinator, the write holds a lease on the map file, renewed while the
+// map file is uploaded, and is not retried.
+//
+// If the write fails with map_retry_interval set, it is queued for retry
+// and putMap returns a nil object and no error, so the operation succeeds
+// although the map file is not written yet. The queued write is counted in
+// the stats and the queue is reported by the health command.
+//
+// The writes of a map file are serialized with its retries so a retry never
+// overwrites a newer version of the map file.
+func (f *Fs) putMap(ctx context.Context, remote string, data []byte) (fs.Object, error) {
+	if c := f.coord; c != nil {
+		l, err := c.acquire(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
+		putCtx, stop := c.hold(ctx, remote, l)
+		obj, err := f.putBytes(putCtx, remote, data)
+		if lost := stop(); lost != nil {
+			// Another client may have written the map file concurrently.
+			obj, err = nil, lost
+		}
+		f.recordMapWrite(err)
+		if err != nil {
+			c.release(ctx, remote, l, 0)
+			return nil, err
+		}
+		c.release(ctx, remote, l, l.Generation+1)
+		f.mirrorObject(remote)
+		return obj, nil
+	}
+	q := f.retries
+	if q == nil {
+		obj, err := f.putBytes(ctx, remote, data)
+		f.recordMapWrite(err)
+		if err == nil {
+			f.mirrorObject(remote)
+		}
+		return obj, err
+	}
+	unlock := q.lock(remote)
+	defer unlock()
+	obj, err := f.putBytes(ctx, remote, data)
+	f.recordMapWrite(err)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err == nil {
+		f.mirrorObject(remote)
+		if _, ok := q.writes[remote]; ok {
+			// The write supersedes the queued one.
+			delete(q.writes, remote)
+			if err := q.save(); err != nil {
+				fs.Errorf(f, "failed to save map retry queue: %v", err)
+			}
+		}
+		return obj, nil
+	}
+	w, queued := q.writes[remote]
+	if !queued {
+		w = &queuedWrite{Queued: time.Now()}
+		q.writes[remote] = w
+	}
+	w.Data = data
+	if saveErr := q.save(); saveErr != nil {
+		delete(q.writes, remote)
+		return nil, fmt.Errorf("%v (and failed to queue it for retry: %w)", err, saveErr)
+	}
+	count(ctx, statQueuedWrites, 1)
+	fs.Errorf(f, "failed to write %q, queued for retry: %v", remote, err)
+	return nil, nil
+}
+
+// retryWrites attempts all queued writes once.
+func (f *Fs) retryWrites(ctx context.Context) {
+	q := f.retries
+	q.mu.Lock()
+	remotes := make([]string, 0, len(q.writes))
+	for remote := range q.writes {
+		remotes = append(remotes, remote)
+	}
+	q.mu.Unlock()
+	for _, remote := range remotes {
+		f.retryWrite(ctx, remote)
+	}
+}
+
+// retryWrite attempts the queued write of the map file remote once.
+func (f *Fs) retryWrite(ctx context.Context, remote string) {
+	q := f.retries
+	unlock := q.lock(remote)
+	defer unlock()
+	q.mu.Lock()
+	w, ok := q.writes[remote]
+	q.mu.Unlock()
+	if !ok {
+		// A newer write succeeded in the meantime.
+		return
+	}
+	stale, err := f.staleWrite(ctx, remote, w)
+	if err != nil {
+		fs.Debugf(f, "retrying write of %q failed: %v", remote, err)
+		return
+	}
+	if stale {
+		fs.Errorf(f, "dropping the write of %q queued at %v: the map file was changed by another client since", remote, w.Queued)
+		f.dropRetry(remote)
+		return
+	}
+	_, err = f.putBytes(ctx, remote, w.Data)
+	f.recordMapWrite(err)
+	if err != nil {
+		fs.Debugf(f, "retrying write of %q failed: %v", remote, err)
+		return
+	}
+	fs.Infof(f, "retried write of %q succeeded", remote)
+	f.mirrorObject(remote)
+	if remote == "map" && f.opt.MapHistory > 0 {
+		// The version was not recorded when the write was queued.
+		if err := f.recordMapVersion(ctx, w.Data); err != nil {
+			fs.Errorf(f, "failed to record map version: %v", err)
+		}
+	}
+	f.dropRetry(remote)
+}
+
+// staleWrite reports whether the map file remote in the base was changed
+// since the write w was queued, e.g. by another client while rclone was not
+// running. Such changes are detected by the modification time of the map
+// file, so they may be missed if the clock of the other client lags behind.
+func (f *Fs) staleWrite(ctx context.Context, remote string, w *queuedWrite) (bool, error) {
+	f.limitMeta(ctx)
+	obj, err := f.base.NewObject(ctx, remote)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorDirNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return obj.ModTime(ctx).After(w.Queued), nil
+}
+
+// dropRetry removes the queued write of the map file remote from the queue.
+func (f *Fs) dropRetry(remote string) {
+	q := f.retries
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.writes, remote)
+	if err := q.save(); err != nil {
+		fs.Errorf(f, "failed to save map retry queue: %v", err)
+	}
+}
+
+// save persists the queue to its local file, removing the file if the
+// queue is empty. It must be called with mu held.
+func (q *retryQueue) save() error {
+	if len(q.writes) == 0 {
+		err := os.Remove(q.file)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(q.writes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.file), 0700); err != nil {
+		return err
+	}
+	tmp := q.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.file)
+}
@@ -0,0 +1,152 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryQueueLock(t *testing.T) {
+	q := newRetryQueue(filepath.Join(t.TempDir(), "queue.json"))
+	unlock := q.lock("a/map")
+	// Other map files are not blocked.
+	q.lock("b/map")()
+	locked := make(chan struct{})
+	go func() {
+		defer q.lock("a/map")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("map file locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The queue itself is not blocked by the lock of a map file.
+	q.mu.Lock()
+	assert.Len(t, q.locks, 1)
+	q.mu.Unlock()
+	unlock()
+	<-locked
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.lock("a/map")()
+		}()
+	}
+	wg.Wait()
+	q.mu.Lock()
+	assert.Empty(t, q.locks)
+	q.mu.Unlock()
+}
+
+func TestRetryQueueSave(t *testing.T) {
+	q := newRetryQueue(filepath.Join(t.TempDir(), "sub", "queue.json"))
+	q.writes["map"] = &queuedWrite{Data: []byte("data"), Queued: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)}
+	require.NoError(t, q.save())
+	data, err := os.ReadFile(q.file)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"map":{"data":"ZGF0YQ==","queued":"2022-01-02T03:04:05Z"}}`, string(data))
+	delete(q.writes, "map")
+	require.NoError(t, q.save())
+	assert.NoFileExists(t, q.file)
+	// Saving an empty queue without a file succeeds.
+	require.NoError(t, q.save())
+}
+
+func TestPutMapRetry(t *testing.T) {
+	ctx := accounting.WithStatsGroup(context.Background(), "TestPutMapRetry")
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{
+		"map_retry_interval": "1h",
+		"cache_dir":          t.TempDir(),
+	})
+	q := f.retries
+	require.NotNil(t, q)
+
+	// A regular file in the way of the map file fails the write.
+	blocker := filepath.Join(dir, "blocked")
+	require.NoError(t, os.WriteFile(blocker, nil, 0600))
+	obj, err := f.putMap(ctx, "blocked/map", []byte("first"))
+	require.NoError(t, err)
+	assert.Nil(t, obj, "queued writes return no object")
+	assert.Equal(t, int64(1), accounting.Stats(ctx).Count(statQueuedWrites, 0))
+	assert.FileExists(t, q.file)
+	_, err = f.putMap(ctx, "blocked/map", []byte("second"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, f.pendingMapWrites())
+
+	// The retry writes the latest content once the base accepts it.
+	f.retryWrites(ctx)
+	assert.Equal(t, 1, f.pendingMapWrites())
+	require.NoError(t, os.Remove(blocker))
+	f.retryWrites(ctx)
+	assert.Equal(t, 0, f.pendingMapWrites())
+	assert.NoFileExists(t, q.file)
+	data, err := os.ReadFile(filepath.Join(dir, "blocked", "map"))
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+}
+
+func TestLoadRetries(t *testing.T) {
+	dir, cacheDir := t.TempDir(), t.TempDir()
+	opt := configmap.Simple{"map_retry_interval": "1h", "cache_dir": cacheDir}
+	f := newTestFs(t, dir, opt)
+	// Queue a write as if a previous run exited before it succeeded.
+	q := newRetryQueue(f.retryFile())
+	q.writes["replayed/map"] = &queuedWrite{Data: []byte("queued"), Queued: time.Now()}
+	// The map file changed by another client since is not overwritten.
+	stale := filepath.Join(dir, "stale", "map")
+	require.NoError(t, os.MkdirAll(filepath.Dir(stale), 0700))
+	require.NoError(t, os.WriteFile(stale, []byte("newer"), 0600))
+	q.writes["stale/map"] = &queuedWrite{Data: []byte("queued"), Queued: time.Now().Add(-time.Hour)}
+	require.NoError(t, q.save())
+
+	f = newTestFs(t, dir, opt)
+	data, err := os.ReadFile(filepath.Join(dir, "replayed", "map"))
+	require.NoError(t, err)
+	assert.Equal(t, "queued", string(data))
+	data, err = os.ReadFile(stale)
+	require.NoError(t, err)
+	assert.Equal(t, "newer", string(data))
+	assert.NoFileExists(t, f.retries.file)
+}
+
+func TestRetryMapHistory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{
+		"map_retry_interval": "1h",
+		"map_history":        "5",
+		"cache_dir":          t.TempDir(),
+	})
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	versions, err := f.mapVersions(ctx)
+	require.NoError(t, err)
+	n := len(versions)
+
+	// A directory in the way of the directory map fails the write.
+	require.NoError(t, os.Rename(filepath.Join(dir, "map"), filepath.Join(dir, "map.saved")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "map"), 0700))
+	require.NoError(t, f.Mkdir(ctx, "b"))
+	assert.Equal(t, 1, f.pendingMapWrites())
+	versions, err = f.mapVersions(ctx)
+	require.NoError(t, err)
+	assert.Len(t, versions, n, "queued writes are not recorded yet")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "map")))
+	f.retryWrites(ctx)
+	assert.Equal(t, 0, f.pendingMapWrites())
+	versions, err = f.mapVersions(ctx)
+	require.NoError(t, err)
+	assert.Len(t, versions, n+1)
+}
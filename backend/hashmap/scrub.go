@@ -0,0 +1,240 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// scrubFinding is an inconsistency between the maps, name files and data
+// objects found by the scrubber.
+type scrubFinding struct {
+	// Path is the overlay path concerned.
+	Path string `json:"path"`
+	// Base is the base path concerned.
+	Base string `json:"base"`
+	// Problem describes the inconsistency.
+	Problem string `json:"problem"`
+	// Repaired is set if the inconsistency was repaired.
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// scrubReport is the result of a scrub of a part of the namespace.
+type scrubReport struct {
+	// Time is the time the scrub finished.
+	Time time.Time `json:"time"`
+	// Dirs is the number of directories scrubbed.
+	Dirs int `json:"dirs"`
+	// Findings are the inconsistencies found.
+	Findings []scrubFinding `json:"findings"`
+}
+
+// scrubDir verifies the map file of the directory entry of the directory
+// map dMap against the name files and data objects in the base. If clean is
+// set, the file directories of interrupted uploads and stale pending markers
+// are removed.
+//
+// It only reads from the base and never from the in-memory state, so it can
+// run concurrently with other operations.
+func (f *Fs) scrubDir(ctx context.Context, dMap *dirMap, entry *dirEntry, clean bool) ([]scrubFinding, error) {
+	var findings []scrubFinding
+	report := func(overlay, base, problem string) {
+		fs.Errorf(overlay, "scrub: %s (%s)", problem, base)
+		findings = append(findings, scrubFinding{Path: overlay, Base: base, Problem: problem})
+	}
+	files, types, err := f.readTypedFileMap(ctx, entry.Hash)
+	if err != nil {
+		report(entry.Path, path.Join(entry.Hash, "map"), err.Error())
+		return findings, nil
+	}
+	dropEmpty(files, types)
+	baseEntries, err := f.base.List(ctx, entry.Hash)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		if len(files) > 0 {
+			report(entry.Path, entry.Hash, "hash directory missing")
+		}
+		return findings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fileDirs := make(map[string]struct{})
+	for _, fileHash := range f.fileHashes(baseEntries) {
+		fileDirs[fileHash] = struct{}{}
+	}
+	// The hash directories of the children may be nested by the layout.
+	for _, child := range dMap.children(entry) {
+		if path.Dir(child.Hash) == entry.Hash {
+			delete(fileDirs, path.Base(child.Hash))
+		}
+	}
+	for name, fileHash := range files {
+		overlay := path.Join(entry.Path, name)
+		basePath := path.Join(entry.Hash, fileHash)
+		if _, ok := fileDirs[fileHash]; !ok {
+			report(overlay, basePath, "file directory missing")
+			continue
+		}
+		delete(fileDirs, fileHash)
+		if _, err := f.base.NewObject(ctx, f.fileKey(basePath, dataLeaf)); errors.Is(err, fs.ErrorObjectNotFound) {
+			report(overlay, basePath, "data object missing")
+		} else if err != nil {
+			return nil, err
+		}
+		if f.opt.PendingMarkers {
+			since, pending, err := f.pendingSince(ctx, entry.Hash, fileHash)
+			if err != nil {
+				return nil, err
+			}
+			if pending && time.Since(since) > pendingGrace {
+				report(overlay, basePath, "stale pending marker")
+				if clean && !f.skipBase(ctx, "remove stale pending marker", f.pendingRemote(entry.Hash, fileHash)) {
+					if err := f.clearPending(ctx, entry.Hash, fileHash); err != nil {
+						return nil, err
+					}
+					findings[len(findings)-1].Repaired = true
+				}
+			}
+		}
+		recorded, err := f.readNameFile(ctx, entry.Hash, fileHash)
+		switch {
+		case errors.Is(err, fs.ErrorObjectNotFound):
+			report(overlay, basePath, "name file missing")
+		case err != nil:
+			return nil, err
+		case recorded != overlay:
+			report(overlay, basePath, "name file mismatch: "+recorded)
+		default:
+			continue
+		}
+		if f.opt.RepairNameFiles && !f.skipBase(ctx, "repair name file", f.fileKey(basePath, nameLeaf)) {
+			if _, err := f.repairNameFile(ctx, entry.Hash, fileHash, overlay); err != nil {
+				return nil, err
+			}
+			findings[len(findings)-1].Repaired = true
+		}
+	}
+	for fileHash := range fileDirs {
+		basePath := path.Join(entry.Hash, fileHash)
+		since, pending, err := f.pendingSince(ctx, entry.Hash, fileHash)
+		if err != nil {
+			return nil, err
+		}
+		if !pending {
+			report(entry.Path, basePath, "unreferenced file directory")
+			continue
+		}
+		if time.Since(since) <= pendingGrace {
+			// The upload is probably still in progress.
+			continue
+		}
+		report(entry.Path, basePath, "interrupted upload")
+		if clean && !f.skipBase(ctx, "delete interrupted upload", basePath) {
+			if err := f.purgeFile(ctx, basePath); err != nil {
+				return nil, err
+			}
+			findings[len(findings)-1].Repaired = true
+		}
+	}
+	return findings, nil
+}
+
+// scrub verifies up to limit directories, in the order of their paths,
+// starting after the directory after. It returns the path to continue from
+// in the next call, which is "" once all directories have been visited. A
+// limit of 0 verifies all directories. See scrubDir for clean.
+//
+// The directory map is read from the base without salvaging it, so scrub
+// only writes to the base with clean, and never concurrently with the
+// writes of the foreground operations in the background scrubber.
+func (f *Fs) scrub(ctx context.Context, after string, limit int, clean bool) (report scrubReport, next string, err error) {
+	dMap, err := f.readDirMap(ctx, false)
+	if err != nil {
+		return report, after, err
+	}
+	entries := dMap.sortedEntries()
+	start := 0
+	if after != "" {
+		start = sort.Search(len(entries), func(i int) bool {
+			return entries[i].Path >= after
+		})
+		if start < len(entries) && entries[start].Path == after {
+			start++
+		}
+	}
+	end := len(entries)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		next = entries[end-1].Path
+	}
+	p := newProgress(ctx, "scrub", end-start)
+	defer p.finish()
+	for _, entry := range entries[start:end] {
+		dir := entry.Path
+		findings, err := f.scrubDir(ctx, dMap, entry, clean)
+		p.scan(dir, err)
+		if err != nil {
+			return report, dir, err
+		}
+		report.Dirs++
+		for _, finding := range findings {
+			if finding.Repaired {
+				p.fix(finding.Path)
+			}
+		}
+		report.Findings = append(report.Findings, findings...)
+	}
+	report.Time = time.Now()
+	return report, next, nil
+}
+
+// scrubber runs in the background and scrubs scrub_batch directories every
+// scrub_interval until the Fs is shut down.
+func (f *Fs) scrubber(stop <-chan struct{}) {
+	// Report the progress separately from the transfers.
+	ctx := accounting.WithStatsGroup(context.Background(), "hashmap-scrub")
+	ticker := time.NewTicker(time.Duration(f.opt.ScrubInterval))
+	defer ticker.Stop()
+	next := ""
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		report, n, err := f.scrub(ctx, next, f.opt.ScrubBatch, false)
+		if err != nil {
+			fs.Errorf(f, "scrub failed: %v", err)
+			continue
+		}
+		next = n
+		fs.Debugf(f, "scrubbed %d directories, %d problems found", report.Dirs, len(report.Findings))
+		f.scrubMu.Lock()
+		f.lastScrub = &report
+		f.scrubMu.Unlock()
+	}
+}
+
+// startScrubber starts the background scrubber if it is configured.
+func (f *Fs) startScrubber() {
+	if f.opt.ScrubInterval <= 0 {
+		return
+	}
+	f.scrubStop = make(chan struct{})
+	go f.scrubber(f.scrubStop)
+}
+
+// stopScrubber stops the background scrubber if it is running.
+func (f *Fs) stopScrubber() {
+	f.scrubMu.Lock()
+	defer f.scrubMu.Unlock()
+	if f.scrubStop != nil {
+		close(f.scrubStop)
+		f.scrubStop = nil
+	}
+}
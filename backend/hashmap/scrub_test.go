@@ -0,0 +1,36 @@
+package hashmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := newTestFs(t, dir, configmap.Simple{"recover_map": "true"})
+	require.NoError(t, f.Mkdir(ctx, "a"))
+	putTestFile(t, f, "a/b.txt", "hello")
+	report, next, err := f.scrub(ctx, "", 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, "", next)
+	assert.Equal(t, 2, report.Dirs)
+	assert.Empty(t, report.Findings)
+
+	// A malformed directory map is not salvaged by scrub.
+	mapFile := filepath.Join(dir, "map")
+	data, err := os.ReadFile(mapFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(mapFile, append(data, data...), 0600))
+	_, _, err = f.scrub(ctx, "", 0, false)
+	assert.ErrorIs(t, err, ErrMapCorrupt)
+	assert.NoFileExists(t, filepath.Join(dir, recoveredMap))
+	_, ok := f.dirMap.get("a")
+	assert.True(t, ok, "the loaded directory map is kept")
+}
@@ -0,0 +1,210 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// zeroReader is an io.Reader returning an endless stream of zeros.
+type zeroReader struct{}
+
+// Read fills p with zeros.
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// shred removes the file or directory at remote including all metadata which
+// refers to it, in particular the copies of previous versions of the map.
+//
+// The name files are overwritten with zeros before they are deleted, so
+// copies retained by the base (e.g. in a trash) do not reveal the name. If
+// overwrite is set, the same is done for the data objects.
+func (f *Fs) shred(ctx context.Context, remote string, overwrite bool) error {
+	absPath := path.Join(f.root, remote)
+	if entry, ok := f.findDir(absPath); ok {
+		if entry.Parent == nil {
+			return errors.New("refusing to shred the root directory")
+		}
+		p := newProgress(ctx, "shred", 0)
+		defer p.finish()
+		shredErr := f.shredDir(ctx, p, entry, overwrite)
+		if !f.skipBase(ctx, "write directory map", "map") {
+			if err := f.dirMap.write(ctx); err != nil {
+				return err
+			}
+		}
+		if shredErr != nil {
+			return shredErr
+		}
+		return f.scrubHistory(ctx, p, absPath)
+	}
+	entry, _, ok := f.toHash(remote)
+	if !ok {
+		return fs.ErrorObjectNotFound
+	}
+	p := newProgress(ctx, "shred", 1)
+	defer p.finish()
+	if err := f.shredFile(ctx, p, entry, path.Base(absPath), overwrite); err != nil {
+		return err
+	}
+	if f.skipBase(ctx, "write map file", path.Join(entry.Hash, "map")) {
+		return nil
+	}
+	return entry.write(ctx)
+}
+
+// shredDir shreds all files in the directory entry and its children and
+// removes them from the directory map. It does not write the directory map.
+func (f *Fs) shredDir(ctx context.Context, p *progress, entry *dirEntry, overwrite bool) error {
+	for _, child := range f.dirMap.children(entry) {
+		if err := f.shredDir(ctx, p, child, overwrite); err != nil {
+			return err
+		}
+	}
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot shred directory with invalid map file: %w", err)
+	}
+	p.add(len(files))
+	for name := range files {
+		if err := f.shredFile(ctx, p, entry, name, overwrite); err != nil {
+			return err
+		}
+	}
+	if f.skipBase(ctx, "purge hash directory", entry.Hash) {
+		return nil
+	}
+	err = operations.Purge(ctx, f.base, entry.Hash)
+	f.mirrorDir(entry.Hash)
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return err
+	}
+	f.dirMap.removeEntry(entry.Path)
+	return nil
+}
+
+// shredFile overwrites and deletes the name file and data object of the file
+// with the given name in the directory entry and removes it from the entry. It
+// does not write the map file of the entry.
+func (f *Fs) shredFile(ctx context.Context, p *progress, entry *dirEntry, name string, overwrite bool) (err error) {
+	defer func() {
+		p.scan(path.Join(entry.Path, name), err)
+	}()
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return err
+	}
+	name, ok := entry.lookupFile(files, name)
+	if !ok {
+		return fs.ErrorObjectNotFound
+	}
+	fileHash := files[name]
+	if _, empty, err := entry.emptyFile(ctx, name); err != nil || empty {
+		// Empty files only stored in the map file have no objects.
+		if err != nil {
+			return err
+		}
+		if f.skipBase(ctx, "remove empty file from map file", path.Join(entry.Hash, "map")) {
+			return nil
+		}
+		return entry.removeFile(ctx, name)
+	}
+	basePath := path.Join(entry.Hash, fileHash)
+	nameSize := int64(len(f.nameFileContent(nameFile{path: path.Join(entry.Path, name), size: -1})))
+	if f.opt.NameFileAttributes {
+		// The attributes make the name file longer.
+		if nameObj, err := f.base.NewObject(ctx, f.fileKey(basePath, nameLeaf)); err == nil {
+			nameSize = nameObj.Size()
+		}
+	}
+	if nameKey := f.fileKey(basePath, nameLeaf); !f.skipBase(ctx, "overwrite name file with zeros", nameKey) {
+		if _, err := f.putBytes(ctx, nameKey, make([]byte, nameSize)); err != nil {
+			return fmt.Errorf("error overwriting name file: %w", err)
+		}
+	}
+	if overwrite {
+		dataObj, err := f.base.NewObject(ctx, f.fileKey(basePath, dataLeaf))
+		switch {
+		case errors.Is(err, fs.ErrorObjectNotFound):
+		case err != nil:
+			return err
+		case f.skipBase(ctx, "overwrite data object with zeros", dataObj.Remote()):
+		default:
+			dataSrc := fakeObjInfo{
+				remote: dataObj.Remote(),
+				fs:     f,
+				size:   dataObj.Size(),
+			}
+			in := io.LimitReader(zeroReader{}, dataObj.Size())
+			if _, err := f.base.Put(ctx, in, dataSrc); err != nil {
+				return fmt.Errorf("error overwriting data file: %w", err)
+			}
+		}
+	}
+	if f.skipBase(ctx, "delete file", basePath) {
+		return nil
+	}
+	if err := f.purgeFile(ctx, basePath); err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return err
+	}
+	return entry.removeFile(ctx, name)
+}
+
+// scrubHistory removes the directory dir and everything below it from all
+// recorded versions of the map.
+func (f *Fs) scrubHistory(ctx context.Context, p *progress, dir string) error {
+	versions, err := f.mapVersions(ctx)
+	if err != nil {
+		return err
+	}
+	p.add(len(versions))
+	for _, v := range versions {
+		err := f.scrubMapVersion(ctx, v, dir)
+		p.scan(v.remote(), err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubMapVersion removes the directory dir and everything below it from the
+// map version v.
+func (f *Fs) scrubMapVersion(ctx context.Context, v mapVersion, dir string) error {
+	in, err := f.openMeta(ctx, v.remote())
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening map version %d: %w", v.Generation, err)
+	}
+	dMap, err := loadDirectoryMap(f, in)
+	_ = in.Close()
+	if err != nil {
+		return fmt.Errorf("cannot scrub map version %d: %w", v.Generation, err)
+	}
+	changed := false
+	for _, entry := range dMap.entries() {
+		if p := entry.Path; p == dir || strings.HasPrefix(p, dir+"/") {
+			dMap.forget(entry)
+			changed = true
+		}
+	}
+	if !changed || f.skipBase(ctx, "scrub map version", v.remote()) {
+		return nil
+	}
+	if _, err := f.putBytes(ctx, v.remote(), dMap.bytes()); err != nil {
+		return fmt.Errorf("error scrubbing map version %d: %w", v.Generation, err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package hashmap
+
+import (
+	"context"
+	"strings"
+)
+
+// loadSnapshot loads the map files of all directories below the root of the
+// Fs up front with the snapshot option. As loaded map files are only read
+// again after writes of this Fs, all listings are then served from the
+// state of the maps at the start, regardless of the writes of other
+// clients.
+func (f *Fs) loadSnapshot(ctx context.Context) error {
+	var entries []*dirEntry
+	for _, entry := range f.dirMap.sortedEntries() {
+		if p := entry.Path; f.root == "" || p == f.root || strings.HasPrefix(p, f.root+"/") {
+			entries = append(entries, entry)
+		}
+	}
+	p := newProgress(ctx, "snapshot", len(entries))
+	defer p.finish()
+	for _, entry := range entries {
+		err := entry.fillFiles(ctx)
+		p.scan(entry.Path, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package hashmap
+
+import (
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Levels of min_hash_strength, from the weakest to the strongest.
+const (
+	// strengthAny accepts every configuration.
+	strengthAny = "any"
+	// strengthHashed requires the names to be hashed, i.e. not stored as
+	// they are with hash type none.
+	strengthHashed = "hashed"
+	// strengthCollisionResistant additionally requires a hash type for
+	// which no practical collisions are known.
+	strengthCollisionResistant = "collision-resistant"
+	// strengthSalted additionally requires the salted layout, so equal
+	// names hash differently in different directories and can't be guessed
+	// with a single dictionary of hashes.
+	strengthSalted = "salted"
+)
+
+// strengthLevels maps the levels of min_hash_strength to their rank.
+var strengthLevels = map[string]int{
+	strengthAny:                0,
+	strengthHashed:             1,
+	strengthCollisionResistant: 2,
+	strengthSalted:             3,
+}
+
+// weakHashTypes are the hash types with known practical collisions.
+var weakHashTypes = map[string]bool{
+	"md5":  true,
+	"sha1": true,
+}
+
+// hashStrength returns the level of min_hash_strength met by the hash type
+// and layout of the Fs.
+func (f *Fs) hashStrength() string {
+	switch {
+	case f.opt.HashType == "none":
+		return strengthAny
+	case weakHashTypes[f.opt.HashType]:
+		return strengthHashed
+	case f.layout != layoutSalted:
+		return strengthCollisionResistant
+	}
+	return strengthSalted
+}
+
+// checkHashStrength returns an error if the hash type and layout of the Fs
+// don't meet min_hash_strength. With allow_weak_hashes it only logs the
+// problem.
+func (f *Fs) checkHashStrength() error {
+	level := f.opt.MinHashStrength
+	if level == "" {
+		level = strengthAny
+	}
+	want, ok := strengthLevels[level]
+	if !ok {
+		return fmt.Errorf("unknown minimum hash strength %q", level)
+	}
+	got := f.hashStrength()
+	if strengthLevels[got] >= want {
+		return nil
+	}
+	err := fmt.Errorf("hash type %q with layout %q only meets hash strength %q, not %q", f.opt.HashType, f.layout, got, level)
+	if f.opt.AllowWeakHashes {
+		fs.Logf(f, "%v (allowed by allow_weak_hashes)", err)
+		return nil
+	}
+	return fmt.Errorf("%w (set allow_weak_hashes to use it anyway)", err)
+}
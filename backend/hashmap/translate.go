@@ -0,0 +1,111 @@
+package hashmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// translation is the location of an overlay path in the base, as returned
+// by the encode and decode commands.
+type translation struct {
+	// Path is the overlay path relative to the root of the Fs.
+	Path string `json:"path"`
+	// Type is "directory" or "file".
+	Type string `json:"type"`
+	// Base is the hash directory of a directory or the file directory of a
+	// file in the base.
+	Base string `json:"base"`
+	// Data is the data object of a file in the base.
+	Data string `json:"data,omitempty"`
+	// Name is the name file of a file in the base.
+	Name string `json:"name,omitempty"`
+	// Recorded is set if the map records the file, otherwise its location
+	// is the one it would be stored at.
+	Recorded bool `json:"recorded"`
+}
+
+// fileTranslation returns the translation of the file name in the directory
+// entry stored with fileHash.
+func (f *Fs) fileTranslation(entry *dirEntry, name, fileHash string, recorded bool) (*translation, error) {
+	remote, ok := f.underRoot(path.Join(entry.Path, name))
+	if !ok {
+		return nil, fmt.Errorf("%q is outside the root %q", path.Join(entry.Path, name), f.root)
+	}
+	basePath := path.Join(entry.Hash, fileHash)
+	return &translation{
+		Path:     remote,
+		Type:     "file",
+		Base:     basePath,
+		Data:     f.fileKey(basePath, dataLeaf),
+		Name:     f.fileKey(basePath, nameLeaf),
+		Recorded: recorded,
+	}, nil
+}
+
+// encode translates the overlay path remote to its location in the base.
+// Files which don't exist are translated to the location they would be
+// stored at.
+func (f *Fs) encode(ctx context.Context, remote string) (*translation, error) {
+	remote = strings.Trim(f.normalize(remote), "/")
+	if entry, ok := f.findDir(path.Join(f.root, remote)); ok {
+		return &translation{Path: remote, Type: "directory", Base: entry.Hash, Recorded: true}, nil
+	}
+	entry, fileHash, ok := f.toHash(remote)
+	if !ok {
+		return nil, fs.ErrorDirNotFound
+	}
+	files, err := entry.Files(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(remote)
+	recorded, ok := entry.recordedHash(files, name)
+	if ok {
+		fileHash = recorded
+	}
+	return f.fileTranslation(entry, name, fileHash, ok)
+}
+
+// decode translates the path basePath of the base, a hash directory, a file
+// directory or an object in them, back to its overlay path. Files which are
+// not in the map are translated with their name file.
+func (f *Fs) decode(ctx context.Context, basePath string) (*translation, error) {
+	basePath = strings.Trim(basePath, "/")
+	if fileDir, _, ok := f.splitFileKey(basePath); ok {
+		basePath = fileDir
+	} else if path.Base(basePath) == "map" {
+		basePath = path.Dir(basePath)
+	}
+	if entry, ok := f.dirMap.byHash(basePath); ok {
+		remote, ok := f.underRoot(entry.Path)
+		if !ok {
+			return nil, fmt.Errorf("%q is outside the root %q", entry.Path, f.root)
+		}
+		return &translation{Path: remote, Type: "directory", Base: entry.Hash, Recorded: true}, nil
+	}
+	dirHash, fileHash := path.Split(basePath)
+	entry, ok := f.dirMap.byHash(strings.TrimSuffix(dirHash, "/"))
+	if !ok {
+		return nil, fmt.Errorf("%q is not in the directory map: %w", basePath, fs.ErrorDirNotFound)
+	}
+	name, ok, err := entry.nameOf(ctx, fileHash)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return f.fileTranslation(entry, name, fileHash, true)
+	}
+	recorded, err := f.readNameFile(ctx, entry.Hash, fileHash)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, fmt.Errorf("%q is neither in the map file nor has a name file: %w", basePath, fs.ErrorObjectNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.fileTranslation(entry, path.Base(recorded), fileHash, false)
+}
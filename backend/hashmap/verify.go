@@ -0,0 +1,81 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// Modes of verify_writes.
+const (
+	// verifyOff trusts the base to store what it accepted.
+	verifyOff = "off"
+	// verifyHash compares the size and checksum reported by the base for
+	// the written object with the ones of the written content.
+	verifyHash = "hash"
+	// verifyRead reads the written object back and compares it with the
+	// written content.
+	verifyRead = "read"
+)
+
+// verifyWrite checks with verify_writes that the metadata object obj the
+// content data was written to holds it. It returns an error matching
+// ErrWriteVerification if it doesn't.
+func (f *Fs) verifyWrite(ctx context.Context, obj fs.Object, data []byte) error {
+	switch f.opt.VerifyWrites {
+	case verifyHash:
+		return f.verifyHash(ctx, obj, data)
+	case verifyRead:
+		return f.verifyRead(ctx, obj.Remote(), data)
+	}
+	return nil
+}
+
+// verifyHash compares the size and the first checksum supported by the base
+// of obj with the ones of data. Only the size is compared if the base
+// supports no checksums.
+func (f *Fs) verifyHash(ctx context.Context, obj fs.Object, data []byte) error {
+	if obj.Size() != int64(len(data)) {
+		return fmt.Errorf("%w: %q has size %d instead of %d", ErrWriteVerification, obj.Remote(), obj.Size(), len(data))
+	}
+	ht := f.base.Hashes().GetOne()
+	if ht == hash.None {
+		return nil
+	}
+	got, err := obj.Hash(ctx, ht)
+	if err != nil || got == "" {
+		// The base doesn't know the checksum of this object.
+		return nil
+	}
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(ht))
+	if err != nil {
+		return err
+	}
+	_, _ = hasher.Write(data)
+	if want := hasher.Sums()[ht]; got != want {
+		return fmt.Errorf("%w: %q has %v %s instead of %s", ErrWriteVerification, obj.Remote(), ht, got, want)
+	}
+	return nil
+}
+
+// verifyRead reads the object at remote back from the base and compares it
+// with data.
+func (f *Fs) verifyRead(ctx context.Context, remote string, data []byte) error {
+	in, err := f.openMeta(ctx, remote)
+	if err != nil {
+		return fmt.Errorf("%w: can't read back %q: %v", ErrWriteVerification, remote, err)
+	}
+	got, err := io.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return fmt.Errorf("%w: can't read back %q: %v", ErrWriteVerification, remote, err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("%w: %q reads back %d bytes which differ from the %d bytes written", ErrWriteVerification, remote, len(got), len(data))
+	}
+	return nil
+}
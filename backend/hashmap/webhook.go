@@ -0,0 +1,158 @@
+package hashmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fshttp"
+)
+
+// webhookQueueSize is the number of events buffered for delivery to the
+// webhook. Events are dropped when the queue is full.
+const webhookQueueSize = 1024
+
+// Operations reported to the webhook.
+const (
+	opPut     = "put"
+	opCopy    = "copy"
+	opMove    = "move"
+	opRemove  = "remove"
+	opMkdir   = "mkdir"
+	opRmdir   = "rmdir"
+	opDirMove = "dirmove"
+	opPurge   = "purge"
+	opAdopt   = "adopt"
+)
+
+// changeEvent is the JSON body posted to the webhook for every change of
+// the map.
+type changeEvent struct {
+	// Path is the overlay path which changed.
+	Path string `json:"path"`
+	// Src is the previous overlay path of moved files and directories.
+	Src string `json:"src,omitempty"`
+	// Operation is the operation which changed the map.
+	Operation string `json:"operation"`
+	// Client is the host name of the client which made the change.
+	Client string `json:"client"`
+	// Generation is the sequence number of the event sent by the client
+	// since it started, so receivers can order the events and detect lost
+	// ones.
+	Generation int64 `json:"generation"`
+	// Time is the time of the change.
+	Time time.Time `json:"time"`
+}
+
+// webhook delivers change events to the configured URL in the background.
+type webhook struct {
+	url  string
+	http *http.Client
+	// mu protects closed and sending to events.
+	mu     sync.RWMutex
+	closed bool
+	// events is closed to stop the delivery.
+	events chan changeEvent
+	// done is closed when the delivery has stopped.
+	done chan struct{}
+}
+
+// startWebhook starts delivering change events to the webhook if webhook_url
+// is set.
+func (f *Fs) startWebhook(ctx context.Context) {
+	if f.opt.WebhookURL == "" {
+		return
+	}
+	h := &webhook{
+		url:    f.opt.WebhookURL,
+		http:   fshttp.NewClient(ctx),
+		events: make(chan changeEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	f.hook = h
+	go f.deliverEvents(h)
+}
+
+// stopWebhook delivers the queued events and stops the delivery.
+func (f *Fs) stopWebhook() {
+	h := f.hook
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.events)
+	}
+	h.mu.Unlock()
+	<-h.done
+}
+
+// notifyChange records an event for the change of the absolute overlay path
+// p by operation op in the event log and queues it for the webhook. src is
+// the previous path of moves and empty otherwise.
+func (f *Fs) notifyChange(op, p, src string) {
+	event := f.events.add(op, p, src)
+	h := f.hook
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.events <- event:
+	default:
+		fs.Errorf(f, "webhook: queue full, dropping %s event for %q", op, p)
+	}
+}
+
+// notifyChangeRel is like notifyChange for paths relative to the root of
+// the Fs.
+func (f *Fs) notifyChangeRel(op, remote, src string) {
+	if src != "" {
+		src = path.Join(f.root, src)
+	}
+	f.notifyChange(op, path.Join(f.root, remote), src)
+}
+
+// deliverEvents posts the queued events to the webhook until the queue is
+// closed.
+func (f *Fs) deliverEvents(h *webhook) {
+	defer close(h.done)
+	for event := range h.events {
+		if err := h.post(event); err != nil {
+			fs.Errorf(f, "webhook: failed to deliver %s event for %q: %v", event.Operation, event.Path, err)
+		}
+	}
+}
+
+// post posts a single event to the webhook.
+func (h *webhook) post(event changeEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
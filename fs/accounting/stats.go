@@ -49,6 +49,7 @@ type StatsInfo struct {
 	renameQueueSize   int64
 	deletes           int64
 	deletedDirs       int64
+	counters          map[string]int64 // counters added by the backends
 	inProgress        *inProgress
 	startedTransfers  []*Transfer   // currently active transfers
 	oldTimeRanges     timeRanges    // a merged list of time ranges for the transfers
@@ -107,6 +108,13 @@ func (s *StatsInfo) RemoteStats() (out rc.Params, err error) {
 	out["deletes"] = s.deletes
 	out["deletedDirs"] = s.deletedDirs
 	out["renames"] = s.renames
+	if len(s.counters) > 0 {
+		counters := make(map[string]int64, len(s.counters))
+		for name, value := range s.counters {
+			counters[name] = value
+		}
+		out["counters"] = counters
+	}
 	out["elapsedTime"] = time.Since(s.startTime).Seconds()
 	eta, etaOK := eta(s.bytes, ts.totalBytes, ts.speed)
 	if etaOK {
@@ -435,6 +443,18 @@ func (s *StatsInfo) String() string {
 		if s.renames != 0 {
 			_, _ = fmt.Fprintf(buf, "Renamed:       %10d\n", s.renames)
 		}
+		names := s.counterNames()
+		// Align the counters with the lines above unless their names are
+		// too long for it.
+		width := 15
+		for _, name := range names {
+			if len(name)+2 > width {
+				width = len(name) + 2
+			}
+		}
+		for _, name := range names {
+			_, _ = fmt.Fprintf(buf, "%-*s%10d\n", width, name+":", s.counters[name])
+		}
 		if s.transfers != 0 || ts.totalTransfers != 0 {
 			_, _ = fmt.Fprintf(buf, "Transferred:   %10d / %d, %s\n",
 				s.transfers, ts.totalTransfers, percent(s.transfers, ts.totalTransfers))
@@ -600,6 +620,33 @@ func (s *StatsInfo) Renames(renames int64) int64 {
 	return s.renames
 }
 
+// Count adds n to the counter with the given name and returns its new value.
+//
+// This is for backends to report counters of their own which are shown in
+// the stats and returned by core/stats under "counters".
+func (s *StatsInfo) Count(name string, n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]int64)
+	}
+	s.counters[name] += n
+	return s.counters[name]
+}
+
+// counterNames returns the names of the counters added with Count in
+// order.
+//
+// Call with lock held
+func (s *StatsInfo) counterNames() []string {
+	names := make([]string, 0, len(s.counters))
+	for name := range s.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // ResetCounters sets the counters (bytes, checks, errors, transfers, deletes, renames) to 0 and resets lastError, fatalError and retryError
 func (s *StatsInfo) ResetCounters() {
 	s.mu.Lock()
@@ -615,6 +662,7 @@ func (s *StatsInfo) ResetCounters() {
 	s.deletes = 0
 	s.deletedDirs = 0
 	s.renames = 0
+	s.counters = nil
 	s.startedTransfers = nil
 	s.oldDuration = 0
 
@@ -88,6 +88,7 @@ Returns the following values:
 {
 	"bytes": total transferred bytes since the start of the group,
 	"checks": number of files checked,
+	"counters": counters of the backends, e.g. of the metadata written by hashmap,
 	"deletes" : number of files deleted,
 	"elapsedTime": time in floating point seconds since rclone was started,
 	"errors": number of errors,
@@ -380,6 +381,12 @@ func (sg *statsGroups) sum(ctx context.Context) *StatsInfo {
 			sum.renameQueueSize += stats.renameQueueSize
 			sum.deletes += stats.deletes
 			sum.deletedDirs += stats.deletedDirs
+			for name, value := range stats.counters {
+				if sum.counters == nil {
+					sum.counters = make(map[string]int64)
+				}
+				sum.counters[name] += value
+			}
 			sum.inProgress.merge(stats.inProgress)
 			sum.startedTransfers = append(sum.startedTransfers, stats.startedTransfers...)
 			sum.oldTimeRanges = append(sum.oldTimeRanges, stats.oldTimeRanges...)
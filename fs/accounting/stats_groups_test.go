@@ -57,6 +57,9 @@ func TestStatsGroupOperations(t *testing.T) {
 		stats1.transferQueueSize = 20
 		stats2.oldDuration = 2 * time.Second
 		stats2.oldTimeRanges = []timeRange{{time.Now(), time.Now().Add(2 * time.Second)}}
+		stats1.Count("backendWrites", 3)
+		stats2.Count("backendWrites", 4)
+		stats2.Count("backendReads", 1)
 		sg := newStatsGroups()
 		sg.set(ctx, "test1", stats1)
 		sg.set(ctx, "test2", stats2)
@@ -66,6 +69,7 @@ func TestStatsGroupOperations(t *testing.T) {
 		assert.Equal(t, stats1.errors+stats2.errors, sum.errors)
 		assert.Equal(t, stats1.oldDuration+stats2.oldDuration, sum.oldDuration)
 		assert.Equal(t, stats1.average.speed+stats2.average.speed, sum.average.speed)
+		assert.Equal(t, map[string]int64{"backendWrites": 7, "backendReads": 1}, sum.counters)
 		// dict can iterate in either order
 		a := timeRanges{stats1.oldTimeRanges[0], stats2.oldTimeRanges[0]}
 		b := timeRanges{stats2.oldTimeRanges[0], stats1.oldTimeRanges[0]}
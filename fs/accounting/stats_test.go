@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -132,6 +133,39 @@ func TestStatsError(t *testing.T) {
 	assert.Equal(t, time.Time{}, s.RetryAfter())
 }
 
+func TestStatsCount(t *testing.T) {
+	ctx := context.Background()
+	s := NewStats(ctx)
+	assert.Equal(t, int64(0), s.Count("backendWrites", 0))
+	assert.Equal(t, int64(2), s.Count("backendWrites", 2))
+	assert.Equal(t, int64(5), s.Count("backendWrites", 3))
+	assert.Equal(t, int64(1), s.Count("backendReads", 1))
+	assert.Equal(t, []string{"backendReads", "backendWrites"}, s.counterNames())
+
+	out, err := s.RemoteStats()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"backendReads": 1, "backendWrites": 5}, out["counters"])
+
+	s.ResetCounters()
+	assert.Empty(t, s.counterNames())
+	out, err = s.RemoteStats()
+	require.NoError(t, err)
+	assert.NotContains(t, out, "counters")
+}
+
+func TestStatsStringCounters(t *testing.T) {
+	ctx := context.Background()
+	s := NewStats(ctx)
+	s.Count("short", 1)
+	assert.Contains(t, s.String(), "\nshort:"+strings.Repeat(" ", 18)+"1\n")
+
+	// Long names widen the column of all counters.
+	s.Count("aVeryLongCounterName", 12345)
+	str := s.String()
+	assert.Contains(t, str, "\naVeryLongCounterName:      12345\n")
+	assert.Contains(t, str, "\nshort:"+strings.Repeat(" ", 25)+"1\n")
+}
+
 func TestStatsTotalDuration(t *testing.T) {
 	ctx := context.Background()
 	startTime := time.Now()